@@ -0,0 +1,178 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// AdminResponse struct
+type AdminResponse struct {
+	Status string `json:"status"`
+}
+
+// admin method routes /admin/* requests
+// admin action must be granted to principal explicitly
+func (h *Handler) admin(w http.ResponseWriter, r *http.Request, pathParts []string) {
+	if !h.App.GetConfig().Auth.Authorize(getRequestInfo(r).Principal, adminAction) {
+		h.renderError(w, http.StatusForbidden, "FORBIDDEN")
+		return
+	}
+
+	l := len(pathParts)
+
+	// config reload
+	if r.Method == "POST" && l == 2 && pathParts[1] == "reload" {
+		h.reloadConfig(w, r)
+		return
+	}
+
+	// autoclean plan
+	if r.Method == "GET" && l == 3 && pathParts[1] == "autoclean" && pathParts[2] == "plan" {
+		h.planAutoClean(w, r)
+		return
+	}
+
+	// manual autoclean run
+	if r.Method == "POST" && l == 3 && pathParts[1] == "autoclean" && pathParts[2] == "run" {
+		h.runAutoClean(w, r)
+		return
+	}
+
+	// autoclean reports
+	if r.Method == "GET" && l == 3 && pathParts[1] == "autoclean" && pathParts[2] == "reports" {
+		h.autoCleanReports(w, r)
+		return
+	}
+
+	// autoclean report
+	if r.Method == "GET" && l == 4 && pathParts[1] == "autoclean" && pathParts[2] == "reports" {
+		h.autoCleanReport(w, r, pathParts[3])
+		return
+	}
+
+	// members of cluster
+	if r.Method == "GET" && l == 2 && pathParts[1] == "cluster" {
+		h.clusterMembers(w)
+		return
+	}
+
+	// report of the latest scrub
+	if r.Method == "GET" && l == 3 && pathParts[1] == "scrub" && pathParts[2] == "report" {
+		h.scrubReport(w, r)
+		return
+	}
+
+	// not found
+	h.renderError(w, http.StatusNotFound, "NOT_FOUND")
+}
+
+func (h *Handler) reloadConfig(w http.ResponseWriter, r *http.Request) {
+	err := h.App.ReloadConfig()
+	if err != nil {
+		details := []string{err.Error()}
+
+		if errs, ok := err.(ValidationErrors); ok {
+			details = make([]string, 0, len(errs))
+			for _, e := range errs {
+				details = append(details, e.Error())
+			}
+		}
+
+		h.requestLogger(r).Warn("config reload rejected", "error", err)
+		h.renderJSON(w, http.StatusUnprocessableEntity, ErrorResponse{Error: "INVALID_CONFIG", Details: details})
+		return
+	}
+
+	h.renderJSON(w, http.StatusOK, AdminResponse{Status: "ok"})
+}
+
+func (h *Handler) planAutoClean(w http.ResponseWriter, r *http.Request) {
+	report, err := h.App.PlanAutoClean()
+	if err != nil {
+		h.requestLogger(r).Error("could not plan autoclean", "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	h.renderJSON(w, http.StatusOK, report)
+}
+
+func (h *Handler) runAutoClean(w http.ResponseWriter, r *http.Request) {
+	report, err := h.App.RunAutoCleanNow()
+	if err == errAutoCleanBusy {
+		h.renderError(w, http.StatusConflict, "AUTOCLEAN_IN_PROGRESS")
+		return
+	} else if err == errAutoCleanDisabled {
+		h.renderError(w, http.StatusConflict, "AUTOCLEAN_DISABLED")
+		return
+	} else if report == nil {
+		h.requestLogger(r).Error("could not run autoclean", "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	// failed run returns report with error
+	code := http.StatusOK
+	if err != nil {
+		code = http.StatusInternalServerError
+	}
+
+	h.renderJSON(w, code, report)
+}
+
+func (h *Handler) autoCleanReports(w http.ResponseWriter, r *http.Request) {
+	limit := 10
+
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			h.renderError(w, http.StatusBadRequest, "INVALID_LIMIT")
+			return
+		}
+
+		limit = n
+	}
+
+	reports, err := h.App.Redis.GetAutoCleanReports(limit)
+	if err != nil {
+		h.requestLogger(r).Error("could not get autoclean reports", "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	h.renderJSON(w, http.StatusOK, reports)
+}
+
+func (h *Handler) autoCleanReport(w http.ResponseWriter, r *http.Request, rawID string) {
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		h.renderError(w, http.StatusNotFound, "REPORT_NOT_FOUND")
+		return
+	}
+
+	report, err := h.App.GetAutoCleanReport(id)
+	if err != nil {
+		h.requestLogger(r).Error("could not get autoclean report", "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	} else if report == nil {
+		h.renderError(w, http.StatusNotFound, "REPORT_NOT_FOUND")
+		return
+	}
+
+	h.renderJSON(w, http.StatusOK, report)
+}
+
+func (h *Handler) scrubReport(w http.ResponseWriter, r *http.Request) {
+	report, err := h.App.Redis.GetScrubReport()
+	if err != nil {
+		h.requestLogger(r).Error("could not get scrub report", "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	} else if report == nil {
+		h.renderError(w, http.StatusNotFound, "REPORT_NOT_FOUND")
+		return
+	}
+
+	h.renderJSON(w, http.StatusOK, report)
+}
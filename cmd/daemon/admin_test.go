@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+)
+
+func TestHandlerAdminReload(t *testing.T) {
+	f, err := ioutil.TempFile("", "t2-config")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"storage": {"path": "mocks/storage/", "max_size": 100}, "auth": {"principals": {"anonymous": {"actions": ["admin"]}}}}`)
+	f.Close()
+
+	cases := []struct {
+		auth    *AuthConfig
+		content string
+		method  string
+		path    string
+		code    int
+		message string
+	}{
+		{
+			method:  "POST",
+			path:    "/admin/reload",
+			code:    403,
+			message: "FORBIDDEN",
+		},
+		{
+			auth: &AuthConfig{
+				Principals: map[string]*PrincipalConfig{
+					anonymousPrincipal: nil,
+				},
+			},
+			method:  "POST",
+			path:    "/admin/reload",
+			code:    403,
+			message: "FORBIDDEN",
+		},
+		{
+			auth: &AuthConfig{
+				Principals: map[string]*PrincipalConfig{
+					anonymousPrincipal: &PrincipalConfig{Actions: []string{"admin"}},
+				},
+			},
+			method:  "GET",
+			path:    "/admin/reload",
+			code:    404,
+			message: "NOT_FOUND",
+		},
+		{
+			auth: &AuthConfig{
+				Principals: map[string]*PrincipalConfig{
+					anonymousPrincipal: &PrincipalConfig{Actions: []string{"admin"}},
+				},
+			},
+			content: `{"storage": {"max_size": -1}}`,
+			method:  "POST",
+			path:    "/admin/reload",
+			code:    422,
+			message: "INVALID_CONFIG",
+		},
+		{
+			auth: &AuthConfig{
+				Principals: map[string]*PrincipalConfig{
+					anonymousPrincipal: &PrincipalConfig{Actions: []string{"admin"}},
+				},
+			},
+			method: "POST",
+			path:   "/admin/reload",
+			code:   200,
+		},
+	}
+
+	for _, tc := range cases {
+		cfg, _ := NewConfig("mocks/config/full.json")
+		cfg.Auth = tc.auth
+
+		app := NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(cfg.RateLimit), NewRedis(cfg.Redis))
+		app.ConfigPath = f.Name()
+
+		if tc.content != "" {
+			invalid, _ := ioutil.TempFile("", "t2-config")
+			invalid.WriteString(tc.content)
+			invalid.Close()
+			defer os.Remove(invalid.Name())
+
+			app.ConfigPath = invalid.Name()
+		}
+
+		h := NewHandler(app)
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(tc.method, tc.path, nil)
+
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("Code must be %d but got %d\n", tc.code, w.Code)
+		}
+
+		if tc.message != "" {
+			errResp := ErrorResponse{}
+
+			json.Unmarshal(w.Body.Bytes(), &errResp)
+			if errResp.Error != tc.message {
+				t.Errorf("Error message must be %v but got %v\n", tc.message, errResp.Error)
+			}
+
+			if tc.code == 422 && len(errResp.Details) != 1 {
+				t.Errorf("Details must contain validation error but got %v\n", errResp.Details)
+			}
+
+			continue
+		}
+
+		if app.GetConfig().Storage.MaxSize != 100 {
+			t.Errorf("Config must be reloaded but got %#v\n", app.GetConfig().Storage)
+		}
+	}
+}
@@ -1,113 +1,692 @@
 package main
 
 import (
+	"context"
 	"os"
-	"path"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 // Application struct contains
 // Config pointer
+// config and rate limit could be replaced on reload, use GetConfig and GetRateLimit for reading them
 type Application struct {
-	Config    *Config
-	Storage   *Storage
-	RateLimit *RateLimit
-	Redis     *Redis
+	Config     *Config
+	ConfigPath string
+	Storage    *Storage
+	RateLimit  *RateLimit
+	Redis      *Redis
+	Metrics    *Metrics
+	Logger     *Logger
+	Cluster    *Cluster
+
+	cleanInProgress int32
+	cleanTrigger    chan struct{}
+	cleanReschedule chan struct{}
+	draining        int32
+
+	// mu guards Config and RateLimit
+	mu sync.RWMutex
+
+	// ctx is canceled on shutdown, background jobs should stop
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	// requests and background jobs are not started after closing is set, closeMu guards it
+	closeMu  sync.Mutex
+	closing  bool
+	requests sync.WaitGroup
+}
+
+// SetLogger method sets logger for application and its components
+func (app *Application) SetLogger(l *Logger) {
+	app.Logger = l
+
+	if app.Storage != nil {
+		app.Storage.Logger = l.With("component", "storage")
+	}
+
+	if app.RateLimit != nil {
+		app.RateLimit.Logger = l.With("component", "rate_limit")
+	}
+
+	if app.Redis != nil {
+		app.Redis.Logger = l.With("component", "redis")
+	}
+}
 
-	cleanInProgress bool
+// GetConfig method returns current config
+func (app *Application) GetConfig() *Config {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+
+	return app.Config
 }
 
-// AutoClean method
+// GetRateLimit method returns current rate limit
+func (app *Application) GetRateLimit() *RateLimit {
+	app.mu.RLock()
+	defer app.mu.RUnlock()
+
+	return app.RateLimit
+}
+
+// AutoClean method evicts files older than max age and files chosen by eviction policy while storage limit is exceeded
+// run is skipped if autoclean is in progress in this process or on another node of cluster
 func (app *Application) AutoClean() error {
-	if app.cleanInProgress || app.Config.Storage.Limit == 0 {
+	_, err := app.RunAutoCleanNow()
+	if err == errAutoCleanBusy || err == errAutoCleanDisabled {
 		return nil
 	}
 
-	app.cleanInProgress = true
+	return err
+}
+
+// RunAutoCleanNow method runs autoclean immediately and returns its report, it's saved in redis
+// report is nil for skipped runs, errAutoCleanBusy or errAutoCleanDisabled is returned for them
+func (app *Application) RunAutoCleanNow() (*AutoCleanReport, error) {
+	cfg := app.GetConfig()
+
+	if cfg.Storage.Limit == 0 && cfg.Storage.GetEviction().MaxAge == 0 {
+		app.Metrics.AutoCleanRuns.Inc("skipped")
+		return nil, errAutoCleanDisabled
+	}
+
+	if !atomic.CompareAndSwapInt32(&app.cleanInProgress, 0, 1) {
+		app.Metrics.AutoCleanRuns.Inc("skipped")
+		return nil, errAutoCleanBusy
+	}
 	defer app.markCleanAsStopped()
 
-	return app.autoClean()
+	start := time.Now()
+	logger := app.Logger.With("component", "autoclean")
+
+	lock, err := app.Redis.AcquireLock(app.Redis.nodeKey(autoCleanLockKey), getLockTTL(cfg.AutoClean))
+	if err != nil {
+		app.Metrics.AutoCleanRuns.Inc("error")
+		logger.Error("could not acquire autoclean lock", "error", err)
+		return nil, err
+	} else if lock == nil {
+		app.Metrics.AutoCleanRuns.Inc("skipped")
+		logger.Debug("autoclean is in progress on another node")
+		return nil, errAutoCleanBusy
+	}
+	defer lock.Release()
+
+	logger = logger.With("fencing_token", lock.Token)
+
+	// fencing token is counted per node, so report id is taken from counter of cluster
+	id, err := app.Redis.NextAutoCleanReportID()
+	if err != nil {
+		app.Metrics.AutoCleanRuns.Inc("error")
+		logger.Error("could not get autoclean report id", "error", err)
+		return nil, err
+	}
+
+	report := newAutoCleanReport(false)
+	report.ID = id
+
+	// run is stopped on shutdown, after max duration or when lease is lost
+	ctx, cancel := app.newAutoCleanContext()
+
+	renewed := make(chan struct{})
+	go func() {
+		lock.KeepAlive(ctx, cancel)
+		close(renewed)
+	}()
+
+	err = app.autoClean(ctx, lock, report, logger)
+
+	cancel()
+	<-renewed
+
+	// run is stopped by limits, but evicted files are fine
+	if err == errMaxFiles {
+		report.Stopped = "max_files"
+		err = nil
+	} else if err == context.DeadlineExceeded {
+		report.Stopped = "max_duration"
+		err = nil
+	}
+
+	if err == errLockLost {
+		app.Metrics.AutoCleanRuns.Inc("lock_lost")
+		logger.Warn("autoclean lock has been lost, run is aborted", "duration", time.Since(start))
+		report.finish("lock_lost", err)
+	} else if err == context.Canceled {
+		app.Metrics.AutoCleanRuns.Inc("canceled")
+		logger.Info("autoclean canceled", "duration", time.Since(start))
+		report.finish("canceled", err)
+	} else if err != nil {
+		app.Metrics.AutoCleanRuns.Inc("error")
+		logger.Error("autoclean failed", "error", err, "duration", time.Since(start))
+		report.finish("error", err)
+	} else {
+		app.Metrics.AutoCleanRuns.Inc("success")
+		logger.Info("autoclean finished", "duration", time.Since(start), "files", report.FilesCount, "bytes", report.FreedBytes, "stopped", report.Stopped)
+		report.finish("success", nil)
+	}
+
+	if e := app.Redis.SaveAutoCleanReport(report); e != nil {
+		logger.Error("could not save autoclean report", "error", e)
+	}
+
+	return report, err
 }
 
-func (app *Application) autoClean() error {
-	if _, err := os.Stat(app.Config.Storage.Path); os.IsNotExist(err) {
+// autoClean method evicts files and adds them to report
+// files are not removed in dry-run mode, report contains plan in this case
+func (app *Application) autoClean(ctx context.Context, lock *RedisLock, report *AutoCleanReport, logger *Logger) error {
+	// limit could be changed by reload, the run uses config from its start
+	cfg := app.GetConfig().Storage
+	eviction := cfg.GetEviction()
+	policyKey := evictionPolicyKeys[eviction.Policy]
+
+	report.Policy = eviction.Policy
+	report.Limit = cfg.Limit
+	report.maxFiles = app.GetConfig().AutoClean.GetMaxFiles()
+
+	policy, err := NewEvictionPolicy(eviction.Policy, app.Redis)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(cfg.GetRoots()[0]); os.IsNotExist(err) {
 		return err
 	}
 
-	dirs, err := getDirectories(app.Config.Storage.Path)
+	size, err := app.GetUsage()
 	if err != nil {
 		return err
 	}
 
-	var size int64
+	report.UsageBefore = size
+	report.UsageAfter = size
 
-	for _, dir := range dirs {
-		s, err := getDirectorySize(path.Join(app.Config.Storage.Path, dir))
-		if err != nil {
-			return err
-		}
+	if !report.DryRun {
+		app.Metrics.StorageUsage.Set(float64(size))
+	}
+
+	now := time.Now()
+
+	// files which are already in plan, they are not removed from indexes in dry-run mode
+	planned := map[string]bool{}
+
+	// evicted files are removed from indexes, so offset is count of files which are left there
+	offset := 0
+
+	// expired files are evicted even if limit is not reached
+	if eviction.MaxAge > 0 {
+		expiredAt := now.Add(-time.Duration(eviction.MaxAge) * time.Second)
 
-		size += s
+		for {
+			hashes, err := app.Redis.GetFilesCreatedBefore(expiredAt, offset, 20)
+			if err != nil {
+				return err
+			} else if len(hashes) == 0 {
+				break
+			}
+
+			local := []string{}
+
+			for _, hash := range hashes {
+				// stop between files on shutdown or lost lease
+				if err := checkLease(ctx, lock); err != nil {
+					return err
+				}
+
+				// files of other nodes are evicted by their owners
+				if _, remote := app.getOwner(hash); remote {
+					offset++
+					continue
+				}
+
+				if report.DryRun {
+					planned[hash] = true
+					offset++
+				}
+
+				local = append(local, hash)
+			}
+
+			if len(local) == 0 {
+				continue
+			}
+
+			freed, err := app.evictFiles(local, "max_age", policyKey, nil, lock, report, logger)
+			if err != nil {
+				return err
+			}
+
+			size -= freed
+			report.UsageAfter = size
+		}
 	}
 
-	if size <= app.Config.Storage.Limit {
+	// eviction starts above high watermark and stops below low one
+	high, low := cfg.GetWatermarks()
+
+	if cfg.Limit == 0 || size <= high {
 		return nil
 	}
 
-do:
-	for {
-		hashes, err := app.Redis.GetUnusedFiles(20)
+	// trashed files are purged before stored ones
+	size, err = app.evictTrash(ctx, lock, size, low, report, logger)
+	if err != nil || size <= low {
+		return err
+	}
 
+	// files uploaded before index has appeared are added with the lowest score
+	err = app.Redis.FillEvictionIndex(policyKey)
+	if err != nil {
+		return err
+	}
+
+	graceTime := now.Add(-time.Duration(eviction.GracePeriod) * time.Second).Unix()
+	offset = 0
+
+	for size > low {
+		hashes, err := policy.Candidates(offset, 20)
 		if err != nil {
 			return err
 		} else if len(hashes) == 0 {
 			break
 		}
 
-		for _, hash := range hashes {
-			fileSize, err := app.Storage.GetFileSize(hash)
+		var created []int64
+		if eviction.GracePeriod > 0 {
+			created, err = app.Redis.GetCreatedTimes(hashes)
 			if err != nil {
 				return err
 			}
+		}
 
-			deleted, err := app.Storage.RemoveFile(hash)
-			if err != nil {
+		for i, hash := range hashes {
+			// stop between files on shutdown or lost lease
+			if err := checkLease(ctx, lock); err != nil {
 				return err
 			}
 
-			t := time.Now()
+			if _, remote := app.getOwner(hash); remote {
+				offset++
+				continue
+			}
+
+			// recent uploads are protected by grace period
+			if created != nil && created[i] > graceTime {
+				offset++
+				continue
+			}
+
+			if planned[hash] {
+				offset++
+				continue
+			}
+
+			if report.DryRun {
+				offset++
+			}
 
-			err = app.Redis.MarkFileAsDeleted(hash, &t)
+			freed, err := app.evictFiles([]string{hash}, "limit", policyKey, policy, lock, report, logger)
 			if err != nil {
 				return err
 			}
 
-			if deleted {
-				size -= fileSize
+			size -= freed
+			report.UsageAfter = size
+
+			if size <= low {
+				break
 			}
+		}
+	}
 
-			if size <= app.Config.Storage.Limit {
-				break do
+	return nil
+}
+
+// evictFiles method evicts files (or only adds them to report in dry-run mode) and returns count of freed bytes
+// files are removed only while lock is held
+func (app *Application) evictFiles(hashes []string, reason, policyKey string, policy EvictionPolicy, lock *RedisLock, report *AutoCleanReport, logger *Logger) (int64, error) {
+	scores, err := app.Redis.GetScores(policyKey, hashes)
+	if err != nil {
+		return 0, err
+	}
+
+	accessed, err := app.Redis.GetScores(accessKey, hashes)
+	if err != nil {
+		return 0, err
+	}
+
+	// expired files could be moved to trash, they are still counted in usage
+	trash := app.GetConfig().Storage.GetTrash()
+	toTrash := reason == "max_age" && trash.Enabled && trash.Evictions
+
+	var total int64
+
+	for i, hash := range hashes {
+		var size int64
+		var ok, trashed bool
+
+		if report.full() {
+			return total, errMaxFiles
+		}
+
+		if report.DryRun {
+			size, err = app.Storage.GetFileSize(hash)
+			if err != nil && !os.IsNotExist(err) {
+				return total, err
+			}
+
+			ok = err == nil
+			trashed = ok && toTrash
+		} else {
+			if toTrash {
+				size, trashed, err = app.trashFile(hash, logger.With("reason", reason))
+				if err != nil {
+					return total, err
+				}
+			}
+
+			// missing files are evicted to clean their metadata
+			if !trashed {
+				size, ok, err = app.evictFile(hash, policy, lock, logger.With("reason", reason))
+				if err != nil {
+					return total, err
+				}
 			}
 		}
 
+		if trashed {
+			file := newEvictedFile(hash, reason, size, scores[i], accessed[i])
+			file.Trashed = true
+			report.add(file)
+		} else if ok {
+			total += size
+			report.add(newEvictedFile(hash, reason, size, scores[i], accessed[i]))
+		}
 	}
 
-	return nil
+	return total, nil
+}
+
+// trashFile method moves evicted file to trash, it returns size of file and true if file has been moved
+func (app *Application) trashFile(hash string, logger *Logger) (int64, bool, error) {
+	size, err := app.Storage.GetFileSize(hash)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, err
+	}
+
+	ok, err := app.MoveToTrash(hash, time.Now())
+	if err != nil || !ok {
+		return 0, false, err
+	}
+
+	logger.Info("file moved to trash", "file_id", hash, "size", size)
+
+	app.Metrics.AutoCleanFiles.Inc()
+
+	return size, true, nil
+}
+
+// evictTrash method purges the oldest files from trash until usage is below low watermark
+// it returns usage after purge
+func (app *Application) evictTrash(ctx context.Context, lock *RedisLock, size, low int64, report *AutoCleanReport, logger *Logger) (int64, error) {
+	offset := 0
+
+	for size > low {
+		hashes, err := app.Redis.GetTrashedFiles(offset, 20)
+		if err != nil {
+			return size, err
+		} else if len(hashes) == 0 {
+			break
+		}
+
+		trashedAt, err := app.Redis.GetScores(app.Redis.nodeKey(trashKey), hashes)
+		if err != nil {
+			return size, err
+		}
+
+		sizes, err := app.Redis.GetTrashSizes(hashes)
+		if err != nil {
+			return size, err
+		}
+
+		for i, hash := range hashes {
+			// stop between files on shutdown or lost lease
+			if err := checkLease(ctx, lock); err != nil {
+				return size, err
+			}
+
+			if _, remote := app.getOwner(hash); remote {
+				offset++
+				continue
+			}
+
+			if report.full() {
+				return size, errMaxFiles
+			}
+
+			freed, ok := sizes[i], true
+
+			if report.DryRun {
+				offset++
+			} else {
+				freed, ok, err = app.purgeTrashFile(hash, "autoclean", lock)
+				if err != nil {
+					return size, err
+				}
+
+				if ok {
+					logger.Info("file purged from trash", "file_id", hash, "size", freed, "reason", "trash")
+					app.Metrics.AutoCleanFiles.Inc()
+					app.Metrics.AutoCleanBytes.Add(float64(freed))
+				}
+			}
+
+			if ok {
+				size -= freed
+				report.add(newEvictedFile(hash, "trash", freed, trashedAt[i], 0))
+				report.UsageAfter = size
+			}
+
+			if size <= low {
+				break
+			}
+		}
+	}
+
+	return size, nil
+}
+
+// evictFile method removes file and its metadata, it returns count of freed bytes and true if file has been removed
+// metadata is removed even if file does not exist, so broken entries don't stop eviction
+// metadata and state of policy are changed before file in transaction which is fenced by lock, so file is never removed
+// by node which has lost the lock, errLockLost is returned in this case (nil lock is not checked)
+func (app *Application) evictFile(hash string, policy EvictionPolicy, lock *RedisLock, logger *Logger) (int64, bool, error) {
+	fileSize, err := app.Storage.GetFileSize(hash)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, err
+	}
+
+	t := time.Now()
+
+	err = app.Redis.markFileAsDeleted(hash, &t, lock, policy)
+	if err != nil {
+		return 0, false, err
+	}
+
+	deleted, err := app.Storage.RemoveFile(hash)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !deleted {
+		return 0, false, nil
+	}
+
+	usage, ok, err := app.Redis.AddUsage(-fileSize)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if ok {
+		app.Metrics.StorageUsage.Set(float64(usage))
+	}
+
+	logger.Info("file evicted", "file_id", hash, "size", fileSize)
+
+	app.Metrics.AutoCleanFiles.Inc()
+	app.Metrics.AutoCleanBytes.Add(float64(fileSize))
+
+	return fileSize, true, nil
 }
 
 func (app *Application) markCleanAsStopped() {
-	app.cleanInProgress = false
+	atomic.StoreInt32(&app.cleanInProgress, 0)
+}
+
+// checkLease func returns error if autoclean must be stopped: on shutdown or when lock is lost
+// it stops run early, removals are fenced by lock in their transactions anyway
+// lock is nil for dry-run
+func checkLease(ctx context.Context, lock *RedisLock) error {
+	if lock == nil {
+		return ctx.Err()
+	}
+
+	if err := ctx.Err(); err != nil {
+		if lock.IsLost() {
+			return errLockLost
+		}
+
+		return err
+	}
+
+	ok, err := lock.Check()
+	if err != nil {
+		return err
+	} else if !ok {
+		return errLockLost
+	}
+
+	return nil
+}
+
+// Go method runs f in background, Shutdown waits until it is finished
+// it's used for metadata writes which must not be lost on shutdown
+// f is not run if shutdown has been started, false is returned in this case
+func (app *Application) Go(f func()) bool {
+	if !app.track(&app.wg) {
+		app.Logger.Warn("background job is rejected, application is shutting down")
+		return false
+	}
+
+	go func() {
+		defer app.wg.Done()
+		f()
+	}()
+
+	return true
+}
+
+// StartRequest method registers request which is being served, false is returned if shutdown has been started
+// FinishRequest must be called after request if true is returned
+func (app *Application) StartRequest() bool {
+	return app.track(&app.requests)
+}
+
+// FinishRequest method marks request as served
+func (app *Application) FinishRequest() {
+	app.requests.Done()
+}
+
+// track method adds work to wg unless shutdown has been started,
+// so wg is never incremented while Shutdown waits for it
+func (app *Application) track(wg *sync.WaitGroup) bool {
+	app.closeMu.Lock()
+	defer app.closeMu.Unlock()
+
+	if app.closing {
+		return false
+	}
+
+	wg.Add(1)
+
+	return true
+}
+
+// Shutdown method stops background jobs, waits for requests and pending writes and closes redis pool
+// new requests and background jobs are rejected from this moment
+// redis pool is left open if something is still running after deadline, it could use the pool
+func (app *Application) Shutdown(ctx context.Context) error {
+	app.closeMu.Lock()
+	app.closing = true
+	app.closeMu.Unlock()
+
+	app.cancel()
+
+	done := make(chan struct{})
+	go func() {
+		app.requests.Wait()
+		app.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		app.Logger.Warn("requests and background jobs have not been finished before deadline, redis pool is left open")
+		return ctx.Err()
+	}
+
+	if app.Redis != nil && app.Redis.pool != nil {
+		return app.Redis.Close()
+	}
+
+	return nil
 }
 
 // NewApplication func returns Application pointer
 func NewApplication(cfg *Config, s *Storage, r *RateLimit, redis *Redis) *Application {
-	return &Application{
+	app := &Application{
 		Config:    cfg,
 		Storage:   s,
 		RateLimit: r,
 		Redis:     redis,
+		Metrics:   NewMetrics(),
+		Cluster:   NewCluster(),
+
+		cleanTrigger:    make(chan struct{}, 1),
+		cleanReschedule: make(chan struct{}, 1),
 	}
+
+	app.ctx, app.cancel = context.WithCancel(context.Background())
+
+	// data keys of encrypted files are kept in metadata
+	if s != nil && redis != nil {
+		s.DataKeys = redis
+	}
+
+	// usage and locks of local storage are separated for each node of cluster
+	if redis != nil && cfg.Cluster != nil {
+		redis.NodeID = cfg.Cluster.NodeID
+	}
+
+	if cfg.Storage != nil {
+		app.Metrics.StorageLimit.Set(float64(cfg.Storage.Limit))
+	}
+
+	if redis != nil && redis.pool != nil {
+		app.Metrics.Register(NewGaugeFunc("t2_redis_pool_active_connections", "Number of active connections in redis pool.", func() float64 {
+			return float64(redis.ActiveCount())
+		}))
+		app.Metrics.Register(NewGaugeFunc("t2_redis_pool_idle_connections", "Number of idle connections in redis pool.", func() float64 {
+			return float64(redis.IdleCount())
+		}))
+	}
+
+	return app
 }
 
 func getDirectories(dirPath string) ([]string, error) {
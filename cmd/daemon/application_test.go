@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"io/ioutil"
 	"math/rand"
 	"os"
 	"path"
+	"reflect"
 	"strconv"
 	"strings"
 	"testing"
@@ -14,20 +17,20 @@ import (
 func TestNewApplication(t *testing.T) {
 	app := NewApplication(&Config{}, &Storage{}, &RateLimit{}, &Redis{})
 
-	if app.cleanInProgress {
-		t.Errorf("cleanInProgress must be %t but got %t\n", false, app.cleanInProgress)
+	if app.cleanInProgress != 0 {
+		t.Errorf("cleanInProgress must be %d but got %d\n", 0, app.cleanInProgress)
 	}
 }
 
 func TestApplicationMarkCleanAsStopped(t *testing.T) {
 	app := NewApplication(&Config{}, &Storage{}, &RateLimit{}, &Redis{})
 
-	app.cleanInProgress = true
+	app.cleanInProgress = 1
 
 	app.markCleanAsStopped()
 
-	if app.cleanInProgress {
-		t.Errorf("cleanInProgress must be %t but got %t\n", false, app.cleanInProgress)
+	if app.cleanInProgress != 0 {
+		t.Errorf("cleanInProgress must be %d but got %d\n", 0, app.cleanInProgress)
 	}
 }
 
@@ -166,3 +169,237 @@ func TestGetDirectorySize(t *testing.T) {
 		t.Error("Size must be greater than 0")
 	}
 }
+
+func TestApplicationShutdown(t *testing.T) {
+	app := NewApplication(&Config{}, &Storage{}, &RateLimit{}, NewRedis(&RedisConfig{}))
+
+	done := false
+	app.Go(func() {
+		time.Sleep(50 * time.Millisecond)
+		done = true
+	})
+
+	err := app.Shutdown(context.Background())
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	}
+
+	if !done {
+		t.Error("Shutdown must wait for background jobs")
+	}
+
+	// no work is started after shutdown
+	if app.Go(func() {}) {
+		t.Error("Background job must be rejected after shutdown")
+	}
+
+	if app.StartRequest() {
+		t.Error("Request must be rejected after shutdown")
+	}
+
+	// slow job must be interrupted by deadline
+	app = NewApplication(&Config{}, &Storage{}, &RateLimit{}, NewRedis(&RedisConfig{}))
+
+	app.Go(func() {
+		time.Sleep(time.Second)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = app.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Err must be %v but got %v\n", context.DeadlineExceeded, err)
+	}
+
+	// redis pool is still used by slow job
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	if conn.Err() != nil {
+		t.Errorf("Redis pool must not be closed but got %v\n", conn.Err())
+	}
+
+	// request which is still served after deadline keeps redis pool open too
+	app = NewApplication(&Config{}, &Storage{}, &RateLimit{}, NewRedis(&RedisConfig{}))
+	app.StartRequest()
+
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	err = app.Shutdown(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Err must be %v but got %v\n", context.DeadlineExceeded, err)
+	}
+
+	app.FinishRequest()
+}
+
+func TestApplicationAutoCleanCanceled(t *testing.T) {
+	cfg := &StorageConfig{
+		Path:  "mocks/storage/",
+		Limit: 1,
+	}
+	app := NewApplication(&Config{Storage: cfg}, NewStorage(cfg), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+
+	conn := app.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	now := time.Now()
+	app.Storage.CreateFile("example1", bytes.NewBuffer([]byte("example")))
+	app.Redis.SaveFileMeta(&FileMeta{
+		Hash:      "example1",
+		Size:      7,
+		CreatedAt: &now,
+	})
+
+	// emulate shutdown without closing redis pool
+	app.cancel()
+
+	err := app.AutoClean()
+	if err != context.Canceled {
+		t.Errorf("Err must be %v but got %v\n", context.Canceled, err)
+	}
+
+	// file must not be removed
+	if _, ok := app.Storage.GetFile("example1"); !ok {
+		t.Error("File must not be removed")
+	}
+
+	app.Storage.RemoveFile("example1")
+}
+
+func TestApplicationAutoCleanPolicies(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		eviction *EvictionConfig
+		limit    int64
+		removed  []string
+	}{
+		{
+			// new file has the lowest download count
+			eviction: &EvictionConfig{Policy: "lfu"},
+			limit:    25,
+			removed:  []string{"example3"},
+		},
+		{
+			eviction: &EvictionConfig{Policy: "lfu", GracePeriod: 60},
+			limit:    25,
+			removed:  []string{"example1"},
+		},
+		{
+			eviction: &EvictionConfig{Policy: "lru"},
+			limit:    25,
+			removed:  []string{"example2"},
+		},
+		{
+			eviction: &EvictionConfig{Policy: "ttl"},
+			limit:    15,
+			removed:  []string{"example1", "example2"},
+		},
+		{
+			// limit is not reached, but the first file is too old
+			eviction: &EvictionConfig{Policy: "lfu", MaxAge: 5000},
+			limit:    0,
+			removed:  []string{"example1"},
+		},
+	}
+
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	for _, tc := range cases {
+		cfg := &StorageConfig{
+			Path:     dir,
+			Limit:    tc.limit,
+			Eviction: tc.eviction,
+		}
+		app := NewApplication(&Config{Storage: cfg}, NewStorage(cfg), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+
+		conn := app.Redis.Get()
+		conn.Do("FLUSHDB")
+		conn.Close()
+
+		files := []struct {
+			hash       string
+			createdAt  time.Time
+			accessedAt time.Time
+			score      int
+		}{
+			{hash: "example1", createdAt: now.Add(-2 * time.Hour), accessedAt: now.Add(-time.Minute), score: 1},
+			{hash: "example2", createdAt: now.Add(-time.Hour), accessedAt: now.Add(-time.Hour), score: 2},
+			{hash: "example3", createdAt: now, accessedAt: now, score: 0},
+		}
+
+		for _, f := range files {
+			createdAt := f.createdAt
+
+			app.Storage.CreateFile(f.hash, bytes.NewBuffer([]byte(strings.Repeat("a", 10))))
+			app.Redis.SaveFileMeta(&FileMeta{
+				Hash:      f.hash,
+				Size:      10,
+				CreatedAt: &createdAt,
+				Score:     f.score,
+			})
+			app.Redis.RecordAccess(f.hash, f.accessedAt, time.Hour)
+		}
+
+		err := app.AutoClean()
+		if err != nil {
+			t.Errorf("Err must be nil but got %v\n", err)
+		}
+
+		removed := []string{}
+		for _, f := range files {
+			if _, ok := app.Storage.GetFile(f.hash); !ok {
+				removed = append(removed, f.hash)
+			}
+
+			app.Storage.RemoveFile(f.hash)
+		}
+
+		if !reflect.DeepEqual(removed, tc.removed) {
+			t.Errorf("Removed files must be %v but got %v for %#v\n", tc.removed, removed, tc.eviction)
+		}
+	}
+}
+
+func TestApplicationAutoCleanMissingFile(t *testing.T) {
+	cfg := &StorageConfig{
+		Path:  "mocks/storage/",
+		Limit: 5,
+	}
+	app := NewApplication(&Config{Storage: cfg}, NewStorage(cfg), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+
+	// metadata without file must not stop eviction
+	app.Redis.SaveFileMeta(&FileMeta{Hash: "example0", Size: 10, CreatedAt: &now})
+
+	app.Storage.CreateFile("example1", bytes.NewBuffer([]byte(strings.Repeat("a", 10))))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: "example1", Size: 10, CreatedAt: &now, Score: 1})
+
+	err := app.AutoClean()
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	}
+
+	if _, ok := app.Storage.GetFile("example1"); ok {
+		t.Error("File must be removed")
+		app.Storage.RemoveFile("example1")
+	}
+
+	if v := app.Metrics.AutoCleanFiles.Value(); v != 1 {
+		t.Errorf("Evicted files count must be %v but got %v\n", 1, v)
+	}
+}
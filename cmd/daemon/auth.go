@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+)
+
+// principal of requests without verified client certificate
+const anonymousPrincipal = "anonymous"
+
+// action for /admin endpoints, it's never allowed implicitly
+const adminAction = "admin"
+
+// action for listing of files, it's never allowed implicitly because file ids could not be guessed otherwise
+const listAction = "list"
+
+// AuthConfig struct contains access rules for principals
+// principal is resolved from verified client certificate (see TLSConfig.Principals),
+// requests without certificate have "anonymous" principal
+// authorization is disabled if there are no principals in config,
+// but admin and list actions must always be listed explicitly
+type AuthConfig struct {
+	Principals map[string]*PrincipalConfig `json:"principals"`
+}
+
+// PrincipalConfig struct contains list of allowed actions (upload, download, remove, restore, meta, list, admin)
+// empty list allows all actions except admin and list
+// max ttl of uploaded files in seconds could be lower than global one (0 - global max ttl is used)
+// content types of uploaded files are checked by rules of principal in addition to global ones
+type PrincipalConfig struct {
+	Actions      []string            `json:"actions"`
+	MaxTTL       int                 `json:"max_ttl"`
+	ContentTypes *ContentTypesConfig `json:"content_types"`
+}
+
+// GetPrincipal method returns config of principal, it's nil if principal is not configured
+func (a *AuthConfig) GetPrincipal(principal string) *PrincipalConfig {
+	if a == nil {
+		return nil
+	}
+
+	return a.Principals[principal]
+}
+
+// Authorize method checks that principal is allowed to do action
+func (a *AuthConfig) Authorize(principal, action string) bool {
+	if a == nil || len(a.Principals) == 0 {
+		return action != adminAction && action != listAction
+	}
+
+	p, ok := a.Principals[principal]
+	if !ok {
+		return false
+	}
+
+	if p == nil || len(p.Actions) == 0 {
+		return action != adminAction && action != listAction
+	}
+
+	for _, v := range p.Actions {
+		if v == action {
+			return true
+		}
+	}
+
+	return false
+}
+
+// getPrincipal func returns principal of request
+// only verified certificates are used, so "request" client auth mode always gives anonymous principal
+func getPrincipal(r *http.Request, cfg *TLSConfig) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return anonymousPrincipal
+	}
+
+	var principals map[string]string
+	if cfg != nil {
+		principals = cfg.Principals
+	}
+
+	p := getCertificatePrincipal(r.TLS.VerifiedChains[0][0], principals)
+	if p == "" {
+		return anonymousPrincipal
+	}
+
+	return p
+}
+
+// getLimitKey func returns key for rate limits: principal if it's known or client ip
+func getLimitKey(principal, ip string) string {
+	if principal == anonymousPrincipal {
+		return ip
+	}
+
+	return "principal:" + principal
+}
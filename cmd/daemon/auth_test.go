@@ -0,0 +1,162 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net/http"
+	"testing"
+)
+
+func TestAuthConfigAuthorize(t *testing.T) {
+	cfg := &AuthConfig{
+		Principals: map[string]*PrincipalConfig{
+			"admin": nil,
+			"reader": &PrincipalConfig{
+				Actions: []string{"download"},
+			},
+		},
+	}
+
+	cases := []struct {
+		cfg       *AuthConfig
+		principal string
+		action    string
+		ok        bool
+	}{
+		{
+			cfg:       nil,
+			principal: anonymousPrincipal,
+			action:    "remove",
+			ok:        true,
+		},
+		{
+			cfg:       &AuthConfig{},
+			principal: anonymousPrincipal,
+			action:    "remove",
+			ok:        true,
+		},
+		{
+			cfg:       cfg,
+			principal: "admin",
+			action:    "remove",
+			ok:        true,
+		},
+		{
+			cfg:       nil,
+			principal: anonymousPrincipal,
+			action:    listAction,
+			ok:        false,
+		},
+		{
+			cfg:       cfg,
+			principal: "admin",
+			action:    listAction,
+			ok:        false,
+		},
+		{
+			cfg:       cfg,
+			principal: "reader",
+			action:    "download",
+			ok:        true,
+		},
+		{
+			cfg:       cfg,
+			principal: "reader",
+			action:    "upload",
+			ok:        false,
+		},
+		{
+			cfg:       cfg,
+			principal: anonymousPrincipal,
+			action:    "download",
+			ok:        false,
+		},
+		{
+			cfg:       nil,
+			principal: anonymousPrincipal,
+			action:    adminAction,
+			ok:        false,
+		},
+		{
+			cfg:       cfg,
+			principal: "admin",
+			action:    adminAction,
+			ok:        false,
+		},
+		{
+			cfg: &AuthConfig{
+				Principals: map[string]*PrincipalConfig{
+					"ops": &PrincipalConfig{Actions: []string{adminAction}},
+				},
+			},
+			principal: "ops",
+			action:    adminAction,
+			ok:        true,
+		},
+	}
+
+	for _, tc := range cases {
+		ok := tc.cfg.Authorize(tc.principal, tc.action)
+		if ok != tc.ok {
+			t.Errorf("Ok must be %t but got %t for %s/%s\n", tc.ok, ok, tc.principal, tc.action)
+		}
+	}
+}
+
+func TestGetPrincipal(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject: pkix.Name{CommonName: "client", Organization: []string{"t2"}},
+	}
+
+	cases := []struct {
+		state     *tls.ConnectionState
+		cfg       *TLSConfig
+		principal string
+	}{
+		{
+			principal: anonymousPrincipal,
+		},
+		{
+			state: &tls.ConnectionState{
+				PeerCertificates: []*x509.Certificate{cert},
+			},
+			principal: anonymousPrincipal,
+		},
+		{
+			state: &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			},
+			principal: "client",
+		},
+		{
+			state: &tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{cert}},
+			},
+			cfg: &TLSConfig{
+				Principals: map[string]string{"CN=client,O=t2": "team-a"},
+			},
+			principal: "team-a",
+		},
+	}
+
+	for _, tc := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.TLS = tc.state
+
+		p := getPrincipal(r, tc.cfg)
+		if p != tc.principal {
+			t.Errorf("Principal must be %s but got %s\n", tc.principal, p)
+		}
+	}
+}
+
+func TestGetLimitKey(t *testing.T) {
+	if key := getLimitKey(anonymousPrincipal, "127.0.0.1"); key != "127.0.0.1" {
+		t.Errorf("Key must be %s but got %s\n", "127.0.0.1", key)
+	}
+
+	if key := getLimitKey("team-a", "127.0.0.1"); key != "principal:team-a" {
+		t.Errorf("Key must be %s but got %s\n", "principal:team-a", key)
+	}
+}
@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// redis key of autoclean lock, only one node of cluster evicts files at once
+const autoCleanLockKey = "AUTOCLEAN_LOCK"
+
+// default lease of autoclean lock
+const defaultLockTTL = 30
+
+// default interval between autoclean runs
+const defaultAutoCleanInterval = 600
+
+var (
+	// errAutoCleanBusy is returned if autoclean is in progress in this process or on another node
+	errAutoCleanBusy = errors.New("Autoclean is in progress")
+	// errAutoCleanDisabled is returned if there is neither storage limit nor max age
+	errAutoCleanDisabled = errors.New("Autoclean is disabled, storage limit and max age are not set")
+	// errMaxFiles is returned when run has evicted max files
+	errMaxFiles = errors.New("Max files per run are evicted")
+)
+
+// AutoCleanConfig struct contains info about
+// - lease of autoclean lock in seconds, default is 30, lease is renewed while autoclean is running
+// - interval between runs in seconds, default is 600
+// - schedule as cron expression (in local time zone), it's used instead of interval if it's set
+// - jitter in seconds, random delay up to jitter is added to each scheduled run
+// - max duration of run in seconds and max count of evicted files per run, 0 means no limit
+type AutoCleanConfig struct {
+	LockTTL     int    `json:"lock_ttl"`
+	Interval    int    `json:"interval"`
+	Schedule    string `json:"schedule"`
+	Jitter      int    `json:"jitter"`
+	MaxDuration int    `json:"max_duration"`
+	MaxFiles    int    `json:"max_files"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *AutoCleanConfig) SetDefaults() {
+	if cfg.LockTTL == 0 {
+		cfg.LockTTL = defaultLockTTL
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultAutoCleanInterval
+	}
+}
+
+// GetSchedule method returns schedule of autoclean runs, it's nil-safe
+func (cfg *AutoCleanConfig) GetSchedule() (Schedule, error) {
+	if cfg == nil {
+		return IntervalSchedule(defaultAutoCleanInterval * time.Second), nil
+	}
+
+	if cfg.Schedule != "" {
+		return ParseCronSchedule(cfg.Schedule)
+	}
+
+	if cfg.Interval <= 0 {
+		return IntervalSchedule(defaultAutoCleanInterval * time.Second), nil
+	}
+
+	return IntervalSchedule(time.Duration(cfg.Interval) * time.Second), nil
+}
+
+// GetJitter method, it's nil-safe
+func (cfg *AutoCleanConfig) GetJitter() time.Duration {
+	if cfg == nil {
+		return 0
+	}
+
+	return time.Duration(cfg.Jitter) * time.Second
+}
+
+// GetMaxDuration method, it's nil-safe
+func (cfg *AutoCleanConfig) GetMaxDuration() time.Duration {
+	if cfg == nil {
+		return 0
+	}
+
+	return time.Duration(cfg.MaxDuration) * time.Second
+}
+
+// GetMaxFiles method, it's nil-safe
+func (cfg *AutoCleanConfig) GetMaxFiles() int {
+	if cfg == nil {
+		return 0
+	}
+
+	return cfg.MaxFiles
+}
+
+// validateAutoCleanConfig func adds problems of autoclean config to errs
+func validateAutoCleanConfig(errs *ValidationErrors, cfg *AutoCleanConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if cfg.LockTTL < 0 {
+		errs.Add("autoclean.lock_ttl", "must not be negative")
+	}
+
+	if cfg.Interval < 0 {
+		errs.Add("autoclean.interval", "must not be negative")
+	}
+
+	if cfg.Jitter < 0 {
+		errs.Add("autoclean.jitter", "must not be negative")
+	}
+
+	if cfg.MaxDuration < 0 {
+		errs.Add("autoclean.max_duration", "must not be negative")
+	}
+
+	if cfg.MaxFiles < 0 {
+		errs.Add("autoclean.max_files", "must not be negative")
+	}
+
+	if cfg.Schedule != "" {
+		s, err := ParseCronSchedule(cfg.Schedule)
+		if err != nil {
+			errs.Add("autoclean.schedule", err.Error())
+		} else if s.Next(time.Now()).IsZero() {
+			errs.Add("autoclean.schedule", "never matches")
+		}
+	}
+}
+
+// RunAutoClean method runs autoclean by schedule from config in background
+// schedule is recalculated after each run and after config reload
+func (app *Application) RunAutoClean() {
+	app.Go(func() {
+		for {
+			delay := app.nextAutoCleanDelay(time.Now())
+			timer := time.NewTimer(delay)
+
+			select {
+			case <-app.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+				// error is logged and counted in metrics by AutoClean
+				app.AutoClean()
+			case <-app.cleanTrigger:
+				timer.Stop()
+				app.AutoClean()
+			case <-app.cleanReschedule:
+				timer.Stop()
+			}
+		}
+	})
+}
+
+// RescheduleAutoClean method makes scheduler recalculate time of the next run, it doesn't block
+func (app *Application) RescheduleAutoClean() {
+	select {
+	case app.cleanReschedule <- struct{}{}:
+	default:
+	}
+}
+
+// nextAutoCleanDelay method returns delay before the next scheduled run
+func (app *Application) nextAutoCleanDelay(now time.Time) time.Duration {
+	cfg := app.GetConfig().AutoClean
+
+	s, err := cfg.GetSchedule()
+	if err != nil {
+		// config is validated, so it's not expected
+		app.Logger.Error("invalid autoclean schedule, default interval is used", "error", err)
+		s = IntervalSchedule(defaultAutoCleanInterval * time.Second)
+	}
+
+	next := getNextRun(s, now, cfg.GetJitter())
+	if next.IsZero() {
+		app.Logger.Warn("autoclean schedule never matches, default interval is used")
+		next = now.Add(defaultAutoCleanInterval * time.Second)
+	}
+
+	app.Metrics.AutoCleanNextRun.Set(float64(next.Unix()))
+
+	return next.Sub(now)
+}
+
+// newAutoCleanContext method returns context of run which is canceled on shutdown or after max duration
+func (app *Application) newAutoCleanContext() (context.Context, context.CancelFunc) {
+	maxDuration := app.GetConfig().AutoClean.GetMaxDuration()
+	if maxDuration > 0 {
+		return context.WithTimeout(app.ctx, maxDuration)
+	}
+
+	return context.WithCancel(app.ctx)
+}
+
+// getLockTTL func returns lease of autoclean lock
+func getLockTTL(cfg *AutoCleanConfig) time.Duration {
+	if cfg == nil || cfg.LockTTL <= 0 {
+		return defaultLockTTL * time.Second
+	}
+
+	return time.Duration(cfg.LockTTL) * time.Second
+}
+
+// count of reports which are kept in redis
+const maxAutoCleanReports = 100
+
+// count of files which are listed in report, totals are counted for all files
+const maxReportFiles = 1000
+
+// AutoCleanReport struct describes autoclean run or dry-run plan
+// id is fencing token of run, it's 0 for dry-run
+// usage after dry-run is projected
+type AutoCleanReport struct {
+	ID          int64         `json:"id"`
+	DryRun      bool          `json:"dry_run"`
+	Result      string        `json:"result"`
+	Error       string        `json:"error,omitempty"`
+	Policy      string        `json:"policy"`
+	StartedAt   time.Time     `json:"started_at"`
+	FinishedAt  time.Time     `json:"finished_at"`
+	Limit       int64         `json:"limit"`
+	UsageBefore int64         `json:"usage_before"`
+	UsageAfter  int64         `json:"usage_after"`
+	FilesCount  int           `json:"files_count"`
+	FreedBytes  int64         `json:"freed_bytes"`
+	Files       []EvictedFile `json:"files"`
+	Truncated   bool          `json:"truncated"`
+	Stopped     string        `json:"stopped,omitempty"`
+
+	// max count of files per run, 0 means no limit
+	maxFiles int
+}
+
+// EvictedFile struct contains info about evicted (or planned for eviction) file
+// score is a value from sorted set of eviction policy, it's time of removal for files purged from trash
+// trashed files are moved to trash, so they don't free space
+type EvictedFile struct {
+	FileID     string     `json:"file_id"`
+	Reason     string     `json:"reason"`
+	Size       int64      `json:"size"`
+	Score      float64    `json:"score"`
+	LastAccess *time.Time `json:"last_access,omitempty"`
+	Trashed    bool       `json:"trashed,omitempty"`
+}
+
+// full method returns true if max files per run have been evicted
+func (r *AutoCleanReport) full() bool {
+	return r.maxFiles > 0 && r.FilesCount >= r.maxFiles
+}
+
+// add method adds file to report
+func (r *AutoCleanReport) add(file EvictedFile) {
+	r.FilesCount++
+
+	if !file.Trashed {
+		r.FreedBytes += file.Size
+	}
+
+	if len(r.Files) >= maxReportFiles {
+		r.Truncated = true
+		return
+	}
+
+	r.Files = append(r.Files, file)
+}
+
+// finish method sets result of run
+func (r *AutoCleanReport) finish(result string, err error) {
+	r.Result = result
+	r.FinishedAt = time.Now().UTC()
+
+	if err != nil {
+		r.Error = err.Error()
+	}
+}
+
+// newAutoCleanReport func returns AutoCleanReport pointer
+func newAutoCleanReport(dryRun bool) *AutoCleanReport {
+	return &AutoCleanReport{
+		DryRun:    dryRun,
+		StartedAt: time.Now().UTC(),
+		Files:     []EvictedFile{},
+	}
+}
+
+// PlanAutoClean method returns files which would be evicted by autoclean now without removing them
+func (app *Application) PlanAutoClean() (*AutoCleanReport, error) {
+	report := newAutoCleanReport(true)
+	logger := app.Logger.With("component", "autoclean", "dry_run", true)
+
+	ctx, cancel := app.newAutoCleanContext()
+	defer cancel()
+
+	err := app.autoClean(ctx, nil, report, logger)
+	if err == errMaxFiles {
+		report.Stopped = "max_files"
+	} else if err == context.DeadlineExceeded {
+		report.Stopped = "max_duration"
+	} else if err != nil {
+		report.finish("error", err)
+		return report, err
+	}
+
+	report.finish("planned", nil)
+
+	return report, nil
+}
+
+// newEvictedFile func returns info about file for report
+// access time is 0 for files without known access time
+func newEvictedFile(hash, reason string, size int64, score, accessedAt float64) EvictedFile {
+	file := EvictedFile{
+		FileID: hash,
+		Reason: reason,
+		Size:   size,
+		Score:  score,
+	}
+
+	if accessedAt > 0 {
+		t := time.Unix(int64(accessedAt), 0).UTC()
+		file.LastAccess = &t
+	}
+
+	return file
+}
+
+// GetAutoCleanReport method returns persisted report of autoclean run by its id, it returns nil if report is not found
+func (app *Application) GetAutoCleanReport(id int64) (*AutoCleanReport, error) {
+	reports, err := app.Redis.GetAutoCleanReports(maxAutoCleanReports)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, report := range reports {
+		if report.ID == id {
+			return report, nil
+		}
+	}
+
+	return nil, nil
+}
@@ -0,0 +1,392 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newAutoCleanTestApp(dir string, storage *StorageConfig) *Application {
+	storage.Path = dir
+
+	cfg := &Config{
+		Storage:   storage,
+		AutoClean: &AutoCleanConfig{},
+		Auth: &AuthConfig{
+			Principals: map[string]*PrincipalConfig{
+				anonymousPrincipal: &PrincipalConfig{Actions: []string{"admin"}},
+			},
+		},
+	}
+	app := NewApplication(cfg, NewStorage(storage), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+
+	conn := app.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	now := time.Now()
+
+	files := []struct {
+		hash       string
+		createdAt  time.Time
+		accessedAt time.Time
+		score      int
+	}{
+		{hash: "example1", createdAt: now.Add(-2 * time.Hour), accessedAt: now.Add(-time.Minute), score: 1},
+		{hash: "example2", createdAt: now.Add(-time.Hour), accessedAt: now.Add(-time.Hour), score: 2},
+		{hash: "example3", createdAt: now, accessedAt: now, score: 0},
+	}
+
+	for _, f := range files {
+		createdAt := f.createdAt
+
+		app.Storage.CreateFile(f.hash, bytes.NewBuffer([]byte(strings.Repeat("a", 10))))
+		app.Redis.SaveFileMeta(&FileMeta{
+			Hash:      f.hash,
+			Size:      10,
+			CreatedAt: &createdAt,
+			Score:     f.score,
+		})
+		app.Redis.RecordAccess(f.hash, f.accessedAt, time.Hour)
+	}
+
+	return app
+}
+
+func getReportFiles(report *AutoCleanReport) []string {
+	res := []string{}
+	for _, f := range report.Files {
+		res = append(res, f.FileID+":"+f.Reason)
+	}
+
+	return res
+}
+
+func TestAutoCleanReportAdd(t *testing.T) {
+	report := newAutoCleanReport(false)
+
+	for i := 0; i < maxReportFiles+1; i++ {
+		report.add(EvictedFile{FileID: "example", Size: 2})
+	}
+
+	if report.FilesCount != maxReportFiles+1 {
+		t.Errorf("FilesCount must be %d but got %d\n", maxReportFiles+1, report.FilesCount)
+	}
+
+	if report.FreedBytes != 2*(maxReportFiles+1) {
+		t.Errorf("FreedBytes must be %d but got %d\n", 2*(maxReportFiles+1), report.FreedBytes)
+	}
+
+	if len(report.Files) != maxReportFiles || !report.Truncated {
+		t.Errorf("Files must be truncated to %d but got %d\n", maxReportFiles, len(report.Files))
+	}
+}
+
+func TestApplicationPlanAutoClean(t *testing.T) {
+	cases := []struct {
+		eviction *EvictionConfig
+		limit    int64
+		files    []string
+		after    int64
+	}{
+		{
+			eviction: &EvictionConfig{Policy: "lfu"},
+			limit:    25,
+			files:    []string{"example3:limit"},
+			after:    20,
+		},
+		{
+			eviction: &EvictionConfig{Policy: "ttl"},
+			limit:    15,
+			files:    []string{"example1:limit", "example2:limit"},
+			after:    10,
+		},
+		{
+			// expired file is planned once
+			eviction: &EvictionConfig{Policy: "ttl", MaxAge: 5000},
+			limit:    15,
+			files:    []string{"example1:max_age", "example2:limit"},
+			after:    10,
+		},
+		{
+			eviction: &EvictionConfig{Policy: "lfu"},
+			limit:    100,
+			files:    []string{},
+			after:    30,
+		},
+	}
+
+	for _, tc := range cases {
+		dir, err := ioutil.TempDir("", "t2-storage")
+		if err != nil {
+			t.Errorf("Err must be nil but got %v\n", err)
+			return
+		}
+		defer os.RemoveAll(dir)
+
+		app := newAutoCleanTestApp(dir, &StorageConfig{Limit: tc.limit, Eviction: tc.eviction})
+
+		report, err := app.PlanAutoClean()
+		if err != nil {
+			t.Errorf("Err must be nil but got %v\n", err)
+			continue
+		}
+
+		if !report.DryRun || report.Result != "planned" {
+			t.Errorf("Report must be planned dry-run but got %#v\n", report)
+		}
+
+		if files := getReportFiles(report); !reflect.DeepEqual(files, tc.files) {
+			t.Errorf("Files must be %v but got %v\n", tc.files, files)
+		}
+
+		if report.UsageBefore != 30 || report.UsageAfter != tc.after {
+			t.Errorf("Usage must be %d -> %d but got %d -> %d\n", 30, tc.after, report.UsageBefore, report.UsageAfter)
+		}
+
+		for _, f := range report.Files {
+			if f.Size != 10 || f.LastAccess == nil {
+				t.Errorf("File must contain size and last access but got %#v\n", f)
+			}
+		}
+
+		// nothing is removed
+		for _, hash := range []string{"example1", "example2", "example3"} {
+			if _, ok := app.Storage.GetFile(hash); !ok {
+				t.Errorf("File %s must not be removed by dry-run\n", hash)
+			}
+		}
+
+		reports, _ := app.Redis.GetAutoCleanReports(10)
+		if len(reports) != 0 {
+			t.Errorf("Plan must not be saved but got %v\n", reports)
+		}
+	}
+}
+
+func TestApplicationAutoCleanReport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	app := newAutoCleanTestApp(dir, &StorageConfig{Limit: 25, Eviction: &EvictionConfig{Policy: "lfu"}})
+
+	report, err := app.RunAutoCleanNow()
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+
+	if report.ID == 0 || report.DryRun || report.Result != "success" || report.Policy != "lfu" {
+		t.Errorf("Unexpected report %#v\n", report)
+	}
+
+	if files := getReportFiles(report); !reflect.DeepEqual(files, []string{"example3:limit"}) {
+		t.Errorf("Files must be %v but got %v\n", []string{"example3:limit"}, files)
+	}
+
+	if report.FreedBytes != 10 || report.UsageAfter != 20 {
+		t.Errorf("Report must contain freed bytes but got %#v\n", report)
+	}
+
+	saved, err := app.GetAutoCleanReport(report.ID)
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	}
+
+	if saved == nil || saved.ID != report.ID || saved.FilesCount != 1 {
+		t.Errorf("Report must be saved but got %#v\n", saved)
+	}
+
+	missing, _ := app.GetAutoCleanReport(report.ID + 1)
+	if missing != nil {
+		t.Errorf("Report must be nil but got %#v\n", missing)
+	}
+
+	// report of another node has its own id
+	app.Redis.NodeID = "node1"
+
+	other, err := app.RunAutoCleanNow()
+	if err != nil || other.ID == report.ID {
+		t.Errorf("Id must differ from %d but got %#v, %v\n", report.ID, other, err)
+	}
+
+	saved, _ = app.GetAutoCleanReport(report.ID)
+	if saved == nil || saved.FilesCount != 1 {
+		t.Errorf("Report must be saved but got %#v\n", saved)
+	}
+}
+
+func TestHandlerAdminAutoClean(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	app := newAutoCleanTestApp(dir, &StorageConfig{Limit: 25, Eviction: &EvictionConfig{Policy: "lfu"}})
+
+	report, err := app.RunAutoCleanNow()
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+
+	id := report.ID
+
+	cases := []struct {
+		method  string
+		path    string
+		code    int
+		message string
+		count   int
+	}{
+		{path: "/admin/autoclean/plan", code: 200},
+		{method: "POST", path: "/admin/autoclean/run", code: 200},
+		{path: "/admin/autoclean/run", code: 404, message: "NOT_FOUND"},
+		{path: "/admin/autoclean/reports", code: 200, count: 2},
+		{path: "/admin/autoclean/reports?limit=0", code: 400, message: "INVALID_LIMIT"},
+		{path: "/admin/autoclean/reports/" + strconv.FormatInt(id, 10), code: 200},
+		{path: "/admin/autoclean/reports/100", code: 404, message: "REPORT_NOT_FOUND"},
+		{path: "/admin/autoclean/reports/example", code: 404, message: "REPORT_NOT_FOUND"},
+	}
+
+	h := NewHandler(app)
+
+	for _, tc := range cases {
+		if tc.method == "" {
+			tc.method = "GET"
+		}
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(tc.method, tc.path, nil)
+
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("Code must be %d but got %d for %s\n", tc.code, w.Code, tc.path)
+		}
+
+		if tc.message != "" {
+			errResp := ErrorResponse{}
+
+			json.Unmarshal(w.Body.Bytes(), &errResp)
+			if errResp.Error != tc.message {
+				t.Errorf("Error message must be %v but got %v\n", tc.message, errResp.Error)
+			}
+
+			continue
+		}
+
+		if tc.count > 0 {
+			reports := []*AutoCleanReport{}
+
+			json.Unmarshal(w.Body.Bytes(), &reports)
+			if len(reports) != tc.count {
+				t.Errorf("Reports count must be %d but got %d\n", tc.count, len(reports))
+			}
+		}
+	}
+}
+
+func TestApplicationAutoCleanMaxFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	app := newAutoCleanTestApp(dir, &StorageConfig{Limit: 15, Eviction: &EvictionConfig{Policy: "ttl"}})
+	app.Config.AutoClean.MaxFiles = 1
+
+	plan, err := app.PlanAutoClean()
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+
+	if plan.FilesCount != 1 || plan.Stopped != "max_files" || plan.Result != "planned" {
+		t.Errorf("Plan must be stopped by max files but got %#v\n", plan)
+	}
+
+	report, err := app.RunAutoCleanNow()
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+
+	if files := getReportFiles(report); !reflect.DeepEqual(files, []string{"example1:limit"}) {
+		t.Errorf("Files must be %v but got %v\n", []string{"example1:limit"}, files)
+	}
+
+	if report.Stopped != "max_files" || report.Result != "success" {
+		t.Errorf("Run must be stopped by max files but got %#v\n", report)
+	}
+
+	if _, ok := app.Storage.GetFile("example2"); !ok {
+		t.Error("File example2 must not be removed\n")
+	}
+}
+
+func TestApplicationNewAutoCleanContext(t *testing.T) {
+	app := NewApplication(&Config{Storage: &StorageConfig{}}, nil, nil, nil)
+
+	ctx, cancel := app.newAutoCleanContext()
+	if _, ok := ctx.Deadline(); ok {
+		t.Error("Context must not have deadline without max duration\n")
+	}
+	cancel()
+
+	app.Config.AutoClean = &AutoCleanConfig{MaxDuration: 60}
+
+	ctx, cancel = app.newAutoCleanContext()
+	defer cancel()
+
+	deadline, ok := ctx.Deadline()
+	if !ok || time.Until(deadline) > time.Minute {
+		t.Errorf("Context must have deadline in a minute but got %v\n", deadline)
+	}
+}
+
+func TestRunAutoCleanNowSkipped(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	app := newAutoCleanTestApp(dir, &StorageConfig{})
+
+	_, err = app.RunAutoCleanNow()
+	if err != errAutoCleanDisabled {
+		t.Errorf("Error must be %v but got %v\n", errAutoCleanDisabled, err)
+	}
+
+	app.Config.Storage.Limit = 15
+	app.cleanInProgress = 1
+
+	_, err = app.RunAutoCleanNow()
+	if err != errAutoCleanBusy {
+		t.Errorf("Error must be %v but got %v\n", errAutoCleanBusy, err)
+	}
+
+	// scheduled run ignores skipped runs
+	err = app.AutoClean()
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+)
+
+// clientKeyHeader contains base64 encoded 32 bytes key which is used to encrypt uploaded file instead of data key
+// server keeps only fingerprint of key, the same key must be sent to download file
+const clientKeyHeader = "X-T2-Encryption-Key"
+
+// errBadClientKey is returned if client key is not base64 encoded 32 bytes
+var errBadClientKey = errors.New("Encryption key must be base64 encoded 32 bytes")
+
+// getClientKey func returns client key from request, it's nil if key is not sent
+func getClientKey(r *http.Request) ([]byte, error) {
+	v := r.Header.Get(clientKeyHeader)
+	if v == "" {
+		return nil, nil
+	}
+
+	key, err := base64.StdEncoding.DecodeString(v)
+	if err != nil || len(key) != dataKeySize {
+		return nil, errBadClientKey
+	}
+
+	return key, nil
+}
+
+// getKeyFingerprint func returns fingerprint of client key, it's salted by file id, so files with the same key could not be linked
+func getKeyFingerprint(hash string, key []byte) string {
+	sum := sha256.Sum256(append([]byte(hash), key...))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// saveClientKey method saves fingerprint of client key and checksum of stored content of file encrypted by it
+func (s *Storage) saveClientKey(hash string, key []byte, storedSHA256 string) error {
+	if s.DataKeys == nil {
+		return errors.New("Storage of data keys is not set")
+	}
+
+	return s.DataKeys.SaveClientKey(hash, getKeyFingerprint(hash, key), storedSHA256)
+}
+
+// checkClientKey method returns client key which is required to read file
+// nil is returned for file which is not encrypted by client key, the key from request is ignored for it
+// error code is returned if key is missing or does not match fingerprint
+func (h *Handler) checkClientKey(r *http.Request, hash string) ([]byte, int, string) {
+	key, err := getClientKey(r)
+	if err != nil {
+		return nil, http.StatusBadRequest, "BAD_ENCRYPTION_KEY"
+	}
+
+	fingerprint, _, err := h.App.Redis.GetClientKey(hash)
+	if err == errDataKeyNotFound {
+		return nil, 0, ""
+	} else if err != nil {
+		h.requestLogger(r).Error("could not get key fingerprint", "file_id", hash, "error", err)
+		return nil, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR"
+	}
+
+	if key == nil {
+		return nil, http.StatusForbidden, "ENCRYPTION_KEY_REQUIRED"
+	}
+
+	if subtle.ConstantTimeCompare([]byte(fingerprint), []byte(getKeyFingerprint(hash, key))) != 1 {
+		return nil, http.StatusForbidden, "ENCRYPTION_KEY_MISMATCH"
+	}
+
+	return key, 0, ""
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetClientKey(t *testing.T) {
+	valid := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+
+	cases := []struct {
+		header string
+		valid  bool
+		empty  bool
+	}{
+		{header: "", valid: true, empty: true},
+		{header: valid, valid: true, empty: false},
+		{header: base64.StdEncoding.EncodeToString([]byte("short")), valid: false, empty: true},
+		{header: "???", valid: false, empty: true},
+	}
+
+	for _, tc := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set(clientKeyHeader, tc.header)
+
+		key, err := getClientKey(r)
+		if (err == nil) != tc.valid || (key == nil) != tc.empty {
+			t.Errorf("Key for %q must be valid %v and empty %v but got %v, %v\n", tc.header, tc.valid, tc.empty, key, err)
+		}
+	}
+}
+
+func TestStorageClientKeyReplication(t *testing.T) {
+	app, replicas := newReplicationTestApplication(t, 3)
+	defer removeReplicationTestApplication(app, replicas)
+
+	key := bytes.Repeat([]byte{1}, 32)
+	content := strings.Repeat("0123456789", 20)
+	hash := getTestFileID(content, time.Now())
+
+	// copies are verified by checksum of stored content
+	_, err := app.Storage.CreateFileWithKey(hash, bytes.NewBufferString(content), key)
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	if fingerprint, _, _ := app.Redis.GetClientKey(hash); fingerprint != getKeyFingerprint(hash, key) {
+		t.Errorf("Fingerprint must be %s but got %s\n", getKeyFingerprint(hash, key), fingerprint)
+	}
+
+	if _, err := app.Storage.Open(hash); err != errDataKeyNotFound {
+		t.Errorf("Error must be %v but got %v\n", errDataKeyNotFound, err)
+	}
+
+	// copies are not removed if they could not be decrypted
+	if _, ok := readTestReplica(app, hash, nil); ok || !hasReplicaFile(replicas[0], hash) {
+		t.Error("Copy in replica must be kept\n")
+	}
+
+	data, ok := readTestReplica(app, hash, key)
+	if !ok || string(data) != content {
+		t.Error("Original content must be read from replica by client key\n")
+	}
+}
+
+func TestHandlerClientKey(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{MaxSize: 1024})
+	defer removeReplicationTestApplication(app, nil)
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	content := strings.Repeat("secret", 20)
+
+	h := NewHandler(app)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "example.txt")
+	part.Write([]byte(content))
+	writer.Close()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/files", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.Header.Set(clientKeyHeader, key)
+	h.ServeHTTP(w, r)
+
+	res := UploadResponse{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+
+	if w.Code != 200 || res.Hash == "" {
+		t.Fatalf("Code must be %d but got %d\n", 200, w.Code)
+	}
+
+	app.wg.Wait()
+
+	fileName := path.Join(app.Config.Storage.Path, res.Hash[:2], res.Hash)
+
+	stored, _ := ioutil.ReadFile(fileName)
+	if !isEncrypted(stored) || bytes.Contains(stored, []byte("secret")) {
+		t.Errorf("Stored file must be encrypted but got %q\n", stored)
+	}
+
+	cases := []struct {
+		key     string
+		rng     string
+		code    int
+		message string
+		body    string
+	}{
+		{key: "", code: 403, message: "ENCRYPTION_KEY_REQUIRED"},
+		{key: base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{2}, 32)), code: 403, message: "ENCRYPTION_KEY_MISMATCH"},
+		{key: "short", code: 400, message: "BAD_ENCRYPTION_KEY"},
+		{key: key, code: 200, body: content},
+		{key: key, rng: "bytes=6-11", code: 206, body: "secret"},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/files/"+res.Hash, nil)
+		r.Header.Set(clientKeyHeader, tc.key)
+		r.Header.Set("Range", tc.rng)
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("Code for %q must be %d but got %d\n", tc.key, tc.code, w.Code)
+		}
+
+		errResp := ErrorResponse{}
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+
+		if tc.message != "" && errResp.Error != tc.message {
+			t.Errorf("Error message must be %v but got %v\n", tc.message, errResp.Error)
+		}
+
+		if tc.body != "" && w.Body.String() != tc.body {
+			t.Errorf("Body must be %q but got %q\n", tc.body, w.Body.String())
+		}
+	}
+
+	app.wg.Wait()
+
+	// scrub verifies stored content without client key
+	report, err := app.Fsck(context.Background(), FsckOptions{})
+	if err != nil || report.CheckedFiles != 1 || !report.Clean() {
+		t.Errorf("Report must be clean but got %+v, %v\n", report, err)
+	}
+
+	ioutil.WriteFile(fileName, flipByte(stored, len(stored)-1), 0644)
+
+	report, err = app.Fsck(context.Background(), FsckOptions{})
+	if err != nil || report.Corrupted != 1 {
+		t.Errorf("Report must contain corrupted file but got %+v, %v\n", report, err)
+	}
+}
@@ -0,0 +1,813 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+const (
+	// default interval of heartbeats and membership refresh
+	defaultHeartbeatInterval = 5
+	// default time after the last heartbeat when node is considered dead
+	defaultNodeTTL = 15
+	// default interval of periodic rebalancing
+	defaultRebalanceInterval = 600
+	// default timeout of requests to other nodes
+	defaultClusterTimeout = 30
+)
+
+// hash of discovered nodes with their last heartbeats
+const clusterNodesKey = "CLUSTER_NODES"
+
+// headers of requests between nodes
+const (
+	clusterSecretHeader    = "X-T2-Cluster-Secret"
+	clusterPrincipalHeader = "X-T2-Principal"
+	clusterNodeHeader      = "X-T2-Node"
+
+	// metadata of moved file which is encrypted by client key
+	clusterFingerprintHeader  = "X-T2-Key-Fingerprint"
+	clusterStoredSHA256Header = "X-T2-Stored-SHA256"
+)
+
+// errNodeUnavailable is returned if owner of file has not saved pushed file
+var errNodeUnavailable = errors.New("Owner node has not saved file")
+
+// ClusterConfig struct contains info about
+// - id and advertised address (base url) of this node
+// - static list of nodes, this node is added to it automatically
+// - discovery flag, nodes announce themselves by heartbeats in redis
+// - interval of heartbeats in seconds, default is 5
+// - node ttl in seconds, node without heartbeats is removed from ring after it, default is 15
+// - count of virtual nodes of each node on hash ring, default is 128
+// - redirect flag, requests to other nodes are redirected with 307 instead of proxying
+// - secret which is shared by nodes, it authenticates requests between them
+// - interval of periodic rebalancing in seconds, default is 600, rebalancing is started on membership change too
+// - timeout of requests to other nodes in seconds, default is 30
+type ClusterConfig struct {
+	NodeID            string        `json:"node_id"`
+	Address           string        `json:"address"`
+	Nodes             []ClusterNode `json:"nodes"`
+	Discovery         bool          `json:"discovery"`
+	HeartbeatInterval int           `json:"heartbeat_interval"`
+	NodeTTL           int           `json:"node_ttl"`
+	VirtualNodes      int           `json:"virtual_nodes"`
+	Redirect          bool          `json:"redirect"`
+	Secret            string        `json:"secret"`
+	RebalanceInterval int           `json:"rebalance_interval"`
+	Timeout           int           `json:"timeout"`
+}
+
+// ClusterNode struct
+type ClusterNode struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *ClusterConfig) SetDefaults() {
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+
+	if cfg.NodeTTL == 0 {
+		cfg.NodeTTL = defaultNodeTTL
+	}
+
+	if cfg.VirtualNodes == 0 {
+		cfg.VirtualNodes = defaultVirtualNodes
+	}
+
+	if cfg.RebalanceInterval == 0 {
+		cfg.RebalanceInterval = defaultRebalanceInterval
+	}
+
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultClusterTimeout
+	}
+}
+
+// validateClusterConfig func adds problems of cluster config to errs
+func validateClusterConfig(errs *ValidationErrors, cfg *ClusterConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if cfg.NodeID == "" {
+		errs.Add("cluster.node_id", "is required")
+	}
+
+	if _, err := url.Parse(cfg.Address); err != nil || cfg.Address == "" {
+		errs.Add("cluster.address", "must be base url of node")
+	}
+
+	for _, node := range cfg.Nodes {
+		if _, err := url.Parse(node.Address); err != nil || node.ID == "" || node.Address == "" {
+			errs.Add("cluster.nodes", "must contain id and address of each node")
+			break
+		}
+	}
+
+	if cfg.Secret == "" {
+		errs.Add("cluster.secret", "is required")
+	}
+
+	for field, v := range map[string]int{
+		"cluster.heartbeat_interval": cfg.HeartbeatInterval,
+		"cluster.node_ttl":           cfg.NodeTTL,
+		"cluster.virtual_nodes":      cfg.VirtualNodes,
+		"cluster.rebalance_interval": cfg.RebalanceInterval,
+		"cluster.timeout":            cfg.Timeout,
+	} {
+		if v < 0 {
+			errs.Add(field, "must not be negative")
+		}
+	}
+
+	if cfg.NodeTTL > 0 && cfg.NodeTTL <= cfg.HeartbeatInterval {
+		errs.Add("cluster.node_ttl", "must be greater than heartbeat interval")
+	}
+}
+
+// Cluster struct contains current members and hash ring, ring is nil in single node mode
+type Cluster struct {
+	sync.RWMutex
+	members []ClusterNode
+	ring    *Ring
+
+	rebalanceTrigger chan struct{}
+}
+
+// Members method returns current members of cluster
+func (c *Cluster) Members() []ClusterNode {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.members
+}
+
+// getRing method returns current hash ring
+func (c *Cluster) getRing() *Ring {
+	c.RLock()
+	defer c.RUnlock()
+
+	return c.ring
+}
+
+// setMembers method rebuilds ring if members have been changed, true is returned then
+func (c *Cluster) setMembers(members []ClusterNode, virtualNodes int) bool {
+	c.Lock()
+	defer c.Unlock()
+
+	if reflect.DeepEqual(c.members, members) && (c.ring != nil) == (members != nil) {
+		return false
+	}
+
+	c.members = members
+	c.ring = nil
+
+	if members != nil {
+		c.ring = NewRing(members, virtualNodes)
+	}
+
+	return true
+}
+
+// NewCluster func returns Cluster pointer
+func NewCluster() *Cluster {
+	return &Cluster{
+		rebalanceTrigger: make(chan struct{}, 1),
+	}
+}
+
+// SaveHeartbeat method announces node in cluster
+func (r *Redis) SaveHeartbeat(node ClusterNode, t time.Time) error {
+	data, err := json.Marshal(heartbeat{ClusterNode: node, Time: t.Unix()})
+	if err != nil {
+		return err
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("HSET", clusterNodesKey, node.ID, data)
+
+	return err
+}
+
+// RemoveHeartbeat method removes node from discovered nodes
+func (r *Redis) RemoveHeartbeat(nodeID string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HDEL", clusterNodesKey, nodeID)
+
+	return err
+}
+
+// GetAliveNodes method returns nodes which have sent heartbeat after t
+func (r *Redis) GetAliveNodes(t time.Time) ([]ClusterNode, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	values, err := redis.StringMap(conn.Do("HGETALL", clusterNodesKey))
+	if err != nil {
+		return nil, err
+	}
+
+	res := []ClusterNode{}
+
+	for _, v := range values {
+		hb := heartbeat{}
+		if err := json.Unmarshal([]byte(v), &hb); err != nil {
+			continue
+		}
+
+		if hb.Time >= t.Unix() {
+			res = append(res, hb.ClusterNode)
+		}
+	}
+
+	return res, nil
+}
+
+type heartbeat struct {
+	ClusterNode
+	Time int64 `json:"time"`
+}
+
+// RefreshCluster method updates members of cluster from config and heartbeats
+// true is returned if members have been changed
+func (app *Application) RefreshCluster() (bool, error) {
+	cfg := app.GetConfig().Cluster
+	if cfg == nil {
+		return app.Cluster.setMembers(nil, 0), nil
+	}
+
+	nodes := map[string]ClusterNode{cfg.NodeID: {ID: cfg.NodeID, Address: cfg.Address}}
+
+	for _, node := range cfg.Nodes {
+		if _, ok := nodes[node.ID]; !ok {
+			nodes[node.ID] = node
+		}
+	}
+
+	if cfg.Discovery {
+		alive, err := app.Redis.GetAliveNodes(time.Now().Add(-time.Duration(cfg.NodeTTL) * time.Second))
+		if err != nil {
+			return false, err
+		}
+
+		for _, node := range alive {
+			if _, ok := nodes[node.ID]; !ok {
+				nodes[node.ID] = node
+			}
+		}
+	}
+
+	members := make([]ClusterNode, 0, len(nodes))
+	for _, node := range nodes {
+		members = append(members, node)
+	}
+
+	sort.Slice(members, func(i, j int) bool { return members[i].ID < members[j].ID })
+
+	changed := app.Cluster.setMembers(members, cfg.VirtualNodes)
+	if changed {
+		app.Logger.Info("cluster members changed", "component", "cluster", "members", len(members))
+	}
+
+	return changed, nil
+}
+
+// getOwner method returns owner of file if it's another node
+// false is returned if cluster is disabled or this node owns file
+func (app *Application) getOwner(fileID string) (ClusterNode, bool) {
+	cfg := app.GetConfig().Cluster
+	if cfg == nil {
+		return ClusterNode{}, false
+	}
+
+	owner, ok := app.Cluster.getRing().Get(fileID)
+	if !ok || owner.ID == cfg.NodeID {
+		return ClusterNode{}, false
+	}
+
+	return owner, true
+}
+
+// StoreFile method saves uploaded file of given size in storage of its owner, file is encrypted by client key if it's set
+func (app *Application) StoreFile(hash string, r io.Reader, size int64, clientKey []byte) (int64, error) {
+	owner, remote := app.getOwner(hash)
+	if !remote {
+		size, err := app.Storage.CreateFileWithKey(hash, r, clientKey)
+		if err != nil {
+			return 0, err
+		}
+
+		// usage is charged by node which writes file
+		err = app.AddUsage(size)
+		if err != nil {
+			app.Logger.Error("could not update storage usage", "component", "usage", "file_id", hash, "error", err)
+		}
+
+		return size, app.recordEncoding(hash, clientKey)
+	}
+
+	err := app.pushFile(owner, hash, r, size, clientKey)
+	if err != nil {
+		app.Logger.Error("could not push file to owner", "component", "cluster", "file_id", hash, "node", owner.ID, "error", err)
+		return 0, errNodeUnavailable
+	}
+
+	return size, nil
+}
+
+// pushFile method sends file to storage of another node, client key is passed to owner which encrypts file
+func (app *Application) pushFile(node ClusterNode, hash string, body io.Reader, size int64, clientKey []byte) error {
+	header := http.Header{}
+
+	if clientKey != nil {
+		header.Set(clientKeyHeader, base64.StdEncoding.EncodeToString(clientKey))
+	}
+
+	return app.push(node, "/cluster/files/"+hash, body, size, header)
+}
+
+// pushStoredFile method sends stored content of file to another node as is
+// fingerprint of client key and checksum of stored content are passed for file which is encrypted by client key
+func (app *Application) pushStoredFile(node ClusterNode, hash string, body io.Reader) error {
+	header := http.Header{}
+
+	fingerprint, storedSHA256, err := app.Redis.GetClientKey(hash)
+	if err == nil {
+		header.Set(clusterFingerprintHeader, fingerprint)
+		header.Set(clusterStoredSHA256Header, storedSHA256)
+	} else if err != errDataKeyNotFound {
+		return err
+	}
+
+	return app.push(node, "/cluster/stored/"+hash, body, -1, header)
+}
+
+// push method sends content to another node, size is -1 if it's unknown
+func (app *Application) push(node ClusterNode, path string, body io.Reader, size int64, header http.Header) error {
+	cfg := app.GetConfig().Cluster
+
+	req, err := http.NewRequest("PUT", strings.TrimRight(node.Address, "/")+path, body)
+	if err != nil {
+		return err
+	}
+
+	req.ContentLength = size
+	req.Header = header
+	req.Header.Set(clusterSecretHeader, cfg.Secret)
+	req.Header.Set(clusterNodeHeader, cfg.NodeID)
+
+	client := &http.Client{Timeout: time.Duration(cfg.Timeout) * time.Second}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return errNodeUnavailable
+	}
+
+	return nil
+}
+
+// Rebalance method moves files which are owned by other nodes to them and returns count of moved files
+// file is removed from this node only after its owner has saved it
+func (app *Application) Rebalance() (int, error) {
+	count := 0
+
+	err := app.Storage.WalkFiles(func(names []string) error {
+		for _, name := range names {
+			if err := app.ctx.Err(); err != nil {
+				return err
+			}
+
+			owner, remote := app.getOwner(name)
+			if !remote {
+				continue
+			}
+
+			err := app.moveFile(owner, name)
+			if os.IsNotExist(err) {
+				continue
+			} else if err != nil {
+				app.Logger.Warn("could not move file to owner", "component", "cluster", "file_id", name, "node", owner.ID, "error", err)
+				continue
+			}
+
+			count++
+		}
+
+		return nil
+	})
+
+	return count, err
+}
+
+// moveFile method sends stored content of file to its owner, so file is not decrypted or decoded
+func (app *Application) moveFile(owner ClusterNode, hash string) error {
+	f, err := app.Storage.OpenRaw(hash)
+	if err != nil {
+		return err
+	}
+
+	err = app.pushStoredFile(owner, hash, f)
+	f.Close()
+
+	if err != nil {
+		return err
+	}
+
+	size, err := app.Storage.GetFileSize(hash)
+	if err != nil {
+		return err
+	}
+
+	_, err = app.Storage.RemoveFile(hash)
+	if err != nil {
+		return err
+	}
+
+	// usage is charged by owner which has received file
+	err = app.AddUsage(-size)
+	if err != nil {
+		return err
+	}
+
+	app.Metrics.RebalancedFiles.Inc()
+
+	return nil
+}
+
+// TriggerRebalance method starts rebalancing if it's not started yet
+func (app *Application) TriggerRebalance() {
+	select {
+	case app.Cluster.rebalanceTrigger <- struct{}{}:
+	default:
+	}
+}
+
+// RunCluster method sends heartbeats, refreshes members and rebalances files until application is shut down
+// heartbeat of node is removed on shutdown, so other nodes exclude it immediately
+func (app *Application) RunCluster() {
+	app.Go(func() {
+		for {
+			interval := defaultHeartbeatInterval * time.Second
+			if cfg := app.GetConfig().Cluster; cfg != nil && cfg.HeartbeatInterval > 0 {
+				interval = time.Duration(cfg.HeartbeatInterval) * time.Second
+			}
+
+			timer := time.NewTimer(interval)
+
+			select {
+			case <-app.ctx.Done():
+				timer.Stop()
+
+				if cfg := app.GetConfig().Cluster; cfg != nil && cfg.Discovery {
+					app.Redis.RemoveHeartbeat(cfg.NodeID)
+				}
+
+				return
+			case <-timer.C:
+			}
+
+			app.heartbeat()
+		}
+	})
+
+	app.Go(func() {
+		for {
+			interval := defaultRebalanceInterval * time.Second
+			if cfg := app.GetConfig().Cluster; cfg != nil && cfg.RebalanceInterval > 0 {
+				interval = time.Duration(cfg.RebalanceInterval) * time.Second
+			}
+
+			timer := time.NewTimer(interval)
+
+			select {
+			case <-app.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			case <-app.Cluster.rebalanceTrigger:
+				timer.Stop()
+			}
+
+			if app.GetConfig().Cluster == nil {
+				continue
+			}
+
+			count, err := app.Rebalance()
+			if err != nil {
+				app.Logger.Error("rebalancing failed", "component", "cluster", "error", err)
+			} else if count > 0 {
+				app.Logger.Info("files moved to owners", "component", "cluster", "files", count)
+			}
+		}
+	})
+}
+
+// heartbeat method announces node and refreshes members, rebalancing is started if members have been changed
+func (app *Application) heartbeat() {
+	if cfg := app.GetConfig().Cluster; cfg != nil && cfg.Discovery {
+		err := app.Redis.SaveHeartbeat(ClusterNode{ID: cfg.NodeID, Address: cfg.Address}, time.Now())
+		if err != nil {
+			app.Logger.Error("could not save heartbeat", "component", "cluster", "error", err)
+		}
+	}
+
+	changed, err := app.RefreshCluster()
+	if err != nil {
+		app.Logger.Error("could not refresh cluster members", "component", "cluster", "error", err)
+	} else if changed {
+		app.TriggerRebalance()
+	}
+}
+
+// isClusterRequest method returns true if request is sent by another node with valid secret
+func (h *Handler) isClusterRequest(r *http.Request) bool {
+	cfg := h.App.GetConfig().Cluster
+	if cfg == nil || cfg.Secret == "" {
+		return false
+	}
+
+	secret := r.Header.Get(clusterSecretHeader)
+
+	return subtle.ConstantTimeCompare([]byte(secret), []byte(cfg.Secret)) == 1
+}
+
+// errByteLimitReached is returned when response of owner exceeds download bandwidth limit of client
+var errByteLimitReached = errors.New("Byte limit has been reached")
+
+// forwardToOwner method proxies or redirects request to owner of file, false is returned if file is owned by this node
+// request which has been forwarded already is served locally, so misconfigured nodes can't loop
+func (h *Handler) forwardToOwner(w http.ResponseWriter, r *http.Request, limitKey, fileID string) bool {
+	if h.isClusterRequest(r) {
+		return false
+	}
+
+	owner, remote := h.App.getOwner(fileID)
+	if !remote {
+		return false
+	}
+
+	target, err := url.Parse(owner.Address)
+	if err != nil {
+		h.requestLogger(r).Error("bad address of node", "node", owner.ID, "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return true
+	}
+
+	cfg := h.App.GetConfig().Cluster
+
+	if cfg.Redirect {
+		http.Redirect(w, r, strings.TrimRight(owner.Address, "/")+r.URL.RequestURI(), http.StatusTemporaryRedirect)
+		return true
+	}
+
+	logger := h.requestLogger(r)
+	principal := getRequestInfo(r).Principal
+
+	proxy := httputil.NewSingleHostReverseProxy(target)
+
+	director := proxy.Director
+	proxy.Director = func(req *http.Request) {
+		director(req)
+
+		// request has been authorized by this node
+		req.Header.Set(clusterSecretHeader, cfg.Secret)
+		req.Header.Set(clusterPrincipalHeader, principal)
+		req.Header.Set(clusterNodeHeader, cfg.NodeID)
+		req.Header.Set(requestIDHeader, getRequestInfo(r).ID)
+	}
+
+	rateLimit := h.App.GetRateLimit()
+
+	proxy.ModifyResponse = func(resp *http.Response) error {
+		// request id has been set already
+		resp.Header.Del(requestIDHeader)
+
+		// owner does not limit forwarded requests, downloaded bytes are limited by this node
+		if r.Method != "GET" || resp.StatusCode != http.StatusOK {
+			return nil
+		}
+
+		// size is unknown before body is sent, so it's counted after that
+		if resp.ContentLength < 0 {
+			resp.Body = &chargedReader{
+				countingReader: countingReader{ReadCloser: resp.Body},
+				charge: func(n int64) {
+					rateLimit.CheckBandwidth("download", limitKey, n)
+				},
+			}
+
+			return nil
+		}
+
+		if !rateLimit.CheckBandwidth("download", limitKey, resp.ContentLength) {
+			resp.Body.Close()
+			return errByteLimitReached
+		}
+
+		return nil
+	}
+
+	proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+		if err == errByteLimitReached {
+			h.rejectByLimit(w, r, "bandwidth", http.StatusForbidden, "BYTE_LIMIT_REACHED")
+			return
+		}
+
+		logger.Error("could not proxy request to owner", "node", owner.ID, "error", err)
+		h.renderError(w, http.StatusBadGateway, "NODE_UNAVAILABLE")
+	}
+
+	proxy.ServeHTTP(w, r)
+
+	return true
+}
+
+// cluster method routes /cluster/* requests of other nodes
+func (h *Handler) cluster(w http.ResponseWriter, r *http.Request, pathParts []string) {
+	if !h.isClusterRequest(r) {
+		h.renderError(w, http.StatusForbidden, "FORBIDDEN")
+		return
+	}
+
+	// file pushed by another node
+	if r.Method == "PUT" && len(pathParts) == 3 && pathParts[1] == "files" {
+		h.receiveFile(w, r, pathParts[2])
+		return
+	}
+
+	// file moved by another node
+	if r.Method == "PUT" && len(pathParts) == 3 && pathParts[1] == "stored" {
+		h.receiveStoredFile(w, r, pathParts[2])
+		return
+	}
+
+	// not found
+	h.renderError(w, http.StatusNotFound, "NOT_FOUND")
+}
+
+// receiveFile method saves file pushed by another node, checksum is verified for files with sha256 in id
+func (h *Handler) receiveFile(w http.ResponseWriter, r *http.Request, hash string) {
+	logger := h.requestLogger(r)
+	sum := sha256.New()
+
+	clientKey, err := getClientKey(r)
+	if err != nil {
+		h.renderError(w, http.StatusBadRequest, "BAD_ENCRYPTION_KEY")
+		return
+	}
+
+	size, err := h.App.Storage.CreateFileWithKey(hash, io.TeeReader(http.MaxBytesReader(w, r.Body, h.App.GetConfig().Storage.MaxSize), sum), clientKey)
+	if err == errFileExists {
+		h.renderJSON(w, http.StatusOK, UploadResponse{Hash: hash})
+		return
+	} else if err == errQuorumNotReached {
+		h.renderError(w, http.StatusServiceUnavailable, "WRITE_QUORUM_NOT_REACHED")
+		return
+	} else if err != nil {
+		logger.Error("could not save pushed file", "file_id", hash, "error", err)
+		h.App.Storage.RemoveFile(hash)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	if expected := strings.Split(hash, "-")[0]; isSHA256(expected) && hex.EncodeToString(sum.Sum(nil)) != expected {
+		logger.Warn("pushed file is corrupted", "file_id", hash, "node", r.Header.Get(clusterNodeHeader))
+		h.App.Storage.RemoveFile(hash)
+		h.renderError(w, http.StatusBadRequest, "BAD_SHA256")
+		return
+	}
+
+	err = h.App.AddUsage(size)
+	if err != nil {
+		logger.Error("could not update storage usage", "file_id", hash, "error", err)
+	}
+
+	err = h.App.recordEncoding(hash, clientKey)
+	if err != nil {
+		logger.Error("could not save encoding of file", "file_id", hash, "error", err)
+	}
+
+	h.renderJSON(w, http.StatusOK, UploadResponse{Hash: hash})
+}
+
+// receiveStoredFile method saves stored content of file moved by another node as is
+// content of file which is encrypted by client key is verified by passed checksum, original content is verified otherwise
+func (h *Handler) receiveStoredFile(w http.ResponseWriter, r *http.Request, hash string) {
+	logger := h.requestLogger(r).With("file_id", hash, "node", r.Header.Get(clusterNodeHeader))
+	fingerprint := r.Header.Get(clusterFingerprintHeader)
+	sum := sha256.New()
+
+	size, err := h.App.Storage.CreateStoredFile(hash, io.TeeReader(r.Body, sum))
+	if err == errFileExists {
+		h.renderJSON(w, http.StatusOK, UploadResponse{Hash: hash})
+		return
+	} else if err == errQuorumNotReached {
+		h.renderError(w, http.StatusServiceUnavailable, "WRITE_QUORUM_NOT_REACHED")
+		return
+	} else if err != nil {
+		logger.Error("could not save moved file", "error", err)
+		h.App.Storage.RemoveFile(hash)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	if fingerprint == "" {
+		err = h.verifyStoredFile(hash)
+	} else if storedSHA256 := r.Header.Get(clusterStoredSHA256Header); hex.EncodeToString(sum.Sum(nil)) != storedSHA256 {
+		err = errChecksumMismatch
+	} else {
+		err = h.App.Redis.SaveClientKey(hash, fingerprint, storedSHA256)
+	}
+
+	if err == errChecksumMismatch {
+		logger.Warn("moved file is corrupted")
+		h.App.Storage.RemoveFile(hash)
+		h.renderError(w, http.StatusBadRequest, "BAD_SHA256")
+		return
+	} else if err != nil {
+		logger.Error("could not save moved file", "error", err)
+		h.App.Storage.RemoveFile(hash)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	err = h.App.AddUsage(size)
+	if err != nil {
+		logger.Error("could not update storage usage", "error", err)
+	}
+
+	h.renderJSON(w, http.StatusOK, UploadResponse{Hash: hash})
+}
+
+// verifyStoredFile method compares sha256 of original content of saved file with its id
+func (h *Handler) verifyStoredFile(hash string) error {
+	expected := strings.Split(hash, "-")[0]
+	if !isSHA256(expected) {
+		return nil
+	}
+
+	f, err := h.App.Storage.OpenRaw(hash)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	sum, err := h.App.Storage.getContentSHA256(hash, f)
+	if err != nil {
+		return err
+	} else if sum != expected {
+		return errChecksumMismatch
+	}
+
+	return nil
+}
+
+// ClusterResponse struct
+type ClusterResponse struct {
+	NodeID  string        `json:"node_id"`
+	Members []ClusterNode `json:"members"`
+}
+
+// clusterMembers method renders current members of cluster
+func (h *Handler) clusterMembers(w http.ResponseWriter) {
+	res := ClusterResponse{Members: h.App.Cluster.Members()}
+
+	if cfg := h.App.GetConfig().Cluster; cfg != nil {
+		res.NodeID = cfg.NodeID
+	}
+
+	if res.Members == nil {
+		res.Members = []ClusterNode{}
+	}
+
+	h.renderJSON(w, http.StatusOK, res)
+}
@@ -0,0 +1,530 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testNode struct {
+	App    *Application
+	Server *httptest.Server
+}
+
+// newTestCluster func starts in-process nodes which know about each other
+func newTestCluster(t *testing.T, count int) []*testNode {
+	nodes := make([]*testNode, count)
+	members := []ClusterNode{}
+
+	for i := range nodes {
+		node := &testNode{}
+
+		node.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			NewHandler(node.App).ServeHTTP(w, r)
+		}))
+
+		nodes[i] = node
+		members = append(members, ClusterNode{ID: "node" + strconv.Itoa(i), Address: node.Server.URL})
+	}
+
+	for i, node := range nodes {
+		dir, err := ioutil.TempDir("", "t2-storage")
+		if err != nil {
+			t.Fatalf("Err must be nil but got %v\n", err)
+		}
+
+		cfg := &Config{
+			Storage: &StorageConfig{Path: dir, MaxSize: 1048576},
+			Cluster: &ClusterConfig{NodeID: members[i].ID, Address: members[i].Address, Nodes: members, Secret: "secret"},
+		}
+		cfg.Cluster.SetDefaults()
+
+		node.App = NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(nil), NewRedis(&RedisConfig{}))
+		node.App.SetLogger(NewWriterLogger(ioutil.Discard, LevelError, ""))
+		node.App.RefreshCluster()
+	}
+
+	conn := nodes[0].App.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	return nodes
+}
+
+func stopTestCluster(nodes []*testNode) {
+	for _, node := range nodes {
+		node.Server.Close()
+		os.RemoveAll(node.App.Config.Storage.Path)
+	}
+}
+
+// getOwnedContent func returns content of file which is owned by node
+func getOwnedContent(app *Application, nodeID string) string {
+	for i := 0; ; i++ {
+		content := "file" + strconv.Itoa(i)
+
+		if owner, _ := app.Cluster.getRing().Get(getTestFileID(content, time.Now())); owner.ID == nodeID {
+			return content
+		}
+	}
+}
+
+func uploadTestFile(t *testing.T, url, content string) string {
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, _ := writer.CreateFormFile("file", "example.txt")
+	part.Write([]byte(content))
+	writer.Close()
+
+	resp, err := http.Post(url+"/files", writer.FormDataContentType(), body)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return ""
+	}
+	defer resp.Body.Close()
+
+	res := UploadResponse{}
+	json.NewDecoder(resp.Body).Decode(&res)
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Code must be %d but got %d\n", 200, resp.StatusCode)
+	}
+
+	return res.Hash
+}
+
+func TestClusterUploadAndDownload(t *testing.T) {
+	nodes := newTestCluster(t, 3)
+	defer stopTestCluster(nodes)
+
+	content := getOwnedContent(nodes[0].App, "node2")
+	hash := uploadTestFile(t, nodes[0].Server.URL, content)
+	nodes[0].App.wg.Wait()
+
+	for i, node := range nodes {
+		if _, ok := node.App.Storage.GetFile(hash); ok != (i == 2) {
+			t.Errorf("File must be stored only by owner but node%d has it: %v\n", i, ok)
+		}
+	}
+
+	for i, node := range nodes {
+		resp, err := http.Get(node.Server.URL + "/files/" + hash)
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 || string(data) != content {
+			t.Errorf("File must be downloaded from node%d but got %d, %s\n", i, resp.StatusCode, data)
+		}
+	}
+
+	req, _ := http.NewRequest("DELETE", nodes[1].Server.URL+"/files/"+hash, nil)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil || resp.StatusCode != 204 {
+		t.Errorf("File must be removed through node1 but got %v, %v\n", resp, err)
+	} else {
+		resp.Body.Close()
+	}
+
+	if _, ok := nodes[2].App.Storage.GetFile(hash); ok {
+		t.Error("File must be removed by owner\n")
+	}
+}
+
+func TestClusterForwardedLimits(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	defer stopTestCluster(nodes)
+
+	content := getOwnedContent(nodes[0].App, "node1")
+	hash := uploadTestFile(t, nodes[0].Server.URL, content)
+	nodes[0].App.wg.Wait()
+
+	download := func() int {
+		resp, err := http.Get(nodes[0].Server.URL + "/files/" + hash)
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			return 0
+		}
+
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// requests for files of another node are limited by node which has received them
+	cases := []struct {
+		limit *RateLimitConfig
+		codes []int
+	}{
+		{limit: &RateLimitConfig{RPS: &RPSConfig{Download: 2}}, codes: []int{200, 200, 429}},
+		{limit: &RateLimitConfig{Bandwidth: &BandwidthConfig{Download: int64(len(content) * 3 / 2)}}, codes: []int{200, 403}},
+	}
+
+	for _, tc := range cases {
+		nodes[0].App.RateLimit = NewRateLimit(tc.limit)
+
+		for i, code := range tc.codes {
+			if v := download(); v != code {
+				t.Errorf("Code of request %d with %+v must be %d but got %d\n", i, tc.limit, code, v)
+			}
+		}
+	}
+}
+
+func TestClusterLocalMaintenance(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	defer stopTestCluster(nodes)
+
+	local := getOwnedContent(nodes[0].App, "node0")
+	remote := getOwnedContent(nodes[0].App, "node1")
+
+	for _, node := range nodes {
+		node.App.Redis.CorrectUsage(0)
+	}
+
+	localID := uploadTestFile(t, nodes[0].Server.URL, local)
+	remoteID := uploadTestFile(t, nodes[0].Server.URL, remote)
+	nodes[0].App.wg.Wait()
+
+	// usage is charged by node which stores file
+	for i, content := range []string{local, remote} {
+		usage, _, err := nodes[i].App.Redis.GetUsage()
+		if usage != int64(len(content)) || err != nil {
+			t.Errorf("Usage of node%d must be %d but got %d, %v\n", i, len(content), usage, err)
+		}
+	}
+
+	// usage is counted per node
+	for i, content := range []string{local, remote} {
+		usage, err := nodes[i].App.ReconcileUsage()
+		if usage != int64(len(content)) || err != nil {
+			t.Errorf("Usage of node%d must be %d but got %d, %v\n", i, len(content), usage, err)
+		}
+	}
+
+	if usage, _ := nodes[0].App.GetUsage(); usage != int64(len(local)) {
+		t.Errorf("Usage of node0 must be %d but got %d\n", len(local), usage)
+	}
+
+	// files of other nodes are not missing
+	report, err := nodes[0].App.Fsck(context.Background(), FsckOptions{Repair: true})
+	if err != nil || report.Missing != 0 {
+		t.Errorf("Fsck must not find missing files but got %#v, %v\n", report, err)
+	}
+
+	// files of other nodes are not evicted
+	cfg := nodes[0].App.Config
+	cfg.AutoClean = &AutoCleanConfig{}
+	cfg.Storage.Limit = 1
+	cfg.Storage.Eviction = &EvictionConfig{Policy: "lfu"}
+
+	clean, err := nodes[0].App.RunAutoCleanNow()
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	} else if files := getReportFiles(clean); !reflect.DeepEqual(files, []string{localID + ":limit"}) {
+		t.Errorf("Files must be %v but got %v\n", []string{localID + ":limit"}, files)
+	}
+
+	resp, err := http.Get(nodes[0].Server.URL + "/files/" + remoteID)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode != 200 {
+		t.Errorf("Code must be %d but got %d\n", 200, resp.StatusCode)
+	}
+}
+
+func TestClusterRedirect(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	defer stopTestCluster(nodes)
+
+	nodes[0].App.Config.Cluster.Redirect = true
+
+	hash := getTestFileID(getOwnedContent(nodes[0].App, "node1"), time.Now())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files/"+hash, nil)
+
+	NewHandler(nodes[0].App).ServeHTTP(w, r)
+
+	if w.Code != 307 {
+		t.Errorf("Code must be %d but got %d\n", 307, w.Code)
+	}
+
+	if v := w.Header().Get("Location"); v != nodes[1].Server.URL+"/files/"+hash {
+		t.Errorf("Location must be %s but got %s\n", nodes[1].Server.URL+"/files/"+hash, v)
+	}
+}
+
+func TestClusterReceiveFile(t *testing.T) {
+	nodes := newTestCluster(t, 1)
+	defer stopTestCluster(nodes)
+
+	h := NewHandler(nodes[0].App)
+	hash := getTestFileID("valid", time.Now())
+
+	cases := []struct {
+		secret  string
+		content string
+		code    int
+	}{
+		{secret: "", content: "valid", code: 403},
+		{secret: "wrong", content: "valid", code: 403},
+		{secret: "secret", content: "corrupted", code: 400},
+		{secret: "secret", content: "valid", code: 200},
+		{secret: "secret", content: "valid", code: 200},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PUT", "/cluster/files/"+hash, strings.NewReader(tc.content))
+		r.Header.Set(clusterSecretHeader, tc.secret)
+
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("Code must be %d but got %d\n", tc.code, w.Code)
+		}
+	}
+
+	if _, ok := nodes[0].App.Storage.GetFile(hash); !ok {
+		t.Error("Pushed file must be saved\n")
+	}
+}
+
+func TestClusterRebalance(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	defer stopTestCluster(nodes)
+
+	// node0 works alone
+	cfg := nodes[0].App.Config.Cluster
+	members := cfg.Nodes
+	cfg.Nodes = nil
+	nodes[0].App.RefreshCluster()
+
+	for _, node := range nodes {
+		node.App.Redis.CorrectUsage(0)
+	}
+
+	hashes := []string{}
+	for i := 0; i < 10; i++ {
+		hashes = append(hashes, uploadTestFile(t, nodes[0].Server.URL, "file"+strconv.Itoa(i)))
+	}
+
+	nodes[0].App.wg.Wait()
+
+	// node1 joins cluster
+	cfg.Nodes = members
+
+	changed, err := nodes[0].App.RefreshCluster()
+	if !changed || err != nil {
+		t.Errorf("Members must be changed but got %v, %v\n", changed, err)
+	}
+
+	count, err := nodes[0].App.Rebalance()
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	moved := 0
+
+	for _, hash := range hashes {
+		owner, _ := nodes[0].App.Cluster.getRing().Get(hash)
+
+		_, local := nodes[0].App.Storage.GetFile(hash)
+		_, remote := nodes[1].App.Storage.GetFile(hash)
+
+		if local != (owner.ID == "node0") || remote != (owner.ID == "node1") {
+			t.Errorf("File %s must be stored by %s\n", hash, owner.ID)
+		}
+
+		if remote {
+			moved++
+		}
+
+		resp, err := http.Get(nodes[0].Server.URL + "/files/" + hash)
+		if err != nil || resp.StatusCode != 200 {
+			t.Errorf("File must be available after rebalancing but got %v, %v\n", resp, err)
+		} else {
+			resp.Body.Close()
+		}
+	}
+
+	if count != moved || moved == 0 {
+		t.Errorf("Count must be %d but got %d\n", moved, count)
+	}
+
+	// usage of moved files is charged by new owner
+	for i, node := range nodes {
+		usage, _, _ := node.App.Redis.GetUsage()
+
+		if expected, err := node.App.ReconcileUsage(); usage != expected || err != nil {
+			t.Errorf("Usage of node%d must be %d but got %d, %v\n", i, expected, usage, err)
+		}
+	}
+}
+
+func TestClusterRebalanceClientKey(t *testing.T) {
+	nodes := newTestCluster(t, 2)
+	defer stopTestCluster(nodes)
+
+	key := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	content := getOwnedContent(nodes[0].App, "node1")
+
+	// node0 works alone
+	cfg := nodes[0].App.Config.Cluster
+	members := cfg.Nodes
+	cfg.Nodes = nil
+	nodes[0].App.RefreshCluster()
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+	part, _ := writer.CreateFormFile("file", "example.txt")
+	part.Write([]byte(content))
+	writer.Close()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/files", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.Header.Set(clientKeyHeader, key)
+	NewHandler(nodes[0].App).ServeHTTP(w, r)
+
+	res := UploadResponse{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+	nodes[0].App.wg.Wait()
+
+	fileName, _ := nodes[0].App.Storage.GetFile(res.Hash)
+	stored, _ := ioutil.ReadFile(fileName)
+
+	// node1 joins cluster
+	cfg.Nodes = members
+	nodes[0].App.RefreshCluster()
+
+	count, err := nodes[0].App.Rebalance()
+	if count != 1 || err != nil {
+		t.Errorf("One file must be moved but got %d, %v\n", count, err)
+	}
+
+	// stored content is moved as is
+	fileName, ok := nodes[1].App.Storage.GetFile(res.Hash)
+	if moved, _ := ioutil.ReadFile(fileName); !ok || !bytes.Equal(moved, stored) {
+		t.Errorf("Stored content must be %q but got %q\n", stored, moved)
+	}
+
+	cases := []struct {
+		key  string
+		code int
+	}{
+		{key: "", code: 403},
+		{key: key, code: 200},
+	}
+
+	for _, tc := range cases {
+		r, _ := http.NewRequest("GET", nodes[0].Server.URL+"/files/"+res.Hash, nil)
+		r.Header.Set(clientKeyHeader, tc.key)
+
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		data, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.code {
+			t.Errorf("Code for %q must be %d but got %d\n", tc.key, tc.code, resp.StatusCode)
+		}
+
+		if tc.code == 200 && string(data) != content {
+			t.Errorf("Content must be %s but got %s\n", content, data)
+		}
+	}
+}
+
+func TestClusterDiscovery(t *testing.T) {
+	nodes := newTestCluster(t, 1)
+	defer stopTestCluster(nodes)
+
+	app := nodes[0].App
+	app.Config.Cluster.Discovery = true
+
+	now := time.Now()
+	app.Redis.SaveHeartbeat(ClusterNode{ID: "alive", Address: "http://alive"}, now)
+	app.Redis.SaveHeartbeat(ClusterNode{ID: "dead", Address: "http://dead"}, now.Add(-time.Minute))
+
+	changed, err := app.RefreshCluster()
+	if !changed || err != nil {
+		t.Errorf("Members must be changed but got %v, %v\n", changed, err)
+	}
+
+	members := app.Cluster.Members()
+	if len(members) != 2 || members[0].ID != "alive" || members[1].ID != "node0" {
+		t.Errorf("Members must be alive and node0 but got %v\n", members)
+	}
+
+	app.Redis.RemoveHeartbeat("alive")
+	app.RefreshCluster()
+
+	if members := app.Cluster.Members(); len(members) != 1 {
+		t.Errorf("Members must be node0 but got %v\n", members)
+	}
+
+	// cluster mode is disabled
+	app.Config.Cluster = nil
+
+	changed, _ = app.RefreshCluster()
+	if _, remote := app.getOwner("example"); !changed || remote {
+		t.Errorf("Files must be owned by node but got %v, %v\n", changed, remote)
+	}
+}
+
+func TestValidateClusterConfig(t *testing.T) {
+	cases := []struct {
+		cfg    *ClusterConfig
+		fields []string
+	}{
+		{cfg: &ClusterConfig{NodeID: "node0", Address: "http://node0", Secret: "secret"}, fields: []string{}},
+		{cfg: &ClusterConfig{Address: "http://node0", Secret: "secret"}, fields: []string{"cluster.node_id"}},
+		{cfg: &ClusterConfig{NodeID: "node0", Address: "http://node0"}, fields: []string{"cluster.secret"}},
+		{cfg: &ClusterConfig{NodeID: "node0", Address: "http://node0", Secret: "secret", Nodes: []ClusterNode{{ID: "node1"}}}, fields: []string{"cluster.nodes"}},
+		{cfg: &ClusterConfig{NodeID: "node0", Address: "http://node0", Secret: "secret", HeartbeatInterval: 10, NodeTTL: 5}, fields: []string{"cluster.node_ttl"}},
+	}
+
+	for _, tc := range cases {
+		tc.cfg.SetDefaults()
+
+		errs := ValidationErrors{}
+		validateClusterConfig(&errs, tc.cfg)
+
+		fields := []string{}
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+
+		if strings.Join(fields, ",") != strings.Join(tc.fields, ",") {
+			t.Errorf("Errors must be %v but got %v\n", tc.fields, fields)
+		}
+	}
+}
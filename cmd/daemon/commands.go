@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// value which is printed instead of secrets
+const maskedSecret = "******"
+
+// runCommand func runs command from arguments and returns exit code
+// new commands should be added here
+func runCommand(cfgPath string, args []string, stdout, stderr io.Writer) int {
+	switch {
+	case len(args) == 2 && args[0] == "config" && args[1] == "check":
+		return configCheckCommand(cfgPath, stdout, stderr)
+	case len(args) == 2 && args[0] == "autoclean" && args[1] == "plan":
+		return autoCleanPlanCommand(cfgPath, stdout, stderr)
+	case len(args) == 2 && args[0] == "autoclean" && args[1] == "run":
+		return autoCleanRunCommand(cfgPath, stdout, stderr)
+	case len(args) == 2 && args[0] == "autoclean" && args[1] == "reports":
+		return autoCleanReportsCommand(cfgPath, "", stdout, stderr)
+	case len(args) == 3 && args[0] == "autoclean" && args[1] == "reports":
+		return autoCleanReportsCommand(cfgPath, args[2], stdout, stderr)
+	case len(args) > 0 && args[0] == "fsck":
+		return fsckCommand(cfgPath, args[1:], stdout, stderr)
+	case len(args) == 2 && args[0] == "keys" && args[1] == "rotate":
+		return keysRotateCommand(cfgPath, stdout, stderr)
+	case len(args) == 2 && args[0] == "files" && args[1] == "reindex":
+		return filesReindexCommand(cfgPath, stdout, stderr)
+	}
+
+	fmt.Fprintf(stderr, "Unknown command: %s\n", strings.Join(args, " "))
+	fmt.Fprintln(stderr, "Available commands:")
+	fmt.Fprintln(stderr, "  config check\tvalidate config and print effective configuration")
+	fmt.Fprintln(stderr, "  autoclean run\tevict files now and print report of run")
+	fmt.Fprintln(stderr, "  autoclean plan\tprint files which would be evicted by autoclean now")
+	fmt.Fprintln(stderr, "  autoclean reports [id]\tprint reports of the latest autoclean runs or one report")
+	fmt.Fprintln(stderr, "  fsck [-repair] [-rate=bytes]\tverify stored files and metadata, corrupted files are quarantined")
+	fmt.Fprintln(stderr, "  keys rotate\trewrap data keys of encrypted files by current master key")
+	fmt.Fprintln(stderr, "  files reindex\trebuild indexes of file listing from metadata of stored files")
+
+	return 2
+}
+
+// configCheckCommand func prints config merged with environment variables and defaults
+// and lists all validation problems, secrets are masked in output
+func configCheckCommand(cfgPath string, stdout, stderr io.Writer) int {
+	cfg, err := LoadConfig(cfgPath)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	res, err := json.MarshalIndent(maskConfigSecrets(cfg), "", "  ")
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s\n", res)
+
+	err = cfg.Validate()
+	if errs, ok := err.(ValidationErrors); ok {
+		for _, e := range errs {
+			fmt.Fprintf(stderr, "%s\n", e.Error())
+		}
+
+		return 1
+	}
+
+	fmt.Fprintln(stderr, "config is valid")
+
+	return 0
+}
+
+// maskConfigSecrets func returns copy of config without secrets, config itself is not changed
+func maskConfigSecrets(cfg *Config) *Config {
+	masked := *cfg
+
+	if cfg.Cluster != nil && cfg.Cluster.Secret != "" {
+		cluster := *cfg.Cluster
+		cluster.Secret = maskedSecret
+		masked.Cluster = &cluster
+	}
+
+	return &masked
+}
+
+// autoCleanPlanCommand func prints dry-run plan of autoclean, files are not removed
+func autoCleanPlanCommand(cfgPath string, stdout, stderr io.Writer) int {
+	app, err := newCommandApplication(cfgPath, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer app.Redis.Close()
+
+	report, err := app.PlanAutoClean()
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	return printJSON(report, stdout, stderr)
+}
+
+// autoCleanRunCommand func runs autoclean immediately, lock is shared with daemons
+func autoCleanRunCommand(cfgPath string, stdout, stderr io.Writer) int {
+	app, err := newCommandApplication(cfgPath, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer app.Redis.Close()
+
+	report, err := app.RunAutoCleanNow()
+	if report == nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	code := printJSON(report, stdout, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	return code
+}
+
+// autoCleanReportsCommand func prints persisted reports of autoclean runs, or one report if id is set
+func autoCleanReportsCommand(cfgPath, rawID string, stdout, stderr io.Writer) int {
+	app, err := newCommandApplication(cfgPath, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer app.Redis.Close()
+
+	if rawID == "" {
+		reports, err := app.Redis.GetAutoCleanReports(maxAutoCleanReports)
+		if err != nil {
+			fmt.Fprintf(stderr, "%s\n", err.Error())
+			return 1
+		}
+
+		return printJSON(reports, stdout, stderr)
+	}
+
+	id, err := strconv.ParseInt(rawID, 10, 64)
+	if err != nil {
+		fmt.Fprintf(stderr, "Invalid report id %s\n", rawID)
+		return 2
+	}
+
+	report, err := app.GetAutoCleanReport(id)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	} else if report == nil {
+		fmt.Fprintf(stderr, "Report %d is not found\n", id)
+		return 1
+	}
+
+	return printJSON(report, stdout, stderr)
+}
+
+// fsckCommand func checks storage and prints report, exit code is 1 if problems are found
+func fsckCommand(cfgPath string, args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("fsck", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+
+	repair := flags.Bool("repair", false, "recreate metadata of orphan files and remove metadata of missing files")
+	rate := flags.Int64("rate", 0, "max i/o rate in bytes per second, 0 means no limit")
+
+	if err := flags.Parse(args); err != nil || flags.NArg() > 0 {
+		return 2
+	}
+
+	app, err := newCommandApplication(cfgPath, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer app.Redis.Close()
+
+	report, err := app.Fsck(context.Background(), FsckOptions{Rate: *rate, Repair: *repair})
+
+	code := printJSON(report, stdout, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	if !report.Clean() {
+		fmt.Fprintf(stderr, "problems found: %d corrupted, %d orphans, %d missing, %d damaged shards, %d repaired\n",
+			report.Corrupted, report.Orphans, report.Missing, report.Damaged, report.Repaired)
+		return 1
+	}
+
+	return code
+}
+
+// keysRotateCommand func rewraps data keys of encrypted files and prints report, exit code is 1 if some keys are not rewrapped
+func keysRotateCommand(cfgPath string, stdout, stderr io.Writer) int {
+	app, err := newCommandApplication(cfgPath, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer app.Redis.Close()
+
+	report, err := app.RotateKeys(context.Background())
+
+	code := printJSON(report, stdout, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	if report.Failed > 0 {
+		fmt.Fprintf(stderr, "data keys of %d files are not rewrapped\n", report.Failed)
+		return 1
+	}
+
+	return code
+}
+
+// filesReindexCommand func rebuilds indexes of file listing and prints count of indexed files
+func filesReindexCommand(cfgPath string, stdout, stderr io.Writer) int {
+	app, err := newCommandApplication(cfgPath, stderr)
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+	defer app.Redis.Close()
+
+	count, err := app.ReindexFiles(context.Background())
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%d files indexed\n", count)
+
+	return 0
+}
+
+// newCommandApplication func returns Application for commands, it logs only warnings to stderr
+func newCommandApplication(cfgPath string, stderr io.Writer) (*Application, error) {
+	cfg, err := NewConfig(cfgPath)
+	if err != nil {
+		return nil, err
+	}
+
+	app := NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(cfg.RateLimit), NewRedis(cfg.Redis))
+	app.SetLogger(NewWriterLogger(stderr, LevelWarn, ""))
+
+	return app, nil
+}
+
+func printJSON(data interface{}, stdout, stderr io.Writer) int {
+	res, err := json.MarshalIndent(data, "", "  ")
+	if err != nil {
+		fmt.Fprintf(stderr, "%s\n", err.Error())
+		return 1
+	}
+
+	fmt.Fprintf(stdout, "%s\n", res)
+
+	return 0
+}
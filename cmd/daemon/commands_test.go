@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRunCommandUnknown(t *testing.T) {
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	code := runCommand("mocks/config/full.json", []string{"example"}, stdout, stderr)
+
+	if code != 2 {
+		t.Errorf("Code must be %d but got %d\n", 2, code)
+	}
+
+	if !strings.Contains(stderr.String(), "Unknown command") {
+		t.Errorf("Unexpected output %s\n", stderr.String())
+	}
+}
+
+func TestConfigCheckCommand(t *testing.T) {
+	cases := []struct {
+		path   string
+		code   int
+		output bool
+		errors []string
+	}{
+		{
+			path:   "mocks/config/full.json",
+			code:   0,
+			output: true,
+		},
+		{
+			path:   "mocks/config/empty.json",
+			code:   0,
+			output: true,
+		},
+		{
+			path:   "mocks/config/invalid.json",
+			code:   1,
+			output: true,
+			errors: []string{"port must be between 1 and 65535", "storage.max_size must be positive"},
+		},
+		{
+			path: "mocks/config/error.json",
+			code: 1,
+		},
+	}
+
+	for _, tc := range cases {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+
+		code := runCommand(tc.path, []string{"config", "check"}, stdout, stderr)
+
+		if code != tc.code {
+			t.Errorf("Code must be %d but got %d\n", tc.code, code)
+		}
+
+		if tc.output {
+			cfg := Config{}
+
+			err := json.Unmarshal(stdout.Bytes(), &cfg)
+			if err != nil {
+				t.Errorf("Error must be nil but got %v\n", err)
+			}
+
+			if cfg.Redis == nil || cfg.Redis.Port != 6379 {
+				t.Errorf("Effective config must contain defaults but got %s\n", stdout.String())
+			}
+		}
+
+		for _, e := range tc.errors {
+			if !strings.Contains(stderr.String(), e) {
+				t.Errorf("Output must contain %s but got %s\n", e, stderr.String())
+			}
+		}
+	}
+}
+
+func TestConfigCheckCommandSecret(t *testing.T) {
+	f, err := ioutil.TempFile("", "t2-config")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"cluster": {"node_id": "node0", "address": "http://node0", "secret": "cluster-secret"}}`)
+	f.Close()
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	runCommand(f.Name(), []string{"config", "check"}, stdout, stderr)
+
+	cfg := Config{}
+	json.Unmarshal(stdout.Bytes(), &cfg)
+
+	if cfg.Cluster == nil || cfg.Cluster.Secret != maskedSecret {
+		t.Errorf("Secret must be masked but got %s\n", stdout.String())
+	}
+
+	// masked secret is still validated
+	if strings.Contains(stderr.String(), "cluster.secret") {
+		t.Errorf("Secret must be valid but got %s\n", stderr.String())
+	}
+}
+
+func TestAutoCleanCommands(t *testing.T) {
+	cases := []struct {
+		args []string
+		code int
+	}{
+		{args: []string{"autoclean", "plan"}, code: 0},
+		{args: []string{"autoclean", "run"}, code: 0},
+		{args: []string{"autoclean", "reports"}, code: 0},
+		{args: []string{"autoclean", "reports", "100"}, code: 1},
+		{args: []string{"autoclean", "reports", "example"}, code: 2},
+	}
+
+	for _, tc := range cases {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+
+		code := runCommand("mocks/config/full.json", tc.args, stdout, stderr)
+
+		if code != tc.code {
+			t.Errorf("Code must be %d but got %d for %v: %s\n", tc.code, code, tc.args, stderr.String())
+		}
+
+		if code == 0 && !json.Valid(stdout.Bytes()) {
+			t.Errorf("Output must be json but got %s\n", stdout.String())
+		}
+	}
+}
+
+func TestFsckCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	f, err := ioutil.TempFile("", "t2-config")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"storage": {"path": "` + dir + `"}}`)
+	f.Close()
+
+	// flush redis db
+	app, err := newCommandApplication(f.Name(), &bytes.Buffer{})
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	conn := app.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	cases := []struct {
+		args []string
+		code int
+	}{
+		{args: []string{"fsck"}, code: 0},
+		{args: []string{"fsck", "-repair", "-rate=1000000"}, code: 0},
+		{args: []string{"fsck", "-example"}, code: 2},
+		{args: []string{"fsck", "example"}, code: 2},
+	}
+
+	for _, tc := range cases {
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+
+		code := runCommand(f.Name(), tc.args, stdout, stderr)
+
+		if code != tc.code {
+			t.Errorf("Code must be %d but got %d for %v: %s\n", tc.code, code, tc.args, stderr.String())
+		}
+
+		if code == 0 && !json.Valid(stdout.Bytes()) {
+			t.Errorf("Output must be json but got %s\n", stdout.String())
+		}
+	}
+}
+
+func TestKeysRotateCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	keyFile := path.Join(dir, "keys.json")
+	writeTestKeyFile(t, keyFile, "k1", "k1")
+
+	cfgFile := path.Join(dir, "config.json")
+	ioutil.WriteFile(cfgFile, []byte(`{"storage": {"path": "`+dir+`"}}`), 0644)
+
+	// flush redis db
+	app, err := newCommandApplication(cfgFile, &bytes.Buffer{})
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	conn := app.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	cases := []struct {
+		cfg  string
+		code int
+	}{
+		{cfg: `{"storage": {"path": "` + dir + `", "encryption": {"key_file": "` + keyFile + `"}}}`, code: 0},
+		// key file is required for rotation
+		{cfg: `{"storage": {"path": "` + dir + `"}}`, code: 1},
+	}
+
+	for _, tc := range cases {
+		ioutil.WriteFile(cfgFile, []byte(tc.cfg), 0644)
+
+		stdout := &bytes.Buffer{}
+		stderr := &bytes.Buffer{}
+
+		code := runCommand(cfgFile, []string{"keys", "rotate"}, stdout, stderr)
+
+		if code != tc.code {
+			t.Errorf("Code must be %d but got %d for %s: %s\n", tc.code, code, tc.cfg, stderr.String())
+		}
+
+		if code == 0 && !json.Valid(stdout.Bytes()) {
+			t.Errorf("Output must be json but got %s\n", stdout.String())
+		}
+	}
+}
+
+func TestFilesReindexCommand(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	cfgFile := path.Join(dir, "config.json")
+	ioutil.WriteFile(cfgFile, []byte(`{"storage": {"path": "`+dir+`"}}`), 0644)
+
+	app, err := newCommandApplication(cfgFile, &bytes.Buffer{})
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	conn := app.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	createTrashTestFile(app, "f1", 10, time.Now())
+
+	stdout := &bytes.Buffer{}
+	stderr := &bytes.Buffer{}
+
+	code := runCommand(cfgFile, []string{"files", "reindex"}, stdout, stderr)
+	if code != 0 || stdout.String() != "1 files indexed\n" {
+		t.Errorf("Code must be %d but got %d (%s%s)\n", 0, code, stdout.String(), stderr.String())
+	}
+}
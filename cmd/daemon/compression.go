@@ -0,0 +1,379 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// files which are smaller are not compressed by default
+const defaultCompressionMinSize = 1024
+
+// max value of min size, beginning of file is buffered to check its size
+const maxCompressionMinSize = 65536
+
+// supported compression algorithms, zstd is not available without third party library
+const encodingGzip = "gzip"
+
+// compressed file starts with header: magic, version and algorithm
+// file is stored as is if it's not compressed, uploaded file which starts with magic of compressed or encrypted file
+// is stored with header without compression
+const (
+	encodedMagic      = "T2CZ"
+	encodedVersion    = 1
+	encodedHeaderSize = 6
+)
+
+// algorithms in header of stored file
+var encodingCodes = map[string]byte{
+	"":           0,
+	encodingGzip: 1,
+}
+
+// default content types which are already compressed, they are matched by prefix
+var defaultSkipTypes = []string{
+	"image/",
+	"video/",
+	"audio/",
+	"font/woff",
+	"application/zip",
+	"application/java-archive",
+	"application/epub+zip",
+	"application/vnd.android.package-archive",
+	"application/vnd.openxmlformats-officedocument.",
+	"application/vnd.oasis.opendocument.",
+	"application/x-gzip",
+	"application/gzip",
+	"application/x-rar-compressed",
+	"application/x-7z-compressed",
+	"application/x-bzip2",
+	"application/x-xz",
+	"application/zstd",
+	"application/pdf",
+	"application/wasm",
+}
+
+// CompressionConfig struct contains info about
+// - algorithm, only gzip is supported
+// - level of compression from 1 to 9, default is gzip default level
+// - min size of file in bytes, smaller files are stored as is, default is 1024
+// - content types which are already compressed, they are detected by content and matched by prefix
+// algorithm of stored file is kept in file header and metadata, so it could be changed by reload
+type CompressionConfig struct {
+	Algorithm string   `json:"algorithm"`
+	Level     int      `json:"level"`
+	MinSize   int      `json:"min_size"`
+	SkipTypes []string `json:"skip_types"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *CompressionConfig) SetDefaults() {
+	if cfg.Algorithm == "" {
+		cfg.Algorithm = encodingGzip
+	}
+
+	if cfg.Level == 0 {
+		cfg.Level = gzip.DefaultCompression
+	}
+
+	if cfg.MinSize == 0 {
+		cfg.MinSize = defaultCompressionMinSize
+	}
+
+	if cfg.SkipTypes == nil {
+		cfg.SkipTypes = defaultSkipTypes
+	}
+}
+
+// validateCompressionConfig func adds problems of compression config to errs
+func validateCompressionConfig(errs *ValidationErrors, cfg *CompressionConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if cfg.Algorithm != encodingGzip {
+		errs.Add("storage.compression.algorithm", "must be gzip")
+	}
+
+	if cfg.Level != gzip.DefaultCompression && (cfg.Level < gzip.BestSpeed || cfg.Level > gzip.BestCompression) {
+		errs.Add("storage.compression.level", "must be between 1 and 9")
+	}
+
+	if cfg.MinSize < 0 || cfg.MinSize > maxCompressionMinSize {
+		errs.Add("storage.compression.min_size", "must be between 0 and 65536")
+	}
+}
+
+// isCompressible method returns false for content types which are already compressed
+func (cfg *CompressionConfig) isCompressible(contentType string) bool {
+	for _, v := range cfg.SkipTypes {
+		if strings.HasPrefix(contentType, v) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// encodeFile method returns stream which is stored instead of uploaded content and its encoding
+// content is compressed if it's enabled, file is big enough and its detected type is not compressed already
+// returned stream must be closed, close waits for compressing goroutine, so content is not read after it
+func (s *Storage) encodeFile(r io.Reader) (io.ReadCloser, string) {
+	cfg := s.GetConfig().Compression
+
+	peekSize := 512
+	if cfg != nil && cfg.MinSize > peekSize {
+		peekSize = cfg.MinSize
+	}
+
+	br := bufio.NewReaderSize(r, peekSize)
+	head, _ := br.Peek(peekSize)
+
+	compress := cfg != nil && len(head) >= cfg.MinSize && cfg.isCompressible(detectContentType(head))
+
+	if !compress {
+		// header is required to distinguish such file from compressed or encrypted one
+		if bytes.HasPrefix(head, []byte(encodedMagic)) || isEncrypted(head) {
+			return readCloser{io.MultiReader(bytes.NewReader(getEncodedHeader("")), br), nil}, ""
+		}
+
+		return readCloser{br, nil}, ""
+	}
+
+	pr, pw := io.Pipe()
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		_, err := pw.Write(getEncodedHeader(cfg.Algorithm))
+		if err != nil {
+			pw.CloseWithError(err)
+			return
+		}
+
+		zw, err := gzip.NewWriterLevel(pw, cfg.Level)
+		if err == nil {
+			_, err = io.Copy(zw, br)
+		}
+
+		if err == nil {
+			err = zw.Close()
+		}
+
+		pw.CloseWithError(err)
+	}()
+
+	return readCloser{pr, closerFunc(func() error {
+		pr.Close()
+		<-done
+
+		return nil
+	})}, cfg.Algorithm
+}
+
+func getEncodedHeader(encoding string) []byte {
+	return append([]byte(encodedMagic), encodedVersion, encodingCodes[encoding])
+}
+
+// decodeHeader func skips header of stored file and returns its encoding, file without header is returned as is
+func decodeHeader(r io.Reader) (io.Reader, string, error) {
+	br := bufio.NewReader(r)
+
+	head, err := br.Peek(encodedHeaderSize)
+	if err != nil && err != io.EOF {
+		return nil, "", err
+	}
+
+	if !bytes.HasPrefix(head, []byte(encodedMagic)) || len(head) < encodedHeaderSize || head[4] != encodedVersion {
+		return br, "", nil
+	}
+
+	br.Discard(encodedHeaderSize)
+
+	for encoding, code := range encodingCodes {
+		if code == head[5] {
+			return br, encoding, nil
+		}
+	}
+
+	return nil, "", gzip.ErrHeader
+}
+
+// newDecoder func returns reader of original content of stored file with given encoding
+func newDecoder(r io.Reader, encoding string) (io.Reader, error) {
+	if encoding == encodingGzip {
+		return gzip.NewReader(r)
+	}
+
+	return r, nil
+}
+
+// decodeContent method returns original content of stored file, it's decrypted, header and encoding are detected
+// client key is required for file which is encrypted by it
+func (s *Storage) decodeContent(hash string, r io.Reader, clientKey []byte) (io.Reader, error) {
+	plain, err := s.decryptFile(hash, r, clientKey)
+	if err != nil {
+		return nil, err
+	}
+
+	payload, encoding, err := decodeHeader(plain)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecoder(payload, encoding)
+}
+
+// copyContent func copies content of stored payload to w and returns sha256 of original content
+// compressed payload is copied as is if sendStored is true, it's decoded on the fly for checksum
+func copyContent(w io.Writer, payload io.Reader, encoding string, sendStored bool) (string, error) {
+	sum := sha256.New()
+
+	if !sendStored {
+		content, err := newDecoder(payload, encoding)
+		if err != nil {
+			return "", err
+		}
+
+		_, err = io.Copy(io.MultiWriter(w, sum), content)
+		if err != nil {
+			return "", err
+		}
+
+		return hex.EncodeToString(sum.Sum(nil)), nil
+	}
+
+	// decoder reads payload through tee, so payload is sent as it's consumed
+	tee := io.TeeReader(payload, w)
+
+	content, err := newDecoder(tee, encoding)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = io.Copy(sum, content)
+	if err == nil {
+		_, err = io.Copy(ioutil.Discard, tee)
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(sum.Sum(nil)), nil
+}
+
+// getContentSHA256 method returns sha256 of original content of stored file
+// file which could not be decrypted or decoded is corrupted, empty sum is returned for it
+// file encrypted by client key could not be decrypted, its stored content is verified by checksum from metadata instead
+func (s *Storage) getContentSHA256(hash string, r io.Reader) (string, error) {
+	br := bufio.NewReader(r)
+
+	if head, _ := br.Peek(len(encryptedMagic)); isEncrypted(head) && s.DataKeys != nil {
+		_, expected, err := s.DataKeys.GetClientKey(hash)
+		if err == nil {
+			sum, err := getSHA256Sum(br)
+			if err != nil || sum != expected {
+				return "", err
+			}
+
+			return strings.Split(hash, "-")[0], nil
+		} else if err != errDataKeyNotFound {
+			return "", err
+		}
+	}
+
+	content, err := s.decodeContent(hash, br, nil)
+	if err == nil {
+		var sum string
+		if sum, err = getSHA256Sum(content); err == nil {
+			return sum, nil
+		}
+	}
+
+	if isCorruptedContent(err) {
+		return "", nil
+	}
+
+	return "", err
+}
+
+// isCorruptedContent func returns true for errors of decryption and decoding of compressed content
+func isCorruptedContent(err error) bool {
+	if _, ok := err.(flate.CorruptInputError); ok {
+		return true
+	}
+
+	return err == errDecryption || err == gzip.ErrHeader || err == gzip.ErrChecksum || err == io.ErrUnexpectedEOF
+}
+
+// acceptsEncoding func returns true if client accepts content with given encoding
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, v := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		parts := strings.Split(v, ";")
+		if name := strings.TrimSpace(parts[0]); name != encoding && name != "*" {
+			continue
+		}
+
+		// encoding could be disabled by zero quality
+		for _, param := range parts[1:] {
+			param = strings.TrimSpace(param)
+
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				return err == nil && q > 0
+			}
+		}
+
+		return true
+	}
+
+	return false
+}
+
+// recordEncoding method saves encoding of stored file to its metadata
+// encoding of file encrypted by client key is known only if the key is set, it's not saved otherwise
+func (app *Application) recordEncoding(hash string, clientKey []byte) error {
+	f, encoding, err := app.Storage.OpenStored(hash, clientKey)
+	if isKeyError(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	f.Close()
+
+	return app.Redis.SetFileEncoding(hash, encoding)
+}
+
+// closerFunc type is func which implements io.Closer
+type closerFunc func() error
+
+// Close method
+func (f closerFunc) Close() error {
+	return f()
+}
+
+// readCloser struct adds Close method to reader, closer is optional
+type readCloser struct {
+	io.Reader
+	closer io.Closer
+}
+
+// Close method
+func (r readCloser) Close() error {
+	if r.closer == nil {
+		return nil
+	}
+
+	return r.closer.Close()
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newCompressionTestApplication(t *testing.T) *Application {
+	compression := &CompressionConfig{}
+	compression.SetDefaults()
+
+	app := newTrashTestApplication(t, &StorageConfig{Compression: compression})
+	app.Storage.Logger = app.Logger
+
+	return app
+}
+
+func TestValidateCompressionConfig(t *testing.T) {
+	cases := []struct {
+		cfg    *CompressionConfig
+		fields []string
+	}{
+		{cfg: nil, fields: []string{}},
+		{cfg: &CompressionConfig{Algorithm: "gzip", Level: 9, MinSize: 0}, fields: []string{}},
+		{cfg: &CompressionConfig{Algorithm: "gzip", Level: -1, MinSize: 1024}, fields: []string{}},
+		{cfg: &CompressionConfig{Algorithm: "zstd", Level: -1}, fields: []string{"storage.compression.algorithm"}},
+		{cfg: &CompressionConfig{Algorithm: "gzip", Level: 10}, fields: []string{"storage.compression.level"}},
+		{cfg: &CompressionConfig{Algorithm: "gzip", Level: -1, MinSize: 100000}, fields: []string{"storage.compression.min_size"}},
+	}
+
+	for _, tc := range cases {
+		errs := ValidationErrors{}
+		validateCompressionConfig(&errs, tc.cfg)
+
+		fields := []string{}
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+
+		if len(fields) != len(tc.fields) || (len(fields) > 0 && fields[0] != tc.fields[0]) {
+			t.Errorf("Errors for %v must be %v but got %v\n", tc.cfg, tc.fields, fields)
+		}
+	}
+}
+
+func TestAcceptsEncoding(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected bool
+	}{
+		{header: "", expected: false},
+		{header: "gzip", expected: true},
+		{header: "deflate, gzip;q=0.8", expected: true},
+		{header: "br, *", expected: true},
+		{header: "gzip;q=0", expected: false},
+		{header: "gzip; q=0.0, br", expected: false},
+		{header: "deflate, br", expected: false},
+	}
+
+	for _, tc := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tc.header)
+
+		if v := acceptsEncoding(r, "gzip"); v != tc.expected {
+			t.Errorf("Result for %q must be %v but got %v\n", tc.header, tc.expected, v)
+		}
+	}
+}
+
+func TestStorageCompression(t *testing.T) {
+	app := newCompressionTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	cases := []struct {
+		content  string
+		encoding string
+		minSize  int
+	}{
+		// compressible text
+		{content: strings.Repeat(`{"level":"info","msg":"request"}`, 100), encoding: "gzip"},
+		// small file
+		{content: "small", encoding: ""},
+		// already compressed content
+		{content: "\x89PNG\x0D\x0A\x1A\x0A" + strings.Repeat("a", 2000), encoding: ""},
+		{content: "\xfd7zXZ\x00" + strings.Repeat("a", 2000), encoding: ""},
+		{content: string(getTestZip("[Content_Types].xml", "word/document.xml")), encoding: "", minSize: 1},
+		{content: string(getTestZip("META-INF/MANIFEST.MF", "Main.class")), encoding: "", minSize: 1},
+		// file which looks like stored compressed file
+		{content: encodedMagic + "\x01\x01", encoding: ""},
+	}
+
+	for _, tc := range cases {
+		app.Config.Storage.Compression.MinSize = defaultCompressionMinSize
+		if tc.minSize > 0 {
+			app.Config.Storage.Compression.MinSize = tc.minSize
+		}
+
+		hash := getTestFileID(tc.content, time.Now())
+
+		size, err := app.Storage.CreateFile(hash, bytes.NewBufferString(tc.content))
+		if err != nil {
+			t.Errorf("Err must be nil but got %v\n", err)
+			continue
+		}
+
+		if tc.encoding != "" && size >= int64(len(tc.content)) {
+			t.Errorf("Stored size must be less than %d but got %d\n", len(tc.content), size)
+		}
+
+		if v, _ := app.Storage.GetFileSize(hash); v != size {
+			t.Errorf("Size of file must be %d but got %d\n", size, v)
+		}
+
+		if encoding, _ := app.Storage.GetEncoding(hash); encoding != tc.encoding {
+			t.Errorf("Encoding must be %q but got %q\n", tc.encoding, encoding)
+		}
+
+		f, err := app.Storage.Open(hash)
+		if err != nil {
+			t.Errorf("Err must be nil but got %v\n", err)
+			continue
+		}
+
+		data, _ := ioutil.ReadAll(f)
+		f.Close()
+
+		if string(data) != tc.content {
+			t.Errorf("Content must be %q but got %q\n", tc.content, data)
+		}
+
+		sum, _, _, err := app.Storage.VerifyFile(hash, newThrottle(context.Background(), 0))
+		if sum != strings.Split(hash, "-")[0] || err != nil {
+			t.Errorf("Sum must be valid but got %s, %v\n", sum, err)
+		}
+	}
+}
+
+func TestStorageCompressionErasure(t *testing.T) {
+	app := newErasureTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.Config.Storage.Compression = &CompressionConfig{}
+	app.Config.Storage.Compression.SetDefaults()
+
+	content := strings.Repeat("0123456789", 200)
+	hash := getTestFileID(content, time.Now())
+
+	app.Storage.CreateFile(hash, bytes.NewBufferString(content))
+	os.Remove(getShardName(app, 0, hash))
+
+	data, err := readTestFile(app, hash)
+	if data != content || err != nil {
+		t.Errorf("Content must be decoded from shards but got %v\n", err)
+	}
+
+	if encoding, _ := app.Storage.GetEncoding(hash); encoding != "gzip" {
+		t.Errorf("Encoding must be %q but got %q\n", "gzip", encoding)
+	}
+}
+
+func TestHandlerDownloadCompressed(t *testing.T) {
+	app := newCompressionTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+	content := strings.Repeat("line of log\n", 200)
+	hash := getTestFileID(content, now)
+
+	size, err := app.StoreFile(hash, strings.NewReader(content), int64(len(content)), nil)
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: size, CreatedAt: &now})
+
+	if encoding, _ := app.Redis.GetFileEncoding(hash); encoding != "gzip" {
+		t.Errorf("Encoding in metadata must be %q but got %q\n", "gzip", encoding)
+	}
+
+	h := NewHandler(app)
+
+	// client which accepts gzip gets stored content
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files/"+hash, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "gzip" || int64(w.Body.Len()) >= int64(len(content)) {
+		t.Errorf("Compressed content must be sent but got %d, %q, %d bytes\n", w.Code, w.Header().Get("Content-Encoding"), w.Body.Len())
+	}
+
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	if data, _ := ioutil.ReadAll(zr); string(data) != content {
+		t.Error("Compressed content must contain original content\n")
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/files/"+hash, nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Header().Get("Content-Encoding") != "" || w.Body.String() != content {
+		t.Errorf("Original content must be sent but got %d, %q\n", w.Code, w.Header().Get("Content-Encoding"))
+	}
+
+	// corrupted compressed file is quarantined
+	fileName := path.Join(app.Config.Storage.Path, hash[:2], hash)
+	data, _ := ioutil.ReadFile(fileName)
+	data[len(data)/2] ^= 0xff
+	ioutil.WriteFile(fileName, data, 0644)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/files/"+hash, nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	h.ServeHTTP(w, r)
+
+	if w.Code != 422 {
+		t.Errorf("Code must be %d but got %d\n", 422, w.Code)
+	}
+
+	app.wg.Wait()
+}
+
+func TestStorageCompressionReplication(t *testing.T) {
+	app, replicas := newReplicationTestApplication(t, 3)
+	defer removeReplicationTestApplication(app, replicas)
+
+	app.Config.Storage.Compression = &CompressionConfig{}
+	app.Config.Storage.Compression.SetDefaults()
+
+	content := strings.Repeat("0123456789", 200)
+	hash := getTestFileID(content, time.Now())
+
+	_, err := app.Storage.CreateFile(hash, bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	// compressed copy is verified by original content
+	app.Storage.QuarantineFile(hash)
+
+	data, ok := readTestReplica(app, hash, nil)
+	if !ok || string(data) != content {
+		t.Error("Original content must be read from replica\n")
+	}
+}
@@ -2,20 +2,402 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"os"
+	"reflect"
+	"strconv"
+	"strings"
 )
 
+// prefix of environment variables which override config values
+const envPrefix = "T2"
+
 // Config struct is application config
+// shutdown timeout is in seconds
 type Config struct {
-	Host      string           `json:"host"`
-	Port      int              `json:"port"`
-	Storage   *StorageConfig   `json:"storage"`
-	RateLimit *RateLimitConfig `json:"rate_limit"`
-	Redis     *RedisConfig     `json:"redis"`
+	Host            string           `json:"host"`
+	Port            int              `json:"port"`
+	ShutdownTimeout int              `json:"shutdown_timeout"`
+	Storage         *StorageConfig   `json:"storage"`
+	RateLimit       *RateLimitConfig `json:"rate_limit"`
+	Redis           *RedisConfig     `json:"redis"`
+	Log             *LogConfig       `json:"log"`
+	AccessLog       *LogConfig       `json:"access_log"`
+	Health          *HealthConfig    `json:"health"`
+	TLS             *TLSConfig       `json:"tls"`
+	Auth            *AuthConfig      `json:"auth"`
+	AutoClean       *AutoCleanConfig `json:"autoclean"`
+	Scrub           *ScrubConfig     `json:"scrub"`
+	Cluster         *ClusterConfig   `json:"cluster"`
 }
 
-// NewConfig func parse file and return Config pointer and error
-func NewConfig(path string) (*Config, error) {
+// SetDefaults method fills missing values with defaults:
+// - port: 8080
+// - shutdown_timeout: 30
+// - storage.path: "storage"
+// - storage.max_size: 10485760 (10MB)
+// - storage.limit: 0 (autoclean is disabled)
+// - storage.high_watermark: 100
+// - storage.low_watermark: 100
+// - storage.reconcile_interval: 3600
+// - storage.eviction.policy: "lfu"
+// - storage.eviction.half_life: 86400
+// - storage.trash.retention: 604800
+// - storage.trash.purge_interval: 3600
+// - storage.expiry.reap_interval: 60
+// - storage.quarantine.max_age: 300
+// - storage.replication.write_quorum: majority of storage path and replicas
+// - storage.replication.interval: 3600
+// - storage.erasure.block_size: 65536
+// - storage.compression.algorithm: "gzip"
+// - storage.compression.min_size: 1024
+// - storage.encryption.chunk_size: 65536
+// - redis.host: "127.0.0.1"
+// - redis.port: 6379
+// - redis.max_active: 10
+// - redis.max_idle: 5
+// - redis.idle_timeout: 10
+// - rate_limit: no limits
+// - autoclean.lock_ttl: 30
+// - autoclean.interval: 600
+// - scrub.interval: 86400
+// - scrub.rate: 10485760
+// - log.level: "info"
+// - log.format: "logfmt"
+// - cluster.heartbeat_interval: 5
+// - cluster.node_ttl: 15
+// - cluster.virtual_nodes: 128
+// - cluster.rebalance_interval: 600
+// - cluster.timeout: 30
+// access_log, health, tls, auth and storage.content_types blocks are optional and have no defaults, cluster, erasure, compression and encryption defaults are set only if they are enabled
+func (cfg *Config) SetDefaults() {
+	if cfg.Port == 0 {
+		cfg.Port = 8080
+	}
+
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = 30
+	}
+
+	if cfg.Storage == nil {
+		cfg.Storage = &StorageConfig{}
+	}
+
+	if cfg.Storage.Path == "" {
+		cfg.Storage.Path = "storage"
+	}
+
+	if cfg.Storage.MaxSize == 0 {
+		cfg.Storage.MaxSize = 10485760
+	}
+
+	if cfg.Storage.HighWatermark == 0 {
+		cfg.Storage.HighWatermark = 100
+	}
+
+	if cfg.Storage.LowWatermark == 0 {
+		cfg.Storage.LowWatermark = 100
+	}
+
+	if cfg.Storage.ReconcileInterval == 0 {
+		cfg.Storage.ReconcileInterval = 3600
+	}
+
+	if cfg.Storage.Eviction == nil {
+		cfg.Storage.Eviction = &EvictionConfig{}
+	}
+
+	cfg.Storage.Eviction.SetDefaults()
+
+	if cfg.Storage.Trash == nil {
+		cfg.Storage.Trash = &TrashConfig{}
+	}
+
+	cfg.Storage.Trash.SetDefaults()
+
+	if cfg.Storage.Expiry == nil {
+		cfg.Storage.Expiry = &ExpiryConfig{}
+	}
+
+	cfg.Storage.Expiry.SetDefaults()
+
+	if cfg.Storage.Quarantine == nil {
+		cfg.Storage.Quarantine = &QuarantineConfig{}
+	}
+
+	cfg.Storage.Quarantine.SetDefaults()
+
+	if cfg.Storage.Replication == nil {
+		cfg.Storage.Replication = &ReplicationConfig{}
+	}
+
+	cfg.Storage.Replication.SetDefaults()
+
+	if cfg.Storage.Erasure != nil {
+		cfg.Storage.Erasure.SetDefaults()
+	}
+
+	if cfg.Storage.Compression != nil {
+		cfg.Storage.Compression.SetDefaults()
+	}
+
+	if cfg.Storage.Encryption != nil {
+		cfg.Storage.Encryption.SetDefaults()
+	}
+
+	if cfg.Redis == nil {
+		cfg.Redis = &RedisConfig{}
+	}
+
+	cfg.Redis.SetDefaults()
+
+	if cfg.RateLimit == nil {
+		cfg.RateLimit = &RateLimitConfig{}
+	}
+
+	if cfg.AutoClean == nil {
+		cfg.AutoClean = &AutoCleanConfig{}
+	}
+
+	cfg.AutoClean.SetDefaults()
+
+	if cfg.Scrub == nil {
+		cfg.Scrub = &ScrubConfig{}
+	}
+
+	cfg.Scrub.SetDefaults()
+
+	if cfg.Cluster != nil {
+		cfg.Cluster.SetDefaults()
+	}
+
+	if cfg.Log == nil {
+		cfg.Log = &LogConfig{}
+	}
+
+	if cfg.Log.Level == "" {
+		cfg.Log.Level = "info"
+	}
+
+	if cfg.Log.Format == "" {
+		cfg.Log.Format = "logfmt"
+	}
+}
+
+// Validate method checks all config values and returns ValidationErrors with every problem
+func (cfg *Config) Validate() error {
+	errs := ValidationErrors{}
+
+	if cfg.Port < 1 || cfg.Port > 65535 {
+		errs.Add("port", "must be between 1 and 65535")
+	}
+
+	if cfg.ShutdownTimeout < 0 {
+		errs.Add("shutdown_timeout", "must not be negative")
+	}
+
+	if cfg.Storage == nil {
+		errs.Add("storage", "is required")
+	} else {
+		if cfg.Storage.Path == "" {
+			errs.Add("storage.path", "is required")
+		}
+
+		if cfg.Storage.MaxSize <= 0 {
+			errs.Add("storage.max_size", "must be positive")
+		}
+
+		if cfg.Storage.Limit < 0 {
+			errs.Add("storage.limit", "must not be negative")
+		}
+
+		if cfg.Storage.HighWatermark < 1 || cfg.Storage.HighWatermark > 100 {
+			errs.Add("storage.high_watermark", "must be between 1 and 100")
+		}
+
+		if cfg.Storage.LowWatermark < 1 || cfg.Storage.LowWatermark > cfg.Storage.HighWatermark {
+			errs.Add("storage.low_watermark", "must be between 1 and high_watermark")
+		}
+
+		if cfg.Storage.ReconcileInterval < 0 {
+			errs.Add("storage.reconcile_interval", "must not be negative")
+		}
+
+		if e := cfg.Storage.Eviction; e != nil {
+			if _, ok := evictionPolicyKeys[e.Policy]; !ok {
+				errs.Add("storage.eviction.policy", "must be one of lfu, lfu_decay, lru, gdsf, ttl")
+			}
+
+			if e.HalfLife < 0 {
+				errs.Add("storage.eviction.half_life", "must not be negative")
+			}
+
+			if e.MaxAge < 0 {
+				errs.Add("storage.eviction.max_age", "must not be negative")
+			}
+
+			if e.GracePeriod < 0 {
+				errs.Add("storage.eviction.grace_period", "must not be negative")
+			}
+		}
+
+		validateTrashConfig(&errs, cfg.Storage.Trash)
+		validateExpiryConfig(&errs, cfg.Storage.Expiry)
+		validateQuarantineConfig(&errs, cfg.Storage.Quarantine, cfg.Storage.Path)
+		validateReplicationConfig(&errs, cfg.Storage.Replication, cfg.Storage.Path)
+		validateErasureConfig(&errs, cfg.Storage)
+		validateCompressionConfig(&errs, cfg.Storage.Compression)
+		validateEncryptionConfig(&errs, cfg.Storage.Encryption)
+		validateContentTypesConfig(&errs, "storage.content_types", cfg.Storage.ContentTypes)
+	}
+
+	if cfg.Redis == nil {
+		errs.Add("redis", "is required")
+	} else {
+		if cfg.Redis.Host == "" {
+			errs.Add("redis.host", "is required")
+		}
+
+		if cfg.Redis.Port < 1 || cfg.Redis.Port > 65535 {
+			errs.Add("redis.port", "must be between 1 and 65535")
+		}
+
+		if cfg.Redis.MaxActive < 0 {
+			errs.Add("redis.max_active", "must not be negative")
+		}
+
+		if cfg.Redis.MaxIdle < 0 {
+			errs.Add("redis.max_idle", "must not be negative")
+		}
+
+		if cfg.Redis.IdleTimeout < 0 {
+			errs.Add("redis.idle_timeout", "must not be negative")
+		}
+	}
+
+	if cfg.RateLimit != nil {
+		if cfg.RateLimit.MaxConnectionsFromIP < 0 {
+			errs.Add("rate_limit.max_connections_from_ip", "must not be negative")
+		}
+
+		if cfg.RateLimit.RPS != nil {
+			if cfg.RateLimit.RPS.Download < 0 {
+				errs.Add("rate_limit.rps.download", "must not be negative")
+			}
+
+			if cfg.RateLimit.RPS.Upload < 0 {
+				errs.Add("rate_limit.rps.upload", "must not be negative")
+			}
+
+			if cfg.RateLimit.RPS.Remove < 0 {
+				errs.Add("rate_limit.rps.remove", "must not be negative")
+			}
+		}
+
+		if cfg.RateLimit.Bandwidth != nil {
+			if cfg.RateLimit.Bandwidth.Download < 0 {
+				errs.Add("rate_limit.bandwidth.download", "must not be negative")
+			}
+
+			if cfg.RateLimit.Bandwidth.Upload < 0 {
+				errs.Add("rate_limit.bandwidth.upload", "must not be negative")
+			}
+		}
+	}
+
+	validateAutoCleanConfig(&errs, cfg.AutoClean)
+	validateScrubConfig(&errs, cfg.Scrub)
+	validateClusterConfig(&errs, cfg.Cluster)
+	validatePrincipalsContentTypes(&errs, cfg.Auth)
+
+	validateLogConfig(&errs, "log", cfg.Log)
+	validateLogConfig(&errs, "access_log", cfg.AccessLog)
+
+	if cfg.Health != nil {
+		if cfg.Health.MinFreeSpace < 0 {
+			errs.Add("health.min_free_space", "must not be negative")
+		}
+
+		if cfg.Health.DrainDelay < 0 {
+			errs.Add("health.drain_delay", "must not be negative")
+		}
+	}
+
+	if cfg.TLS != nil {
+		if cfg.TLS.CertFile == "" {
+			errs.Add("tls.cert_file", "is required")
+		}
+
+		if cfg.TLS.KeyFile == "" {
+			errs.Add("tls.key_file", "is required")
+		}
+
+		if _, err := newBaseTLSConfig(cfg.TLS); err != nil {
+			errs.Add("tls", err.Error())
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func validateLogConfig(errs *ValidationErrors, field string, cfg *LogConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if _, err := ParseLogLevel(cfg.Level); err != nil {
+		errs.Add(field+".level", "must be one of debug, info, warn, error")
+	}
+
+	if cfg.Format != "" && cfg.Format != "logfmt" && cfg.Format != "json" {
+		errs.Add(field+".format", "must be logfmt or json")
+	}
+
+	if cfg.MaxSize < 0 {
+		errs.Add(field+".max_size", "must not be negative")
+	}
+
+	if cfg.MaxBackups < 0 {
+		errs.Add(field+".max_backups", "must not be negative")
+	}
+}
+
+// ValidationError struct describes problem with single config field
+type ValidationError struct {
+	Field   string
+	Message string
+}
+
+// Error method
+func (e *ValidationError) Error() string {
+	return e.Field + " " + e.Message
+}
+
+// ValidationErrors type contains all config problems
+type ValidationErrors []*ValidationError
+
+// Add method
+func (e *ValidationErrors) Add(field, message string) {
+	*e = append(*e, &ValidationError{Field: field, Message: message})
+}
+
+// Error method
+func (e ValidationErrors) Error() string {
+	msgs := make([]string, 0, len(e))
+	for _, v := range e {
+		msgs = append(msgs, v.Error())
+	}
+
+	return "invalid config: " + strings.Join(msgs, "; ")
+}
+
+// LoadConfig func parses file, applies environment variables and defaults
+// config is not validated, it's useful for showing effective config
+func LoadConfig(path string) (*Config, error) {
 	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
@@ -29,5 +411,155 @@ func NewConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	err = applyEnv(&cfg, envPrefix, getEnvMap(os.Environ()))
+	if err != nil {
+		return nil, err
+	}
+
+	cfg.SetDefaults()
+
 	return &cfg, nil
 }
+
+// NewConfig func parse file and return valid Config pointer and error
+func NewConfig(path string) (*Config, error) {
+	cfg, err := LoadConfig(path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func getEnvMap(environ []string) map[string]string {
+	env := map[string]string{}
+
+	for _, v := range environ {
+		parts := strings.SplitN(v, "=", 2)
+		if len(parts) == 2 && strings.HasPrefix(parts[0], envPrefix+"_") {
+			env[parts[0]] = parts[1]
+		}
+	}
+
+	return env
+}
+
+// applyEnv func overrides config fields with environment variables
+// variable name is prefix and json names of nested fields joined by "_" in upper case,
+// for example T2_STORAGE_MAX_SIZE or T2_RATE_LIMIT_RPS_DOWNLOAD
+// lists of strings are comma separated, maps and other complex values are json encoded
+func applyEnv(cfg interface{}, prefix string, env map[string]string) error {
+	errs := ValidationErrors{}
+
+	applyEnvValue(reflect.ValueOf(cfg).Elem(), prefix, env, &errs)
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+func applyEnvValue(v reflect.Value, prefix string, env map[string]string, errs *ValidationErrors) {
+	t := v.Type()
+
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+
+		tag := strings.Split(field.Tag.Get("json"), ",")[0]
+		if tag == "" || tag == "-" {
+			continue
+		}
+
+		name := prefix + "_" + strings.ToUpper(tag)
+		fv := v.Field(i)
+
+		// nested config block
+		if field.Type.Kind() == reflect.Ptr && field.Type.Elem().Kind() == reflect.Struct {
+			if _, ok := env[name]; !ok && !hasEnvPrefix(env, name+"_") {
+				continue
+			}
+
+			if fv.IsNil() {
+				fv.Set(reflect.New(field.Type.Elem()))
+			}
+
+			// whole block could be set as json
+			if raw, ok := env[name]; ok {
+				if err := json.Unmarshal([]byte(raw), fv.Interface()); err != nil {
+					errs.Add(name, "must be valid json")
+				}
+			}
+
+			applyEnvValue(fv.Elem(), name, env, errs)
+			continue
+		}
+
+		raw, ok := env[name]
+		if !ok {
+			continue
+		}
+
+		if err := setEnvValue(fv, raw); err != nil {
+			errs.Add(name, err.Error())
+		}
+	}
+}
+
+func setEnvValue(v reflect.Value, raw string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(raw)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		n, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return errors.New("must be integer")
+		}
+		v.SetInt(n)
+	case reflect.Float32, reflect.Float64:
+		n, err := strconv.ParseFloat(raw, 64)
+		if err != nil {
+			return errors.New("must be number")
+		}
+		v.SetFloat(n)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("must be boolean")
+		}
+		v.SetBool(b)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.String && !strings.HasPrefix(strings.TrimSpace(raw), "[") {
+			parts := []string{}
+			for _, part := range strings.Split(raw, ",") {
+				if part = strings.TrimSpace(part); part != "" {
+					parts = append(parts, part)
+				}
+			}
+			v.Set(reflect.ValueOf(parts))
+			return nil
+		}
+		fallthrough
+	default:
+		if err := json.Unmarshal([]byte(raw), v.Addr().Interface()); err != nil {
+			return errors.New("must be valid json")
+		}
+	}
+
+	return nil
+}
+
+func hasEnvPrefix(env map[string]string, prefix string) bool {
+	for key := range env {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
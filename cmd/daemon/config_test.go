@@ -2,7 +2,9 @@ package main
 
 import (
 	"errors"
+	"os"
 	"path"
+	"reflect"
 	"testing"
 )
 
@@ -41,3 +43,159 @@ func TestNewConfig(t *testing.T) {
 		}
 	}
 }
+
+func TestConfigDefaults(t *testing.T) {
+	cfg, err := NewConfig("mocks/config/empty.json")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	if cfg.Port != 8080 {
+		t.Errorf("Port must be %d but got %d\n", 8080, cfg.Port)
+	}
+
+	if cfg.Storage == nil || cfg.Storage.Path != "storage" || cfg.Storage.MaxSize != 10485760 {
+		t.Errorf("Unexpected storage config %#v\n", cfg.Storage)
+	}
+
+	if cfg.Redis == nil || cfg.Redis.Host != "127.0.0.1" || cfg.Redis.Port != 6379 || cfg.Redis.MaxActive != 10 {
+		t.Errorf("Unexpected redis config %#v\n", cfg.Redis)
+	}
+
+	if cfg.RateLimit == nil {
+		t.Error("Rate limit config must not be nil")
+	}
+
+	if cfg.Log == nil || cfg.Log.Level != "info" {
+		t.Errorf("Unexpected log config %#v\n", cfg.Log)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	_, err := NewConfig("mocks/config/invalid.json")
+
+	errs, ok := err.(ValidationErrors)
+	if !ok {
+		t.Errorf("Error must be ValidationErrors but got %v\n", err)
+		return
+	}
+
+	expected := []string{
+		"port",
+		"storage.max_size",
+		"storage.limit",
+		"storage.eviction.policy",
+		"storage.trash.retention",
+		"rate_limit.rps.download",
+		"autoclean.schedule",
+		"scrub.rate",
+		"log.level",
+	}
+
+	if len(errs) != len(expected) {
+		t.Errorf("Errors count must be %d but got %d (%v)\n", len(expected), len(errs), errs)
+		return
+	}
+
+	for index, field := range expected {
+		if errs[index].Field != field {
+			t.Errorf("Field must be %s but got %s\n", field, errs[index].Field)
+		}
+	}
+
+	// tls block requires certificate
+	cfg := &Config{TLS: &TLSConfig{MinVersion: "2.0"}}
+	cfg.SetDefaults()
+
+	errs, _ = cfg.Validate().(ValidationErrors)
+	if len(errs) != 3 {
+		t.Errorf("Errors count must be %d but got %d (%v)\n", 3, len(errs), errs)
+	}
+
+	// watermarks are percents of limit
+	cfg = &Config{Storage: &StorageConfig{HighWatermark: 101, LowWatermark: -1}}
+	cfg.SetDefaults()
+
+	errs, _ = cfg.Validate().(ValidationErrors)
+	if len(errs) != 2 || errs[0].Field != "storage.high_watermark" || errs[1].Field != "storage.low_watermark" {
+		t.Errorf("Errors must be for watermarks but got %v\n", errs)
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	cfg := &Config{
+		Host: "127.0.0.1",
+		Storage: &StorageConfig{
+			Path: "example",
+		},
+	}
+
+	env := getEnvMap([]string{
+		"T2_PORT=9090",
+		"T2_STORAGE_MAX_SIZE=1024",
+		"T2_RATE_LIMIT_RPS_DOWNLOAD=5",
+		"T2_REDIS_HOST=redis",
+		"T2_TLS_CIPHERS=a, b",
+		"T2_AUTH_PRINCIPALS={\"admin\":{\"actions\":[\"remove\"]}}",
+		"OTHER_PORT=1",
+	})
+
+	err := applyEnv(cfg, envPrefix, env)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	if cfg.Host != "127.0.0.1" || cfg.Port != 9090 {
+		t.Errorf("Unexpected address %s:%d\n", cfg.Host, cfg.Port)
+	}
+
+	if cfg.Storage.Path != "example" || cfg.Storage.MaxSize != 1024 {
+		t.Errorf("Unexpected storage config %#v\n", cfg.Storage)
+	}
+
+	if cfg.RateLimit == nil || cfg.RateLimit.RPS == nil || cfg.RateLimit.RPS.Download != 5 || cfg.RateLimit.Bandwidth != nil {
+		t.Errorf("Unexpected rate limit config %#v\n", cfg.RateLimit)
+	}
+
+	if cfg.Redis == nil || cfg.Redis.Host != "redis" {
+		t.Errorf("Unexpected redis config %#v\n", cfg.Redis)
+	}
+
+	if cfg.TLS == nil || !reflect.DeepEqual(cfg.TLS.Ciphers, []string{"a", "b"}) {
+		t.Errorf("Unexpected tls config %#v\n", cfg.TLS)
+	}
+
+	if cfg.Auth == nil || cfg.Auth.Principals["admin"] == nil || cfg.Auth.Principals["admin"].Actions[0] != "remove" {
+		t.Errorf("Unexpected auth config %#v\n", cfg.Auth)
+	}
+
+	if cfg.Health != nil || cfg.Log != nil {
+		t.Error("Blocks without variables must not be created")
+	}
+
+	// invalid values
+	err = applyEnv(&Config{}, envPrefix, map[string]string{
+		"T2_PORT":            "example",
+		"T2_STORAGE_LIMIT":   "1.5",
+		"T2_AUTH_PRINCIPALS": "{",
+	})
+
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 3 {
+		t.Errorf("Must be 3 errors but got %v\n", err)
+	}
+}
+
+func TestNewConfigEnv(t *testing.T) {
+	os.Setenv("T2_STORAGE_LIMIT", "-1")
+	defer os.Unsetenv("T2_STORAGE_LIMIT")
+
+	_, err := NewConfig("mocks/config/full.json")
+
+	errs, ok := err.(ValidationErrors)
+	if !ok || len(errs) != 1 || errs[0].Field != "storage.limit" {
+		t.Errorf("Error must be about storage.limit but got %v\n", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// max count of bytes which are searched for markup in text content, http.DetectContentType uses only 512 bytes
+const sniffLen = 8192
+
+// ContentTypesConfig struct contains lists of allowed and denied media types of uploaded files
+// types are matched without parameters, "image/*" matches all images and "*/*" matches all types
+// denied types are rejected even if they are allowed, empty allow list allows all types
+type ContentTypesConfig struct {
+	Allow []string `json:"allow"`
+	Deny  []string `json:"deny"`
+}
+
+// Allows method checks that media type is in allow list or allow list is empty, nil config allows all types
+func (cfg *ContentTypesConfig) Allows(contentType string) bool {
+	if cfg == nil || len(cfg.Allow) == 0 {
+		return true
+	}
+
+	return matchMediaType(cfg.Allow, contentType)
+}
+
+// Denies method checks that media type is in deny list
+func (cfg *ContentTypesConfig) Denies(contentType string) bool {
+	if cfg == nil {
+		return false
+	}
+
+	return matchMediaType(cfg.Deny, contentType)
+}
+
+// validateContentTypesConfig func adds problems of content types config to errs
+func validateContentTypesConfig(errs *ValidationErrors, field string, cfg *ContentTypesConfig) {
+	if cfg == nil {
+		return
+	}
+
+	for _, list := range []struct {
+		name     string
+		patterns []string
+	}{{name: "allow", patterns: cfg.Allow}, {name: "deny", patterns: cfg.Deny}} {
+		for _, pattern := range list.patterns {
+			if !isValidTypePattern(pattern) {
+				errs.Add(field+"."+list.name, "must contain media types like \"image/png\", \"image/*\" or \"*/*\"")
+				break
+			}
+		}
+	}
+}
+
+// validatePrincipalsContentTypes func adds problems of content types configs of principals to errs
+func validatePrincipalsContentTypes(errs *ValidationErrors, cfg *AuthConfig) {
+	if cfg == nil {
+		return
+	}
+
+	names := make([]string, 0, len(cfg.Principals))
+	for name := range cfg.Principals {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		if p := cfg.Principals[name]; p != nil {
+			validateContentTypesConfig(errs, "auth.principals."+name+".content_types", p.ContentTypes)
+		}
+	}
+}
+
+func isValidTypePattern(pattern string) bool {
+	mediaType, params, err := mime.ParseMediaType(pattern)
+	if err != nil || len(params) > 0 {
+		return false
+	}
+
+	parts := strings.Split(mediaType, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return false
+	}
+
+	return parts[0] != "*" || parts[1] == "*"
+}
+
+// matchMediaType func checks that media type of content type matches any of patterns
+func matchMediaType(patterns []string, contentType string) bool {
+	mediaType := getMediaType(contentType)
+
+	for _, pattern := range patterns {
+		pattern = strings.ToLower(pattern)
+
+		switch {
+		case pattern == "*/*" || pattern == mediaType:
+			return true
+		case strings.HasSuffix(pattern, "/*") && strings.HasPrefix(mediaType, pattern[:len(pattern)-1]):
+			return true
+		}
+	}
+
+	return false
+}
+
+// getMediaType func returns lower case media type of content type without parameters
+func getMediaType(contentType string) string {
+	if mediaType, _, err := mime.ParseMediaType(contentType); err == nil {
+		return mediaType
+	}
+
+	return strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+}
+
+// isGenericType func checks that content type carries no information about content
+// such types are detected for content without known signature, so they are not checked by allow lists
+func isGenericType(contentType string) bool {
+	mediaType := getMediaType(contentType)
+
+	return mediaType == "application/octet-stream" || mediaType == "text/plain"
+}
+
+// isAllowedType func checks content type of uploaded file by global rules and rules of principal
+// content type which is stored with file must be allowed and not denied,
+// detected type must not be denied and must be allowed if it's not generic, empty detected type is not checked
+func isAllowedType(cfg *Config, principal, contentType, detected string) bool {
+	rules := []*ContentTypesConfig{cfg.Storage.ContentTypes}
+	if p := cfg.Auth.GetPrincipal(principal); p != nil {
+		rules = append(rules, p.ContentTypes)
+	}
+
+	for _, rule := range rules {
+		if !rule.Allows(contentType) || rule.Denies(contentType) {
+			return false
+		}
+
+		if detected == "" {
+			continue
+		}
+
+		if rule.Denies(detected) || (!isGenericType(detected) && !rule.Allows(detected)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// dangerousTypes are rendered by browsers as active content, such files are never sent inline
+var dangerousTypes = map[string]bool{
+	"text/html":                     true,
+	"application/xhtml+xml":         true,
+	"image/svg+xml":                 true,
+	"text/xml":                      true,
+	"application/xml":               true,
+	"text/xsl":                      true,
+	"text/javascript":               true,
+	"application/javascript":        true,
+	"application/x-javascript":      true,
+	"application/ecmascript":        true,
+	"text/ecmascript":               true,
+	"application/x-shockwave-flash": true,
+}
+
+// isDangerousType func checks that content could run scripts if it's rendered inline, all xml based types are dangerous
+func isDangerousType(contentType string) bool {
+	mediaType := getMediaType(contentType)
+
+	return dangerousTypes[mediaType] || strings.HasSuffix(mediaType, "+xml")
+}
+
+// signature struct contains magic bytes of content type at offset
+type signature struct {
+	offset      int
+	magic       string
+	contentType string
+}
+
+// signatures of formats which are not detected by http.DetectContentType
+var signatures = []signature{
+	{offset: 0, magic: "7z\xbc\xaf\x27\x1c", contentType: "application/x-7z-compressed"},
+	{offset: 0, magic: "BZh", contentType: "application/x-bzip2"},
+	{offset: 0, magic: "\xfd7zXZ\x00", contentType: "application/x-xz"},
+	{offset: 0, magic: "\x28\xb5\x2f\xfd", contentType: "application/zstd"},
+	{offset: 0, magic: "\x7fELF", contentType: "application/x-executable"},
+	{offset: 0, magic: "\xcf\xfa\xed\xfe", contentType: "application/x-mach-binary"},
+	{offset: 0, magic: "\xce\xfa\xed\xfe", contentType: "application/x-mach-binary"},
+	{offset: 0, magic: "SQLite format 3\x00", contentType: "application/vnd.sqlite3"},
+	{offset: 257, magic: "ustar", contentType: "application/x-tar"},
+	{offset: 4, magic: "ftypheic", contentType: "image/heic"},
+	{offset: 4, magic: "ftypheix", contentType: "image/heic"},
+	{offset: 4, magic: "ftypmif1", contentType: "image/heif"},
+	{offset: 4, magic: "ftypavif", contentType: "image/avif"},
+}
+
+// html tags which make text content dangerous even if they are not at the beginning of it
+var htmlMarkers = [][]byte{
+	[]byte("<!doctype html"),
+	[]byte("<html"),
+	[]byte("<head"),
+	[]byte("<body"),
+	[]byte("<script"),
+	[]byte("<iframe"),
+}
+
+// detectContentType func returns content type of content by magic bytes
+// it detects more formats than http.DetectContentType, content of zip archives is inspected to detect
+// office documents, svg and html are searched in the first sniffLen bytes of text content
+func detectContentType(content []byte) string {
+	for _, sig := range signatures {
+		if len(content) >= sig.offset+len(sig.magic) && string(content[sig.offset:sig.offset+len(sig.magic)]) == sig.magic {
+			return sig.contentType
+		}
+	}
+
+	if isPortableExecutable(content) {
+		return "application/vnd.microsoft.portable-executable"
+	}
+
+	contentType := http.DetectContentType(content)
+
+	switch getMediaType(contentType) {
+	case "application/zip":
+		return detectZipType(content)
+	case "text/xml", "text/plain":
+		head := content
+		if len(head) > sniffLen {
+			head = head[:sniffLen]
+		}
+
+		head = bytes.ToLower(head)
+
+		if bytes.Contains(head, []byte("<svg")) {
+			return "image/svg+xml"
+		}
+
+		if bytes.Contains(head, []byte("http://www.w3.org/1999/xhtml")) {
+			return "application/xhtml+xml"
+		}
+
+		for _, marker := range htmlMarkers {
+			if bytes.Contains(head, marker) {
+				return "text/html; charset=utf-8"
+			}
+		}
+	}
+
+	return contentType
+}
+
+// isPortableExecutable func checks that content is windows executable, pe header is referenced from dos header
+func isPortableExecutable(content []byte) bool {
+	if len(content) < 0x40 || string(content[:2]) != "MZ" {
+		return false
+	}
+
+	offset := int64(binary.LittleEndian.Uint32(content[0x3c:]))
+
+	return offset+4 <= int64(len(content)) && string(content[offset:offset+4]) == "PE\x00\x00"
+}
+
+// detectContentTypeAt func detects content type of file like detectContentType
+// only head of file and directory of zip archive are read, so file is not loaded to memory
+func detectContentTypeAt(r io.ReaderAt, size int64) string {
+	head := make([]byte, sniffLen)
+	if size < sniffLen {
+		head = head[:size]
+	}
+
+	n, _ := r.ReadAt(head, 0)
+
+	contentType := detectContentType(head[:n])
+	if contentType == "application/zip" {
+		return detectZipTypeAt(r, size)
+	}
+
+	return contentType
+}
+
+// detectZipType func returns content type of zip based formats by names of files in archive
+func detectZipType(content []byte) string {
+	return detectZipTypeAt(bytes.NewReader(content), int64(len(content)))
+}
+
+// detectZipTypeAt func returns content type of zip archive which is read from r
+// odf documents and epub books declare their type in the first file "mimetype"
+func detectZipTypeAt(ra io.ReaderAt, size int64) string {
+	r, err := zip.NewReader(ra, size)
+	if err != nil || len(r.File) == 0 {
+		return "application/zip"
+	}
+
+	if f := r.File[0]; f.Name == "mimetype" && f.UncompressedSize64 < 128 {
+		if rc, err := f.Open(); err == nil {
+			data, err := ioutil.ReadAll(rc)
+			rc.Close()
+
+			if err == nil && isValidTypePattern(string(data)) && !strings.Contains(string(data), "*") {
+				return string(data)
+			}
+		}
+	}
+
+	names := map[string]bool{}
+	for _, f := range r.File {
+		names[strings.SplitAfter(f.Name, "/")[0]] = true
+	}
+
+	switch {
+	case names["[Content_Types].xml"] && names["word/"]:
+		return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+	case names["[Content_Types].xml"] && names["xl/"]:
+		return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+	case names["[Content_Types].xml"] && names["ppt/"]:
+		return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+	case names["AndroidManifest.xml"]:
+		return "application/vnd.android.package-archive"
+	case hasZipFile(r, "META-INF/MANIFEST.MF"):
+		return "application/java-archive"
+	}
+
+	return "application/zip"
+}
+
+func hasZipFile(r *zip.Reader, name string) bool {
+	for _, f := range r.File {
+		if f.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func getTestZip(names ...string) []byte {
+	buf := &bytes.Buffer{}
+	w := zip.NewWriter(buf)
+
+	for _, name := range names {
+		f, _ := w.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Store})
+
+		if name == "mimetype" {
+			f.Write([]byte("application/epub+zip"))
+		} else {
+			f.Write([]byte("content"))
+		}
+	}
+
+	w.Close()
+
+	return buf.Bytes()
+}
+
+func TestDetectContentType(t *testing.T) {
+	pe := make([]byte, 0x100)
+	copy(pe, "MZ")
+	pe[0x3c] = 0x80
+	copy(pe[0x80:], "PE\x00\x00")
+
+	tar := make([]byte, 512)
+	copy(tar[257:], "ustar")
+
+	comment := "<!-- " + strings.Repeat("long comment ", 100) + "-->"
+
+	cases := []struct {
+		content  []byte
+		expected string
+	}{
+		{content: []byte("hello world"), expected: "text/plain; charset=utf-8"},
+		{content: []byte("\x89PNG\x0d\x0a\x1a\x0a"), expected: "image/png"},
+		{content: []byte("7z\xbc\xaf\x27\x1c\x00\x04"), expected: "application/x-7z-compressed"},
+		{content: []byte("\x7fELF\x02\x01\x01"), expected: "application/x-executable"},
+		{content: pe, expected: "application/vnd.microsoft.portable-executable"},
+		{content: []byte("MZ" + strings.Repeat("\x00", 100)), expected: "application/octet-stream"},
+		{content: tar, expected: "application/x-tar"},
+		{content: []byte("\x00\x00\x00\x1cftypavif"), expected: "image/avif"},
+		{content: getTestZip("a.txt"), expected: "application/zip"},
+		{content: getTestZip("[Content_Types].xml", "word/document.xml"), expected: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{content: getTestZip("[Content_Types].xml", "xl/workbook.xml"), expected: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{content: getTestZip("mimetype", "META-INF/container.xml"), expected: "application/epub+zip"},
+		{content: getTestZip("META-INF/MANIFEST.MF", "Main.class"), expected: "application/java-archive"},
+		{content: []byte(`<?xml version="1.0"?>` + comment + `<svg xmlns="http://www.w3.org/2000/svg"></svg>`), expected: "image/svg+xml"},
+		{content: []byte(`<?xml version="1.0"?><note></note>`), expected: "text/xml; charset=utf-8"},
+		{content: []byte(strings.Repeat("plain text ", 100) + "<SCRIPT>alert(1)</SCRIPT>"), expected: "text/html; charset=utf-8"},
+		{content: []byte(strings.Repeat("plain text ", 1000) + "<script>alert(1)</script>"), expected: "text/plain; charset=utf-8"},
+	}
+
+	for i, tc := range cases {
+		if v := detectContentType(tc.content); v != tc.expected {
+			t.Errorf("Content type of case %d must be %s but got %s\n", i, tc.expected, v)
+		}
+	}
+}
+
+func TestDetectContentTypeAt(t *testing.T) {
+	// directory of large archive is out of sniffed head
+	names := []string{"[Content_Types].xml"}
+	for i := 0; i < 200; i++ {
+		names = append(names, "word/media/image"+strconv.Itoa(i)+".png")
+	}
+
+	cases := []struct {
+		content  []byte
+		expected string
+	}{
+		{content: []byte{}, expected: "text/plain; charset=utf-8"},
+		{content: []byte("\x89PNG\x0d\x0a\x1a\x0a"), expected: "image/png"},
+		{content: getTestZip("a.txt"), expected: "application/zip"},
+		{content: getTestZip(names...), expected: "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{content: []byte(strings.Repeat("plain text ", 1000) + "<script>alert(1)</script>"), expected: "text/plain; charset=utf-8"},
+	}
+
+	for i, tc := range cases {
+		if v := detectContentTypeAt(bytes.NewReader(tc.content), int64(len(tc.content))); v != tc.expected {
+			t.Errorf("Content type of case %d must be %s but got %s\n", i, tc.expected, v)
+		}
+	}
+}
+
+func TestIsDangerousType(t *testing.T) {
+	cases := []struct {
+		contentType string
+		expected    bool
+	}{
+		{contentType: "text/html; charset=utf-8", expected: true},
+		{contentType: "IMAGE/SVG+XML", expected: true},
+		{contentType: "application/atom+xml", expected: true},
+		{contentType: "application/javascript", expected: true},
+		{contentType: "image/png", expected: false},
+		{contentType: "text/plain; charset=utf-8", expected: false},
+		{contentType: "application/pdf", expected: false},
+	}
+
+	for _, tc := range cases {
+		if v := isDangerousType(tc.contentType); v != tc.expected {
+			t.Errorf("Dangerous for %s must be %v but got %v\n", tc.contentType, tc.expected, v)
+		}
+	}
+}
+
+func TestIsAllowedType(t *testing.T) {
+	cfg := &Config{
+		Storage: &StorageConfig{
+			ContentTypes: &ContentTypesConfig{Deny: []string{"text/html", "application/x-executable"}},
+		},
+		Auth: &AuthConfig{
+			Principals: map[string]*PrincipalConfig{
+				"images": &PrincipalConfig{ContentTypes: &ContentTypesConfig{Allow: []string{"image/*"}, Deny: []string{"image/gif"}}},
+				"all":    nil,
+			},
+		},
+	}
+
+	cases := []struct {
+		principal   string
+		contentType string
+		detected    string
+		expected    bool
+	}{
+		{principal: "all", contentType: "application/pdf", detected: "application/pdf", expected: true},
+		{principal: "all", contentType: "text/html; charset=utf-8", detected: "text/html; charset=utf-8", expected: false},
+		{principal: "all", contentType: "text/csv", detected: "text/html; charset=utf-8", expected: false},
+		{principal: "all", contentType: "TEXT/HTML", detected: "", expected: false},
+		{principal: "images", contentType: "image/png", detected: "image/png", expected: true},
+		{principal: "images", contentType: "image/x-raw", detected: "application/octet-stream", expected: true},
+		{principal: "images", contentType: "image/png", detected: "application/zip", expected: false},
+		{principal: "images", contentType: "image/gif", detected: "image/gif", expected: false},
+		{principal: "images", contentType: "application/pdf", detected: "application/pdf", expected: false},
+		{principal: "images", contentType: "image/png", detected: "application/x-executable", expected: false},
+	}
+
+	for _, tc := range cases {
+		if v := isAllowedType(cfg, tc.principal, tc.contentType, tc.detected); v != tc.expected {
+			t.Errorf("Allowed for %s/%s/%s must be %v but got %v\n", tc.principal, tc.contentType, tc.detected, tc.expected, v)
+		}
+	}
+}
+
+func TestValidateContentTypesConfig(t *testing.T) {
+	cfg := &Config{
+		Storage: &StorageConfig{
+			ContentTypes: &ContentTypesConfig{Allow: []string{"image/*", "*/*", "application/pdf"}, Deny: []string{"*/html"}},
+		},
+		Auth: &AuthConfig{
+			Principals: map[string]*PrincipalConfig{
+				"a": &PrincipalConfig{ContentTypes: &ContentTypesConfig{Allow: []string{"text/plain; charset=utf-8"}}},
+				"b": &PrincipalConfig{ContentTypes: &ContentTypesConfig{Deny: []string{"image"}}},
+				"c": nil,
+			},
+		},
+	}
+	cfg.SetDefaults()
+
+	expected := []string{
+		"storage.content_types.deny",
+		"auth.principals.a.content_types.allow",
+		"auth.principals.b.content_types.deny",
+	}
+
+	errs, _ := cfg.Validate().(ValidationErrors)
+	if len(errs) != len(expected) {
+		t.Fatalf("Errors count must be %d but got %d (%v)\n", len(expected), len(errs), errs)
+	}
+
+	for index, field := range expected {
+		if errs[index].Field != field {
+			t.Errorf("Field must be %s but got %s\n", field, errs[index].Field)
+		}
+	}
+}
+
+func TestHandlerContentTypes(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{
+		MaxSize:      1024,
+		ContentTypes: &ContentTypesConfig{Deny: []string{"application/x-executable"}},
+	})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.Config.Auth = &AuthConfig{
+		Principals: map[string]*PrincipalConfig{
+			anonymousPrincipal: &PrincipalConfig{ContentTypes: &ContentTypesConfig{Deny: []string{"application/zip"}}},
+		},
+	}
+
+	h := NewHandler(app)
+
+	upload := func(content []byte, contentType string) (int, string) {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+
+		part, _ := writer.CreatePart(textproto.MIMEHeader{
+			"Content-Disposition": {`form-data; name="file"; filename="file"`},
+			"Content-Type":        {contentType},
+		})
+		part.Write(content)
+		writer.Close()
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/files", body)
+		r.Header.Set("Content-Type", writer.FormDataContentType())
+		h.ServeHTTP(w, r)
+
+		res := UploadResponse{}
+		errResp := ErrorResponse{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+
+		if w.Code != 200 {
+			return w.Code, errResp.Error
+		}
+
+		return w.Code, res.Hash
+	}
+
+	cases := []struct {
+		content     []byte
+		contentType string
+		code        int
+		message     string
+	}{
+		{content: []byte("\x7fELF\x02\x01\x01"), contentType: "image/png", code: 415, message: "CONTENT_TYPE_NOT_ALLOWED"},
+		{content: getTestZip("a.txt"), contentType: "application/octet-stream", code: 415, message: "CONTENT_TYPE_NOT_ALLOWED"},
+		{content: []byte("a,b\n1,2\n"), contentType: "application/zip", code: 415, message: "CONTENT_TYPE_NOT_ALLOWED"},
+	}
+
+	for _, tc := range cases {
+		code, message := upload(tc.content, tc.contentType)
+		if code != tc.code || message != tc.message {
+			t.Errorf("Response for %s must be %d %s but got %d %s\n", tc.contentType, tc.code, tc.message, code, message)
+		}
+	}
+
+	_, htmlHash := upload([]byte(strings.Repeat("text ", 120)+"<script>alert(1)</script>"), "")
+	_, textHash := upload([]byte("hello world"), "")
+
+	app.wg.Wait()
+
+	downloads := []struct {
+		hash        string
+		query       string
+		contentType string
+		disposition string
+	}{
+		{hash: htmlHash, query: "?disposition=inline", contentType: "text/html; charset=utf-8", disposition: "attachment; filename=\"file\""},
+		{hash: textHash, query: "?disposition=inline", contentType: "text/plain; charset=utf-8", disposition: "inline; filename=\"file\""},
+		{hash: textHash, query: "", contentType: "text/plain; charset=utf-8", disposition: "attachment; filename=\"file\""},
+	}
+
+	for _, tc := range downloads {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/files/"+tc.hash+tc.query, nil)
+		h.ServeHTTP(w, r)
+
+		if w.Code != 200 {
+			t.Errorf("Code must be %d but got %d\n", 200, w.Code)
+		}
+
+		if v := w.Header().Get("Content-Type"); v != tc.contentType {
+			t.Errorf("Content type must be %s but got %s\n", tc.contentType, v)
+		}
+
+		if v := w.Header().Get("Content-Disposition"); v != tc.disposition {
+			t.Errorf("Content disposition must be %s but got %s\n", tc.disposition, v)
+		}
+
+		if v := w.Header().Get("X-Content-Type-Options"); v != "nosniff" {
+			t.Errorf("Content type options must be %s but got %s\n", "nosniff", v)
+		}
+	}
+
+	app.wg.Wait()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("PATCH", "/files/"+textHash+"/meta", strings.NewReader(`{"content_type": "application/zip"}`))
+	h.ServeHTTP(w, r)
+
+	if w.Code != 415 {
+		t.Errorf("Code must be %d but got %d\n", 415, w.Code)
+	}
+}
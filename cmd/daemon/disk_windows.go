@@ -0,0 +1,6 @@
+package main
+
+// getFreeSpace func is not implemented on windows, free space is unknown there
+func getFreeSpace(path string) (int64, error) {
+	return 0, errFreeSpaceUnknown
+}
@@ -0,0 +1,562 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"time"
+)
+
+// default size of plaintext chunk of encrypted file
+const defaultEncryptionChunkSize = 65536
+
+// encrypted file starts with header: magic, version, size of chunk and nonce prefix
+// each chunk is sealed by AES-256-GCM, nonce is prefix and number of chunk, the last chunk is marked in additional data
+const (
+	encryptedMagic      = "T2EN"
+	encryptedVersion    = 1
+	encryptedHeaderSize = 17
+	noncePrefixSize     = 8
+	dataKeySize         = 32
+)
+
+var (
+	// errDecryption is returned if authentication tag of chunk does not match, file is corrupted
+	errDecryption = errors.New("Authentication of encrypted chunk failed")
+	// errDataKeyNotFound is returned if encrypted file has no data key in metadata
+	errDataKeyNotFound = errors.New("Data key is not found")
+	// errUnknownMasterKey is returned if data key is wrapped by key which is missing in key file
+	errUnknownMasterKey = errors.New("Master key is not found in key file")
+	// errInvalidDataKey is returned if wrapped data key could not be unwrapped by master key
+	errInvalidDataKey = errors.New("Data key could not be unwrapped")
+)
+
+// EncryptionConfig struct contains info about
+// - path of key file with master keys, data keys of files are wrapped by current one
+// - size of plaintext chunk in bytes, default is 65536
+// key file is read again on reload, so new master key could be added without restart
+type EncryptionConfig struct {
+	KeyFile   string `json:"key_file"`
+	ChunkSize int    `json:"chunk_size"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *EncryptionConfig) SetDefaults() {
+	if cfg.ChunkSize == 0 {
+		cfg.ChunkSize = defaultEncryptionChunkSize
+	}
+}
+
+// validateEncryptionConfig func adds problems of encryption config to errs
+func validateEncryptionConfig(errs *ValidationErrors, cfg *EncryptionConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if _, err := LoadKeyRing(cfg.KeyFile); err != nil {
+		errs.Add("storage.encryption.key_file", err.Error())
+	}
+
+	if cfg.ChunkSize < 0 {
+		errs.Add("storage.encryption.chunk_size", "must not be negative")
+	}
+}
+
+// KeyRing struct contains master keys by id, data keys of new files are wrapped by current key
+type KeyRing struct {
+	Current string
+	Keys    map[string][]byte
+}
+
+// LoadKeyRing func reads key file, it's json with id of current key and base64 encoded 32 bytes keys by id:
+// {"current": "2024-01", "keys": {"2023-01": "...", "2024-01": "..."}}
+func LoadKeyRing(path string) (*KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var v struct {
+		Current string            `json:"current"`
+		Keys    map[string]string `json:"keys"`
+	}
+
+	err = json.Unmarshal(data, &v)
+	if err != nil {
+		return nil, err
+	}
+
+	kr := &KeyRing{Current: v.Current, Keys: map[string][]byte{}}
+
+	for id, encoded := range v.Keys {
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil || len(key) != dataKeySize {
+			return nil, errors.New("key " + id + " must be base64 encoded 32 bytes")
+		}
+
+		kr.Keys[id] = key
+	}
+
+	if _, ok := kr.Keys[kr.Current]; !ok {
+		return nil, errors.New("current key is not found in keys")
+	}
+
+	return kr, nil
+}
+
+// Wrap method encrypts data key of file by current master key, id of file is authenticated
+func (kr *KeyRing) Wrap(hash string, dataKey []byte) (string, []byte, error) {
+	aead, err := newGCM(kr.Keys[kr.Current])
+	if err != nil {
+		return "", nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+
+	return kr.Current, aead.Seal(nonce, nonce, dataKey, []byte(hash)), nil
+}
+
+// Unwrap method decrypts data key of file by master key with given id
+func (kr *KeyRing) Unwrap(hash, keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := kr.Keys[keyID]
+	if !ok {
+		return nil, errUnknownMasterKey
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errInvalidDataKey
+	}
+
+	dataKey, err := aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(hash))
+	if err != nil {
+		return nil, errInvalidDataKey
+	}
+
+	return dataKey, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// DataKeys interface stores wrapped data keys of encrypted files
+// and fingerprints of client keys with checksums of files encrypted by them
+type DataKeys interface {
+	SaveDataKey(hash, keyID string, wrapped []byte) (bool, error)
+	GetDataKey(hash string) (string, []byte, error)
+	SaveClientKey(hash, fingerprint, storedSHA256 string) error
+	GetClientKey(hash string) (string, string, error)
+}
+
+// getKeyRing method returns master keys, key file is read on the first call after start or reload
+func (s *Storage) getKeyRing() (*KeyRing, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.Config.Encryption == nil {
+		return nil, errors.New("Key file is not configured")
+	}
+
+	if s.keyRing == nil {
+		kr, err := LoadKeyRing(s.Config.Encryption.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		s.keyRing = kr
+	}
+
+	return s.keyRing, nil
+}
+
+// getDataKey method returns data key of file, new key is generated and saved if file has no key yet
+// key is saved before file is written, so copies in replicas could be verified
+func (s *Storage) getDataKey(hash string) ([]byte, error) {
+	key, err := s.loadDataKey(hash)
+	if err != errDataKeyNotFound {
+		// copies of file in replicas and sources are encrypted by the same key
+		return key, err
+	}
+
+	key = make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+
+	kr, err := s.getKeyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	keyID, wrapped, err := kr.Wrap(hash, key)
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := s.DataKeys.SaveDataKey(hash, keyID, wrapped)
+	if err != nil {
+		return nil, err
+	} else if !ok {
+		// key has been saved by concurrent upload of the same file
+		return s.loadDataKey(hash)
+	}
+
+	return key, nil
+}
+
+// loadDataKey method returns unwrapped data key of file
+func (s *Storage) loadDataKey(hash string) ([]byte, error) {
+	keyID, wrapped, err := s.DataKeys.GetDataKey(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	kr, err := s.getKeyRing()
+	if err != nil {
+		return nil, err
+	}
+
+	return kr.Unwrap(hash, keyID, wrapped)
+}
+
+// encryptFile method returns encrypted stream of file if encryption is enabled or client key is set
+// file is encrypted by client key instead of its data key, client key is not saved
+func (s *Storage) encryptFile(hash string, r io.Reader, clientKey []byte) (io.Reader, error) {
+	cfg := s.GetConfig().Encryption
+
+	if clientKey != nil {
+		chunkSize := defaultEncryptionChunkSize
+		if cfg != nil {
+			chunkSize = cfg.ChunkSize
+		}
+
+		return newEncryptReader(r, clientKey, hash, chunkSize)
+	}
+
+	if cfg == nil {
+		return r, nil
+	}
+
+	if s.DataKeys == nil {
+		return nil, errors.New("Storage of data keys is not set")
+	}
+
+	key, err := s.getDataKey(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return newEncryptReader(r, key, hash, cfg.ChunkSize)
+}
+
+// decryptFile method returns decrypted stream of stored file, file which is not encrypted is returned as is
+// file is decrypted by client key if it's set, data key of file is used otherwise
+func (s *Storage) decryptFile(hash string, r io.Reader, clientKey []byte) (io.Reader, error) {
+	br := bufio.NewReader(r)
+
+	head, err := br.Peek(len(encryptedMagic))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	if !isEncrypted(head) {
+		return br, nil
+	}
+
+	if clientKey != nil {
+		return newDecryptReader(br, clientKey, hash)
+	}
+
+	if s.DataKeys == nil {
+		return nil, errDataKeyNotFound
+	}
+
+	key, err := s.loadDataKey(hash)
+	if err != nil {
+		return nil, err
+	}
+
+	return newDecryptReader(br, key, hash)
+}
+
+// encryptReader struct encrypts source stream chunk by chunk
+type encryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	hash    string
+	counter uint32
+	chunk   []byte
+	buf     []byte
+	done    bool
+}
+
+func newEncryptReader(r io.Reader, key []byte, hash string, chunkSize int) (*encryptReader, error) {
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if chunkSize <= 0 {
+		chunkSize = defaultEncryptionChunkSize
+	}
+
+	header := make([]byte, encryptedHeaderSize)
+	copy(header, encryptedMagic)
+	header[4] = encryptedVersion
+	binary.BigEndian.PutUint32(header[5:], uint32(chunkSize))
+
+	if _, err := rand.Read(header[9:]); err != nil {
+		return nil, err
+	}
+
+	return &encryptReader{
+		r:      bufio.NewReader(r),
+		aead:   aead,
+		prefix: header[9:],
+		hash:   hash,
+		chunk:  make([]byte, chunkSize),
+		buf:    header,
+	}, nil
+}
+
+// Read method
+func (er *encryptReader) Read(p []byte) (int, error) {
+	for len(er.buf) == 0 {
+		if er.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(er.r, er.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		// the last chunk is the one which is not followed by data
+		if err == nil {
+			_, err = er.r.Peek(1)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+
+		er.done = err != nil
+		er.buf = er.aead.Seal(er.buf[:0], getChunkNonce(er.prefix, er.counter), er.chunk[:n], getChunkData(er.hash, er.done))
+		er.counter++
+	}
+
+	n := copy(p, er.buf)
+	er.buf = er.buf[n:]
+
+	return n, nil
+}
+
+// decryptReader struct decrypts stream chunk by chunk and verifies authentication tag of each chunk
+type decryptReader struct {
+	r       *bufio.Reader
+	aead    cipher.AEAD
+	prefix  []byte
+	hash    string
+	counter uint32
+	chunk   []byte
+	buf     []byte
+	done    bool
+}
+
+func newDecryptReader(r io.Reader, key []byte, hash string) (*decryptReader, error) {
+	br := bufio.NewReader(r)
+
+	header := make([]byte, encryptedHeaderSize)
+
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, errDecryption
+	}
+
+	chunkSize := int(binary.BigEndian.Uint32(header[5:]))
+	if header[4] != encryptedVersion || chunkSize <= 0 || chunkSize > 1<<26 {
+		return nil, errDecryption
+	}
+
+	aead, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return &decryptReader{
+		r:      br,
+		aead:   aead,
+		prefix: header[9:],
+		hash:   hash,
+		chunk:  make([]byte, chunkSize+aead.Overhead()),
+	}, nil
+}
+
+// Read method
+func (dr *decryptReader) Read(p []byte) (int, error) {
+	for len(dr.buf) == 0 {
+		if dr.done {
+			return 0, io.EOF
+		}
+
+		n, err := io.ReadFull(dr.r, dr.chunk)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		if err == nil {
+			_, err = dr.r.Peek(1)
+			if err != nil && err != io.EOF {
+				return 0, err
+			}
+		}
+
+		dr.done = err != nil
+
+		// truncated file fails too, the last chunk must be marked
+		dr.buf, err = dr.aead.Open(dr.buf[:0], getChunkNonce(dr.prefix, dr.counter), dr.chunk[:n], getChunkData(dr.hash, dr.done))
+		if err != nil {
+			return 0, errDecryption
+		}
+
+		dr.counter++
+	}
+
+	n := copy(p, dr.buf)
+	dr.buf = dr.buf[n:]
+
+	return n, nil
+}
+
+func getChunkNonce(prefix []byte, counter uint32) []byte {
+	nonce := make([]byte, noncePrefixSize+4)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+
+	return nonce
+}
+
+// getChunkData func returns additional data of chunk, it binds chunk to file and marks the last chunk
+func getChunkData(hash string, last bool) []byte {
+	flag := byte(0)
+	if last {
+		flag = 1
+	}
+
+	return append([]byte(hash), flag)
+}
+
+// KeyRotationReport struct describes rewrapping of data keys
+type KeyRotationReport struct {
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	KeyID      string    `json:"key_id"`
+	Checked    int       `json:"checked"`
+	Rotated    int       `json:"rotated"`
+	Failed     int       `json:"failed"`
+}
+
+// RotateKeys method rewraps data keys of all encrypted files by current master key, files are not rewritten
+// old master key could be removed from key file after rotation without failures
+func (app *Application) RotateKeys(ctx context.Context) (*KeyRotationReport, error) {
+	report := &KeyRotationReport{StartedAt: time.Now().UTC()}
+
+	kr, err := app.Storage.getKeyRing()
+	if err != nil {
+		return report, err
+	}
+
+	report.KeyID = kr.Current
+	offset := 0
+
+	for {
+		hashes, err := app.Redis.GetEncryptedFiles(offset, 100)
+		if err != nil {
+			return report, err
+		} else if len(hashes) == 0 {
+			break
+		}
+
+		for _, hash := range hashes {
+			if err := ctx.Err(); err != nil {
+				return report, err
+			}
+
+			report.Checked++
+
+			ok, err := app.rotateDataKey(kr, hash)
+			if err != nil {
+				app.Logger.Error("could not rewrap data key", "component", "encryption", "file_id", hash, "error", err)
+				report.Failed++
+			} else if ok {
+				report.Rotated++
+			}
+		}
+
+		offset += len(hashes)
+	}
+
+	report.FinishedAt = time.Now().UTC()
+
+	app.Logger.Info("data keys rotated", "component", "encryption", "key_id", kr.Current, "rotated", report.Rotated, "failed", report.Failed)
+
+	return report, nil
+}
+
+// rotateDataKey method rewraps data key of file, false is returned if it's wrapped by current key already
+func (app *Application) rotateDataKey(kr *KeyRing, hash string) (bool, error) {
+	keyID, wrapped, err := app.Redis.GetDataKey(hash)
+	if err == errDataKeyNotFound {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	if keyID == kr.Current {
+		return false, nil
+	}
+
+	key, err := kr.Unwrap(hash, keyID, wrapped)
+	if err != nil {
+		return false, err
+	}
+
+	newID, rewrapped, err := kr.Wrap(hash, key)
+	if err != nil {
+		return false, err
+	}
+
+	// key is not replaced if it has been rotated concurrently
+	return app.Redis.ReplaceDataKey(hash, wrapped, newID, rewrapped)
+}
+
+// isKeyError func returns true for errors of data key, content of file could be valid, so it's not corrupted
+func isKeyError(err error) bool {
+	return err == errDataKeyNotFound || err == errUnknownMasterKey || err == errInvalidDataKey
+}
+
+// isEncrypted func returns true if stored file is encrypted
+func isEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(encryptedMagic))
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeTestKeyFile func writes key file with keys derived from ids
+func writeTestKeyFile(t *testing.T, fileName, current string, ids ...string) {
+	keys := map[string]string{}
+	for _, id := range ids {
+		key := sha256.Sum256([]byte(id))
+		keys[id] = base64.StdEncoding.EncodeToString(key[:])
+	}
+
+	data, _ := json.Marshal(map[string]interface{}{"current": current, "keys": keys})
+
+	err := ioutil.WriteFile(fileName, data, 0600)
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+}
+
+func newEncryptionTestApplication(t *testing.T) *Application {
+	app := newTrashTestApplication(t, &StorageConfig{})
+	app.Storage.Logger = app.Logger
+
+	keyFile := path.Join(app.Config.Storage.Path, "keys.json")
+	writeTestKeyFile(t, keyFile, "k1", "k1")
+
+	app.Config.Storage.Encryption = &EncryptionConfig{KeyFile: keyFile, ChunkSize: 16}
+
+	return app
+}
+
+func TestLoadKeyRing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-keys")
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := path.Join(dir, "keys.json")
+	valid := base64.StdEncoding.EncodeToString(make([]byte, 32))
+
+	cases := []struct {
+		content string
+		valid   bool
+	}{
+		{content: `{"current": "a", "keys": {"a": "` + valid + `"}}`, valid: true},
+		{content: `{"current": "b", "keys": {"a": "` + valid + `", "b": "` + valid + `"}}`, valid: true},
+		{content: `{"current": "b", "keys": {"a": "` + valid + `"}}`, valid: false},
+		{content: `{"current": "a", "keys": {"a": "c2hvcnQ="}}`, valid: false},
+		{content: `{"current": "a", "keys": {"a": "???"}}`, valid: false},
+		{content: `{"current": "a"`, valid: false},
+	}
+
+	for _, tc := range cases {
+		ioutil.WriteFile(fileName, []byte(tc.content), 0600)
+
+		_, err := LoadKeyRing(fileName)
+		if (err == nil) != tc.valid {
+			t.Errorf("Valid flag for %s must be %v but got %v\n", tc.content, tc.valid, err)
+		}
+	}
+
+	if _, err := LoadKeyRing(path.Join(dir, "missing.json")); !os.IsNotExist(err) {
+		t.Errorf("Error must be %v but got %v\n", os.ErrNotExist, err)
+	}
+}
+
+func TestKeyRingWrap(t *testing.T) {
+	kr := &KeyRing{Current: "a", Keys: map[string][]byte{"a": make([]byte, 32), "b": bytes.Repeat([]byte{1}, 32)}}
+	key := bytes.Repeat([]byte{7}, 32)
+
+	keyID, wrapped, err := kr.Wrap("hash", key)
+	if keyID != "a" || err != nil {
+		t.Fatalf("Key id must be %s but got %s, %v\n", "a", keyID, err)
+	}
+
+	cases := []struct {
+		hash  string
+		keyID string
+		err   error
+	}{
+		{hash: "hash", keyID: "a", err: nil},
+		{hash: "hash", keyID: "b", err: errInvalidDataKey},
+		{hash: "other", keyID: "a", err: errInvalidDataKey},
+		{hash: "hash", keyID: "c", err: errUnknownMasterKey},
+	}
+
+	for _, tc := range cases {
+		v, err := kr.Unwrap(tc.hash, tc.keyID, wrapped)
+		if err != tc.err {
+			t.Errorf("Error for %s, %s must be %v but got %v\n", tc.hash, tc.keyID, tc.err, err)
+		}
+
+		if err == nil && !bytes.Equal(v, key) {
+			t.Errorf("Key must be %v but got %v\n", key, v)
+		}
+	}
+}
+
+func TestEncryptReader(t *testing.T) {
+	key := bytes.Repeat([]byte{7}, 32)
+
+	for _, size := range []int{0, 1, 15, 16, 17, 48, 100} {
+		content := bytes.Repeat([]byte("x"), size)
+
+		er, _ := newEncryptReader(bytes.NewReader(content), key, "hash", 16)
+		encrypted, err := ioutil.ReadAll(er)
+		if err != nil {
+			t.Fatalf("Err must be nil but got %v\n", err)
+		}
+
+		// the last chunk is sealed even if it's empty
+		chunks := size/16 + 1
+		if size > 0 && size%16 == 0 {
+			chunks = size / 16
+		}
+
+		if expected := encryptedHeaderSize + size + chunks*16; len(encrypted) != expected {
+			t.Errorf("Size of encrypted %d bytes must be %d but got %d\n", size, expected, len(encrypted))
+		}
+
+		cases := []struct {
+			name string
+			data []byte
+			hash string
+			err  error
+		}{
+			{name: "valid", data: encrypted, hash: "hash", err: nil},
+			{name: "other file", data: encrypted, hash: "other", err: errDecryption},
+			{name: "flipped byte", data: flipByte(encrypted, len(encrypted)-1), hash: "hash", err: errDecryption},
+			{name: "truncated", data: encrypted[:len(encrypted)-1], hash: "hash", err: errDecryption},
+			{name: "appended", data: append(append([]byte{}, encrypted...), make([]byte, 32)...), hash: "hash", err: errDecryption},
+			{name: "header", data: encrypted[:encryptedHeaderSize-1], hash: "hash", err: errDecryption},
+		}
+
+		for _, tc := range cases {
+			var data []byte
+
+			dr, err := newDecryptReader(bytes.NewReader(tc.data), key, tc.hash)
+			if err == nil {
+				data, err = ioutil.ReadAll(dr)
+			}
+
+			if err != tc.err {
+				t.Errorf("Error for %s content of %d bytes must be %v but got %v\n", tc.name, size, tc.err, err)
+			}
+
+			if err == nil && !bytes.Equal(data, content) {
+				t.Errorf("Decrypted content of %d bytes does not match\n", size)
+			}
+		}
+	}
+
+	// chunks of full size could not be dropped from the end
+	er, _ := newEncryptReader(bytes.NewReader(make([]byte, 32)), key, "hash", 16)
+	encrypted, _ := ioutil.ReadAll(er)
+
+	dr, _ := newDecryptReader(bytes.NewReader(encrypted[:encryptedHeaderSize+32]), key, "hash")
+	if _, err := ioutil.ReadAll(dr); err != errDecryption {
+		t.Errorf("Error must be %v but got %v\n", errDecryption, err)
+	}
+}
+
+func TestStorageEncryption(t *testing.T) {
+	app := newEncryptionTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.Config.Storage.Compression = &CompressionConfig{}
+	app.Config.Storage.Compression.SetDefaults()
+
+	cases := []struct {
+		content  string
+		encoding string
+	}{
+		{content: strings.Repeat("secret text ", 200), encoding: "gzip"},
+		{content: "secret", encoding: ""},
+		{content: "", encoding: ""},
+		// file which looks like stored encrypted file
+		{content: encryptedMagic + "\x01\x00\x00\x00\x10", encoding: ""},
+	}
+
+	for _, tc := range cases {
+		hash := getTestFileID(tc.content, time.Now())
+
+		_, err := app.Storage.CreateFile(hash, bytes.NewBufferString(tc.content))
+		if err != nil {
+			t.Errorf("Err must be nil but got %v\n", err)
+			continue
+		}
+
+		stored, _ := ioutil.ReadFile(path.Join(app.Config.Storage.Path, hash[:2], hash))
+		if !isEncrypted(stored) || (tc.content != "" && bytes.Contains(stored[encryptedHeaderSize:], []byte(tc.content))) {
+			t.Errorf("Stored file must be encrypted but got %q\n", stored)
+		}
+
+		if keyID, _, err := app.Redis.GetDataKey(hash); keyID != "k1" || err != nil {
+			t.Errorf("Key id must be %s but got %s, %v\n", "k1", keyID, err)
+		}
+
+		if encoding, _ := app.Storage.GetEncoding(hash); encoding != tc.encoding {
+			t.Errorf("Encoding must be %q but got %q\n", tc.encoding, encoding)
+		}
+
+		if data, err := readTestFile(app, hash); data != tc.content || err != nil {
+			t.Errorf("Content must be %q but got %q, %v\n", tc.content, data, err)
+		}
+
+		sum, _, _, err := app.Storage.VerifyFile(hash, newThrottle(context.Background(), 0))
+		if sum != strings.Split(hash, "-")[0] || err != nil {
+			t.Errorf("Sum must be valid but got %s, %v\n", sum, err)
+		}
+
+		// corrupted chunk is detected by verification
+		ioutil.WriteFile(path.Join(app.Config.Storage.Path, hash[:2], hash), flipByte(stored, len(stored)-20), 0644)
+
+		sum, _, _, err = app.Storage.VerifyFile(hash, newThrottle(context.Background(), 0))
+		if sum != "" || err != nil {
+			t.Errorf("Sum of corrupted file must be empty but got %s, %v\n", sum, err)
+		}
+	}
+}
+
+func TestStorageEncryptionReplication(t *testing.T) {
+	app, replicas := newReplicationTestApplication(t, 3)
+	defer removeReplicationTestApplication(app, replicas)
+
+	keyFile := path.Join(app.Config.Storage.Path, "keys.json")
+	writeTestKeyFile(t, keyFile, "k1", "k1")
+
+	app.Config.Storage.Encryption = &EncryptionConfig{KeyFile: keyFile, ChunkSize: 16}
+
+	content := strings.Repeat("0123456789", 20)
+	hash := getTestFileID(content, time.Now())
+
+	_, err := app.Storage.CreateFile(hash, bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	app.Storage.QuarantineFile(hash)
+
+	data, ok := readTestReplica(app, hash, nil)
+	if !ok || string(data) != content {
+		t.Error("Original content must be read from replica\n")
+	}
+}
+
+func TestApplicationRotateKeys(t *testing.T) {
+	app := newEncryptionTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	hashes := []string{}
+	for _, content := range []string{"first", "second", "third"} {
+		hash := getTestFileID(content, time.Now())
+		app.Storage.CreateFile(hash, bytes.NewBufferString(content))
+
+		hashes = append(hashes, hash)
+	}
+
+	stored, _ := ioutil.ReadFile(path.Join(app.Config.Storage.Path, hashes[0][:2], hashes[0]))
+
+	// new master key is added and applied by reload
+	writeTestKeyFile(t, app.Config.Storage.Encryption.KeyFile, "k2", "k1", "k2")
+	app.Storage.SetConfig(app.Config.Storage)
+
+	hash := getTestFileID("fourth", time.Now())
+	app.Storage.CreateFile(hash, bytes.NewBufferString("fourth"))
+
+	if keyID, _, _ := app.Redis.GetDataKey(hash); keyID != "k2" {
+		t.Errorf("Key id must be %s but got %s\n", "k2", keyID)
+	}
+
+	report, err := app.RotateKeys(context.Background())
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	if report.KeyID != "k2" || report.Checked != 4 || report.Rotated != 3 || report.Failed != 0 {
+		t.Errorf("Report must contain 3 rotated keys but got %+v\n", report)
+	}
+
+	// files are not rewritten, old master key is not required anymore
+	if data, _ := ioutil.ReadFile(path.Join(app.Config.Storage.Path, hashes[0][:2], hashes[0])); !bytes.Equal(data, stored) {
+		t.Error("Stored file must not be changed by rotation\n")
+	}
+
+	writeTestKeyFile(t, app.Config.Storage.Encryption.KeyFile, "k2", "k2")
+	app.Storage.SetConfig(app.Config.Storage)
+
+	for i, content := range []string{"first", "second", "third"} {
+		if data, err := readTestFile(app, hashes[i]); data != content || err != nil {
+			t.Errorf("Content must be %s but got %s, %v\n", content, data, err)
+		}
+	}
+
+	report, _ = app.RotateKeys(context.Background())
+	if report.Rotated != 0 {
+		t.Errorf("Rotated keys must be %d but got %d\n", 0, report.Rotated)
+	}
+}
+
+func TestHandlerDownloadEncrypted(t *testing.T) {
+	app := newEncryptionTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+	content := strings.Repeat("secret", 20)
+	hash := getTestFileID(content, now)
+
+	app.Storage.CreateFile(hash, bytes.NewBufferString(content))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: int64(len(content)), CreatedAt: &now})
+
+	h := NewHandler(app)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files/"+hash, nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Body.String() != content {
+		t.Errorf("Decrypted content must be sent but got %d, %s\n", w.Code, w.Body.String())
+	}
+
+	// corrupted chunk makes file corrupted
+	fileName := path.Join(app.Config.Storage.Path, hash[:2], hash)
+	data, _ := ioutil.ReadFile(fileName)
+	ioutil.WriteFile(fileName, flipByte(data, encryptedHeaderSize+1), 0644)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/files/"+hash, nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != 422 {
+		t.Errorf("Code must be %d but got %d\n", 422, w.Code)
+	}
+
+	app.wg.Wait()
+}
+
+func TestApplicationFsckEncryption(t *testing.T) {
+	app := newEncryptionTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+
+	valid := getTestFileID("valid", now)
+	app.Storage.CreateFile(valid, bytes.NewBufferString("valid"))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: valid, Size: 5, CreatedAt: &now})
+
+	// file without data key is skipped
+	nokey := getTestFileID("nokey", now)
+	app.Storage.CreateFile(nokey, bytes.NewBufferString("nokey"))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: nokey, Size: 5, CreatedAt: &now})
+
+	conn := app.Redis.Get()
+	conn.Do("HDEL", metaPrefix+nokey, "key_id", "data_key")
+	conn.Close()
+
+	report, err := app.Fsck(context.Background(), FsckOptions{})
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	if report.CheckedFiles != 2 || !report.Clean() {
+		t.Errorf("Report must be clean but got %+v\n", report)
+	}
+}
+
+func flipByte(data []byte, i int) []byte {
+	res := append([]byte{}, data...)
+	res[i] ^= 0xff
+
+	return res
+}
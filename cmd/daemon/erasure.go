@@ -0,0 +1,656 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+)
+
+// default size of block of shard, memory of encoding and decoding is (data shards + parity shards) * block size
+const defaultErasureBlockSize = 65536
+
+// shard starts with header: magic, version, index, data shards, parity shards, block size and size of file
+// each block of shard is followed by its crc32, so corrupted blocks are reconstructed from other shards
+const (
+	shardMagic      = "T2EC"
+	shardVersion    = 1
+	shardHeaderSize = 20
+)
+
+// errBadShard is returned if shard has invalid header
+var errBadShard = errors.New("Bad shard header")
+
+// ErasureConfig struct contains info about
+// - count of data shards and parity shards, file could be read if any data shards count of shards is valid
+// - directories of shards, one per shard, they should be on different disks or mounted backends
+// - size of block in bytes, default is 65536
+// erasure coding replaces storage path and could not be used with replication
+type ErasureConfig struct {
+	DataShards   int      `json:"data_shards"`
+	ParityShards int      `json:"parity_shards"`
+	Dirs         []string `json:"dirs"`
+	BlockSize    int      `json:"block_size"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *ErasureConfig) SetDefaults() {
+	if cfg.BlockSize == 0 {
+		cfg.BlockSize = defaultErasureBlockSize
+	}
+}
+
+// validateErasureConfig func adds problems of erasure config to errs
+func validateErasureConfig(errs *ValidationErrors, cfg *StorageConfig) {
+	e := cfg.Erasure
+	if e == nil {
+		return
+	}
+
+	// index and count of shards are stored in one byte of shard header
+	if e.DataShards < 1 || e.ParityShards < 0 || e.DataShards+e.ParityShards > 255 {
+		errs.Add("storage.erasure.data_shards", "must be positive, total count of shards must not exceed 255")
+	}
+
+	seen := map[string]bool{}
+
+	for _, dir := range e.Dirs {
+		if dir == "" || seen[path.Clean(dir)] {
+			errs.Add("storage.erasure.dirs", "must contain unique paths")
+			break
+		}
+
+		seen[path.Clean(dir)] = true
+	}
+
+	if len(e.Dirs) != e.DataShards+e.ParityShards {
+		errs.Add("storage.erasure.dirs", "must contain directory for each shard")
+	}
+
+	if e.BlockSize < 0 {
+		errs.Add("storage.erasure.block_size", "must not be negative")
+	}
+
+	if cfg.Replication != nil && len(cfg.Replication.Replicas) > 0 {
+		errs.Add("storage.erasure", "could not be used with replication")
+	}
+}
+
+// GetRoots method returns directories where files are stored: directories of shards or storage path
+func (cfg *StorageConfig) GetRoots() []string {
+	if cfg.Erasure != nil {
+		return cfg.Erasure.Dirs
+	}
+
+	return []string{cfg.Path}
+}
+
+type shardHeader struct {
+	Index        int
+	DataShards   int
+	ParityShards int
+	BlockSize    int
+	Size         int64
+}
+
+func (h shardHeader) bytes() []byte {
+	b := make([]byte, shardHeaderSize)
+
+	copy(b, shardMagic)
+	b[4] = shardVersion
+	b[5] = byte(h.Index)
+	b[6] = byte(h.DataShards)
+	b[7] = byte(h.ParityShards)
+	binary.BigEndian.PutUint32(b[8:], uint32(h.BlockSize))
+	binary.BigEndian.PutUint64(b[12:], uint64(h.Size))
+
+	return b
+}
+
+func readShardHeader(r io.Reader) (shardHeader, error) {
+	b := make([]byte, shardHeaderSize)
+
+	if _, err := io.ReadFull(r, b); err != nil {
+		return shardHeader{}, err
+	}
+
+	if string(b[:4]) != shardMagic || b[4] != shardVersion {
+		return shardHeader{}, errBadShard
+	}
+
+	return shardHeader{
+		Index:        int(b[5]),
+		DataShards:   int(b[6]),
+		ParityShards: int(b[7]),
+		BlockSize:    int(binary.BigEndian.Uint32(b[8:])),
+		Size:         int64(binary.BigEndian.Uint64(b[12:])),
+	}, nil
+}
+
+// createShards method splits file into shards, it returns total size of shards
+// all shards are written to temporary files first, so file appears only if all shards are saved
+func (s *Storage) createShards(hash string, r io.Reader) (int64, error) {
+	cfg := s.GetConfig().Erasure
+
+	rs, err := NewReedSolomon(cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return 0, err
+	}
+
+	w := &shardWriter{rs: rs, blockSize: cfg.BlockSize}
+	defer w.cleanup()
+
+	for i, dir := range cfg.Dirs {
+		folder := path.Join(dir, hash[:2])
+
+		if _, err := os.Stat(path.Join(folder, hash)); err == nil {
+			return 0, errFileExists
+		}
+
+		err := os.MkdirAll(folder, 0755)
+		if err != nil {
+			return 0, err
+		}
+
+		f, err := ioutil.TempFile(folder, "."+hash+".")
+		if err != nil {
+			return 0, err
+		}
+
+		w.files = append(w.files, f)
+		w.names = append(w.names, path.Join(folder, hash))
+
+		// header is rewritten when size of file is known
+		_, err = f.Write(shardHeader{Index: i}.bytes())
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	size, err := w.write(r)
+	if err != nil {
+		return 0, err
+	}
+
+	err = w.commit(shardHeader{DataShards: cfg.DataShards, ParityShards: cfg.ParityShards, BlockSize: cfg.BlockSize, Size: size})
+	if err != nil {
+		return 0, err
+	}
+
+	s.Logger.Debug("file created", "file_id", hash, "size", size, "shards", len(cfg.Dirs))
+
+	return w.total, nil
+}
+
+// shardWriter struct encodes stream to temporary files of shards
+type shardWriter struct {
+	rs        *ReedSolomon
+	blockSize int
+	files     []*os.File
+	names     []string
+	total     int64
+	committed bool
+}
+
+// write method encodes stream stripe by stripe and returns size of stream
+func (w *shardWriter) write(r io.Reader) (int64, error) {
+	k := w.rs.DataShards
+	bs := w.blockSize
+
+	data := make([]byte, k*bs)
+	shards := make([][]byte, len(w.files))
+
+	for i := range shards {
+		if i < k {
+			shards[i] = data[i*bs : (i+1)*bs]
+		} else {
+			shards[i] = make([]byte, bs)
+		}
+	}
+
+	writers := make([]*bufio.Writer, len(w.files))
+	for i, f := range w.files {
+		writers[i] = bufio.NewWriter(f)
+	}
+
+	var size int64
+	crc := make([]byte, 4)
+
+	for {
+		n, err := io.ReadFull(r, data)
+		if n == 0 && (err == io.EOF || err == io.ErrUnexpectedEOF) {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+
+		// the last stripe is padded with zeros
+		for x := n; x < len(data); x++ {
+			data[x] = 0
+		}
+
+		w.rs.Encode(shards)
+
+		for i, shard := range shards {
+			binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(shard))
+
+			if _, err := writers[i].Write(shard); err != nil {
+				return 0, err
+			}
+
+			if _, err := writers[i].Write(crc); err != nil {
+				return 0, err
+			}
+		}
+
+		size += int64(n)
+
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	for _, bw := range writers {
+		if err := bw.Flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return size, nil
+}
+
+// commit method writes headers and renames temporary files to shards
+func (w *shardWriter) commit(h shardHeader) error {
+	for i, f := range w.files {
+		h.Index = i
+
+		if _, err := f.WriteAt(h.bytes(), 0); err != nil {
+			return err
+		}
+
+		if err := f.Sync(); err != nil {
+			return err
+		}
+
+		info, err := f.Stat()
+		if err != nil {
+			return err
+		}
+
+		w.total += info.Size()
+	}
+
+	for i, f := range w.files {
+		f.Close()
+
+		if err := os.Rename(f.Name(), w.names[i]); err != nil {
+			// renamed shards are removed, file must not be partially saved
+			for _, name := range w.names[:i] {
+				os.Remove(name)
+			}
+
+			return err
+		}
+	}
+
+	w.committed = true
+
+	return nil
+}
+
+// cleanup method removes temporary files if shards have not been committed
+func (w *shardWriter) cleanup() {
+	if w.committed {
+		return
+	}
+
+	for _, f := range w.files {
+		f.Close()
+		os.Remove(f.Name())
+	}
+}
+
+// shardReader struct decodes file from its shards stripe by stripe
+// blocks of missing or corrupted shards are reconstructed, such shards are remembered as damaged
+type shardReader struct {
+	rs        *ReedSolomon
+	files     []*os.File
+	readers   []*bufio.Reader
+	blockSize int
+	size      int64
+	remaining int64
+
+	data    []byte
+	shards  [][]byte
+	valid   []bool
+	damaged []bool
+	buf     []byte
+}
+
+// openShards method returns reader of file from its shards
+// os.ErrNotExist is returned if there are no shards and errTooFewShards if there are less than data shards count of them
+func (s *Storage) openShards(hash string) (*shardReader, error) {
+	cfg := s.GetConfig().Erasure
+
+	rs, err := NewReedSolomon(cfg.DataShards, cfg.ParityShards)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(cfg.Dirs)
+	sr := &shardReader{
+		rs:      rs,
+		files:   make([]*os.File, n),
+		readers: make([]*bufio.Reader, n),
+		damaged: make([]bool, n),
+		valid:   make([]bool, n),
+	}
+
+	var header *shardHeader
+	found := 0
+
+	for i, dir := range cfg.Dirs {
+		f, err := os.Open(path.Join(dir, hash[:2], hash))
+		if err != nil {
+			sr.damaged[i] = true
+			continue
+		}
+
+		found++
+
+		h, err := readShardHeader(f)
+
+		// shards with different layout are not used
+		if err != nil || h.Index != i || h.DataShards != cfg.DataShards || h.ParityShards != cfg.ParityShards ||
+			h.BlockSize <= 0 || (header != nil && (h.BlockSize != header.BlockSize || h.Size != header.Size)) {
+			f.Close()
+			sr.damaged[i] = true
+			continue
+		}
+
+		if header == nil {
+			header = &h
+		}
+
+		sr.files[i] = f
+		sr.readers[i] = bufio.NewReader(f)
+	}
+
+	if found == 0 {
+		return nil, os.ErrNotExist
+	}
+
+	if header == nil || n-countTrue(sr.damaged) < cfg.DataShards {
+		sr.Close()
+		return nil, errTooFewShards
+	}
+
+	sr.blockSize = header.BlockSize
+	sr.size = header.Size
+	sr.remaining = header.Size
+	sr.data = make([]byte, cfg.DataShards*header.BlockSize)
+	sr.shards = make([][]byte, n)
+
+	for i := range sr.shards {
+		if i < cfg.DataShards {
+			sr.shards[i] = sr.data[i*header.BlockSize : (i+1)*header.BlockSize]
+		} else {
+			sr.shards[i] = make([]byte, header.BlockSize)
+		}
+	}
+
+	return sr, nil
+}
+
+// Read method
+func (sr *shardReader) Read(p []byte) (int, error) {
+	if len(sr.buf) == 0 {
+		if sr.remaining <= 0 {
+			return 0, io.EOF
+		}
+
+		if err := sr.readStripe(); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, sr.buf)
+	sr.buf = sr.buf[n:]
+
+	return n, nil
+}
+
+// readStripe method reads the next block of each shard and reconstructs invalid blocks
+func (sr *shardReader) readStripe() error {
+	crc := make([]byte, 4)
+
+	for i, r := range sr.readers {
+		sr.valid[i] = false
+
+		if r == nil {
+			continue
+		}
+
+		if _, err := io.ReadFull(r, sr.shards[i]); err != nil {
+			sr.damaged[i] = true
+			continue
+		}
+
+		if _, err := io.ReadFull(r, crc); err != nil || binary.BigEndian.Uint32(crc) != crc32.ChecksumIEEE(sr.shards[i]) {
+			sr.damaged[i] = true
+			continue
+		}
+
+		sr.valid[i] = true
+	}
+
+	if countTrue(sr.valid) < len(sr.valid) {
+		if err := sr.rs.Reconstruct(sr.shards, sr.valid); err != nil {
+			return err
+		}
+	}
+
+	n := int64(len(sr.data))
+	if n > sr.remaining {
+		n = sr.remaining
+	}
+
+	sr.buf = sr.data[:n]
+	sr.remaining -= n
+
+	return nil
+}
+
+// Close method
+func (sr *shardReader) Close() error {
+	for _, f := range sr.files {
+		if f != nil {
+			f.Close()
+		}
+	}
+
+	return nil
+}
+
+// Damaged method returns indexes of shards which are missing or have corrupted blocks
+// all blocks must be read before the call
+func (sr *shardReader) Damaged() []int {
+	var res []int
+
+	for i, v := range sr.damaged {
+		if v {
+			res = append(res, i)
+		}
+	}
+
+	return res
+}
+
+// rebuildShards method decodes file again and rewrites damaged shards
+func (s *Storage) rebuildShards(hash string, damaged []int) error {
+	cfg := s.GetConfig().Erasure
+
+	sr, err := s.openShards(hash)
+	if err != nil {
+		return err
+	}
+	defer sr.Close()
+
+	w := &shardWriter{rs: sr.rs, blockSize: sr.blockSize}
+	defer w.cleanup()
+
+	files := map[int]*bufio.Writer{}
+
+	for _, i := range damaged {
+		folder := path.Join(cfg.Dirs[i], hash[:2])
+
+		err := os.MkdirAll(folder, 0755)
+		if err != nil {
+			return err
+		}
+
+		f, err := ioutil.TempFile(folder, "."+hash+".")
+		if err != nil {
+			return err
+		}
+
+		w.files = append(w.files, f)
+		w.names = append(w.names, path.Join(folder, hash))
+
+		h := shardHeader{Index: i, DataShards: cfg.DataShards, ParityShards: cfg.ParityShards, BlockSize: sr.blockSize, Size: sr.size}
+		if _, err := f.Write(h.bytes()); err != nil {
+			return err
+		}
+
+		files[i] = bufio.NewWriter(f)
+	}
+
+	crc := make([]byte, 4)
+
+	for sr.remaining > 0 {
+		if err := sr.readStripe(); err != nil {
+			return err
+		}
+
+		// all blocks of rebuilt shards are written, even valid ones
+		for i, bw := range files {
+			binary.BigEndian.PutUint32(crc, crc32.ChecksumIEEE(sr.shards[i]))
+
+			if _, err := bw.Write(sr.shards[i]); err != nil {
+				return err
+			}
+
+			if _, err := bw.Write(crc); err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, bw := range files {
+		if err := bw.Flush(); err != nil {
+			return err
+		}
+	}
+
+	for _, f := range w.files {
+		if err := f.Sync(); err != nil {
+			return err
+		}
+
+		f.Close()
+	}
+
+	for i, f := range w.files {
+		if err := os.Rename(f.Name(), w.names[i]); err != nil {
+			return err
+		}
+	}
+
+	w.committed = true
+
+	s.Logger.Info("shards rebuilt", "file_id", hash, "shards", damaged)
+
+	return nil
+}
+
+// getShardsInfo method returns stat info of file with total size of its shards and the latest modification time
+func (s *Storage) getShardsInfo(hash string) (os.FileInfo, error) {
+	var res *shardsInfo
+
+	for _, dir := range s.GetConfig().Erasure.Dirs {
+		info, err := os.Stat(path.Join(dir, hash[:2], hash))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		if res == nil {
+			res = &shardsInfo{FileInfo: info}
+		} else if info.ModTime().After(res.ModTime()) {
+			res.FileInfo = info
+		}
+
+		res.size += info.Size()
+	}
+
+	if res == nil {
+		return nil, os.ErrNotExist
+	}
+
+	return res, nil
+}
+
+type shardsInfo struct {
+	os.FileInfo
+	size int64
+}
+
+// Size method
+func (i *shardsInfo) Size() int64 {
+	return i.size
+}
+
+// getShardNames func returns sorted union of file names from directories of shards
+func getShardNames(dirs []string, prefix string) ([]string, error) {
+	seen := map[string]bool{}
+
+	for _, dir := range dirs {
+		names, err := getFileNames(path.Join(dir, prefix))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+
+		for _, name := range names {
+			seen[name] = true
+		}
+	}
+
+	res := make([]string, 0, len(seen))
+	for name := range seen {
+		res = append(res, name)
+	}
+
+	sort.Strings(res)
+
+	return res, nil
+}
+
+func countTrue(values []bool) int {
+	n := 0
+
+	for _, v := range values {
+		if v {
+			n++
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newErasureTestApplication(t *testing.T) *Application {
+	app := newTrashTestApplication(t, &StorageConfig{})
+	app.Storage.Logger = app.Logger
+
+	dirs := []string{}
+	for _, name := range []string{"a", "b", "c", "d", "e"} {
+		dirs = append(dirs, path.Join(app.Config.Storage.Path, name))
+	}
+
+	app.Config.Storage.Erasure = &ErasureConfig{DataShards: 3, ParityShards: 2, Dirs: dirs, BlockSize: 16}
+
+	return app
+}
+
+func getShardName(app *Application, i int, hash string) string {
+	return path.Join(app.Config.Storage.Erasure.Dirs[i], hash[:2], hash)
+}
+
+func readTestFile(app *Application, hash string) (string, error) {
+	f, err := app.Storage.Open(hash)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	data, err := ioutil.ReadAll(f)
+
+	return string(data), err
+}
+
+func TestValidateErasureConfig(t *testing.T) {
+	cases := []struct {
+		cfg    *StorageConfig
+		fields []string
+	}{
+		{cfg: &StorageConfig{}, fields: []string{}},
+		{cfg: &StorageConfig{Erasure: &ErasureConfig{DataShards: 2, ParityShards: 1, Dirs: []string{"a", "b", "c"}}}, fields: []string{}},
+		{cfg: &StorageConfig{Erasure: &ErasureConfig{DataShards: 0, Dirs: []string{}}}, fields: []string{"storage.erasure.data_shards"}},
+		{cfg: &StorageConfig{Erasure: &ErasureConfig{DataShards: 200, ParityShards: 56}}, fields: []string{"storage.erasure.data_shards", "storage.erasure.dirs"}},
+		{cfg: &StorageConfig{Erasure: &ErasureConfig{DataShards: 1, ParityShards: 1, Dirs: []string{"a", "a/"}}}, fields: []string{"storage.erasure.dirs"}},
+		{cfg: &StorageConfig{Erasure: &ErasureConfig{DataShards: 2, ParityShards: 1, Dirs: []string{"a", "b"}}}, fields: []string{"storage.erasure.dirs"}},
+		{cfg: &StorageConfig{Erasure: &ErasureConfig{DataShards: 1, Dirs: []string{"a"}, BlockSize: -1}}, fields: []string{"storage.erasure.block_size"}},
+		{
+			cfg:    &StorageConfig{Erasure: &ErasureConfig{DataShards: 1, Dirs: []string{"a"}}, Replication: &ReplicationConfig{Replicas: []string{"b"}}},
+			fields: []string{"storage.erasure"},
+		},
+	}
+
+	for _, tc := range cases {
+		errs := ValidationErrors{}
+		validateErasureConfig(&errs, tc.cfg)
+
+		fields := []string{}
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+
+		if len(fields) != len(tc.fields) || (len(fields) > 0 && fields[0] != tc.fields[0]) {
+			t.Errorf("Errors for %v must be %v but got %v\n", tc.cfg.Erasure, tc.fields, fields)
+		}
+	}
+}
+
+func TestStorageErasure(t *testing.T) {
+	app := newErasureTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	// content takes several stripes, the last one is padded
+	content := strings.Repeat("0123456789", 10)
+	hash := getTestFileID(content, time.Now())
+
+	size, err := app.Storage.CreateFile(hash, bytes.NewBufferString(content))
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	// 3 stripes of 5 blocks with crc and 5 headers
+	if expected := int64(5*shardHeaderSize + 3*5*(16+4)); size != expected {
+		t.Errorf("Size must be %d but got %d\n", expected, size)
+	}
+
+	if v, _ := app.Storage.GetFileSize(hash); v != size {
+		t.Errorf("Size of file must be %d but got %d\n", size, v)
+	}
+
+	if _, err := app.Storage.CreateFile(hash, bytes.NewBufferString(content)); err != errFileExists {
+		t.Errorf("Error must be %v but got %v\n", errFileExists, err)
+	}
+
+	// any 3 shards are enough
+	os.Remove(getShardName(app, 0, hash))
+	os.Remove(getShardName(app, 3, hash))
+
+	data, err := readTestFile(app, hash)
+	if data != content || err != nil {
+		t.Errorf("Content must be %s but got %s, %v\n", content, data, err)
+	}
+
+	// the third lost shard makes file unreadable
+	ioutil.WriteFile(getShardName(app, 1, hash), []byte("corrupted"), 0644)
+
+	_, err = readTestFile(app, hash)
+	if err != errTooFewShards {
+		t.Errorf("Error must be %v but got %v\n", errTooFewShards, err)
+	}
+
+	ok, err := app.Storage.RemoveFile(hash)
+	if !ok || err != nil {
+		t.Errorf("Removed flag must be %v but got %v, %v\n", true, ok, err)
+	}
+
+	if _, err := app.Storage.Open(hash); !os.IsNotExist(err) {
+		t.Errorf("Error must be %v but got %v\n", os.ErrNotExist, err)
+	}
+}
+
+func TestStorageVerifyFileErasure(t *testing.T) {
+	app := newErasureTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	content := strings.Repeat("0123456789", 10)
+	hash := getTestFileID(content, time.Now())
+
+	app.Storage.CreateFile(hash, bytes.NewBufferString(content))
+
+	original, _ := ioutil.ReadFile(getShardName(app, 2, hash))
+
+	// block of the second stripe is corrupted and parity shard is lost
+	corrupted := append([]byte{}, original...)
+	corrupted[shardHeaderSize+20+3] ^= 0xff
+	ioutil.WriteFile(getShardName(app, 2, hash), corrupted, 0644)
+	os.Remove(getShardName(app, 4, hash))
+
+	sum, n, damaged, err := app.Storage.VerifyFile(hash, newThrottle(context.Background(), 0))
+	if sum != strings.Split(hash, "-")[0] || n != 100 || err != nil {
+		t.Errorf("Sum must be valid but got %s, %d, %v\n", sum, n, err)
+	}
+
+	if len(damaged) != 2 || damaged[0] != 2 || damaged[1] != 4 {
+		t.Errorf("Damaged shards must be %v but got %v\n", []int{2, 4}, damaged)
+	}
+
+	err = app.Storage.RebuildFile(hash, damaged)
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	}
+
+	if data, _ := ioutil.ReadFile(getShardName(app, 2, hash)); !bytes.Equal(data, original) {
+		t.Error("Corrupted shard must be rebuilt\n")
+	}
+
+	_, _, damaged, _ = app.Storage.VerifyFile(hash, newThrottle(context.Background(), 0))
+	if len(damaged) != 0 {
+		t.Errorf("Damaged shards must be empty but got %v\n", damaged)
+	}
+}
+
+func TestStorageTrashFileErasure(t *testing.T) {
+	app := newErasureTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	hash := getTestFileID("valid", time.Now())
+	app.Storage.CreateFile(hash, bytes.NewBufferString("valid"))
+
+	ok, err := app.Storage.TrashFile(hash)
+	if !ok || err != nil {
+		t.Errorf("Trashed flag must be %v but got %v, %v\n", true, ok, err)
+	}
+
+	for i := range app.Config.Storage.Erasure.Dirs {
+		if _, err := os.Stat(getShardName(app, i, hash)); !os.IsNotExist(err) {
+			t.Errorf("Shard %d must be moved to trash\n", i)
+		}
+	}
+
+	ok, err = app.Storage.RestoreFile(hash)
+	if !ok || err != nil {
+		t.Errorf("Restored flag must be %v but got %v, %v\n", true, ok, err)
+	}
+
+	if data, err := readTestFile(app, hash); data != "valid" || err != nil {
+		t.Errorf("Content must be %s but got %s, %v\n", "valid", data, err)
+	}
+}
+
+func TestApplicationFsckErasure(t *testing.T) {
+	app := newErasureTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+
+	valid := getTestFileID("valid", now)
+	app.Storage.CreateFile(valid, bytes.NewBufferString("valid"))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: valid, Size: 5, CreatedAt: &now})
+
+	lost := getTestFileID("lost", now)
+	app.Storage.CreateFile(lost, bytes.NewBufferString("lost"))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: lost, Size: 4, CreatedAt: &now})
+
+	os.Remove(getShardName(app, 0, valid))
+
+	for i := 0; i < 3; i++ {
+		os.Remove(getShardName(app, i, lost))
+	}
+
+	report, err := app.Fsck(context.Background(), FsckOptions{})
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	if report.CheckedFiles != 2 || report.Damaged != 1 || report.Corrupted != 1 || report.Repaired != 1 {
+		t.Errorf("Report must contain damaged shards and corrupted file but got %+v\n", report)
+	}
+
+	if _, err := os.Stat(getShardName(app, 0, valid)); err != nil {
+		t.Errorf("Shard must be rebuilt but got %v\n", err)
+	}
+
+	if _, err := os.Stat(path.Join(app.Config.Storage.Erasure.Dirs[4], quarantineDir, lost[:2], lost)); err != nil {
+		t.Errorf("Shards of corrupted file must be moved to quarantine but got %v\n", err)
+	}
+}
+
+func TestHandlerDownloadErasure(t *testing.T) {
+	app := newErasureTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+	hash := getTestFileID("valid", now)
+
+	app.Storage.CreateFile(hash, bytes.NewBufferString("valid"))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: 5, CreatedAt: &now})
+
+	os.Remove(getShardName(app, 1, hash))
+
+	h := NewHandler(app)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files/"+hash, nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Body.String() != "valid" {
+		t.Errorf("File must be decoded from shards but got %d, %s\n", w.Code, w.Body.String())
+	}
+
+	app.wg.Wait()
+}
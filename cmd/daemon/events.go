@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// redis channel of storage events
+const eventsChannel = "EVENTS"
+
+// types of events
+const (
+	eventFileQuarantined = "file_quarantined"
+	eventFileRepaired    = "file_repaired"
+)
+
+// Event struct describes change of stored file, events are published to redis channel
+type Event struct {
+	Type   string    `json:"type"`
+	FileID string    `json:"file_id"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// PublishEvent method publishes event to events channel
+func (r *Redis) PublishEvent(event *Event) error {
+	data, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("PUBLISH", eventsChannel, data)
+
+	return err
+}
+
+// emitEvent method logs and publishes event, error of publishing is only logged
+func (app *Application) emitEvent(event *Event) {
+	app.Logger.Info("event", "component", "events", "type", event.Type, "file_id", event.FileID, "reason", event.Reason)
+
+	err := app.Redis.PublishEvent(event)
+	if err != nil {
+		app.Logger.Error("could not publish event", "component", "events", "type", event.Type, "error", err)
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRedisPublishEvent(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	conn := redis.PubSubConn{Conn: r.Get()}
+	defer conn.Close()
+
+	err := conn.Subscribe(eventsChannel)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	// subscription confirmation
+	conn.Receive()
+
+	now := time.Unix(1515151515, 0).UTC()
+
+	err = r.PublishEvent(&Event{Type: eventFileQuarantined, FileID: "example", Reason: "checksum", Time: now})
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	msg, ok := conn.Receive().(redis.Message)
+	if !ok {
+		t.Error("Message must be received\n")
+		return
+	}
+
+	event := Event{}
+	json.Unmarshal(msg.Data, &event)
+
+	expected := Event{Type: eventFileQuarantined, FileID: "example", Reason: "checksum", Time: now}
+	if event != expected {
+		t.Errorf("Event must be %v but got %v\n", expected, event)
+	}
+}
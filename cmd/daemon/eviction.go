@@ -0,0 +1,128 @@
+package main
+
+import (
+	"errors"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// eviction policies
+const (
+	// all-time download count, new files are evicted first
+	policyLFU = "lfu"
+	// download count which halves every half life
+	policyLFUDecay = "lfu_decay"
+	// last access (upload or download) time
+	policyLRU = "lru"
+	// greedy dual size frequency: small and popular files are kept
+	policyGDSF = "gdsf"
+	// creation time, the oldest files are evicted first
+	policyTTL = "ttl"
+)
+
+// default half life of downloads for lfu_decay policy is one day
+const defaultHalfLife = 86400
+
+var evictionPolicyKeys = map[string]string{
+	policyLFU:      scoreKey,
+	policyLFUDecay: decayKey,
+	policyLRU:      accessKey,
+	policyGDSF:     gdsfKey,
+	policyTTL:      createdKey,
+}
+
+// EvictionConfig struct contains info about
+// - policy which chooses files for eviction when storage limit is reached: lfu (default), lfu_decay, lru, gdsf, ttl
+// - half life of downloads in seconds for lfu_decay policy, default is 86400
+// - max age of files in seconds, older files are evicted even if limit is not reached (0 - disabled)
+// - grace period in seconds, files uploaded during this period are not evicted by limit (0 - disabled)
+type EvictionConfig struct {
+	Policy      string `json:"policy"`
+	HalfLife    int    `json:"half_life"`
+	MaxAge      int    `json:"max_age"`
+	GracePeriod int    `json:"grace_period"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *EvictionConfig) SetDefaults() {
+	if cfg.Policy == "" {
+		cfg.Policy = policyLFU
+	}
+
+	if cfg.HalfLife == 0 {
+		cfg.HalfLife = defaultHalfLife
+	}
+}
+
+// GetEviction method returns eviction config, default one is returned if it's not set
+func (cfg *StorageConfig) GetEviction() *EvictionConfig {
+	if cfg.Eviction != nil {
+		return cfg.Eviction
+	}
+
+	v := &EvictionConfig{}
+	v.SetDefaults()
+
+	return v
+}
+
+// EvictionPolicy interface chooses files for eviction
+type EvictionPolicy interface {
+	// Candidates method returns files ordered by eviction priority
+	Candidates(offset, count int) ([]string, error)
+	// Evicted method sends changes of policy state to transaction which removes metadata of evicted file,
+	// so they are applied only if file is removed by holder of autoclean lock
+	Evicted(conn redis.Conn, hash string) error
+}
+
+// sortedSetPolicy struct evicts files with the lowest scores in redis sorted set
+type sortedSetPolicy struct {
+	redis *Redis
+	key   string
+}
+
+// Candidates method
+func (p *sortedSetPolicy) Candidates(offset, count int) ([]string, error) {
+	return p.redis.GetEvictionCandidates(p.key, offset, count)
+}
+
+// Evicted method
+func (p *sortedSetPolicy) Evicted(conn redis.Conn, hash string) error {
+	return nil
+}
+
+// gdsfPolicy struct is sortedSetPolicy which ages remaining files by raising inflation on eviction
+type gdsfPolicy struct {
+	sortedSetPolicy
+}
+
+// Evicted method
+func (p *gdsfPolicy) Evicted(conn redis.Conn, hash string) error {
+	return inflationScript.Send(conn, gdsfKey, inflationKey, hash)
+}
+
+// NewEvictionPolicy func returns EvictionPolicy for policy name
+func NewEvictionPolicy(name string, r *Redis) (EvictionPolicy, error) {
+	key, ok := evictionPolicyKeys[name]
+	if !ok {
+		return nil, errors.New("Unknown eviction policy " + name)
+	}
+
+	p := sortedSetPolicy{redis: r, key: key}
+
+	if name == policyGDSF {
+		return &gdsfPolicy{sortedSetPolicy: p}, nil
+	}
+
+	return &p, nil
+}
+
+// getHalfLife func returns half life of downloads as duration
+func getHalfLife(cfg *EvictionConfig) time.Duration {
+	if cfg.HalfLife <= 0 {
+		return defaultHalfLife * time.Second
+	}
+
+	return time.Duration(cfg.HalfLife) * time.Second
+}
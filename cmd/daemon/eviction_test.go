@@ -0,0 +1,69 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewEvictionPolicy(t *testing.T) {
+	cases := []struct {
+		name string
+		key  string
+		gdsf bool
+		err  bool
+	}{
+		{name: "lfu", key: scoreKey},
+		{name: "lfu_decay", key: decayKey},
+		{name: "lru", key: accessKey},
+		{name: "ttl", key: createdKey},
+		{name: "gdsf", key: gdsfKey, gdsf: true},
+		{name: "example", err: true},
+	}
+
+	for _, tc := range cases {
+		p, err := NewEvictionPolicy(tc.name, &Redis{})
+
+		if tc.err {
+			if err == nil {
+				t.Errorf("Error must not be nil for %s\n", tc.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		if v, ok := p.(*gdsfPolicy); ok != tc.gdsf || (ok && v.key != tc.key) {
+			t.Errorf("Unexpected policy %#v for %s\n", p, tc.name)
+		}
+
+		if v, ok := p.(*sortedSetPolicy); ok && v.key != tc.key {
+			t.Errorf("Key must be %s but got %s\n", tc.key, v.key)
+		}
+	}
+}
+
+func TestStorageConfigGetEviction(t *testing.T) {
+	cfg := &StorageConfig{}
+
+	v := cfg.GetEviction()
+	if v.Policy != "lfu" || v.HalfLife != 86400 {
+		t.Errorf("Unexpected default eviction config %#v\n", v)
+	}
+
+	cfg.Eviction = &EvictionConfig{Policy: "lru", MaxAge: 10}
+
+	if v := cfg.GetEviction(); v != cfg.Eviction {
+		t.Errorf("Eviction config must be %#v but got %#v\n", cfg.Eviction, v)
+	}
+
+	if v := getHalfLife(cfg.Eviction); v != 24*time.Hour {
+		t.Errorf("Half life must be %v but got %v\n", 24*time.Hour, v)
+	}
+
+	if v := getHalfLife(&EvictionConfig{HalfLife: 60}); v != time.Minute {
+		t.Errorf("Half life must be %v but got %v\n", time.Minute, v)
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"time"
+)
+
+// default interval of expired files reaping
+const defaultReapInterval = 60
+
+var (
+	// errBadExpiry is returned for invalid expiry of uploaded file
+	errBadExpiry = errors.New("Expiry must be positive expires_in or future expires_at")
+	// errTTLTooLong is returned if requested expiry exceeds max ttl
+	errTTLTooLong = errors.New("Expiry exceeds max ttl")
+)
+
+// ExpiryConfig struct contains info about
+// - max ttl of files in seconds, files without expiry get it too (0 - no limit), it could be reduced for principal
+// - interval of expired files reaping in seconds, default is 60
+type ExpiryConfig struct {
+	MaxTTL       int `json:"max_ttl"`
+	ReapInterval int `json:"reap_interval"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *ExpiryConfig) SetDefaults() {
+	if cfg.ReapInterval == 0 {
+		cfg.ReapInterval = defaultReapInterval
+	}
+}
+
+// GetExpiry method returns expiry config, default one is returned if it's not set
+func (cfg *StorageConfig) GetExpiry() *ExpiryConfig {
+	if cfg.Expiry != nil {
+		return cfg.Expiry
+	}
+
+	v := &ExpiryConfig{}
+	v.SetDefaults()
+
+	return v
+}
+
+// validateExpiryConfig func adds problems of expiry config to errs
+func validateExpiryConfig(errs *ValidationErrors, cfg *ExpiryConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if cfg.MaxTTL < 0 {
+		errs.Add("storage.expiry.max_ttl", "must not be negative")
+	}
+
+	if cfg.ReapInterval < 0 {
+		errs.Add("storage.expiry.reap_interval", "must not be negative")
+	}
+}
+
+// getMaxTTL func returns the smallest of global and principal max ttl, 0 means no limit
+func getMaxTTL(cfg *Config, principal string) time.Duration {
+	maxTTL := cfg.Storage.GetExpiry().MaxTTL
+
+	if p := cfg.Auth.GetPrincipal(principal); p != nil && p.MaxTTL > 0 && (maxTTL == 0 || p.MaxTTL < maxTTL) {
+		maxTTL = p.MaxTTL
+	}
+
+	return time.Duration(maxTTL) * time.Second
+}
+
+// getExpiresAt func returns expiry of uploaded file from expires_in (seconds) or expires_at (unix time or RFC 3339)
+// file without expiry gets max ttl, nil is returned if file never expires
+func getExpiresAt(expiresIn, expiresAt string, maxTTL time.Duration, now time.Time) (*time.Time, error) {
+	var t time.Time
+
+	switch {
+	case expiresIn != "" && expiresAt != "":
+		return nil, errBadExpiry
+	case expiresIn != "":
+		n, err := strconv.ParseInt(expiresIn, 10, 64)
+		if err != nil || n <= 0 {
+			return nil, errBadExpiry
+		}
+
+		t = now.Add(time.Duration(n) * time.Second)
+	case expiresAt != "":
+		if n, err := strconv.ParseInt(expiresAt, 10, 64); err == nil {
+			t = time.Unix(n, 0)
+		} else if v, err := time.Parse(time.RFC3339, expiresAt); err == nil {
+			t = v
+		} else {
+			return nil, errBadExpiry
+		}
+
+		if !t.After(now) {
+			return nil, errBadExpiry
+		}
+	case maxTTL > 0:
+		t = now.Add(maxTTL)
+	default:
+		return nil, nil
+	}
+
+	if maxTTL > 0 && t.Sub(now) > maxTTL {
+		return nil, errTTLTooLong
+	}
+
+	t = t.UTC()
+
+	return &t, nil
+}
+
+// ReapExpired method removes files which have expired before t and returns count of files and bytes
+// expired files are not moved to trash
+func (app *Application) ReapExpired(t time.Time) (int, int64, error) {
+	var count int
+	var total int64
+
+	for {
+		hashes, err := app.Redis.GetExpiredFiles(t, 20)
+		if err != nil {
+			return count, total, err
+		} else if len(hashes) == 0 {
+			break
+		}
+
+		for _, hash := range hashes {
+			size, ok, err := app.reapFile(hash, t)
+			if err != nil {
+				return count, total, err
+			}
+
+			if ok {
+				count++
+				total += size
+			}
+		}
+	}
+
+	return count, total, nil
+}
+
+// reapFile method removes expired file, metadata is removed even if file does not exist
+func (app *Application) reapFile(hash string, t time.Time) (int64, bool, error) {
+	size, err := app.Storage.GetFileSize(hash)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, false, err
+	}
+
+	deleted, err := app.Storage.RemoveFile(hash)
+	if err != nil {
+		return 0, false, err
+	}
+
+	err = app.Redis.MarkFileAsDeleted(hash, &t)
+	if err != nil {
+		return 0, false, err
+	}
+
+	if !deleted {
+		return 0, false, nil
+	}
+
+	err = app.AddUsage(-size)
+	if err != nil {
+		return size, true, err
+	}
+
+	app.Metrics.ExpiredFiles.Inc()
+
+	return size, true, nil
+}
+
+// RunReapExpired method removes expired files periodically until application is shut down
+func (app *Application) RunReapExpired() {
+	app.Go(func() {
+		for {
+			interval := time.Duration(app.GetConfig().Storage.GetExpiry().ReapInterval) * time.Second
+			if interval <= 0 {
+				interval = defaultReapInterval * time.Second
+			}
+
+			timer := time.NewTimer(interval)
+
+			select {
+			case <-app.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			count, size, err := app.ReapExpired(time.Now())
+			if err != nil {
+				app.Logger.Error("could not reap expired files", "component", "expiry", "error", err)
+			} else if count > 0 {
+				app.Logger.Info("expired files removed", "component", "expiry", "files", count, "bytes", size)
+			}
+		}
+	})
+}
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestGetExpiresAt(t *testing.T) {
+	now := time.Date(2018, time.March, 14, 10, 0, 0, 0, time.UTC)
+	hour := now.Add(time.Hour)
+
+	cases := []struct {
+		expiresIn string
+		expiresAt string
+		maxTTL    time.Duration
+		expected  *time.Time
+		err       error
+	}{
+		{},
+		{expiresIn: "3600", expected: &hour},
+		{expiresAt: "1521025200", expected: &hour},
+		{expiresAt: "2018-03-14T11:00:00Z", expected: &hour},
+		{expiresAt: "2018-03-14T12:00:00+01:00", expected: &hour},
+		// max ttl is applied to files without expiry
+		{maxTTL: time.Hour, expected: &hour},
+		{expiresIn: "3600", maxTTL: time.Hour, expected: &hour},
+		{expiresIn: "3601", maxTTL: time.Hour, err: errTTLTooLong},
+		{expiresIn: "0", err: errBadExpiry},
+		{expiresIn: "example", err: errBadExpiry},
+		{expiresAt: "example", err: errBadExpiry},
+		{expiresAt: "1521021600", err: errBadExpiry},
+		{expiresIn: "60", expiresAt: "1521025200", err: errBadExpiry},
+	}
+
+	for _, tc := range cases {
+		expiresAt, err := getExpiresAt(tc.expiresIn, tc.expiresAt, tc.maxTTL, now)
+		if err != tc.err {
+			t.Errorf("Error must be %v but got %v\n", tc.err, err)
+		}
+
+		if !reflect.DeepEqual(expiresAt, tc.expected) {
+			t.Errorf("Expiry must be %v but got %v\n", tc.expected, expiresAt)
+		}
+	}
+}
+
+func TestGetMaxTTL(t *testing.T) {
+	cases := []struct {
+		global    int
+		principal int
+		expected  time.Duration
+	}{
+		{},
+		{global: 60, expected: time.Minute},
+		{principal: 60, expected: time.Minute},
+		{global: 60, principal: 120, expected: time.Minute},
+		{global: 120, principal: 60, expected: time.Minute},
+	}
+
+	for _, tc := range cases {
+		cfg := &Config{
+			Storage: &StorageConfig{Expiry: &ExpiryConfig{MaxTTL: tc.global}},
+			Auth: &AuthConfig{
+				Principals: map[string]*PrincipalConfig{
+					"example": &PrincipalConfig{MaxTTL: tc.principal},
+				},
+			},
+		}
+
+		maxTTL := getMaxTTL(cfg, "example")
+		if maxTTL != tc.expected {
+			t.Errorf("Max ttl must be %v but got %v\n", tc.expected, maxTTL)
+		}
+
+		// principal without config uses global max ttl
+		maxTTL = getMaxTTL(cfg, anonymousPrincipal)
+		if maxTTL != time.Duration(tc.global)*time.Second {
+			t.Errorf("Max ttl must be %v but got %v\n", time.Duration(tc.global)*time.Second, maxTTL)
+		}
+	}
+}
+
+func TestApplicationReapExpired(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.ReconcileUsage()
+
+	now := time.Now()
+	expired := now.Add(-time.Minute)
+	future := now.Add(time.Hour)
+
+	for hash, expiresAt := range map[string]*time.Time{"example1": &expired, "example2": &future, "example3": nil} {
+		createTrashTestFile(app, hash, 10, now)
+		app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: 10, CreatedAt: &now, ExpiresAt: expiresAt})
+	}
+
+	count, size, err := app.ReapExpired(now)
+	if count != 1 || size != 10 || err != nil {
+		t.Errorf("One file must be reaped but got %d, %d, %v\n", count, size, err)
+	}
+
+	if _, ok := app.Storage.GetFile("example1"); ok {
+		t.Error("Expired file must be removed\n")
+	}
+
+	for _, hash := range []string{"example2", "example3"} {
+		if _, ok := app.Storage.GetFile(hash); !ok {
+			t.Errorf("File %s must not be removed\n", hash)
+		}
+	}
+
+	usage, _, _ := app.Redis.GetUsage()
+	if usage != 20 {
+		t.Errorf("Usage must be %d but got %d\n", 20, usage)
+	}
+
+	// expiry index is cleaned
+	hashes, _ := app.Redis.GetExpiredFiles(now.Add(2*time.Hour), 10)
+	if !reflect.DeepEqual(hashes, []string{"example2"}) {
+		t.Errorf("Expiring files must be %v but got %v\n", []string{"example2"}, hashes)
+	}
+}
+
+func TestHandlerDownloadExpiredFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	app := newAutoCleanTestApp(dir, &StorageConfig{})
+	app.Config.Auth = nil
+
+	expired := time.Now().Add(-time.Minute)
+	created := expired.Add(-time.Hour)
+	app.Redis.SaveFileMeta(&FileMeta{Hash: "example1", Size: 10, CreatedAt: &created, ExpiresAt: &expired})
+
+	h := NewHandler(app)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files/example1", nil)
+
+	h.ServeHTTP(w, r)
+
+	if w.Code != 410 {
+		t.Errorf("Code must be %d but got %d\n", 410, w.Code)
+	}
+
+	errResp := ErrorResponse{}
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+
+	if errResp.Error != "FILE_EXPIRED" {
+		t.Errorf("Error message must be %v but got %v\n", "FILE_EXPIRED", errResp.Error)
+	}
+}
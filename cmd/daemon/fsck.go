@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redis key of scrub lock, only one node of cluster scrubs storage at once
+const scrubLockKey = "SCRUB_LOCK"
+
+// default interval between scrubs is one day
+const defaultScrubInterval = 86400
+
+// default i/o rate of scrub is 10 MB/s
+const defaultScrubRate = 10485760
+
+// files which are younger are not reported as orphans, their metadata could be not saved yet
+const fsckGracePeriod = time.Minute
+
+// problems found by fsck
+const (
+	// content doesn't match sha256 from file id, file is moved to quarantine
+	problemCorrupted = "corrupted"
+	// file exists on disk, but it has no metadata
+	problemOrphan = "orphan"
+	// metadata exists, but file is missing on disk
+	problemMissing = "missing"
+	// some shards of erasure coded file are missing or corrupted, they are rebuilt from valid ones
+	problemDamagedShards = "damaged_shards"
+)
+
+// ScrubConfig struct contains info about
+// - enabled flag of background scrub
+// - interval between scrubs in seconds, default is 86400
+// - i/o rate in bytes per second, default is 10485760
+// - repair flag, metadata of orphans is recreated and metadata of missing files is removed
+type ScrubConfig struct {
+	Enabled  bool  `json:"enabled"`
+	Interval int   `json:"interval"`
+	Rate     int64 `json:"rate"`
+	Repair   bool  `json:"repair"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *ScrubConfig) SetDefaults() {
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultScrubInterval
+	}
+
+	if cfg.Rate == 0 {
+		cfg.Rate = defaultScrubRate
+	}
+}
+
+// validateScrubConfig func adds problems of scrub config to errs
+func validateScrubConfig(errs *ValidationErrors, cfg *ScrubConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if cfg.Interval < 0 {
+		errs.Add("scrub.interval", "must not be negative")
+	}
+
+	if cfg.Rate < 0 {
+		errs.Add("scrub.rate", "must not be negative")
+	}
+}
+
+// FsckOptions struct contains i/o rate in bytes per second (0 - no limit) and repair flag
+type FsckOptions struct {
+	Rate   int64
+	Repair bool
+}
+
+// FsckReport struct describes storage check
+type FsckReport struct {
+	StartedAt    time.Time   `json:"started_at"`
+	FinishedAt   time.Time   `json:"finished_at"`
+	Result       string      `json:"result"`
+	Error        string      `json:"error,omitempty"`
+	Repair       bool        `json:"repair"`
+	CheckedFiles int         `json:"checked_files"`
+	CheckedBytes int64       `json:"checked_bytes"`
+	Corrupted    int         `json:"corrupted"`
+	Orphans      int         `json:"orphans"`
+	Missing      int         `json:"missing"`
+	Damaged      int         `json:"damaged_shards"`
+	Repaired     int         `json:"repaired"`
+	Issues       []FsckIssue `json:"issues"`
+	Truncated    bool        `json:"truncated"`
+}
+
+// FsckIssue struct describes problem of file
+type FsckIssue struct {
+	FileID   string `json:"file_id"`
+	Problem  string `json:"problem"`
+	Repaired bool   `json:"repaired"`
+}
+
+// add method adds issue to report
+func (r *FsckReport) add(issue FsckIssue) {
+	switch issue.Problem {
+	case problemCorrupted:
+		r.Corrupted++
+	case problemOrphan:
+		r.Orphans++
+	case problemMissing:
+		r.Missing++
+	case problemDamagedShards:
+		r.Damaged++
+	}
+
+	if issue.Repaired {
+		r.Repaired++
+	}
+
+	if len(r.Issues) >= maxReportFiles {
+		r.Truncated = true
+		return
+	}
+
+	r.Issues = append(r.Issues, issue)
+}
+
+// Clean method returns true if there are no problems which are not repaired
+// corrupted files which could not be repaired stay in quarantine
+func (r *FsckReport) Clean() bool {
+	return r.Corrupted+r.Orphans+r.Missing+r.Damaged-r.Repaired == 0
+}
+
+// Fsck method verifies content of stored files and reconciles metadata with disk
+// corrupted files are moved to quarantine, orphans and missing files are repaired only with repair option
+func (app *Application) Fsck(ctx context.Context, opts FsckOptions) (*FsckReport, error) {
+	report := &FsckReport{
+		StartedAt: time.Now().UTC(),
+		Repair:    opts.Repair,
+		Issues:    []FsckIssue{},
+	}
+
+	err := app.fsck(ctx, opts, report)
+
+	report.FinishedAt = time.Now().UTC()
+	report.Result = "success"
+
+	if err != nil {
+		report.Result = "error"
+		report.Error = err.Error()
+
+		if err == context.Canceled {
+			report.Result = "canceled"
+		}
+	}
+
+	for _, issue := range report.Issues {
+		app.Metrics.ScrubIssues.Inc(issue.Problem)
+	}
+
+	return report, err
+}
+
+func (app *Application) fsck(ctx context.Context, opts FsckOptions, report *FsckReport) error {
+	throttle := newThrottle(ctx, opts.Rate)
+
+	err := app.Storage.WalkFiles(func(names []string) error {
+		for len(names) > 0 {
+			n := 100
+			if n > len(names) {
+				n = len(names)
+			}
+
+			err := app.fsckFiles(ctx, names[:n], throttle, opts, report)
+			if err != nil {
+				return err
+			}
+
+			names = names[n:]
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return app.fsckMeta(ctx, opts, report)
+}
+
+// fsckFiles method checks content and metadata of files
+func (app *Application) fsckFiles(ctx context.Context, names []string, throttle *throttle, opts FsckOptions, report *FsckReport) error {
+	hasMeta, err := app.Redis.HasFileMeta(names)
+	if err != nil {
+		return err
+	}
+
+	for i, name := range names {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		info, err := app.Storage.StatFile(name)
+		if os.IsNotExist(err) {
+			// file has been removed during check
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		report.CheckedFiles++
+
+		// files with ids without hash are not verified
+		if expected := strings.Split(name, "-")[0]; isSHA256(expected) {
+			sum, n, damaged, err := app.Storage.VerifyFile(name, throttle)
+			report.CheckedBytes += n
+
+			if os.IsNotExist(err) {
+				continue
+			} else if isKeyError(err) {
+				// file could not be decrypted without its key, it's not verified
+				app.Logger.Error("could not get data key", "component", "fsck", "file_id", name, "error", err)
+				continue
+			} else if err != nil && err != errTooFewShards {
+				return err
+			}
+
+			if sum != expected {
+				_, err = app.QuarantineFile(name, "fsck", time.Now())
+				if err != nil {
+					return err
+				}
+
+				app.Logger.Warn("corrupted file found", "component", "fsck", "file_id", name)
+
+				// corrupted file is repaired from sources regardless of repair option, it's the same file
+				healed, err := app.HealFile(name)
+				if err != nil {
+					return err
+				}
+
+				report.add(FsckIssue{FileID: name, Problem: problemCorrupted, Repaired: healed})
+
+				continue
+			}
+
+			// shards are rebuilt regardless of repair option, file content is valid
+			if len(damaged) > 0 {
+				app.Logger.Warn("damaged shards found", "component", "fsck", "file_id", name, "shards", damaged)
+
+				err = app.Storage.RebuildFile(name, damaged)
+				if err != nil {
+					app.Logger.Error("could not rebuild shards", "component", "fsck", "file_id", name, "error", err)
+				} else {
+					app.Metrics.RebuiltShards.Add(float64(len(damaged)))
+				}
+
+				report.add(FsckIssue{FileID: name, Problem: problemDamagedShards, Repaired: err == nil})
+
+				// size of shards is changed
+				if info, err = app.Storage.StatFile(name); err != nil {
+					return err
+				}
+			}
+		}
+
+		if hasMeta[i] || time.Since(info.ModTime()) < fsckGracePeriod {
+			continue
+		}
+
+		issue := FsckIssue{FileID: name, Problem: problemOrphan}
+
+		if opts.Repair {
+			err = app.repairOrphan(name, info)
+			if err != nil {
+				return err
+			}
+
+			issue.Repaired = true
+		}
+
+		report.add(issue)
+	}
+
+	return nil
+}
+
+// fsckMeta method finds metadata of files which are missing on disk
+func (app *Application) fsckMeta(ctx context.Context, opts FsckOptions, report *FsckReport) error {
+	offset := 0
+
+	for {
+		hashes, err := app.Redis.GetLiveFiles(offset, 100)
+		if err != nil {
+			return err
+		} else if len(hashes) == 0 {
+			return nil
+		}
+
+		for _, hash := range hashes {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+
+			// files of other nodes are checked by their owners
+			if _, remote := app.getOwner(hash); remote {
+				offset++
+				continue
+			}
+
+			// file which exists in replica is restored by re-replication
+			if _, ok := app.Storage.FindFile(hash); ok {
+				offset++
+				continue
+			}
+
+			issue := FsckIssue{FileID: hash, Problem: problemMissing}
+
+			if opts.Repair {
+				// file is removed from index, so offset is not changed
+				now := time.Now()
+
+				err = app.Redis.MarkFileAsDeleted(hash, &now)
+				if err != nil {
+					return err
+				}
+
+				issue.Repaired = true
+			} else {
+				offset++
+			}
+
+			report.add(issue)
+		}
+	}
+}
+
+// repairOrphan method recreates metadata of file from its id and stat info
+func (app *Application) repairOrphan(hash string, info os.FileInfo) error {
+	createdAt := info.ModTime()
+
+	// id contains time of upload
+	if parts := strings.Split(hash, "-"); len(parts) > 1 {
+		if v, err := strconv.ParseInt(parts[1], 10, 64); err == nil {
+			createdAt = time.Unix(v, 0)
+		}
+	}
+
+	err := app.Redis.RepairFileMeta(&FileMeta{
+		Hash:      hash,
+		Size:      info.Size(),
+		CreatedAt: &createdAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	app.Logger.Info("metadata of orphan file recreated", "component", "fsck", "file_id", hash)
+
+	err = app.recordEncoding(hash, nil)
+	if err != nil {
+		return err
+	}
+
+	return app.Redis.RecordAccess(hash, info.ModTime(), getHalfLife(app.GetConfig().Storage.GetEviction()))
+}
+
+// Scrub method checks storage under scrub lock and saves report, nil report is returned if scrub is running on another node
+func (app *Application) Scrub() (*FsckReport, error) {
+	cfg := app.GetConfig()
+	logger := app.Logger.With("component", "scrub")
+
+	lock, err := app.Redis.AcquireLock(app.Redis.nodeKey(scrubLockKey), getLockTTL(cfg.AutoClean))
+	if err != nil {
+		app.Metrics.ScrubRuns.Inc("error")
+		return nil, err
+	} else if lock == nil {
+		app.Metrics.ScrubRuns.Inc("skipped")
+		logger.Debug("scrub is in progress on another node")
+		return nil, nil
+	}
+	defer lock.Release()
+
+	scrub := cfg.Scrub
+	if scrub == nil {
+		scrub = &ScrubConfig{}
+		scrub.SetDefaults()
+	}
+
+	// scrub is stopped on shutdown or when lease is lost
+	ctx, cancel := context.WithCancel(app.ctx)
+
+	renewed := make(chan struct{})
+	go func() {
+		lock.KeepAlive(ctx, cancel)
+		close(renewed)
+	}()
+
+	report, err := app.Fsck(ctx, FsckOptions{Rate: scrub.Rate, Repair: scrub.Repair})
+
+	cancel()
+	<-renewed
+
+	app.Metrics.ScrubRuns.Inc(report.Result)
+
+	if err != nil {
+		logger.Error("scrub failed", "error", err)
+	} else {
+		logger.Info("scrub finished", "files", report.CheckedFiles, "bytes", report.CheckedBytes,
+			"corrupted", report.Corrupted, "orphans", report.Orphans, "missing", report.Missing, "damaged_shards", report.Damaged,
+			"repaired", report.Repaired)
+	}
+
+	if e := app.Redis.SaveScrubReport(report); e != nil {
+		logger.Error("could not save scrub report", "error", e)
+	}
+
+	return report, err
+}
+
+// RunScrub method scrubs storage periodically until application is shut down
+// scrub config is read before each run, so it could be enabled by reload
+func (app *Application) RunScrub() {
+	app.Go(func() {
+		for {
+			interval := time.Duration(defaultScrubInterval) * time.Second
+			if cfg := app.GetConfig().Scrub; cfg != nil && cfg.Interval > 0 {
+				interval = time.Duration(cfg.Interval) * time.Second
+			}
+
+			timer := time.NewTimer(interval)
+
+			select {
+			case <-app.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if cfg := app.GetConfig().Scrub; cfg != nil && cfg.Enabled {
+				app.Scrub()
+			}
+		}
+	})
+}
+
+// throttle struct limits i/o rate of all readers of one run
+type throttle struct {
+	ctx   context.Context
+	rate  int64
+	start time.Time
+	bytes int64
+}
+
+// newThrottle func returns throttle pointer, rate is in bytes per second (0 - no limit)
+func newThrottle(ctx context.Context, rate int64) *throttle {
+	return &throttle{
+		ctx:   ctx,
+		rate:  rate,
+		start: time.Now(),
+	}
+}
+
+// wait method sleeps until average rate is below limit
+func (t *throttle) wait(n int) error {
+	t.bytes += int64(n)
+
+	if t.rate <= 0 {
+		return t.ctx.Err()
+	}
+
+	expected := time.Duration(float64(t.bytes) / float64(t.rate) * float64(time.Second))
+
+	d := expected - time.Since(t.start)
+	if d <= 0 {
+		return t.ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-t.ctx.Done():
+		return t.ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// throttledReader struct waits for throttle after each read and counts read bytes
+type throttledReader struct {
+	r io.Reader
+	t *throttle
+	n int64
+}
+
+// Read method
+func (r *throttledReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+
+	if e := r.t.wait(n); e != nil {
+		return n, e
+	}
+
+	return n, err
+}
+
+// isSHA256 func returns true for hex encoded sha256
+func isSHA256(v string) bool {
+	if len(v) != sha256.Size*2 {
+		return false
+	}
+
+	_, err := hex.DecodeString(v)
+
+	return err == nil
+}
+
+// getFileNames func returns names of files in directory
+func getFileNames(dirPath string) ([]string, error) {
+	d, err := os.Open(dirPath)
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	items, err := d.Readdir(-1)
+	if err != nil {
+		return nil, err
+	}
+
+	res := []string{}
+
+	for _, item := range items {
+		// temporary files of copies start with dot
+		if !item.IsDir() && !strings.HasPrefix(item.Name(), ".") {
+			res = append(res, item.Name())
+		}
+	}
+
+	return res, nil
+}
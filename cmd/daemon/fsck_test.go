@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func getTestFileID(content string, t time.Time) string {
+	sum := sha256.Sum256([]byte(content))
+
+	return hex.EncodeToString(sum[:]) + "-" + strconv.FormatInt(t.Unix(), 10) + "-1"
+}
+
+func newFsckTestApplication(t *testing.T) (*Application, map[string]string) {
+	app := newTrashTestApplication(t, &StorageConfig{})
+	app.ReconcileUsage()
+
+	now := time.Now()
+	old := now.Add(-time.Hour)
+
+	ids := map[string]string{
+		"valid":     getTestFileID("valid", old),
+		"corrupted": getTestFileID("example", old),
+		"orphan":    getTestFileID("orphan", old),
+		"recent":    getTestFileID("recent", now),
+		"missing":   getTestFileID("missing", old),
+	}
+
+	createTrashTestFile(app, ids["valid"], 0, old)
+	createTrashTestFile(app, ids["corrupted"], 0, old)
+	createTrashTestFile(app, ids["missing"], 0, old)
+	createTrashTestFile(app, "example", 3, old)
+
+	// content is written after creation, so files have the right content
+	for name, content := range map[string]string{"valid": "valid", "corrupted": "corrupted"} {
+		ioutil.WriteFile(path.Join(app.Config.Storage.Path, ids[name][:2], ids[name]), []byte(content), 0644)
+	}
+
+	app.Storage.CreateFile(ids["orphan"], bytes.NewBuffer([]byte("orphan")))
+	os.Chtimes(path.Join(app.Config.Storage.Path, ids["orphan"][:2], ids["orphan"]), old, old)
+
+	// recent file could be uploaded right now, its metadata is not saved yet
+	app.Storage.CreateFile(ids["recent"], bytes.NewBuffer([]byte("recent")))
+
+	app.Storage.RemoveFile(ids["missing"])
+
+	return app, ids
+}
+
+func getFsckIssues(report *FsckReport) map[string]string {
+	res := map[string]string{}
+	for _, issue := range report.Issues {
+		res[issue.FileID] = issue.Problem
+	}
+
+	return res
+}
+
+func TestApplicationFsck(t *testing.T) {
+	app, ids := newFsckTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	report, err := app.Fsck(context.Background(), FsckOptions{})
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	expected := map[string]string{
+		ids["corrupted"]: problemCorrupted,
+		ids["orphan"]:    problemOrphan,
+		ids["missing"]:   problemMissing,
+	}
+
+	if issues := getFsckIssues(report); !reflect.DeepEqual(issues, expected) {
+		t.Errorf("Issues must be %v but got %v\n", expected, issues)
+	}
+
+	if report.CheckedFiles != 5 || report.Repaired != 0 || report.Clean() || report.Result != "success" {
+		t.Errorf("Unexpected report %#v\n", report)
+	}
+
+	// corrupted file is quarantined
+	if _, ok := app.Storage.GetFile(ids["corrupted"]); ok {
+		t.Error("Corrupted file must be moved to quarantine\n")
+	}
+
+	quarantined, _ := app.Redis.GetQuarantinedFiles(0, 10)
+	if !reflect.DeepEqual(quarantined, []string{ids["corrupted"]}) {
+		t.Errorf("Quarantine must be %v but got %v\n", []string{ids["corrupted"]}, quarantined)
+	}
+
+	report, _ = app.Fsck(context.Background(), FsckOptions{Repair: true})
+
+	if report.Orphans != 1 || report.Missing != 1 || report.Repaired != 2 || !report.Clean() {
+		t.Errorf("Problems must be repaired but got %#v\n", report)
+	}
+
+	report, _ = app.Fsck(context.Background(), FsckOptions{})
+	if len(report.Issues) != 0 {
+		t.Errorf("Storage must be clean but got %v\n", report.Issues)
+	}
+
+	// orphan gets metadata with time of upload from id
+	times, _ := app.Redis.GetCreatedTimes([]string{ids["orphan"]})
+	if times[0] != time.Now().Add(-time.Hour).Unix() && times[0] != time.Now().Add(-time.Hour).Unix()-1 {
+		t.Errorf("Created time must be taken from id but got %d\n", times[0])
+	}
+}
+
+func TestApplicationFsckCanceled(t *testing.T) {
+	app, _ := newFsckTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	report, err := app.Fsck(ctx, FsckOptions{})
+	if err != context.Canceled || report.Result != "canceled" {
+		t.Errorf("Fsck must be canceled but got %v, %v\n", err, report.Result)
+	}
+}
+
+func TestApplicationScrub(t *testing.T) {
+	app, _ := newFsckTestApplication(t)
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.Config.Auth = &AuthConfig{
+		Principals: map[string]*PrincipalConfig{
+			anonymousPrincipal: &PrincipalConfig{Actions: []string{"admin"}},
+		},
+	}
+
+	h := NewHandler(app)
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/admin/scrub/report", nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != 404 {
+		t.Errorf("Code must be %d but got %d\n", 404, w.Code)
+	}
+
+	report, err := app.Scrub()
+	if err != nil || report == nil || report.Corrupted != 1 {
+		t.Errorf("Scrub must find corrupted file but got %#v, %v\n", report, err)
+	}
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Code must be %d but got %d\n", 200, w.Code)
+	}
+
+	// scrub is running on another node
+	lock, _ := app.Redis.AcquireLock(scrubLockKey, time.Minute)
+	defer lock.Release()
+
+	report, err = app.Scrub()
+	if report != nil || err != nil {
+		t.Errorf("Scrub must be skipped but got %#v, %v\n", report, err)
+	}
+}
+
+func TestThrottle(t *testing.T) {
+	th := newThrottle(context.Background(), 10000)
+
+	start := time.Now()
+	th.wait(1000)
+
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("Throttle must wait about %v but got %v\n", 100*time.Millisecond, d)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	th = newThrottle(ctx, 1)
+	if err := th.wait(1000); err != context.Canceled {
+		t.Errorf("Error must be %v but got %v\n", context.Canceled, err)
+	}
+
+	th = newThrottle(context.Background(), 0)
+	if err := th.wait(1000); err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+}
+
+func TestIsSHA256(t *testing.T) {
+	cases := []struct {
+		value    string
+		expected bool
+	}{
+		{value: "b4373779db9de9f4782f1d878c5468b24c2d8110d3b322602c0322f486223f0c", expected: true},
+		{value: "b4373779db9de9f4782f1d878c5468b24c2d8110d3b322602c0322f486223f0", expected: false},
+		{value: "x4373779db9de9f4782f1d878c5468b24c2d8110d3b322602c0322f486223f0c", expected: false},
+		{value: "example", expected: false},
+	}
+
+	for _, tc := range cases {
+		if v := isSHA256(tc.value); v != tc.expected {
+			t.Errorf("Result for %s must be %v but got %v\n", tc.value, tc.expected, v)
+		}
+	}
+}
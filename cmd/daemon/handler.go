@@ -1,10 +1,14 @@
 package main
 
 import (
-	"bytes"
+	"bufio"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"io"
-	"io/ioutil"
 	"math/rand"
 	"net/http"
 	"os"
@@ -13,125 +17,309 @@ import (
 	"time"
 )
 
+// maxUploadMemory is count of bytes of multipart form which are kept in memory, the rest is written to temporary files
+const maxUploadMemory = 1 << 20
+
+// downloadBufferSize is count of bytes of downloaded file which are checked before response is sent
+const downloadBufferSize = 64 << 10
+
+// errCorruptedResponse is returned if file is corrupted and its content has been partially sent
+var errCorruptedResponse = errors.New("Corrupted content has been partially sent")
+
 // ErrorResponse struct
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Error   string   `json:"error"`
+	Details []string `json:"details,omitempty"`
 }
 
 // UploadResponse struct
 type UploadResponse struct {
-	Hash string `json:"hash"`
+	Hash      string     `json:"hash"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 // Handler struct
 type Handler struct {
-	App *Application
+	App       *Application
+	Logger    *Logger
+	AccessLog *Logger
 }
 
-// ServeHTTP method is application router
+// ServeHTTP method assigns request id, collects request metrics, writes access log and calls router
 func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// requests which have been accepted after shutdown start could find redis pool closed
+	if !h.App.StartRequest() {
+		h.renderError(w, http.StatusServiceUnavailable, "SHUTTING_DOWN")
+		return
+	}
+	defer h.App.FinishRequest()
+
+	start := time.Now()
 	pathParts := getPathParts(r.URL.Path)
-	// for simplicity we don't check ip from headers (X-FORWARDED-FOR, X-REAL-IP)
-	ip := strings.Split(r.RemoteAddr, ":")[0]
+	action := getAction(r.Method, pathParts)
+
+	info := &requestInfo{
+		ID:        getRequestID(r),
+		Limit:     "allowed",
+		Principal: getPrincipal(r, h.App.GetConfig().TLS),
+	}
+
+	// request proxied by another node of cluster has been authorized there
+	if h.isClusterRequest(r) && r.Header.Get(clusterPrincipalHeader) != "" {
+		info.Principal = r.Header.Get(clusterPrincipalHeader)
+	}
+
+	if action != "upload" && len(pathParts) > 1 {
+		info.FileID = pathParts[1]
+	}
+
+	r = withRequestInfo(r, info)
+	w.Header().Set(requestIDHeader, info.ID)
+
+	sw := &statusWriter{ResponseWriter: w}
+
+	body := &countingReader{}
+	if r.Body != nil {
+		body.ReadCloser = r.Body
+		r.Body = body
+	}
+
+	h.route(sw, r, pathParts)
+
+	duration := time.Since(start)
+	status := strconv.Itoa(sw.Status())
+
+	h.App.Metrics.Requests.Inc(action, status)
+	h.App.Metrics.RequestDuration.Observe(duration.Seconds(), action, status)
+	h.App.Metrics.BytesIn.Add(float64(body.count), action)
+	h.App.Metrics.BytesOut.Add(float64(sw.count), action)
+
+	h.AccessLog.Info("request",
+		"request_id", info.ID,
+		"method", r.Method,
+		"path", r.URL.Path,
+		"file_id", info.FileID,
+		"ip", getIP(r),
+		"principal", info.Principal,
+		"status", sw.Status(),
+		"bytes_in", body.count,
+		"bytes_out", sw.count,
+		"duration", duration,
+		"limit", info.Limit,
+	)
+
+	// connection is broken, so client does not take partially sent content as complete one
+	if info.Aborted {
+		panic(http.ErrAbortHandler)
+	}
+}
 
+// rps limits of file actions
+var rpsBuckets = map[string]string{
+	"download": "download",
+	listAction: "download",
+	"upload":   "upload",
+	"meta":     "upload",
+	"remove":   "remove",
+	"restore":  "remove",
+}
+
+// getRateLimit method returns current rate limit, requests forwarded by another node of cluster
+// have been limited there, so they are not limited again
+func (h *Handler) getRateLimit(r *http.Request) *RateLimit {
+	if h.isClusterRequest(r) {
+		return NewRateLimit(nil)
+	}
+
+	return h.App.GetRateLimit()
+}
+
+// route method is application router
+func (h *Handler) route(w http.ResponseWriter, r *http.Request, pathParts []string) {
 	l := len(pathParts)
 
-	if l < 1 || pathParts[0] != "files" || l > 2 {
+	if r.Method == "GET" && l == 1 && pathParts[0] == "metrics" {
+		h.renderMetrics(w)
+		return
+	}
+
+	if r.Method == "GET" && l == 1 && pathParts[0] == "healthz" {
+		h.renderJSON(w, http.StatusOK, HealthResponse{Status: "ok"})
+		return
+	}
+
+	if r.Method == "GET" && l == 1 && pathParts[0] == "readyz" {
+		h.readiness(w)
+		return
+	}
+
+	if l > 0 && pathParts[0] == "admin" {
+		h.admin(w, r, pathParts)
+		return
+	}
+
+	if l > 0 && pathParts[0] == "cluster" {
+		h.cluster(w, r, pathParts)
+		return
+	}
+
+	if l < 1 || pathParts[0] != "files" || l > 3 || (l == 3 && pathParts[2] != "restore" && pathParts[2] != "meta") {
 		// not found
 		h.renderError(w, http.StatusNotFound, "NOT_FOUND")
 		return
 	}
 
+	principal := getRequestInfo(r).Principal
+
+	action := getAction(r.Method, pathParts)
+
+	if action != "not_found" && !h.App.GetConfig().Auth.Authorize(principal, action) {
+		h.renderError(w, http.StatusForbidden, "FORBIDDEN")
+		return
+	}
+
+	// rate limit could be replaced by reload, connection must be released by the same one
+	rateLimit := h.getRateLimit(r)
+
+	// rate limits are applied per principal if client is authenticated by certificate or per ip
+	key := getLimitKey(principal, getIP(r))
+
 	// check connections limit
-	allowed := h.App.RateLimit.AddConnection(ip)
-	defer h.App.RateLimit.RemoveConnection(ip)
+	allowed := rateLimit.AddConnection(key)
+	defer rateLimit.RemoveConnection(key)
 
 	if !allowed {
-		h.renderError(w, http.StatusTooManyRequests, "TOO_MANY_REQUESTS")
+		h.rejectByLimit(w, r, "connections", http.StatusTooManyRequests, "TOO_MANY_REQUESTS")
 		return
 	}
 
-	// file download
-	if r.Method == "GET" && l == 2 {
-		// check rps
-		if !h.App.RateLimit.CheckRPS("download") {
-			h.renderError(w, http.StatusTooManyRequests, "TOO_MANY_REQUESTS")
-			return
-		}
-
-		h.downloadFile(w, r, ip, pathParts[1])
+	bucket, ok := rpsBuckets[action]
+	if !ok {
+		// not found
+		h.renderError(w, http.StatusNotFound, "NOT_FOUND")
 		return
 	}
 
-	// file upload
-	if r.Method == "POST" && l == 1 {
-		// check rps
-		if !h.App.RateLimit.CheckRPS("upload") {
-			h.renderError(w, http.StatusTooManyRequests, "TOO_MANY_REQUESTS")
-			return
-		}
+	// check rps
+	if !rateLimit.CheckRPS(bucket) {
+		h.rejectByLimit(w, r, "rps", http.StatusTooManyRequests, "TOO_MANY_REQUESTS")
+		return
+	}
 
-		h.uploadFile(w, r, ip)
+	// request for file of another node of cluster, it's limited by this node
+	if l > 1 && h.forwardToOwner(w, r, key, pathParts[1]) {
 		return
 	}
 
-	// file removing
-	if r.Method == "DELETE" && l == 2 {
-		// check rps
-		if !h.App.RateLimit.CheckRPS("remove") {
-			h.renderError(w, http.StatusTooManyRequests, "TOO_MANY_REQUESTS")
+	switch action {
+	case "download":
+		if r.Method == "HEAD" {
+			h.headFile(w, r, pathParts[1])
 			return
 		}
 
+		h.downloadFile(w, r, key, pathParts[1])
+	case listAction:
+		h.listFiles(w, r)
+	case "upload":
+		h.uploadFile(w, r, key)
+	case "remove":
 		h.removeFile(w, r, pathParts[1])
-		return
+	case "restore":
+		h.restoreFile(w, r, pathParts[1])
+	case "meta":
+		h.updateFileMeta(w, r, pathParts[1])
 	}
-
-	// here we can handle some other routes if we would need
-
-	// not found
-	h.renderError(w, http.StatusNotFound, "NOT_FOUND")
 }
 
-func (h *Handler) uploadFile(w http.ResponseWriter, r *http.Request, ip string) {
+func (h *Handler) uploadFile(w http.ResponseWriter, r *http.Request, limitKey string) {
+	maxSize := h.App.GetConfig().Storage.MaxSize
+
 	// tell client that request is too large. it prevents file upload
-	if r.ContentLength > h.App.Config.Storage.MaxSize {
+	if r.ContentLength > maxSize {
 		h.renderError(w, http.StatusExpectationFailed, "REQUEST_TOO_LARGE")
 		return
 	}
 
-	if !h.App.RateLimit.CheckBandwidth("upload", ip, r.ContentLength) {
-		h.renderError(w, http.StatusForbidden, "BYTE_LIMIT_REACHED")
+	if !h.getRateLimit(r).CheckBandwidth("upload", limitKey, r.ContentLength) {
+		h.rejectByLimit(w, r, "bandwidth", http.StatusForbidden, "BYTE_LIMIT_REACHED")
 		return
 	}
 
-	r.Body = http.MaxBytesReader(w, r.Body, h.App.Config.Storage.MaxSize)
+	r.Body = http.MaxBytesReader(w, r.Body, maxSize)
 
-	err := r.ParseMultipartForm(h.App.Config.Storage.MaxSize)
+	// large file is kept in temporary file, so it's not loaded to memory
+	err := r.ParseMultipartForm(maxUploadMemory)
 	if err != nil {
 		h.renderError(w, http.StatusBadRequest, "BAD_REQUEST")
 		return
 	}
 
-	f, _, err := r.FormFile("file")
+	f, fileHeader, err := r.FormFile("file")
 	if err != nil {
 		h.renderError(w, http.StatusBadRequest, "BAD_FILE")
 		return
 	}
 	defer f.Close()
 
-	bytesData, err := ioutil.ReadAll(f)
+	// custom metadata is sent in headers
+	userMeta, err := getUserMeta(r.Header)
+	if err == errUserMetaTooLarge {
+		h.renderError(w, http.StatusBadRequest, "META_TOO_LARGE")
+		return
+	} else if err != nil {
+		h.renderError(w, http.StatusBadRequest, "BAD_META")
+		return
+	}
+
+	// tags are sent as comma separated list, files are listed by them
+	tags, err := getTags(r.FormValue("tags"))
 	if err != nil {
-		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		h.renderError(w, http.StatusBadRequest, "BAD_TAGS")
+		return
+	}
+
+	// file is encrypted by client key if it's sent
+	clientKey, err := getClientKey(r)
+	if err != nil {
+		h.renderError(w, http.StatusBadRequest, "BAD_ENCRYPTION_KEY")
+		return
+	}
+
+	// file expiry is limited by max ttl of principal
+	maxTTL := getMaxTTL(h.App.GetConfig(), getRequestInfo(r).Principal)
+
+	expiresAt, err := getExpiresAt(r.FormValue("expires_in"), r.FormValue("expires_at"), maxTTL, time.Now())
+	if err == errTTLTooLong {
+		h.renderError(w, http.StatusBadRequest, "TTL_TOO_LONG")
+		return
+	} else if err != nil {
+		h.renderError(w, http.StatusBadRequest, "BAD_EXPIRY")
 		return
 	}
 
-	hash, err := getSHA256Sum(bytes.NewBuffer(bytesData))
+	// checksums are calculated in one pass, sha1 and md5 only if they have been sent
+	sha256Sum := sha256.New()
+	sums := []io.Writer{sha256Sum}
+
+	sha1Hash, sha1Sum := r.FormValue("sha1"), sha1.New()
+	if sha1Hash != "" {
+		sums = append(sums, sha1Sum)
+	}
+
+	md5Hash, md5Sum := r.FormValue("md5"), md5.New()
+	if md5Hash != "" {
+		sums = append(sums, md5Sum)
+	}
+
+	_, err = io.Copy(io.MultiWriter(sums...), f)
 	if err != nil {
 		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
 		return
 	}
 
+	hash := hex.EncodeToString(sha256Sum.Sum(nil))
+
 	// check hashes
 	sha256Hash := r.FormValue("sha256")
 	if sha256Hash != "" && sha256Hash != hash {
@@ -140,33 +328,24 @@ func (h *Handler) uploadFile(w http.ResponseWriter, r *http.Request, ip string)
 	}
 
 	// check sha1 hash if it has been sent
-	sha1Hash := r.FormValue("sha1")
-	if sha1Hash != "" {
-		fileHash, err := getSHA1Sum(bytes.NewBuffer(bytesData))
-		if err != nil {
-			h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
-			return
-		}
-
-		if fileHash != sha1Hash {
-			h.renderError(w, http.StatusBadRequest, "BAD_SHA1")
-			return
-		}
+	if sha1Hash != "" && hex.EncodeToString(sha1Sum.Sum(nil)) != sha1Hash {
+		h.renderError(w, http.StatusBadRequest, "BAD_SHA1")
+		return
 	}
 
 	// check md5 hash if it has been sent
-	md5Hash := r.FormValue("md5")
-	if md5Hash != "" {
-		fileHash, err := getMd5Sum(bytes.NewBuffer(bytesData))
-		if err != nil {
-			h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
-			return
-		}
+	if md5Hash != "" && hex.EncodeToString(md5Sum.Sum(nil)) != md5Hash {
+		h.renderError(w, http.StatusBadRequest, "BAD_MD5")
+		return
+	}
 
-		if fileHash != md5Hash {
-			h.renderError(w, http.StatusBadRequest, "BAD_MD5")
-			return
-		}
+	// content type declared in form is used if it's specific, both types are checked by allow and deny lists
+	detected := detectContentTypeAt(f, fileHeader.Size)
+	contentType := getContentType(fileHeader.Header.Get("Content-Type"), detected)
+
+	if !isAllowedType(h.App.GetConfig(), getRequestInfo(r).Principal, contentType, detected) {
+		h.renderError(w, http.StatusUnsupportedMediaType, "CONTENT_TYPE_NOT_ALLOWED")
+		return
 	}
 
 	// make hash unique
@@ -174,89 +353,358 @@ func (h *Handler) uploadFile(w http.ResponseWriter, r *http.Request, ip string)
 
 	// @todo place precallback here
 
-	size, err := h.App.Storage.CreateFile(uniqHash, bytes.NewBuffer(bytesData))
+	// file is saved by its owner in cluster mode
+	_, err = f.Seek(0, io.SeekStart)
 	if err != nil {
 		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
 		return
 	}
 
+	size, err := h.App.StoreFile(uniqHash, f, fileHeader.Size, clientKey)
+	if err == errQuorumNotReached {
+		h.renderError(w, http.StatusServiceUnavailable, "WRITE_QUORUM_NOT_REACHED")
+		return
+	} else if err == errNodeUnavailable {
+		h.renderError(w, http.StatusBadGateway, "NODE_UNAVAILABLE")
+		return
+	} else if err != nil {
+		h.requestLogger(r).Error("could not create file", "file_id", uniqHash, "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
 	createdAt := time.Now()
 
+	var fingerprint string
+	if clientKey != nil {
+		fingerprint = getKeyFingerprint(uniqHash, clientKey)
+	}
+
 	// @todo place postcallback here
 
+	getRequestInfo(r).FileID = uniqHash
+	logger := h.requestLogger(r)
+
+	// principal which has uploaded file is its owner in listing
+	owner := getRequestInfo(r).Principal
+
+	halfLife := getHalfLife(h.App.GetConfig().Storage.GetEviction())
+
 	// save meta data to redis
-	go h.App.Redis.SaveFileMeta(&FileMeta{
-		Hash:      hash,
-		Size:      size,
-		CreatedAt: &createdAt,
-	})
+	ok := h.App.Go(func() {
+		err := h.App.Redis.SaveFileMeta(&FileMeta{
+			Hash:           uniqHash,
+			Size:           size,
+			CreatedAt:      &createdAt,
+			ExpiresAt:      expiresAt,
+			KeyFingerprint: fingerprint,
+			Filename:       sanitizeFilename(fileHeader.Filename),
+			ContentType:    contentType,
+			UserMeta:       userMeta,
+			Owner:          owner,
+			Tags:           tags,
+		})
+		if err != nil {
+			logger.Error("could not save file meta", "file_id", uniqHash, "error", err)
+			return
+		}
 
-	// render response
-	data := UploadResponse{Hash: uniqHash}
+		// upload is the first access of file
+		err = h.App.Redis.RecordAccess(uniqHash, createdAt, halfLife)
+		if err != nil {
+			logger.Error("could not update eviction scores", "file_id", uniqHash, "error", err)
+		}
+	})
 
-	res, err := json.Marshal(data)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	// meta data is not saved on shutdown, so file is not reported as uploaded
+	if !ok {
+		h.renderError(w, http.StatusServiceUnavailable, "SHUTTING_DOWN")
 		return
 	}
 
-	w.Header().Set("Content-type", "application/json")
-	w.WriteHeader(http.StatusOK)
-	w.Write(res)
+	// render response
+	h.renderJSON(w, http.StatusOK, UploadResponse{Hash: uniqHash, ExpiresAt: expiresAt})
 }
 
-func (h *Handler) downloadFile(w http.ResponseWriter, r *http.Request, ip, hash string) {
-	fileName, ok := h.App.Storage.GetFile(hash)
-	if !ok {
-		// file not found
-		h.renderError(w, http.StatusNotFound, "FILE_NOT_FOUND")
+func (h *Handler) downloadFile(w http.ResponseWriter, r *http.Request, limitKey, hash string) {
+	// file encrypted by client key is available only with the same key
+	clientKey, code, message := h.checkClientKey(r, hash)
+	if code != 0 {
+		h.renderError(w, code, message)
 		return
 	}
 
-	f, err := os.Open(fileName)
-	if err != nil {
+	// file is read from replica if it's missing in storage, it's decoded from shards in erasure mode and decrypted
+	f, encoding, err := h.App.Storage.OpenStored(hash, clientKey)
+	if os.IsNotExist(err) {
+		h.renderMissingFile(w, r, hash)
+		return
+	} else if err != nil && err != errTooFewShards && !isCorruptedContent(err) {
+		h.requestLogger(r).Error("could not open file", "file_id", hash, "error", err)
 		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
 		return
 	}
-	defer f.Close()
 
-	bytesData, err := ioutil.ReadAll(f)
+	if f != nil {
+		defer f.Close()
+	}
+
+	// expired file is not available even if it has not been reaped yet
+	expiresAt, err := h.App.Redis.GetExpiresAt(hash)
 	if err != nil {
+		h.requestLogger(r).Error("could not get file expiry", "file_id", hash, "error", err)
 		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
 		return
 	}
 
-	if !h.App.RateLimit.CheckBandwidth("download", ip, int64(len(bytesData))) {
-		h.renderError(w, http.StatusForbidden, "BYTE_LIMIT_REACHED")
+	if expiresAt != nil && !time.Now().Before(*expiresAt) {
+		h.renderError(w, http.StatusGone, "FILE_EXPIRED")
 		return
 	}
 
-	hashSHA256, err := getSHA256Sum(bytes.NewBuffer(bytesData))
-	if err != nil {
-		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+	// content is not read before it's sent, so bandwidth is checked by size of stored file
+	storedSize, _ := h.App.Storage.GetFileSize(hash)
+
+	if !h.getRateLimit(r).CheckBandwidth("download", limitKey, storedSize) {
+		h.rejectByLimit(w, r, "bandwidth", http.StatusForbidden, "BYTE_LIMIT_REACHED")
 		return
 	}
 
-	if strings.Split(hash, "-")[0] != hashSHA256 {
-		// file is corrupted
-		// maybe we should remove this file?
-		h.renderError(w, http.StatusUnprocessableEntity, "FILE_IS_CORRUPTED")
+	logger := h.requestLogger(r)
+
+	// original filename, content type and custom metadata are optional
+	meta, err := h.App.Redis.GetFileMeta(hash)
+	if err != nil {
+		logger.Error("could not get file meta", "file_id", hash, "error", err)
+	}
+
+	if meta == nil {
+		meta = &FileMeta{Hash: hash}
+	}
+
+	// content type of file without metadata is detected, so it's checked before it's sent inline
+	if meta.ContentType == "" && f != nil {
+		head, _ := h.App.Storage.ReadHead(hash, clientKey, sniffLen)
+		meta.ContentType = detectContentType(head)
+	}
+
+	// compressed content is sent as is to clients which accept its encoding
+	sendStored := encoding != "" && acceptsEncoding(r, encoding)
+
+	// file which could not be decoded from shards or decrypted is handled as corrupted one
+	sent, err := false, errChecksumMismatch
+
+	if f != nil && r.Header.Get("Range") != "" {
+		sent, err = h.sendRange(w, r, meta, f, encoding, sendStored, clientKey)
+	} else if f != nil {
+		sent, err = h.sendContent(w, r, meta, f, encoding, sendStored)
+	}
+
+	if err != nil {
+		// file is corrupted, it's moved to quarantine and repaired from sources if they are configured
+		logger.Warn("file is corrupted", "file_id", hash)
+
+		ok, qErr := h.App.QuarantineFile(hash, "checksum", time.Now())
+		if qErr != nil {
+			logger.Error("could not quarantine file", "file_id", hash, "error", qErr)
+		} else if ok {
+			h.App.healFileAsync(hash)
+		}
+
+		// part of content has been sent already
+		if err == errCorruptedResponse {
+			return
+		}
+
+		// valid copy from replica is streamed if there is one
+		replica, size, ok := h.App.Storage.OpenReplica(hash, clientKey)
+		if !ok {
+			h.renderQuarantined(w, "FILE_IS_CORRUPTED")
+			return
+		}
+
+		buffered := bufio.NewReaderSize(replica, sniffLen)
+
+		if meta.ContentType == "" {
+			head, _ := buffered.Peek(sniffLen)
+			meta.ContentType = detectContentType(head)
+		}
+
+		// copy is opened again if range starts before position of reader
+		content := &contentSeeker{size: size, r: readCloser{buffered, replica}, open: func() (io.ReadCloser, error) {
+			reopened, _, ok := h.App.Storage.OpenReplica(hash, clientKey)
+			if !ok {
+				return nil, os.ErrNotExist
+			}
+
+			return reopened, nil
+		}}
+		defer content.Close()
+
+		h.setContentHeaders(w, r, meta, encoding, false)
+		http.ServeContent(w, r, "", time.Time{}, content)
+
+		sent = true
+	}
+
+	if !sent {
 		return
 	}
 
+	halfLife := getHalfLife(h.App.GetConfig().Storage.GetEviction())
+	accessedAt := time.Now()
+
 	// update file donwload score
-	go h.App.Redis.IncScore(hashSHA256)
+	h.App.Go(func() {
+		_, err := h.App.Redis.IncScore(hash)
+		if err != nil {
+			logger.Error("could not update download score", "file_id", hash, "error", err)
+			return
+		}
+
+		err = h.App.Redis.RecordAccess(hash, accessedAt, halfLife)
+		if err != nil {
+			logger.Error("could not update eviction scores", "file_id", hash, "error", err)
+		}
+	})
+}
 
-	w.Header().Set("Content-Disposition", "attachment; filename="+hash)
+// sendContent method streams content of file to client, checksum is calculated on the fly
+// content of small file is buffered, so it's replaced by error if file is corrupted
+// response is aborted if corruption is detected after content has been partially sent
+func (h *Handler) sendContent(w http.ResponseWriter, r *http.Request, meta *FileMeta, f io.Reader, encoding string, sendStored bool) (bool, error) {
+	resp := &bufferedResponse{
+		ResponseWriter: w,
+		limit:          downloadBufferSize,
+		start: func() {
+			h.setContentHeaders(w, r, meta, encoding, sendStored)
+			w.Header().Set("Accept-Ranges", "bytes")
+		},
+	}
+
+	sum, err := copyContent(resp, f, encoding, sendStored)
+	if resp.err != nil {
+		// client has gone
+		return false, nil
+	}
 
-	io.Copy(w, bytes.NewBuffer(bytesData))
+	if err == nil && strings.Split(meta.Hash, "-")[0] != sum || err == errTooFewShards || isCorruptedContent(err) {
+		err = errChecksumMismatch
+	}
+
+	if err != nil && resp.started {
+		getRequestInfo(r).Aborted = true
+
+		if err == errChecksumMismatch {
+			return false, errCorruptedResponse
+		}
+
+		h.requestLogger(r).Error("could not read file", "file_id", meta.Hash, "error", err)
+
+		return false, nil
+	} else if err == errChecksumMismatch {
+		return false, err
+	} else if err != nil {
+		h.requestLogger(r).Error("could not read file", "file_id", meta.Hash, "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+
+		return false, nil
+	}
+
+	return resp.flush() == nil, nil
+}
+
+// sendRange method verifies checksum of file before requested range is sent
+// range of compressed content is sent with its encoding, content is reopened to seek it
+func (h *Handler) sendRange(w http.ResponseWriter, r *http.Request, meta *FileMeta, f io.Reader, encoding string, sendStored bool, clientKey []byte) (bool, error) {
+	size := &countingWriter{}
+
+	sum, err := copyContent(size, f, encoding, sendStored)
+	if err == nil && strings.Split(meta.Hash, "-")[0] != sum || err == errTooFewShards || isCorruptedContent(err) {
+		return false, errChecksumMismatch
+	} else if err != nil {
+		h.requestLogger(r).Error("could not read file", "file_id", meta.Hash, "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+
+		return false, nil
+	}
+
+	content := &contentSeeker{size: size.count, open: func() (io.ReadCloser, error) {
+		stored, _, err := h.App.Storage.OpenStored(meta.Hash, clientKey)
+		if err != nil || sendStored {
+			return stored, err
+		}
+
+		decoded, err := newDecoder(stored, encoding)
+		if err != nil {
+			stored.Close()
+			return nil, err
+		}
+
+		return readCloser{decoded, stored}, nil
+	}}
+	defer content.Close()
+
+	h.setContentHeaders(w, r, meta, encoding, sendStored)
+	http.ServeContent(w, r, "", time.Time{}, content)
+
+	return true, nil
+}
+
+// setContentHeaders method sets headers of downloaded file, compressed content is sent with its encoding
+func (h *Handler) setContentHeaders(w http.ResponseWriter, r *http.Request, meta *FileMeta, encoding string, sendStored bool) {
+	setFileHeaders(w, meta.Hash, meta, isInline(r))
+
+	if encoding != "" {
+		w.Header().Set("Vary", "Accept-Encoding")
+	}
+
+	if sendStored {
+		w.Header().Set("Content-Encoding", encoding)
+	}
+}
+
+// renderMissingFile method renders error for file which is not in storage
+// quarantined file gets cacheable error, so clients don't request it until it's repaired
+func (h *Handler) renderMissingFile(w http.ResponseWriter, r *http.Request, hash string) {
+	quarantined, err := h.App.Redis.IsQuarantined(hash)
+	if err != nil {
+		h.requestLogger(r).Error("could not check quarantine", "file_id", hash, "error", err)
+	}
+
+	if quarantined {
+		h.renderQuarantined(w, "FILE_IS_QUARANTINED")
+		return
+	}
+
+	// file not found
+	h.renderError(w, http.StatusNotFound, "FILE_NOT_FOUND")
+}
+
+// renderQuarantined method renders error for corrupted file with cache max age from config
+func (h *Handler) renderQuarantined(w http.ResponseWriter, message string) {
+	maxAge := h.App.GetConfig().Storage.GetQuarantine().MaxAge
+	if maxAge > 0 {
+		w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(maxAge))
+	}
+
+	h.renderError(w, http.StatusUnprocessableEntity, message)
 }
 
 func (h *Handler) removeFile(w http.ResponseWriter, r *http.Request, hash string) {
+	if h.App.GetConfig().Storage.GetTrash().Enabled {
+		h.trashFile(w, r, hash)
+		return
+	}
+
+	// size is needed for usage accounting, missing file is handled below
+	size, _ := h.App.Storage.GetFileSize(hash)
+
 	ok, err := h.App.Storage.RemoveFile(hash)
 	now := time.Now()
 
 	if err != nil {
+		h.requestLogger(r).Error("could not remove file", "file_id", hash, "error", err)
 		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
 		return
 	}
@@ -266,17 +714,100 @@ func (h *Handler) removeFile(w http.ResponseWriter, r *http.Request, hash string
 		return
 	}
 
+	logger := h.requestLogger(r)
+
 	// update file meta data
-	go h.App.Redis.MarkFileAsDeleted(hash, &now)
+	h.App.Go(func() {
+		err := h.App.AddUsage(-size)
+		if err != nil {
+			logger.Error("could not update storage usage", "file_id", hash, "error", err)
+		}
+
+		err = h.App.Redis.MarkFileAsDeleted(hash, &now)
+		if err != nil {
+			logger.Error("could not mark file as deleted", "file_id", hash, "error", err)
+		}
+	})
+
+	// it's ok
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// trashFile method moves file to trash, index is updated synchronously so file could be restored right away
+func (h *Handler) trashFile(w http.ResponseWriter, r *http.Request, hash string) {
+	ok, err := h.App.MoveToTrash(hash, time.Now())
+	if err != nil {
+		h.requestLogger(r).Error("could not move file to trash", "file_id", hash, "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	if !ok {
+		h.renderError(w, http.StatusNotFound, "FILE_NOT_FOUND")
+		return
+	}
 
 	// it's ok
 	w.WriteHeader(http.StatusNoContent)
 }
 
+func (h *Handler) restoreFile(w http.ResponseWriter, r *http.Request, hash string) {
+	ok, err := h.App.RestoreFile(hash, time.Now())
+	if err == errFileExists {
+		h.renderError(w, http.StatusConflict, "FILE_ALREADY_EXISTS")
+		return
+	} else if err != nil {
+		h.requestLogger(r).Error("could not restore file", "file_id", hash, "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	if !ok {
+		h.renderError(w, http.StatusNotFound, "FILE_NOT_FOUND")
+		return
+	}
+
+	h.renderJSON(w, http.StatusOK, UploadResponse{Hash: hash})
+}
+
+// rejectByLimit method renders error for request rejected by rate limit
+func (h *Handler) rejectByLimit(w http.ResponseWriter, r *http.Request, limit string, code int, message string) {
+	h.App.Metrics.RateLimitRejections.Inc(limit)
+	getRequestInfo(r).Limit = limit
+
+	h.renderError(w, code, message)
+}
+
+// requestLogger method returns logger with request id
+func (h *Handler) requestLogger(r *http.Request) *Logger {
+	return h.Logger.With("request_id", getRequestInfo(r).ID)
+}
+
+func (h *Handler) readiness(w http.ResponseWriter) {
+	checks, ok := h.App.Readiness()
+
+	if !ok {
+		h.renderJSON(w, http.StatusServiceUnavailable, HealthResponse{Status: "fail", Checks: checks})
+		return
+	}
+
+	h.renderJSON(w, http.StatusOK, HealthResponse{Status: "ok", Checks: checks})
+}
+
+func (h *Handler) renderMetrics(w http.ResponseWriter) {
+	w.Header().Set("Content-type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+
+	h.App.updateStorageUsage()
+	h.App.Metrics.Render(w)
+}
+
 func (h *Handler) renderError(w http.ResponseWriter, code int, message string) {
-	e := ErrorResponse{Error: message}
+	h.renderJSON(w, code, ErrorResponse{Error: message})
+}
 
-	res, err := json.Marshal(e)
+func (h *Handler) renderJSON(w http.ResponseWriter, code int, data interface{}) {
+	res, err := json.Marshal(data)
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		return
@@ -290,7 +821,8 @@ func (h *Handler) renderError(w http.ResponseWriter, code int, message string) {
 // NewHandler func return Handler pointer
 func NewHandler(app *Application) *Handler {
 	return &Handler{
-		App: app,
+		App:    app,
+		Logger: app.Logger.With("component", "handler"),
 	}
 }
 
@@ -318,3 +850,43 @@ func getPathParts(path string) []string {
 
 	return res
 }
+
+func getAction(method string, pathParts []string) string {
+	l := len(pathParts)
+
+	if l == 1 && method == "GET" {
+		switch pathParts[0] {
+		case "metrics", "healthz", "readyz":
+			return pathParts[0]
+		}
+	}
+
+	if l > 0 && pathParts[0] == "admin" {
+		return adminAction
+	}
+
+	if l > 0 && pathParts[0] == "cluster" {
+		return "cluster"
+	}
+
+	if l < 1 || pathParts[0] != "files" || l > 3 {
+		return "not_found"
+	}
+
+	switch {
+	case method == "POST" && l == 3 && pathParts[2] == "restore":
+		return "restore"
+	case method == "PATCH" && l == 3 && pathParts[2] == "meta":
+		return "meta"
+	case (method == "GET" || method == "HEAD") && l == 2:
+		return "download"
+	case method == "POST" && l == 1:
+		return "upload"
+	case method == "GET" && l == 1:
+		return listAction
+	case method == "DELETE" && l == 2:
+		return "remove"
+	}
+
+	return "not_found"
+}
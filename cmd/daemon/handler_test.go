@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"io"
 	"io/ioutil"
@@ -254,6 +255,21 @@ func TestHandlerUploadFile(t *testing.T) {
 			},
 			code: 200,
 		},
+		{
+			file: "mocks/files/small.txt",
+			data: map[string]string{
+				"expires_in": "example",
+			},
+			code:       400,
+			errMessage: "BAD_EXPIRY",
+		},
+		{
+			file: "mocks/files/small.txt",
+			data: map[string]string{
+				"expires_in": "60",
+			},
+			code: 200,
+		},
 	}
 
 	for _, tc := range cases {
@@ -321,6 +337,39 @@ func TestHandlerUploadFile(t *testing.T) {
 	}
 }
 
+func TestHandlerUploadFileShuttingDown(t *testing.T) {
+	cfg, _ := NewConfig("mocks/config/full.json")
+
+	h := NewHandler(NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(cfg.RateLimit), NewRedis(cfg.Redis)))
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, _ := writer.CreateFormFile("file", "small.txt")
+	part.Write([]byte("shutting down"))
+	writer.Close()
+
+	r, _ := http.NewRequest("POST", "/files/", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+
+	// request has been started before shutdown, so meta data could not be saved
+	h.App.closing = true
+
+	w := httptest.NewRecorder()
+	h.uploadFile(w, r, "")
+
+	if w.Code != 503 {
+		t.Errorf("Code must be %d but got %d\n", 503, w.Code)
+	}
+
+	errResp := ErrorResponse{}
+
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if errResp.Error != "SHUTTING_DOWN" {
+		t.Errorf("Error message must be %v but got %v\n", "SHUTTING_DOWN", errResp.Error)
+	}
+}
+
 func TestHandlerUploadFileBandwidth(t *testing.T) {
 	cfg, _ := NewConfig("mocks/config/full.json")
 
@@ -517,6 +566,82 @@ func TestHandlerDownloadFile(t *testing.T) {
 	}
 }
 
+func TestHandlerStreamLargeFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := &StorageConfig{Path: dir, MaxSize: 4 << 20}
+	app := NewApplication(&Config{Storage: cfg}, NewStorage(cfg), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+
+	conn := app.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	server := httptest.NewServer(NewHandler(app))
+	defer server.Close()
+
+	// content is larger than memory of upload and buffer of download
+	content := strings.Repeat("0123456789abcdef", 1<<17)
+	hash := uploadTestFile(t, server.URL, content)
+	app.wg.Wait()
+
+	cases := []struct {
+		rng  string
+		code int
+		body string
+	}{
+		{code: 200, body: content},
+		{rng: "bytes=1048576-1048591", code: 206, body: "0123456789abcdef"},
+		{rng: "bytes=-4", code: 206, body: "cdef"},
+	}
+
+	for _, tc := range cases {
+		r, _ := http.NewRequest("GET", server.URL+"/files/"+hash, nil)
+		r.Header.Set("Range", tc.rng)
+
+		resp, err := http.DefaultClient.Do(r)
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != tc.code || err != nil || string(data) != tc.body {
+			t.Errorf("Response for %q must be %d with %d bytes but got %d with %d bytes, %v\n", tc.rng, tc.code, len(tc.body), resp.StatusCode, len(data), err)
+		}
+	}
+
+	// corruption is detected after content has been partially sent, so response is aborted
+	fileName, _ := app.Storage.GetFile(hash)
+	data, _ := ioutil.ReadFile(fileName)
+	data[len(data)-1] ^= 0xff
+	ioutil.WriteFile(fileName, data, 0644)
+
+	resp, err := http.Get(server.URL + "/files/" + hash)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	_, err = ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if err == nil {
+		t.Error("Corrupted response must be aborted\n")
+	}
+
+	app.wg.Wait()
+
+	if _, ok := app.Storage.GetFile(hash); ok {
+		t.Error("Corrupted file must be quarantined\n")
+	}
+}
+
 func TestHandlerDownloadBandwidth(t *testing.T) {
 	cfg, _ := NewConfig("mocks/config/full.json")
 
@@ -534,6 +659,7 @@ func TestHandlerDownloadBandwidth(t *testing.T) {
 	strData := strings.Repeat("a", int(cfg.RateLimit.Bandwidth.Download+1))
 
 	h.App.Storage.CreateFile("example", bytes.NewBuffer([]byte(strData)))
+	defer h.App.Storage.RemoveFile("example")
 	now := time.Now()
 
 	h.App.Redis.SaveFileMeta(&FileMeta{
@@ -626,7 +752,7 @@ func TestHandler404(t *testing.T) {
 		},
 		{
 			method: "GET",
-			path:   "/files",
+			path:   "/files/file/meta",
 		},
 		{
 			method: "GET",
@@ -660,3 +786,197 @@ func TestHandler404(t *testing.T) {
 		}
 	}
 }
+
+func TestHandlerMetrics(t *testing.T) {
+	cfg, _ := NewConfig("mocks/config/full.json")
+
+	h := NewHandler(NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(cfg.RateLimit), NewRedis(cfg.Redis)))
+
+	// usage is read from counter on scrape even if autoclean has never been run
+	conn := h.App.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	h.App.Redis.CorrectUsage(1000)
+
+	// make request which should be counted
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/", nil)
+	h.ServeHTTP(w, r)
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("GET", "/metrics", nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 {
+		t.Errorf("Code must be %d but got %d\n", 200, w.Code)
+	}
+
+	contentType := w.Header().Get("Content-type")
+	if !strings.HasPrefix(contentType, "text/plain") {
+		t.Errorf("Content-type must be %s but got %s\n", "text/plain", contentType)
+	}
+
+	for _, line := range []string{
+		"t2_http_requests_total{action=\"not_found\",status=\"404\"} 1",
+		"t2_storage_limit_bytes 2048",
+		"t2_storage_usage_bytes 1000",
+		"t2_redis_pool_active_connections",
+	} {
+		if !strings.Contains(w.Body.String(), line) {
+			t.Errorf("Metrics must contain %q\n", line)
+		}
+	}
+}
+
+func TestHandlerShuttingDown(t *testing.T) {
+	app := NewApplication(&Config{}, &Storage{}, &RateLimit{}, NewRedis(&RedisConfig{}))
+	app.Shutdown(context.Background())
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/healthz", nil)
+	NewHandler(app).ServeHTTP(w, r)
+
+	if w.Code != 503 {
+		t.Errorf("Code must be %d but got %d\n", 503, w.Code)
+	}
+
+	errResp := ErrorResponse{}
+
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if errResp.Error != "SHUTTING_DOWN" {
+		t.Errorf("Error message must be %v but got %v\n", "SHUTTING_DOWN", errResp.Error)
+	}
+}
+
+func TestGetAction(t *testing.T) {
+	cases := []struct {
+		method string
+		path   string
+		action string
+	}{
+		{
+			method: "GET",
+			path:   "/files/example",
+			action: "download",
+		},
+		{
+			method: "HEAD",
+			path:   "/files/example",
+			action: "download",
+		},
+		{
+			method: "POST",
+			path:   "/files",
+			action: "upload",
+		},
+		{
+			method: "PATCH",
+			path:   "/files/example/meta",
+			action: "meta",
+		},
+		{
+			method: "DELETE",
+			path:   "/files/example",
+			action: "remove",
+		},
+		{
+			method: "GET",
+			path:   "/metrics",
+			action: "metrics",
+		},
+		{
+			method: "POST",
+			path:   "/admin/reload",
+			action: "admin",
+		},
+		{
+			method: "POST",
+			path:   "/files/example/restore",
+			action: "restore",
+		},
+		{
+			method: "POST",
+			path:   "/files/example/example",
+			action: "not_found",
+		},
+		{
+			method: "GET",
+			path:   "/files",
+			action: "list",
+		},
+		{
+			method: "GET",
+			path:   "/example",
+			action: "not_found",
+		},
+	}
+
+	for _, tc := range cases {
+		action := getAction(tc.method, getPathParts(tc.path))
+		if action != tc.action {
+			t.Errorf("Action must be %s but got %s\n", tc.action, action)
+		}
+	}
+}
+
+func TestHandlerAccessLog(t *testing.T) {
+	cfg, _ := NewConfig("mocks/config/full.json")
+
+	h := NewHandler(NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(cfg.RateLimit), NewRedis(cfg.Redis)))
+
+	buf := &bytes.Buffer{}
+	h.AccessLog = NewWriterLogger(buf, LevelInfo, "logfmt")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files/example/example", nil)
+	r.Header.Set("X-Request-ID", "example-request")
+	r.RemoteAddr = "127.0.0.1:12345"
+
+	h.ServeHTTP(w, r)
+
+	if id := w.Header().Get("X-Request-ID"); id != "example-request" {
+		t.Errorf("Request id must be %s but got %s\n", "example-request", id)
+	}
+
+	for _, part := range []string{
+		"request_id=example-request",
+		"method=GET",
+		"path=/files/example/example",
+		"file_id=example",
+		"ip=127.0.0.1",
+		"status=404",
+		"limit=allowed",
+	} {
+		if !strings.Contains(buf.String(), part) {
+			t.Errorf("Access log must contain %s but got %s\n", part, buf.String())
+		}
+	}
+}
+
+func TestHandlerForbidden(t *testing.T) {
+	cfg, _ := NewConfig("mocks/config/full.json")
+	cfg.Auth = &AuthConfig{
+		Principals: map[string]*PrincipalConfig{
+			"team-a": nil,
+		},
+	}
+
+	h := NewHandler(NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(cfg.RateLimit), NewRedis(cfg.Redis)))
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files/example", nil)
+
+	h.ServeHTTP(w, r)
+
+	if w.Code != 403 {
+		t.Errorf("Code must be %d but got %d\n", 403, w.Code)
+	}
+
+	errResp := ErrorResponse{}
+
+	json.Unmarshal(w.Body.Bytes(), &errResp)
+	if errResp.Error != "FORBIDDEN" {
+		t.Errorf("Error message must be %v but got %v\n", "FORBIDDEN", errResp.Error)
+	}
+}
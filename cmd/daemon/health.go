@@ -0,0 +1,147 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync/atomic"
+)
+
+// HealthConfig struct contains info about
+// - min free space on storage disk in bytes, daemon is not ready if there is less space
+// - delay in seconds between marking daemon as draining and closing listener on shutdown
+type HealthConfig struct {
+	MinFreeSpace int64 `json:"min_free_space"`
+	DrainDelay   int   `json:"drain_delay"`
+}
+
+// errFreeSpaceUnknown is returned by getFreeSpace on platforms where free space could not be detected
+var errFreeSpaceUnknown = errors.New("Free space is unknown on this platform")
+
+// HealthCheck struct is result of single readiness check
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// HealthResponse struct
+type HealthResponse struct {
+	Status string        `json:"status"`
+	Checks []HealthCheck `json:"checks,omitempty"`
+}
+
+// SetDraining method marks application as draining, it's not ready for new requests after that
+func (app *Application) SetDraining() {
+	atomic.StoreInt32(&app.draining, 1)
+}
+
+// IsDraining method
+func (app *Application) IsDraining() bool {
+	return atomic.LoadInt32(&app.draining) == 1
+}
+
+// Readiness method checks that application could serve requests
+func (app *Application) Readiness() ([]HealthCheck, bool) {
+	checks := []HealthCheck{
+		newHealthCheck("storage_writable", app.checkStorageWritable()),
+		newHealthCheck("disk_space", app.checkDiskSpace()),
+		newHealthCheck("redis", app.checkRedis()),
+		newHealthCheck("not_draining", app.checkDraining()),
+	}
+
+	ok := true
+	for _, check := range checks {
+		ok = ok && check.OK
+	}
+
+	return checks, ok
+}
+
+func (app *Application) checkStorageWritable() error {
+	for _, root := range app.GetConfig().Storage.GetRoots() {
+		err := checkDirWritable(root)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func checkDirWritable(dir string) error {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(dir, ".readyz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	_, err = f.Write([]byte("ok"))
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// checkDiskSpace method checks free space only if min free space is configured
+// free space is unknown on some platforms, daemon is ready there
+func (app *Application) checkDiskSpace() error {
+	cfg := app.GetConfig()
+
+	if cfg.Health == nil || cfg.Health.MinFreeSpace <= 0 {
+		return nil
+	}
+
+	for _, root := range cfg.Storage.GetRoots() {
+		free, err := getFreeSpace(root)
+		if err == errFreeSpaceUnknown {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		if free < cfg.Health.MinFreeSpace {
+			return fmt.Errorf("free space %d of %s is less than %d", free, root, cfg.Health.MinFreeSpace)
+		}
+	}
+
+	return nil
+}
+
+func (app *Application) checkRedis() error {
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("PING")
+
+	return err
+}
+
+func (app *Application) checkDraining() error {
+	if app.IsDraining() {
+		return errors.New("daemon is draining")
+	}
+
+	return nil
+}
+
+func newHealthCheck(name string, err error) HealthCheck {
+	check := HealthCheck{
+		Name: name,
+		OK:   err == nil,
+	}
+
+	if err != nil {
+		check.Error = err.Error()
+	}
+
+	return check
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestApplicationDraining(t *testing.T) {
+	app := NewApplication(&Config{}, &Storage{}, &RateLimit{}, &Redis{})
+
+	if app.IsDraining() {
+		t.Error("Application must not be draining")
+	}
+
+	app.SetDraining()
+
+	if !app.IsDraining() {
+		t.Error("Application must be draining")
+	}
+}
+
+func TestApplicationCheckDiskSpace(t *testing.T) {
+	cases := []struct {
+		health *HealthConfig
+		ok     bool
+	}{
+		{health: nil, ok: true},
+		{health: &HealthConfig{}, ok: true},
+		{health: &HealthConfig{MinFreeSpace: 1}, ok: false},
+	}
+
+	for _, tc := range cases {
+		// free space of missing directory could not be checked
+		cfg := &Config{Storage: &StorageConfig{Path: "mocks/missing"}, Health: tc.health}
+		app := NewApplication(cfg, NewStorage(cfg.Storage), &RateLimit{}, &Redis{})
+
+		if err := app.checkDiskSpace(); (err == nil) != tc.ok {
+			t.Errorf("Check for %+v must pass: %v but got %v\n", tc.health, tc.ok, err)
+		}
+	}
+}
+
+func TestApplicationReadiness(t *testing.T) {
+	cases := []struct {
+		cfg      *Config
+		redis    *RedisConfig
+		draining bool
+		ok       bool
+		failed   string
+	}{
+		{
+			cfg: &Config{
+				Storage: &StorageConfig{Path: mockStoragePath},
+			},
+			redis: &RedisConfig{},
+			ok:    true,
+		},
+		{
+			cfg: &Config{
+				Storage: &StorageConfig{Path: mockStoragePath},
+			},
+			redis:    &RedisConfig{},
+			draining: true,
+			failed:   "not_draining",
+		},
+		{
+			cfg: &Config{
+				Storage: &StorageConfig{Path: mockStoragePath},
+				Health:  &HealthConfig{MinFreeSpace: 1 << 62},
+			},
+			redis:  &RedisConfig{},
+			failed: "disk_space",
+		},
+		{
+			cfg: &Config{
+				Storage: &StorageConfig{Path: mockStoragePath},
+			},
+			redis:  &RedisConfig{Port: 1},
+			failed: "redis",
+		},
+		{
+			cfg: &Config{
+				Storage: &StorageConfig{Path: "mocks/files/small.txt/storage"},
+			},
+			redis:  &RedisConfig{},
+			failed: "storage_writable",
+		},
+	}
+
+	for _, tc := range cases {
+		app := NewApplication(tc.cfg, NewStorage(tc.cfg.Storage), NewRateLimit(&RateLimitConfig{}), NewRedis(tc.redis))
+
+		if tc.draining {
+			app.SetDraining()
+		}
+
+		checks, ok := app.Readiness()
+
+		if ok != tc.ok {
+			t.Errorf("Ok must be %t but got %t (%v)\n", tc.ok, ok, checks)
+		}
+
+		for _, check := range checks {
+			if check.Name == tc.failed && check.OK {
+				t.Errorf("Check %s must fail\n", check.Name)
+			}
+
+			if check.Name != tc.failed && !check.OK && check.Name != "disk_space" {
+				t.Errorf("Check %s must not fail but got %s\n", check.Name, check.Error)
+			}
+		}
+	}
+}
+
+func TestHandlerHealth(t *testing.T) {
+	cfg, _ := NewConfig("mocks/config/full.json")
+
+	h := NewHandler(NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(cfg.RateLimit), NewRedis(cfg.Redis)))
+
+	cases := []struct {
+		path     string
+		draining bool
+		code     int
+		status   string
+	}{
+		{
+			path:   "/healthz",
+			code:   200,
+			status: "ok",
+		},
+		{
+			path:   "/readyz",
+			code:   200,
+			status: "ok",
+		},
+		{
+			path:     "/readyz",
+			draining: true,
+			code:     503,
+			status:   "fail",
+		},
+		{
+			path:     "/healthz",
+			draining: true,
+			code:     200,
+			status:   "ok",
+		},
+	}
+
+	for _, tc := range cases {
+		if tc.draining {
+			h.App.SetDraining()
+		}
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", tc.path, nil)
+
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("Code must be %d but got %d\n", tc.code, w.Code)
+		}
+
+		resp := HealthResponse{}
+		json.Unmarshal(w.Body.Bytes(), &resp)
+
+		if resp.Status != tc.status {
+			t.Errorf("Status must be %s but got %s\n", tc.status, resp.Status)
+		}
+	}
+}
@@ -56,6 +56,13 @@ func (c *CountLimit) Decr(ip string) {
 	c.Unlock()
 }
 
+// SetMaxCount method changes limit, current counts are kept
+func (c *CountLimit) SetMaxCount(maxCount int) {
+	c.Lock()
+	c.maxCount = maxCount
+	c.Unlock()
+}
+
 // NewCountLimt func returns CountLimit pointer
 func NewCountLimt(maxCount int) *CountLimit {
 	return &CountLimit{
@@ -88,6 +95,13 @@ func (r *RPSLimit) Inc() bool {
 	return r.count <= r.rps
 }
 
+// SetRPS method changes limit, current count is kept
+func (r *RPSLimit) SetRPS(rps int) {
+	r.Lock()
+	r.rps = rps
+	r.Unlock()
+}
+
 // NewRPSLimit func returns RPSLimit pointer
 func NewRPSLimit(rps int) *RPSLimit {
 	return &RPSLimit{
@@ -126,6 +140,13 @@ func (b *BandwidthLimit) Inc(ip string, bytesCount int64) bool {
 	return v <= b.maxCount
 }
 
+// SetMaxCount method changes limit, current counts are kept
+func (b *BandwidthLimit) SetMaxCount(maxCount int64) {
+	b.Lock()
+	b.maxCount = maxCount
+	b.Unlock()
+}
+
 // NewBandwidthLimit func returns BandwidthLimit pointer
 func NewBandwidthLimit(maxCount int64) *BandwidthLimit {
 	return &BandwidthLimit{
@@ -138,6 +159,7 @@ func NewBandwidthLimit(maxCount int64) *BandwidthLimit {
 // RateLimit struct
 type RateLimit struct {
 	Config            *RateLimitConfig
+	Logger            *Logger
 	maxConnection     *CountLimit
 	bandwidthDownload *BandwidthLimit
 	bandwidthUpload   *BandwidthLimit
@@ -152,7 +174,12 @@ func (r *RateLimit) AddConnection(ip string) bool {
 		return true
 	}
 
-	return r.maxConnection.Inc(ip)
+	ok := r.maxConnection.Inc(ip)
+	if !ok {
+		r.Logger.Debug("connections limit reached", "ip", ip)
+	}
+
+	return ok
 }
 
 // RemoveConnection method
@@ -166,6 +193,15 @@ func (r *RateLimit) RemoveConnection(ip string) {
 
 // CheckBandwidth method
 func (r *RateLimit) CheckBandwidth(action, ip string, bytesCount int64) bool {
+	ok := r.checkBandwidth(action, ip, bytesCount)
+	if !ok {
+		r.Logger.Debug("bandwidth limit reached", "action", action, "ip", ip, "bytes", bytesCount)
+	}
+
+	return ok
+}
+
+func (r *RateLimit) checkBandwidth(action, ip string, bytesCount int64) bool {
 	switch action {
 	case "upload":
 		if r.bandwidthUpload == nil {
@@ -187,6 +223,15 @@ func (r *RateLimit) CheckBandwidth(action, ip string, bytesCount int64) bool {
 
 // CheckRPS method
 func (r *RateLimit) CheckRPS(action string) bool {
+	ok := r.checkRPS(action)
+	if !ok {
+		r.Logger.Debug("rps limit reached", "action", action)
+	}
+
+	return ok
+}
+
+func (r *RateLimit) checkRPS(action string) bool {
 	switch action {
 	case "upload":
 		if r.rpsUpload == nil {
@@ -212,8 +257,51 @@ func (r *RateLimit) CheckRPS(action string) bool {
 	return true
 }
 
+// Inherit method takes counters from old rate limit for limits which are enabled in both of them
+// limits are shared, so connections opened before reload are released properly
+func (r *RateLimit) Inherit(old *RateLimit) {
+	if old == nil {
+		return
+	}
+
+	if r.maxConnection != nil && old.maxConnection != nil {
+		old.maxConnection.SetMaxCount(r.maxConnection.maxCount)
+		r.maxConnection = old.maxConnection
+	}
+
+	if r.bandwidthDownload != nil && old.bandwidthDownload != nil {
+		old.bandwidthDownload.SetMaxCount(r.bandwidthDownload.maxCount)
+		r.bandwidthDownload = old.bandwidthDownload
+	}
+
+	if r.bandwidthUpload != nil && old.bandwidthUpload != nil {
+		old.bandwidthUpload.SetMaxCount(r.bandwidthUpload.maxCount)
+		r.bandwidthUpload = old.bandwidthUpload
+	}
+
+	if r.rpsDownload != nil && old.rpsDownload != nil {
+		old.rpsDownload.SetRPS(r.rpsDownload.rps)
+		r.rpsDownload = old.rpsDownload
+	}
+
+	if r.rpsUpload != nil && old.rpsUpload != nil {
+		old.rpsUpload.SetRPS(r.rpsUpload.rps)
+		r.rpsUpload = old.rpsUpload
+	}
+
+	if r.rpsRemove != nil && old.rpsRemove != nil {
+		old.rpsRemove.SetRPS(r.rpsRemove.rps)
+		r.rpsRemove = old.rpsRemove
+	}
+}
+
 // NewRateLimit func returns RateLimit pointer
 func NewRateLimit(cfg *RateLimitConfig) *RateLimit {
+	// missing config means no limits
+	if cfg == nil {
+		cfg = &RateLimitConfig{}
+	}
+
 	r := RateLimit{
 		Config: cfg,
 	}
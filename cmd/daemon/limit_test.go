@@ -506,3 +506,53 @@ func TestRateLimitCheckRPS(t *testing.T) {
 		}
 	}
 }
+
+func TestNewRateLimitWithoutConfig(t *testing.T) {
+	v := NewRateLimit(nil)
+
+	if !v.AddConnection("127.0.0.1") || !v.CheckRPS("download") || !v.CheckBandwidth("upload", "127.0.0.1", 1024) {
+		t.Error("Rate limit without config must allow everything")
+	}
+}
+
+func TestRateLimitInherit(t *testing.T) {
+	old := NewRateLimit(&RateLimitConfig{
+		MaxConnectionsFromIP: 1,
+		RPS:                  &RPSConfig{Download: 1, Upload: 1},
+		Bandwidth:            &BandwidthConfig{Download: 10},
+	})
+
+	old.AddConnection("127.0.0.1")
+	old.CheckRPS("download")
+	old.CheckBandwidth("download", "127.0.0.1", 8)
+
+	v := NewRateLimit(&RateLimitConfig{
+		MaxConnectionsFromIP: 2,
+		RPS:                  &RPSConfig{Download: 2},
+		Bandwidth:            &BandwidthConfig{Download: 20, Upload: 5},
+	})
+	v.Inherit(old)
+
+	if v.maxConnection != old.maxConnection || v.maxConnection.maxCount != 2 {
+		t.Error("Connections limit must be shared with new max count")
+	}
+
+	if v.rpsDownload != old.rpsDownload || v.rpsDownload.count != 1 || v.rpsDownload.rps != 2 {
+		t.Error("Download rps limit must be shared with new rps")
+	}
+
+	if v.rpsUpload != nil {
+		t.Error("Upload rps limit must be disabled")
+	}
+
+	if v.bandwidthDownload.m["127.0.0.1"] != 8 || v.bandwidthDownload.maxCount != 20 {
+		t.Error("Download bandwidth counters must be kept")
+	}
+
+	if v.bandwidthUpload == nil || v.bandwidthUpload.maxCount != 5 {
+		t.Error("Upload bandwidth limit must be created")
+	}
+
+	// nil is ignored
+	v.Inherit(nil)
+}
@@ -0,0 +1,427 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// default and max count of files in page of listing
+const (
+	defaultListLimit = 100
+	maxListLimit     = 1000
+)
+
+// max count of files which are examined for one page of listing, page with rare filters could be incomplete
+const listMaxScan = 10000
+
+var (
+	// errBadFilter is returned if parameter of listing is invalid
+	errBadFilter = errors.New("Filter of files is invalid")
+	// errBadCursor is returned if cursor could not be decoded or it belongs to another sorting
+	errBadCursor = errors.New("Cursor is invalid")
+)
+
+// sorted sets of file listing by sorting
+var sortKeys = map[string]string{
+	"created_at": createdKey,
+	"size":       sizeKey,
+	"downloads":  scoreKey,
+}
+
+// FileFilter struct contains sorting of file listing and filters of files, empty filters match all files
+// time bounds are exclusive, size and download bounds are inclusive
+type FileFilter struct {
+	Sort           string
+	Desc           bool
+	UploadedAfter  *time.Time
+	UploadedBefore *time.Time
+	MinSize        *int64
+	MaxSize        *int64
+	MinDownloads   *int64
+	Owner          string
+	Tag            string
+	ContentType    string
+}
+
+// FileCursor struct contains position of the last examined file in sorted set of listing
+type FileCursor struct {
+	Score string
+	Hash  string
+}
+
+// FileInfo struct contains metadata of file in listing
+// filename, content type, custom metadata and tags of file encrypted by client key are hidden
+type FileInfo struct {
+	Hash        string            `json:"hash"`
+	Size        int64             `json:"size"`
+	CreatedAt   *time.Time        `json:"created_at"`
+	ExpiresAt   *time.Time        `json:"expires_at,omitempty"`
+	Downloads   int64             `json:"downloads"`
+	Owner       string            `json:"owner,omitempty"`
+	Encrypted   bool              `json:"encrypted,omitempty"`
+	Filename    string            `json:"filename,omitempty"`
+	ContentType string            `json:"content_type,omitempty"`
+	Meta        map[string]string `json:"meta,omitempty"`
+	Tags        []string          `json:"tags,omitempty"`
+}
+
+// FileListResponse struct, next cursor is empty if there are no more files
+type FileListResponse struct {
+	Files      []FileInfo `json:"files"`
+	NextCursor string     `json:"next_cursor,omitempty"`
+}
+
+type indexRange struct {
+	key string
+	min string
+	max string
+}
+
+// getSortKey method returns sorted set of listing order
+func (f *FileFilter) getSortKey() string {
+	if key, ok := sortKeys[f.Sort]; ok {
+		return key
+	}
+
+	return createdKey
+}
+
+// getIndexes method returns bounds of scores in sorted sets and sets which must contain listed files
+// bounds of creation time are always returned, only live files have it
+func (f *FileFilter) getIndexes() ([]indexRange, []string) {
+	created := indexRange{key: createdKey}
+	if f.UploadedAfter != nil {
+		created.min = strconv.FormatInt(f.UploadedAfter.Unix()+1, 10)
+	}
+
+	if f.UploadedBefore != nil {
+		created.max = strconv.FormatInt(f.UploadedBefore.Unix()-1, 10)
+	}
+
+	ranges := []indexRange{created}
+
+	if f.MinSize != nil || f.MaxSize != nil {
+		ranges = append(ranges, indexRange{key: sizeKey, min: formatBound(f.MinSize), max: formatBound(f.MaxSize)})
+	}
+
+	if f.MinDownloads != nil {
+		ranges = append(ranges, indexRange{key: scoreKey, min: formatBound(f.MinDownloads)})
+	}
+
+	var sets []string
+
+	if f.Owner != "" {
+		sets = append(sets, ownerPrefix+f.Owner)
+	}
+
+	if f.Tag != "" {
+		sets = append(sets, tagPrefix+f.Tag)
+	}
+
+	if f.ContentType != "" {
+		sets = append(sets, contentTypePrefix+f.ContentType)
+	}
+
+	return ranges, sets
+}
+
+func formatBound(v *int64) string {
+	if v == nil {
+		return ""
+	}
+
+	return strconv.FormatInt(*v, 10)
+}
+
+// getIndexKeys func returns sets of file listing which must contain file
+// content type is indexed by media type and by main type with "*" subtype, so "image/*" filter is supported
+// description of file encrypted by client key is not indexed, it's available only with the key
+func getIndexKeys(file *FileMeta) []string {
+	keys := []string{}
+
+	if file.Owner != "" {
+		keys = append(keys, ownerPrefix+file.Owner)
+	}
+
+	if file.KeyFingerprint != "" {
+		return keys
+	}
+
+	if file.ContentType != "" {
+		mediaType := getMediaType(file.ContentType)
+		keys = append(keys, contentTypePrefix+mediaType, contentTypePrefix+strings.Split(mediaType, "/")[0]+"/*")
+	}
+
+	for _, tag := range file.Tags {
+		keys = append(keys, tagPrefix+tag)
+	}
+
+	return keys
+}
+
+// getFileFilter func returns filter of listing from query parameters:
+// sort (created_at, size, downloads), order (asc, desc), uploaded_after and uploaded_before (unix time or RFC 3339),
+// min_size, max_size, min_downloads, owner, tag and content_type ("image/png" or "image/*")
+func getFileFilter(query url.Values) (*FileFilter, error) {
+	f := &FileFilter{Sort: "created_at", Desc: true}
+
+	if v := query.Get("sort"); v != "" {
+		if _, ok := sortKeys[v]; !ok {
+			return nil, errBadFilter
+		}
+
+		f.Sort = v
+	}
+
+	switch query.Get("order") {
+	case "", "desc":
+	case "asc":
+		f.Desc = false
+	default:
+		return nil, errBadFilter
+	}
+
+	var err error
+
+	for _, v := range []struct {
+		name string
+		dst  **time.Time
+	}{{name: "uploaded_after", dst: &f.UploadedAfter}, {name: "uploaded_before", dst: &f.UploadedBefore}} {
+		if *v.dst, err = parseTimeParam(query.Get(v.name)); err != nil {
+			return nil, err
+		}
+	}
+
+	for _, v := range []struct {
+		name string
+		dst  **int64
+	}{{name: "min_size", dst: &f.MinSize}, {name: "max_size", dst: &f.MaxSize}, {name: "min_downloads", dst: &f.MinDownloads}} {
+		if *v.dst, err = parseCountParam(query.Get(v.name)); err != nil {
+			return nil, err
+		}
+	}
+
+	f.Owner = query.Get("owner")
+
+	if v := query.Get("tag"); v != "" {
+		tags, err := normalizeTags([]string{v})
+		if err != nil {
+			return nil, errBadFilter
+		}
+
+		f.Tag = tags[0]
+	}
+
+	if v := query.Get("content_type"); v != "" && v != "*/*" {
+		if !isValidTypePattern(v) {
+			return nil, errBadFilter
+		}
+
+		f.ContentType = strings.ToLower(v)
+	}
+
+	return f, nil
+}
+
+// parseTimeParam func returns time from unix time or RFC 3339, it's nil for empty value
+func parseTimeParam(v string) (*time.Time, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+		return getTime(n), nil
+	}
+
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return nil, errBadFilter
+	}
+
+	return &t, nil
+}
+
+// parseCountParam func returns non-negative number, it's nil for empty value
+func parseCountParam(v string) (*int64, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil || n < 0 {
+		return nil, errBadFilter
+	}
+
+	return &n, nil
+}
+
+// getListLimit func returns count of files in page, default one is returned for empty value
+func getListLimit(v string) (int, error) {
+	if v == "" {
+		return defaultListLimit, nil
+	}
+
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 1 || n > maxListLimit {
+		return 0, errBadFilter
+	}
+
+	return n, nil
+}
+
+// encodeFileCursor func returns opaque cursor which is bound to sorting of filter
+func encodeFileCursor(c *FileCursor, f *FileFilter) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(f.Sort + " " + strconv.FormatBool(f.Desc) + " " + c.Score + " " + c.Hash))
+}
+
+// decodeFileCursor func returns cursor of listing, it's nil for empty value
+func decodeFileCursor(v string, f *FileFilter) (*FileCursor, error) {
+	if v == "" {
+		return nil, nil
+	}
+
+	data, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, errBadCursor
+	}
+
+	parts := strings.Split(string(data), " ")
+	if len(parts) != 4 || parts[0] != f.Sort || parts[1] != strconv.FormatBool(f.Desc) || parts[3] == "" {
+		return nil, errBadCursor
+	}
+
+	if _, err := strconv.ParseFloat(parts[2], 64); err != nil {
+		return nil, errBadCursor
+	}
+
+	return &FileCursor{Score: parts[2], Hash: parts[3]}, nil
+}
+
+// getFileInfo func returns metadata of file for listing
+func getFileInfo(meta *FileMeta, downloads int64) FileInfo {
+	info := FileInfo{
+		Hash:      meta.Hash,
+		Size:      meta.Size,
+		CreatedAt: meta.CreatedAt,
+		ExpiresAt: meta.ExpiresAt,
+		Downloads: downloads,
+		Owner:     meta.Owner,
+		Encrypted: meta.KeyFingerprint != "",
+	}
+
+	if !info.Encrypted {
+		info.Filename = meta.Filename
+		info.ContentType = meta.ContentType
+		info.Meta = meta.UserMeta
+		info.Tags = meta.Tags
+	}
+
+	return info
+}
+
+// listFiles method renders page of files which match filter from query, expired files are skipped
+func (h *Handler) listFiles(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	filter, err := getFileFilter(query)
+	if err != nil {
+		h.renderError(w, http.StatusBadRequest, "BAD_FILTER")
+		return
+	}
+
+	limit, err := getListLimit(query.Get("limit"))
+	if err != nil {
+		h.renderError(w, http.StatusBadRequest, "BAD_LIMIT")
+		return
+	}
+
+	cursor, err := decodeFileCursor(query.Get("cursor"), filter)
+	if err != nil {
+		h.renderError(w, http.StatusBadRequest, "BAD_CURSOR")
+		return
+	}
+
+	hashes, next, err := h.App.Redis.ListFiles(filter, cursor, limit, listMaxScan)
+	if err != nil {
+		h.requestLogger(r).Error("could not list files", "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	files, err := h.App.Redis.GetFilesMeta(hashes)
+	if err != nil {
+		h.requestLogger(r).Error("could not get meta of listed files", "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	downloads, err := h.App.Redis.GetScores(scoreKey, hashes)
+	if err != nil {
+		h.requestLogger(r).Error("could not get download scores of listed files", "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	res := FileListResponse{Files: make([]FileInfo, 0, len(files))}
+	now := time.Now()
+
+	for i, meta := range files {
+		if meta == nil || (meta.ExpiresAt != nil && !now.Before(*meta.ExpiresAt)) {
+			continue
+		}
+
+		res.Files = append(res.Files, getFileInfo(meta, int64(downloads[i])))
+	}
+
+	if next != nil {
+		res.NextCursor = encodeFileCursor(next, filter)
+	}
+
+	h.renderJSON(w, http.StatusOK, res)
+}
+
+// ReindexFiles method rebuilds indexes of file listing from metadata of live files and returns count of indexed files
+// it's needed for files which have been uploaded before the indexes appeared
+func (app *Application) ReindexFiles(ctx context.Context) (int, error) {
+	count := 0
+	offset := 0
+
+	for {
+		hashes, err := app.Redis.GetLiveFiles(offset, 100)
+		if err != nil {
+			return count, err
+		} else if len(hashes) == 0 {
+			return count, nil
+		}
+
+		files, err := app.Redis.GetFilesMeta(hashes)
+		if err != nil {
+			return count, err
+		}
+
+		for _, file := range files {
+			if err := ctx.Err(); err != nil {
+				return count, err
+			}
+
+			if file == nil {
+				continue
+			}
+
+			err = app.Redis.IndexFile(file)
+			if err != nil {
+				return count, err
+			}
+
+			count++
+		}
+
+		offset += len(hashes)
+	}
+}
@@ -0,0 +1,350 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGetFileFilter(t *testing.T) {
+	cases := []struct {
+		query string
+		err   error
+		sort  string
+		desc  bool
+		sets  []string
+	}{
+		{query: "", sort: "created_at", desc: true},
+		{query: "sort=size&order=asc&min_size=10&max_size=20", sort: "size", desc: false},
+		{query: "owner=ops&tag=Build&content_type=image/*", sort: "created_at", desc: true, sets: []string{"OWNER:ops", "TAG:build", "CONTENT_TYPE:image/*"}},
+		{query: "content_type=*/*&uploaded_after=1515151515&uploaded_before=2018-01-05T12:00:00Z", sort: "created_at", desc: true},
+		{query: "sort=name", err: errBadFilter},
+		{query: "order=up", err: errBadFilter},
+		{query: "min_size=-1", err: errBadFilter},
+		{query: "min_downloads=many", err: errBadFilter},
+		{query: "uploaded_after=yesterday", err: errBadFilter},
+		{query: "tag=bad%20tag", err: errBadFilter},
+		{query: "content_type=image", err: errBadFilter},
+	}
+
+	for _, tc := range cases {
+		query, _ := url.ParseQuery(tc.query)
+
+		f, err := getFileFilter(query)
+		if err != tc.err {
+			t.Errorf("Error for %q must be %v but got %v\n", tc.query, tc.err, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if f.Sort != tc.sort || f.Desc != tc.desc {
+			t.Errorf("Sorting for %q must be %s/%v but got %s/%v\n", tc.query, tc.sort, tc.desc, f.Sort, f.Desc)
+		}
+
+		if _, sets := f.getIndexes(); !reflect.DeepEqual(sets, tc.sets) {
+			t.Errorf("Sets for %q must be %v but got %v\n", tc.query, tc.sets, sets)
+		}
+	}
+}
+
+func TestFileCursor(t *testing.T) {
+	filter := &FileFilter{Sort: "size", Desc: true}
+	cursor := &FileCursor{Score: "1024", Hash: "abc-1-2"}
+
+	v := encodeFileCursor(cursor, filter)
+
+	cases := []struct {
+		cursor string
+		filter *FileFilter
+		err    error
+	}{
+		{cursor: v, filter: filter, err: nil},
+		{cursor: v, filter: &FileFilter{Sort: "size", Desc: false}, err: errBadCursor},
+		{cursor: v, filter: &FileFilter{Sort: "created_at", Desc: true}, err: errBadCursor},
+		{cursor: "???", filter: filter, err: errBadCursor},
+		{cursor: "c2l6ZSB0cnVlIHggYWJj", filter: filter, err: errBadCursor},
+	}
+
+	for _, tc := range cases {
+		c, err := decodeFileCursor(tc.cursor, tc.filter)
+		if err != tc.err {
+			t.Errorf("Error for %s must be %v but got %v\n", tc.cursor, tc.err, err)
+		}
+
+		if err == nil && *c != *cursor {
+			t.Errorf("Cursor must be %v but got %v\n", cursor, c)
+		}
+	}
+}
+
+// listAllFiles func returns files of all pages of listing
+func listAllFiles(t *testing.T, app *Application, filter *FileFilter, count int) []string {
+	var res []string
+	var cursor *FileCursor
+
+	for i := 0; i < 100; i++ {
+		hashes, next, err := app.Redis.ListFiles(filter, cursor, count, listMaxScan)
+		if err != nil {
+			t.Fatalf("Err must be nil but got %v\n", err)
+		}
+
+		res = append(res, hashes...)
+
+		if next == nil {
+			return res
+		}
+
+		cursor = next
+	}
+
+	t.Fatalf("Listing must be finished\n")
+
+	return nil
+}
+
+func TestRedisListFiles(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	createdAt := time.Unix(1515151515, 0)
+
+	// sizes repeat, so files with the same score are ordered by id
+	for i := 0; i < 10; i++ {
+		t := createdAt.Add(time.Duration(i) * time.Second)
+
+		file := &FileMeta{
+			Hash:        fmt.Sprintf("f%d", i),
+			Size:        int64(100 * (i % 4)),
+			CreatedAt:   &t,
+			Score:       i,
+			Owner:       []string{"ops", "dev"}[i%2],
+			ContentType: []string{"image/png", "text/plain; charset=utf-8", "image/jpeg"}[i%3],
+			Tags:        []string{fmt.Sprintf("t%d", i%3)},
+		}
+
+		if i == 9 {
+			file.KeyFingerprint = "fingerprint"
+		}
+
+		app.Redis.SaveFileMeta(file)
+	}
+
+	after := createdAt.Add(2 * time.Second)
+	minSize, maxSize := int64(100), int64(200)
+	minDownloads := int64(7)
+
+	cases := []struct {
+		filter   *FileFilter
+		expected string
+	}{
+		{filter: &FileFilter{Sort: "created_at", Desc: true}, expected: "f9 f8 f7 f6 f5 f4 f3 f2 f1 f0"},
+		{filter: &FileFilter{Sort: "created_at", UploadedAfter: &after}, expected: "f3 f4 f5 f6 f7 f8 f9"},
+		{filter: &FileFilter{Sort: "size"}, expected: "f0 f4 f8 f1 f5 f9 f2 f6 f3 f7"},
+		{filter: &FileFilter{Sort: "size", Desc: true}, expected: "f7 f3 f6 f2 f9 f5 f1 f8 f4 f0"},
+		{filter: &FileFilter{Sort: "size", MinSize: &minSize, MaxSize: &maxSize}, expected: "f1 f5 f9 f2 f6"},
+		{filter: &FileFilter{Sort: "size", Desc: true, MinSize: &minSize, MaxSize: &maxSize}, expected: "f6 f2 f9 f5 f1"},
+		{filter: &FileFilter{Sort: "downloads", Desc: true, MinDownloads: &minDownloads}, expected: "f9 f8 f7"},
+		{filter: &FileFilter{Sort: "created_at", Owner: "ops"}, expected: "f0 f2 f4 f6 f8"},
+		{filter: &FileFilter{Sort: "created_at", ContentType: "image/*"}, expected: "f0 f2 f3 f5 f6 f8"},
+		{filter: &FileFilter{Sort: "created_at", ContentType: "text/plain"}, expected: "f1 f4 f7"},
+		// description of file encrypted by client key is not indexed
+		{filter: &FileFilter{Sort: "created_at", Tag: "t0"}, expected: "f0 f3 f6"},
+		{filter: &FileFilter{Sort: "created_at", Tag: "t0", Owner: "dev"}, expected: "f3"},
+	}
+
+	for _, tc := range cases {
+		for _, count := range []int{1, 3, 100} {
+			if v := strings.Join(listAllFiles(t, app, tc.filter, count), " "); v != tc.expected {
+				t.Errorf("Files for %+v by %d must be %s but got %s\n", tc.filter, count, tc.expected, v)
+			}
+		}
+	}
+
+	// removed and quarantined files are not listed, restored file is listed again
+	now := time.Now()
+	app.Redis.MarkFileAsDeleted("f1", &now)
+	app.Redis.QuarantineFile("f2", "checksum", now)
+
+	filter := &FileFilter{Sort: "size"}
+	if v := strings.Join(listAllFiles(t, app, filter, 100), " "); v != "f0 f4 f8 f5 f9 f6 f3 f7" {
+		t.Errorf("Files must be %s but got %s\n", "f0 f4 f8 f5 f9 f6 f3 f7", v)
+	}
+
+	if v := strings.Join(listAllFiles(t, app, &FileFilter{Owner: "dev"}, 100), " "); v != "f3 f5 f7 f9" {
+		t.Errorf("Files must be %s but got %s\n", "f3 f5 f7 f9", v)
+	}
+
+	app.Redis.RestoreFileMeta("f1")
+
+	if v := strings.Join(listAllFiles(t, app, &FileFilter{Owner: "dev"}, 100), " "); v != "f1 f3 f5 f7 f9" {
+		t.Errorf("Files must be %s but got %s\n", "f1 f3 f5 f7 f9", v)
+	}
+
+	// page continues after file of cursor even if it has been removed
+	hashes, next, _ := app.Redis.ListFiles(filter, nil, 3, listMaxScan)
+	app.Redis.MarkFileAsDeleted(hashes[2], &now)
+
+	hashes, _, _ = app.Redis.ListFiles(filter, next, 100, listMaxScan)
+	if v := strings.Join(hashes, " "); v != "f1 f5 f9 f6 f3 f7" {
+		t.Errorf("Files must be %s but got %s\n", "f1 f5 f9 f6 f3 f7", v)
+	}
+
+	// page is incomplete if too many files are examined
+	hashes, next, _ = app.Redis.ListFiles(&FileFilter{Tag: "t2", Desc: true}, nil, 10, 4)
+	if v := strings.Join(hashes, " "); v != "f5" || next == nil || next.Hash != "f5" {
+		t.Errorf("Files must be %s with cursor but got %s, %v\n", "f5", v, next)
+	}
+
+	// changed tags are indexed
+	meta, _ := app.Redis.GetFileMeta("f0")
+	meta.Tags = []string{"release"}
+	app.Redis.UpdateFileMeta(meta)
+
+	if v := strings.Join(listAllFiles(t, app, &FileFilter{Tag: "t0"}, 100), " "); v != "f3 f6" {
+		t.Errorf("Files must be %s but got %s\n", "f3 f6", v)
+	}
+
+	if v := strings.Join(listAllFiles(t, app, &FileFilter{Tag: "release"}, 100), " "); v != "f0" {
+		t.Errorf("Files must be %s but got %s\n", "f0", v)
+	}
+}
+
+func TestApplicationReindexFiles(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	createdAt := time.Now()
+	createTrashTestFile(app, "old", 10, createdAt)
+
+	// file uploaded before indexes appeared has no index keys
+	conn := app.Redis.Get()
+	conn.Do("HSET", metaPrefix+"old", "owner", "ops")
+	conn.Do("HDEL", metaPrefix+"old", "index_keys")
+	conn.Do("ZREM", sizeKey, "old")
+	conn.Close()
+
+	if v := listAllFiles(t, app, &FileFilter{Sort: "size"}, 10); len(v) != 0 {
+		t.Errorf("Files must be empty but got %v\n", v)
+	}
+
+	count, err := app.ReindexFiles(context.Background())
+	if err != nil || count != 1 {
+		t.Errorf("Count must be %d but got %d, %v\n", 1, count, err)
+	}
+
+	if v := listAllFiles(t, app, &FileFilter{Sort: "size", Owner: "ops"}, 10); len(v) != 1 {
+		t.Errorf("Files must contain reindexed file but got %v\n", v)
+	}
+}
+
+func TestHandlerListFiles(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{MaxSize: 1024})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	h := NewHandler(app)
+
+	for i, tags := range []string{"build, Nightly", "build", "bad tag"} {
+		body := &bytes.Buffer{}
+		writer := multipart.NewWriter(body)
+		part, _ := writer.CreateFormFile("file", fmt.Sprintf("file%d.txt", i))
+		part.Write([]byte(strings.Repeat("a", i+1)))
+		writer.WriteField("tags", tags)
+		writer.Close()
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("POST", "/files", body)
+		r.Header.Set("Content-Type", writer.FormDataContentType())
+		h.ServeHTTP(w, r)
+
+		if i < 2 && w.Code != 200 {
+			t.Fatalf("Code must be %d but got %d\n", 200, w.Code)
+		} else if i == 2 && w.Code != 400 {
+			t.Errorf("Code for bad tags must be %d but got %d\n", 400, w.Code)
+		}
+	}
+
+	app.wg.Wait()
+
+	// listing is not allowed implicitly
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files", nil)
+	h.ServeHTTP(w, r)
+
+	if w.Code != 403 {
+		t.Errorf("Code must be %d but got %d\n", 403, w.Code)
+	}
+
+	app.Config.Auth = &AuthConfig{
+		Principals: map[string]*PrincipalConfig{
+			anonymousPrincipal: &PrincipalConfig{Actions: []string{"list"}},
+		},
+	}
+
+	cases := []struct {
+		query   string
+		code    int
+		message string
+		files   []string
+		next    bool
+	}{
+		{query: "?sort=size", code: 200, files: []string{"file1.txt", "file0.txt"}},
+		{query: "?sort=size&order=asc&limit=1", code: 200, files: []string{"file0.txt"}, next: true},
+		{query: "?tag=nightly&owner=anonymous&content_type=text/*", code: 200, files: []string{"file0.txt"}},
+		{query: "?min_size=2", code: 200, files: []string{"file1.txt"}},
+		{query: "?owner=ops", code: 200, files: []string{}},
+		{query: "?sort=name", code: 400, message: "BAD_FILTER"},
+		{query: "?limit=0", code: 400, message: "BAD_LIMIT"},
+		{query: "?cursor=abc", code: 400, message: "BAD_CURSOR"},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/files"+tc.query, nil)
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("Code for %s must be %d but got %d\n", tc.query, tc.code, w.Code)
+			continue
+		}
+
+		if tc.code != 200 {
+			errResp := ErrorResponse{}
+			json.Unmarshal(w.Body.Bytes(), &errResp)
+
+			if errResp.Error != tc.message {
+				t.Errorf("Error message must be %v but got %v\n", tc.message, errResp.Error)
+			}
+
+			continue
+		}
+
+		res := FileListResponse{}
+		json.Unmarshal(w.Body.Bytes(), &res)
+
+		files := []string{}
+		for _, f := range res.Files {
+			files = append(files, f.Filename)
+
+			if f.Owner != anonymousPrincipal || f.CreatedAt == nil || f.Size == 0 || len(f.Tags) == 0 {
+				t.Errorf("File info must be complete but got %+v\n", f)
+			}
+		}
+
+		if !reflect.DeepEqual(files, tc.files) || (res.NextCursor != "") != tc.next {
+			t.Errorf("Files for %s must be %v (next %v) but got %v (%s)\n", tc.query, tc.files, tc.next, files, res.NextCursor)
+		}
+	}
+}
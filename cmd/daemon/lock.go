@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+// errLockLost is returned when lease of lock has expired or lock has been taken by someone else
+var errLockLost = errors.New("Lock has been lost")
+
+// renewLockScript prolongs lock only if it's still held by the same owner
+var renewLockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+
+return 0
+`)
+
+// releaseLockScript removes lock only if it's still held by the same owner
+var releaseLockScript = redis.NewScript(1, `
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+
+return 0
+`)
+
+// RedisLock struct is distributed lock with lease
+// every acquisition gets fencing token which is greater than all previous ones and is a part of lock value,
+// destructive operations of holder are done in transactions which are executed only if lock is still held with its token
+type RedisLock struct {
+	Token int64
+
+	redis *Redis
+	key   string
+	value string
+	ttl   time.Duration
+	lost  int32
+}
+
+// AcquireLock method tries to take lock for ttl, nil is returned if lock is held by someone else
+func (r *Redis) AcquireLock(key string, ttl time.Duration) (*RedisLock, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	token, err := redis.Int64(conn.Do("INCR", key+":FENCING"))
+	if err != nil {
+		return nil, err
+	}
+
+	l := &RedisLock{
+		Token: token,
+		redis: r,
+		key:   key,
+		value: getLockOwner() + ":" + strconv.FormatInt(token, 10),
+		ttl:   ttl,
+	}
+
+	_, err = redis.String(conn.Do("SET", key, l.value, "NX", "PX", int64(ttl/time.Millisecond)))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+// Check method returns true if lock is still held with the same token
+func (l *RedisLock) Check() (bool, error) {
+	if l.IsLost() {
+		return false, nil
+	}
+
+	conn := l.redis.Get()
+	defer conn.Close()
+
+	v, err := redis.String(conn.Do("GET", l.key))
+	if err != nil && err != redis.ErrNil {
+		return false, err
+	}
+
+	if v != l.value {
+		atomic.StoreInt32(&l.lost, 1)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// watch method watches lock on conn and checks that it's still held, errLockLost is returned otherwise
+// transaction which follows on conn is not executed if lock is changed after the check, nil lock is not checked
+func (l *RedisLock) watch(conn redis.Conn) error {
+	if l == nil {
+		return nil
+	}
+
+	_, err := conn.Do("WATCH", l.key)
+	if err != nil {
+		return err
+	}
+
+	v, err := redis.String(conn.Do("GET", l.key))
+	if err != nil && err != redis.ErrNil {
+		conn.Do("UNWATCH")
+		return err
+	}
+
+	if v != l.value {
+		conn.Do("UNWATCH")
+		atomic.StoreInt32(&l.lost, 1)
+		return errLockLost
+	}
+
+	return nil
+}
+
+// exec method executes transaction on conn and returns its replies
+// errLockLost is returned if transaction has been aborted because watched lock has been changed
+func (l *RedisLock) exec(conn redis.Conn) ([]interface{}, error) {
+	values, err := redis.Values(conn.Do("EXEC"))
+	if err == redis.ErrNil && l != nil {
+		atomic.StoreInt32(&l.lost, 1)
+		return nil, errLockLost
+	}
+
+	return values, err
+}
+
+// Renew method prolongs lease, false is returned if lock has been lost
+func (l *RedisLock) Renew() (bool, error) {
+	conn := l.redis.Get()
+	defer conn.Close()
+
+	ok, err := redis.Int(renewLockScript.Do(conn, l.key, l.value, int64(l.ttl/time.Millisecond)))
+	if err != nil {
+		return false, err
+	}
+
+	if ok == 0 {
+		atomic.StoreInt32(&l.lost, 1)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// KeepAlive method renews lease every third of ttl until ctx is done
+// cancel is called when lease is lost or could not be renewed before it expires
+func (l *RedisLock) KeepAlive(ctx context.Context, cancel context.CancelFunc) {
+	ticker := time.NewTicker(l.ttl / 3)
+	defer ticker.Stop()
+
+	renewedAt := time.Now()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			ok, err := l.Renew()
+			if err == nil && ok {
+				renewedAt = time.Now()
+				continue
+			}
+
+			// temporary redis error is tolerated while lease is valid
+			if err != nil && time.Since(renewedAt) < l.ttl*2/3 {
+				continue
+			}
+
+			atomic.StoreInt32(&l.lost, 1)
+			cancel()
+
+			return
+		}
+	}
+}
+
+// IsLost method returns true if lock loss has been detected
+func (l *RedisLock) IsLost() bool {
+	return atomic.LoadInt32(&l.lost) == 1
+}
+
+// Release method removes lock if it's still held
+func (l *RedisLock) Release() error {
+	conn := l.redis.Get()
+	defer conn.Close()
+
+	_, err := releaseLockScript.Do(conn, l.key, l.value)
+
+	return err
+}
+
+// getLockOwner func returns identifier of process for lock values
+func getLockOwner() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+
+	return host + ":" + strconv.Itoa(os.Getpid())
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/garyburd/redigo/redis"
+)
+
+func TestRedisLock(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	lock, err := r.AcquireLock("EXAMPLE_LOCK", time.Minute)
+	if err != nil || lock == nil {
+		t.Errorf("Lock must be acquired but got %v\n", err)
+		return
+	}
+
+	other, err := r.AcquireLock("EXAMPLE_LOCK", time.Minute)
+	if err != nil || other != nil {
+		t.Errorf("Lock must not be acquired twice (%v)\n", err)
+	}
+
+	if ok, err := lock.Check(); !ok || err != nil {
+		t.Errorf("Lock must be held (%v)\n", err)
+	}
+
+	if ok, err := lock.Renew(); !ok || err != nil {
+		t.Errorf("Lock must be renewed (%v)\n", err)
+	}
+
+	err = lock.Release()
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	next, err := r.AcquireLock("EXAMPLE_LOCK", time.Minute)
+	if err != nil || next == nil {
+		t.Errorf("Lock must be acquired after release (%v)\n", err)
+		return
+	}
+
+	// fencing token grows with every acquisition attempt
+	if next.Token <= lock.Token {
+		t.Errorf("Token %d must be greater than %d\n", next.Token, lock.Token)
+	}
+
+	// released lock is not held anymore and could not be renewed
+	if ok, _ := lock.Check(); ok {
+		t.Error("Released lock must not be held")
+	}
+
+	if ok, _ := lock.Renew(); ok {
+		t.Error("Released lock must not be renewed")
+	}
+
+	// old owner must not release new lock
+	lock.Release()
+
+	if ok, _ := next.Check(); !ok {
+		t.Error("Lock must be held by new owner")
+	}
+
+	next.Release()
+}
+
+func TestRedisLockKeepAlive(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	lock, _ := r.AcquireLock("EXAMPLE_LOCK", 300*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	done := make(chan struct{})
+	go func() {
+		lock.KeepAlive(ctx, cancel)
+		close(done)
+	}()
+
+	// lease is renewed
+	time.Sleep(500 * time.Millisecond)
+
+	if ok, _ := lock.Check(); !ok {
+		t.Error("Lock must be renewed")
+	}
+
+	// lock is taken by someone else
+	conn.Do("SET", "EXAMPLE_LOCK", "other")
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("KeepAlive must be stopped when lock is lost")
+		return
+	}
+
+	if ctx.Err() != context.Canceled {
+		t.Error("Context must be canceled when lock is lost")
+	}
+
+	if !lock.IsLost() {
+		t.Error("Lock must be lost")
+	}
+
+	if err := checkLease(ctx, lock); err != errLockLost {
+		t.Errorf("Error must be %v but got %v\n", errLockLost, err)
+	}
+}
+
+func TestCheckLease(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	lock, _ := r.AcquireLock("EXAMPLE_LOCK", time.Minute)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	if err := checkLease(ctx, lock); err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	cancel()
+
+	if err := checkLease(ctx, lock); err != context.Canceled {
+		t.Errorf("Error must be %v but got %v\n", context.Canceled, err)
+	}
+
+	// lease has expired and lock has been taken by another node
+	conn.Do("SET", "EXAMPLE_LOCK", "other")
+
+	if err := checkLease(context.Background(), lock); err != errLockLost {
+		t.Errorf("Error must be %v but got %v\n", errLockLost, err)
+	}
+}
+
+func TestApplicationEvictFileFenced(t *testing.T) {
+	cfg := &StorageConfig{
+		Path:  "mocks/storage/",
+		Limit: 1,
+	}
+	app := NewApplication(&Config{Storage: cfg}, NewStorage(cfg), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+
+	for _, hash := range []string{"example1", "example2"} {
+		app.Storage.CreateFile(hash, bytes.NewBuffer([]byte("example")))
+		defer app.Storage.RemoveFile(hash)
+
+		app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: 7, CreatedAt: &now})
+		app.Redis.RecordAccess(hash, now, time.Hour)
+	}
+
+	policy, _ := NewEvictionPolicy(policyGDSF, app.Redis)
+
+	app.MoveToTrash("example2", now)
+	defer app.Storage.PurgeFile("example2")
+
+	lock, _ := app.Redis.AcquireLock(autoCleanLockKey, time.Minute)
+
+	// node has been paused, lease has expired and lock has been taken by another node
+	conn.Do("SET", autoCleanLockKey, "other")
+
+	if _, _, err := app.evictFile("example1", policy, lock, nil); err != errLockLost {
+		t.Errorf("Error must be %v but got %v\n", errLockLost, err)
+	}
+
+	if inflation, _ := redis.Float64(conn.Do("GET", inflationKey)); inflation != 0 {
+		t.Errorf("Inflation must be %v but got %v\n", 0, inflation)
+	}
+
+	if _, ok := app.Storage.GetFile("example1"); !ok {
+		t.Error("File must not be removed")
+	}
+
+	if hashes, _ := app.Redis.GetLiveFiles(0, 10); len(hashes) != 1 {
+		t.Errorf("Metadata must not be removed but got %v\n", hashes)
+	}
+
+	if _, _, err := app.purgeTrashFile("example2", "autoclean", lock); err != errLockLost {
+		t.Errorf("Error must be %v but got %v\n", errLockLost, err)
+	}
+
+	if hashes, _ := app.Redis.GetTrashedFiles(0, 10); len(hashes) != 1 {
+		t.Errorf("Trashed file must not be purged but got %v\n", hashes)
+	}
+
+	if !lock.IsLost() {
+		t.Error("Lock must be lost")
+	}
+
+	// holder of lock removes files
+	conn.Do("DEL", autoCleanLockKey)
+	lock, _ = app.Redis.AcquireLock(autoCleanLockKey, time.Minute)
+
+	if _, ok, err := app.evictFile("example1", policy, lock, nil); !ok || err != nil {
+		t.Errorf("File must be evicted but got %v\n", err)
+	}
+
+	if inflation, _ := redis.Float64(conn.Do("GET", inflationKey)); inflation == 0 {
+		t.Error("Inflation must be raised\n")
+	}
+
+	if _, ok, err := app.purgeTrashFile("example2", "autoclean", lock); !ok || err != nil {
+		t.Errorf("File must be purged but got %v\n", err)
+	}
+}
+
+func TestApplicationAutoCleanLocked(t *testing.T) {
+	cfg := &StorageConfig{
+		Path:  "mocks/storage/",
+		Limit: 1,
+	}
+	app := NewApplication(&Config{Storage: cfg}, NewStorage(cfg), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+
+	conn := app.Redis.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+	app.Storage.CreateFile("example1", bytes.NewBuffer([]byte("example")))
+	defer app.Storage.RemoveFile("example1")
+
+	app.Redis.SaveFileMeta(&FileMeta{Hash: "example1", Size: 7, CreatedAt: &now})
+
+	// another node is cleaning storage
+	conn.Do("SET", autoCleanLockKey, "other")
+
+	err := app.AutoClean()
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	}
+
+	if _, ok := app.Storage.GetFile("example1"); !ok {
+		t.Error("File must not be removed")
+	}
+
+	if v := app.Metrics.AutoCleanRuns.Value("skipped"); v != 1 {
+		t.Errorf("Skipped runs must be %v but got %v\n", 1, v)
+	}
+
+	// the same process does not run autoclean twice
+	conn.Do("DEL", autoCleanLockKey)
+	app.cleanInProgress = 1
+
+	app.AutoClean()
+
+	if v := app.Metrics.AutoCleanRuns.Value("skipped"); v != 2 {
+		t.Errorf("Skipped runs must be %v but got %v\n", 2, v)
+	}
+
+	app.markCleanAsStopped()
+
+	app.AutoClean()
+
+	if _, ok := app.Storage.GetFile("example1"); ok {
+		t.Error("File must be removed")
+	}
+
+	// lock is released after run
+	if v, _ := conn.Do("GET", autoCleanLockKey); v != nil {
+		t.Errorf("Lock must be released but got %v\n", v)
+	}
+}
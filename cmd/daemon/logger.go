@@ -0,0 +1,376 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// LogLevel type
+type LogLevel int
+
+// log levels
+const (
+	LevelDebug LogLevel = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[LogLevel]string{
+	LevelDebug: "debug",
+	LevelInfo:  "info",
+	LevelWarn:  "warn",
+	LevelError: "error",
+}
+
+// ParseLogLevel func converts level name to LogLevel
+func ParseLogLevel(name string) (LogLevel, error) {
+	for level, v := range levelNames {
+		if strings.EqualFold(v, name) {
+			return level, nil
+		}
+	}
+
+	if name == "" {
+		return LevelInfo, nil
+	}
+
+	return LevelInfo, errors.New("Unknown log level " + name)
+}
+
+// LogConfig struct contains info about
+// - minimal level of messages (debug, info, warn, error)
+// - format of messages (logfmt or json)
+// - file for messages (stderr if empty)
+// - max size of file in bytes before rotation (0 - no rotation)
+// - count of rotated files which should be kept
+type LogConfig struct {
+	Level      string `json:"level"`
+	Format     string `json:"format"`
+	File       string `json:"file"`
+	MaxSize    int64  `json:"max_size"`
+	MaxBackups int    `json:"max_backups"`
+}
+
+// logOutput is shared between logger and its children
+type logOutput struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// Logger struct is leveled structured logger
+type Logger struct {
+	out    *logOutput
+	level  LogLevel
+	format string
+	fields []interface{}
+}
+
+// With method returns child logger which adds key/value pairs to every message
+func (l *Logger) With(kv ...interface{}) *Logger {
+	if l == nil {
+		return nil
+	}
+
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	fields = append(fields, kv...)
+
+	return &Logger{
+		out:    l.out,
+		level:  l.level,
+		format: l.format,
+		fields: fields,
+	}
+}
+
+// Debug method
+func (l *Logger) Debug(msg string, kv ...interface{}) {
+	l.log(LevelDebug, msg, kv)
+}
+
+// Info method
+func (l *Logger) Info(msg string, kv ...interface{}) {
+	l.log(LevelInfo, msg, kv)
+}
+
+// Warn method
+func (l *Logger) Warn(msg string, kv ...interface{}) {
+	l.log(LevelWarn, msg, kv)
+}
+
+// Error method
+func (l *Logger) Error(msg string, kv ...interface{}) {
+	l.log(LevelError, msg, kv)
+}
+
+// Close method closes underlying file if it has been opened by logger
+func (l *Logger) Close() error {
+	if l == nil {
+		return nil
+	}
+
+	if c, ok := l.out.w.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+func (l *Logger) log(level LogLevel, msg string, kv []interface{}) {
+	// nil logger discards everything, it's useful for tests
+	if l == nil || level < l.level {
+		return
+	}
+
+	pairs := make([]interface{}, 0, 6+len(l.fields)+len(kv))
+	pairs = append(pairs, "time", time.Now().UTC().Format(time.RFC3339Nano), "level", levelNames[level], "msg", msg)
+	pairs = append(pairs, l.fields...)
+	pairs = append(pairs, kv...)
+
+	var line string
+	if l.format == "json" {
+		line = formatJSON(pairs)
+	} else {
+		line = formatLogfmt(pairs)
+	}
+
+	l.out.Lock()
+	io.WriteString(l.out.w, line+"\n")
+	l.out.Unlock()
+}
+
+// NewLogger func returns Logger pointer
+func NewLogger(cfg *LogConfig) (*Logger, error) {
+	if cfg == nil {
+		cfg = &LogConfig{}
+	}
+
+	level, err := ParseLogLevel(cfg.Level)
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Format != "" && cfg.Format != "logfmt" && cfg.Format != "json" {
+		return nil, errors.New("Unknown log format " + cfg.Format)
+	}
+
+	var w io.Writer = os.Stderr
+
+	if cfg.File != "" {
+		w, err = NewRotatingFile(cfg.File, cfg.MaxSize, cfg.MaxBackups)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return NewWriterLogger(w, level, cfg.Format), nil
+}
+
+// NewWriterLogger func returns Logger pointer which writes to w
+func NewWriterLogger(w io.Writer, level LogLevel, format string) *Logger {
+	return &Logger{
+		out:    &logOutput{w: w},
+		level:  level,
+		format: format,
+	}
+}
+
+func formatLogfmt(pairs []interface{}) string {
+	parts := make([]string, 0, len(pairs)/2+1)
+
+	for i := 0; i < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+
+		var value interface{} = "MISSING"
+		if i+1 < len(pairs) {
+			value = pairs[i+1]
+		}
+
+		parts = append(parts, key+"="+quoteLogfmt(logValueString(value)))
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func quoteLogfmt(v string) string {
+	if v == "" {
+		return `""`
+	}
+
+	if strings.ContainsAny(v, " =\"\t\r\n\\") {
+		return strconv.Quote(v)
+	}
+
+	return v
+}
+
+func formatJSON(pairs []interface{}) string {
+	parts := make([]string, 0, len(pairs)/2+1)
+	seen := map[string]bool{}
+
+	for i := 0; i < len(pairs); i += 2 {
+		key := fmt.Sprint(pairs[i])
+
+		var value interface{} = "MISSING"
+		if i+1 < len(pairs) {
+			value = pairs[i+1]
+		}
+
+		// json keys must be unique, so the first value wins
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		k, _ := json.Marshal(key)
+
+		var v []byte
+		switch value.(type) {
+		case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+			v, _ = json.Marshal(value)
+		default:
+			v, _ = json.Marshal(logValueString(value))
+		}
+
+		parts = append(parts, string(k)+":"+string(v))
+	}
+
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func logValueString(value interface{}) string {
+	switch v := value.(type) {
+	case nil:
+		return "nil"
+	case string:
+		return v
+	case error:
+		return v.Error()
+	case time.Duration:
+		return strconv.FormatFloat(v.Seconds(), 'f', -1, 64)
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return fmt.Sprint(value)
+}
+
+// RotatingFile struct is a file writer which rotates file when it reaches max size
+type RotatingFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// Write method
+func (f *RotatingFile) Write(b []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	var rotateErr error
+
+	if f.maxSize > 0 && f.size+int64(len(b)) > f.maxSize && f.size > 0 {
+		// file which could not be moved is still written, rotation is retried by next write
+		rotateErr = f.rotate()
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+
+	if err == nil {
+		err = rotateErr
+	}
+
+	return n, err
+}
+
+// Close method
+func (f *RotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	return f.file.Close()
+}
+
+// Reopen method reopens file, it's useful for external rotation (logrotate)
+func (f *RotatingFile) Reopen() error {
+	f.Lock()
+	defer f.Unlock()
+
+	f.file.Close()
+
+	return f.open()
+}
+
+// rotate method moves file to backup and opens new one, file is reopened even if it could not be moved
+// open file could not be renamed on windows, so it's closed first
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+
+	err := f.shift()
+
+	if e := f.open(); e != nil {
+		return e
+	}
+
+	return err
+}
+
+// shift method removes the oldest backup and shifts others: file -> file.1 -> file.2 ...
+func (f *RotatingFile) shift() error {
+	if f.maxBackups == 0 {
+		return os.Remove(f.path)
+	}
+
+	os.Remove(f.path + "." + strconv.Itoa(f.maxBackups))
+
+	for i := f.maxBackups - 1; i > 0; i-- {
+		os.Rename(f.path+"."+strconv.Itoa(i), f.path+"."+strconv.Itoa(i+1))
+	}
+
+	return os.Rename(f.path, f.path+".1")
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+
+	return nil
+}
+
+// NewRotatingFile func returns RotatingFile pointer
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{
+		path:       path,
+		maxSize:    maxSize,
+		maxBackups: maxBackups,
+	}
+
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+
+	return f, nil
+}
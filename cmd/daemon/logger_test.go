@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLevel(t *testing.T) {
+	cases := []struct {
+		name     string
+		level    LogLevel
+		hasError bool
+	}{
+		{
+			name:  "",
+			level: LevelInfo,
+		},
+		{
+			name:  "debug",
+			level: LevelDebug,
+		},
+		{
+			name:  "WARN",
+			level: LevelWarn,
+		},
+		{
+			name:  "error",
+			level: LevelError,
+		},
+		{
+			name:     "example",
+			level:    LevelInfo,
+			hasError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		level, err := ParseLogLevel(tc.name)
+
+		if tc.hasError != (err != nil) {
+			t.Errorf("Error must be %t but got %v\n", tc.hasError, err)
+		}
+
+		if level != tc.level {
+			t.Errorf("Level must be %d but got %d\n", tc.level, level)
+		}
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	cases := []struct {
+		cfg      *LogConfig
+		hasError bool
+	}{
+		{
+			cfg: nil,
+		},
+		{
+			cfg: &LogConfig{Level: "debug", Format: "json"},
+		},
+		{
+			cfg:      &LogConfig{Level: "example"},
+			hasError: true,
+		},
+		{
+			cfg:      &LogConfig{Format: "example"},
+			hasError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		l, err := NewLogger(tc.cfg)
+
+		if tc.hasError {
+			if err == nil {
+				t.Error("Error must not be nil")
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+		}
+
+		if l == nil {
+			t.Error("Logger must not be nil")
+		}
+	}
+}
+
+func TestLoggerLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewWriterLogger(buf, LevelWarn, "logfmt")
+
+	l.Debug("debug message")
+	l.Info("info message")
+	l.Warn("warn message")
+	l.Error("error message")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Errorf("Lines count must be %d but got %d\n", 2, len(lines))
+		return
+	}
+
+	if !strings.Contains(lines[0], "level=warn") || !strings.Contains(lines[1], "level=error") {
+		t.Errorf("Unexpected lines %v\n", lines)
+	}
+}
+
+func TestLoggerLogfmt(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewWriterLogger(buf, LevelDebug, "logfmt").With("component", "example")
+
+	l.Info("file created", "file_id", "example", "size", 10, "error", errors.New("bad thing"), "duration", 1500*time.Millisecond, "empty", "")
+
+	line := buf.String()
+
+	for _, part := range []string{
+		"level=info",
+		"msg=\"file created\"",
+		"component=example",
+		"file_id=example",
+		"size=10",
+		"error=\"bad thing\"",
+		"duration=1.5",
+		"empty=\"\"",
+	} {
+		if !strings.Contains(line, part) {
+			t.Errorf("Line must contain %s but got %s\n", part, line)
+		}
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewWriterLogger(buf, LevelDebug, "json").With("component", "example")
+
+	l.Error("failed", "size", 10, "ok", true, "error", errors.New("bad thing"), "component", "duplicate")
+
+	data := map[string]interface{}{}
+
+	err := json.Unmarshal(buf.Bytes(), &data)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	expected := map[string]interface{}{
+		"level":     "error",
+		"msg":       "failed",
+		"component": "example",
+		"size":      float64(10),
+		"ok":        true,
+		"error":     "bad thing",
+	}
+
+	for key, val := range expected {
+		if data[key] != val {
+			t.Errorf("%s must be %v but got %v\n", key, val, data[key])
+		}
+	}
+}
+
+func TestNilLogger(t *testing.T) {
+	var l *Logger
+
+	// nil logger must not panic
+	l.With("key", "value").Info("message")
+
+	if err := l.Close(); err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-log")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := path.Join(dir, "daemon.log")
+
+	f, err := NewRotatingFile(fileName, 10, 2)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	for i := 0; i < 4; i++ {
+		if _, err := f.Write([]byte("12345678\n")); err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+		}
+	}
+
+	f.Close()
+
+	for _, name := range []string{"daemon.log", "daemon.log.1", "daemon.log.2"} {
+		v, err := os.Stat(path.Join(dir, name))
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		if v.Size() != 9 {
+			t.Errorf("Size must be %d but got %d\n", 9, v.Size())
+		}
+	}
+
+	if _, err := os.Stat(path.Join(dir, "daemon.log.3")); err == nil {
+		t.Error("Only 2 backups must be kept")
+	}
+}
+
+func TestRotatingFileMoveError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-log")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	fileName := path.Join(dir, "daemon.log")
+
+	// backup could not be replaced by file
+	os.MkdirAll(path.Join(fileName+".1", "busy"), 0755)
+
+	f, err := NewRotatingFile(fileName, 10, 1)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer f.Close()
+
+	f.Write([]byte("12345678\n"))
+
+	if _, err := f.Write([]byte("abcdefgh\n")); err == nil {
+		t.Error("Error must not be nil\n")
+	}
+
+	os.RemoveAll(fileName + ".1")
+
+	if _, err := f.Write([]byte("ABCDEFGH\n")); err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	for name, content := range map[string]string{"daemon.log": "ABCDEFGH\n", "daemon.log.1": "12345678\nabcdefgh\n"} {
+		data, _ := ioutil.ReadFile(path.Join(dir, name))
+		if string(data) != content {
+			t.Errorf("Content of %s must be %q but got %q\n", name, content, data)
+		}
+	}
+}
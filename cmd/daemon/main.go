@@ -4,7 +4,8 @@ import (
 	"flag"
 	"log"
 	"math/rand"
-	"net/http"
+	"net"
+	"os"
 	"strconv"
 	"time"
 )
@@ -16,13 +17,33 @@ func main() {
 
 	flag.Parse()
 
-	cfg, err := NewConfig(*pathPtr)
+	// daemon is started if there is no command
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(*pathPtr, flag.Args(), os.Stdout, os.Stderr))
+	}
+
+	runDaemon(*pathPtr)
+}
+
+func runDaemon(cfgPath string) {
+	cfg, err := NewConfig(cfgPath)
+	if err != nil {
+		log.Fatalf("FATAL\t%s\n", err.Error())
+	}
+
+	logger, err := NewLogger(cfg.Log)
 	if err != nil {
 		log.Fatalf("FATAL\t%s\n", err.Error())
 	}
+	defer logger.Close()
 
-	if cfg.Storage == nil {
-		log.Fatalf("FATAL\t%s\n", "STORAGE_IS_NIL")
+	var accessLog *Logger
+	if cfg.AccessLog != nil {
+		accessLog, err = NewLogger(cfg.AccessLog)
+		if err != nil {
+			log.Fatalf("FATAL\t%s\n", err.Error())
+		}
+		defer accessLog.Close()
 	}
 
 	storage := NewStorage(cfg.Storage)
@@ -30,25 +51,42 @@ func main() {
 	redis := NewRedis(cfg.Redis)
 
 	app := NewApplication(cfg, storage, rateLimiter, redis)
+	app.ConfigPath = cfgPath
+	app.SetLogger(logger)
 
 	h := NewHandler(app)
+	h.AccessLog = accessLog
 
-	go func() {
-		for range time.Tick(10 * time.Minute) {
-			err := app.AutoClean()
-			if err != nil {
-				// @todo log or send metric
-			}
-		}
-	}()
+	app.RunReconcileUsage(time.Duration(cfg.Storage.ReconcileInterval) * time.Second)
+	app.RunAutoClean()
+	app.RunPurgeTrash()
+	app.RunReapExpired()
+	app.RunScrub()
+	app.RunRereplicate()
 
-	log.Println(cfg.Host + ":" + strconv.Itoa(cfg.Port))
+	// members of cluster are known before the first request
+	app.heartbeat()
+	app.RunCluster()
 
-	// for simplicity we don't handle https requests
-	err = http.ListenAndServe(cfg.Host+":"+strconv.Itoa(cfg.Port), h)
+	addr := cfg.Host + ":" + strconv.Itoa(cfg.Port)
+
+	l, err := net.Listen("tcp", addr)
 	if err != nil {
-		// again for simplicity we don't check config values, just check errors
+		logger.Error("could not listen", "addr", addr, "error", err)
 		log.Fatalf("FATAL\t%s\n", err.Error())
 	}
 
+	logger.Info("listening", "addr", addr)
+
+	server, err := NewServer(app, h)
+	if err != nil {
+		logger.Error("could not create server", "error", err)
+		log.Fatalf("FATAL\t%s\n", err.Error())
+	}
+
+	err = server.Run(l)
+	if err != nil {
+		logger.Error("server stopped", "error", err)
+		log.Fatalf("FATAL\t%s\n", err.Error())
+	}
 }
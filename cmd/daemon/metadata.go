@@ -0,0 +1,374 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+// max size of original filename in bytes, longer names are truncated
+const maxFilenameSize = 255
+
+// max total size of keys and values of custom metadata in bytes
+const maxUserMetaSize = 2048
+
+// custom metadata is sent and returned in headers with this prefix, keys are stored in lower case without it
+const userMetaPrefix = "X-Meta-"
+
+// max count of tags of file and max size of tag in bytes
+const (
+	maxTags    = 32
+	maxTagSize = 64
+)
+
+var (
+	// errUserMetaTooLarge is returned if custom metadata exceeds maxUserMetaSize
+	errUserMetaTooLarge = errors.New("Custom metadata is too large")
+	// errBadUserMeta is returned if key or value of custom metadata could not be sent in header
+	errBadUserMeta = errors.New("Custom metadata contains invalid key or value")
+	// errBadTags is returned if there are too many tags or tag contains invalid characters
+	errBadTags = errors.New("Tags are invalid")
+)
+
+// MetaUpdate struct contains changes of file metadata, missing fields are not changed
+// empty filename or content type removes it, custom metadata and tags are replaced entirely
+type MetaUpdate struct {
+	Filename    *string           `json:"filename"`
+	ContentType *string           `json:"content_type"`
+	Meta        map[string]string `json:"meta"`
+	Tags        []string          `json:"tags"`
+}
+
+// MetaResponse struct
+type MetaResponse struct {
+	Filename    string            `json:"filename"`
+	ContentType string            `json:"content_type"`
+	Meta        map[string]string `json:"meta"`
+	Tags        []string          `json:"tags"`
+}
+
+// sanitizeFilename func returns base name of uploaded file without control characters and quotes
+// name is truncated to maxFilenameSize bytes, empty string is returned if nothing is left
+func sanitizeFilename(name string) string {
+	name = strings.Replace(name, "\\", "/", -1)
+	name = path.Base(name)
+
+	name = strings.Map(func(r rune) rune {
+		if r == utf8.RuneError || unicode.IsControl(r) || r == '"' {
+			return -1
+		}
+
+		return r
+	}, name)
+
+	name = strings.TrimSpace(name)
+	if name == "." || name == ".." || name == "/" {
+		return ""
+	}
+
+	for len(name) > maxFilenameSize {
+		_, size := utf8.DecodeLastRuneInString(name)
+		name = name[:len(name)-size]
+	}
+
+	return name
+}
+
+// getContentDisposition func returns attachment header with ascii filename and utf-8 one encoded by rfc 5987
+func getContentDisposition(filename string) string {
+	fallback := strings.Map(func(r rune) rune {
+		if r > unicode.MaxASCII || r == '\\' {
+			return '_'
+		}
+
+		return r
+	}, filename)
+
+	if fallback == filename {
+		return `attachment; filename="` + filename + `"`
+	}
+
+	return `attachment; filename="` + fallback + `"; filename*=UTF-8''` + encodeRFC5987(filename)
+}
+
+// encodeRFC5987 func percent-encodes all bytes except attr-char of rfc 5987
+func encodeRFC5987(s string) string {
+	const hex = "0123456789ABCDEF"
+
+	var b strings.Builder
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+
+		if c < utf8.RuneSelf && (isAlphaNum(c) || strings.IndexByte("!#$&+-.^_`|~", c) >= 0) {
+			b.WriteByte(c)
+			continue
+		}
+
+		b.WriteByte('%')
+		b.WriteByte(hex[c>>4])
+		b.WriteByte(hex[c&0x0f])
+	}
+
+	return b.String()
+}
+
+func isAlphaNum(c byte) bool {
+	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9')
+}
+
+// getContentType func returns declared content type if it's valid and specific, detected one is returned otherwise
+func getContentType(declared, detected string) string {
+	if declared != "" && declared != "application/octet-stream" {
+		if _, _, err := mime.ParseMediaType(declared); err == nil {
+			return declared
+		}
+	}
+
+	return detected
+}
+
+// getUserMeta func returns custom metadata from headers with userMetaPrefix
+func getUserMeta(header http.Header) (map[string]string, error) {
+	meta := map[string]string{}
+
+	for name, values := range header {
+		if !strings.HasPrefix(name, userMetaPrefix) || len(name) == len(userMetaPrefix) {
+			continue
+		}
+
+		meta[strings.ToLower(name[len(userMetaPrefix):])] = values[0]
+	}
+
+	return meta, validateUserMeta(meta)
+}
+
+// validateUserMeta func checks that custom metadata could be sent in headers and it's not too large
+// keys must contain only letters, digits, "-" and "_", values must not contain control characters
+func validateUserMeta(meta map[string]string) error {
+	size := 0
+
+	for k, v := range meta {
+		if k == "" || strings.IndexFunc(k, func(r rune) bool {
+			return r > unicode.MaxASCII || !(isAlphaNum(byte(r)) || r == '-' || r == '_')
+		}) >= 0 {
+			return errBadUserMeta
+		}
+
+		if !utf8.ValidString(v) || strings.IndexFunc(v, unicode.IsControl) >= 0 {
+			return errBadUserMeta
+		}
+
+		size += len(k) + len(v)
+	}
+
+	if size > maxUserMetaSize {
+		return errUserMetaTooLarge
+	}
+
+	return nil
+}
+
+// getTags func returns tags from comma separated list, see normalizeTags
+func getTags(v string) ([]string, error) {
+	if strings.TrimSpace(v) == "" {
+		return []string{}, nil
+	}
+
+	return normalizeTags(strings.Split(v, ","))
+}
+
+// normalizeTags func returns unique lower case tags without spaces around them
+// tags must contain only letters, digits, "-", "_", "." and ":"
+func normalizeTags(tags []string) ([]string, error) {
+	res := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+
+	for _, tag := range tags {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+
+		if tag == "" || len(tag) > maxTagSize || strings.IndexFunc(tag, func(r rune) bool {
+			return r > unicode.MaxASCII || !(isAlphaNum(byte(r)) || strings.ContainsRune("-_.:", r))
+		}) >= 0 {
+			return nil, errBadTags
+		}
+
+		if !seen[tag] {
+			seen[tag] = true
+			res = append(res, tag)
+		}
+	}
+
+	if len(res) > maxTags {
+		return nil, errBadTags
+	}
+
+	return res, nil
+}
+
+// setFileHeaders func sets headers with original filename, content type and custom metadata of file
+// file id is used as filename if original one is unknown
+// file is sent inline if it's requested and its content type is not dangerous, browsers must not sniff content type
+func setFileHeaders(w http.ResponseWriter, hash string, meta *FileMeta, inline bool) {
+	disposition := "attachment; filename=" + hash
+	if meta != nil && meta.Filename != "" {
+		disposition = getContentDisposition(meta.Filename)
+	}
+
+	if inline && meta != nil && meta.ContentType != "" && !isDangerousType(meta.ContentType) {
+		disposition = "inline" + strings.TrimPrefix(disposition, "attachment")
+	}
+
+	w.Header().Set("Content-Disposition", disposition)
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+
+	if meta == nil {
+		return
+	}
+
+	if meta.ContentType != "" {
+		w.Header().Set("Content-Type", meta.ContentType)
+	}
+
+	for k, v := range meta.UserMeta {
+		w.Header().Set(userMetaPrefix+k, v)
+	}
+}
+
+// isInline func checks that client asks to render file in browser by "disposition=inline" query parameter
+func isInline(r *http.Request) bool {
+	return r.URL.Query().Get("disposition") == "inline"
+}
+
+// headFile method renders headers of file without content
+func (h *Handler) headFile(w http.ResponseWriter, r *http.Request, hash string) {
+	// metadata of file encrypted by client key is available only with the same key
+	if _, code, message := h.checkClientKey(r, hash); code != 0 {
+		h.renderError(w, code, message)
+		return
+	}
+
+	meta, ok := h.getLiveFileMeta(w, r, hash)
+	if !ok {
+		return
+	}
+
+	setFileHeaders(w, hash, meta, isInline(r))
+	w.WriteHeader(http.StatusOK)
+}
+
+// updateFileMeta method changes original filename, content type and custom metadata of file
+func (h *Handler) updateFileMeta(w http.ResponseWriter, r *http.Request, hash string) {
+	if _, code, message := h.checkClientKey(r, hash); code != 0 {
+		h.renderError(w, code, message)
+		return
+	}
+
+	update := MetaUpdate{}
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4*maxUserMetaSize)).Decode(&update)
+	if err != nil {
+		h.renderError(w, http.StatusBadRequest, "BAD_REQUEST")
+		return
+	}
+
+	if update.ContentType != nil && *update.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(*update.ContentType); err != nil {
+			h.renderError(w, http.StatusBadRequest, "BAD_CONTENT_TYPE")
+			return
+		}
+
+		// content is not detected again, only new content type is checked by allow and deny lists
+		if !isAllowedType(h.App.GetConfig(), getRequestInfo(r).Principal, *update.ContentType, "") {
+			h.renderError(w, http.StatusUnsupportedMediaType, "CONTENT_TYPE_NOT_ALLOWED")
+			return
+		}
+	}
+
+	if update.Meta != nil {
+		err = validateUserMeta(update.Meta)
+		if err == errUserMetaTooLarge {
+			h.renderError(w, http.StatusBadRequest, "META_TOO_LARGE")
+			return
+		} else if err != nil {
+			h.renderError(w, http.StatusBadRequest, "BAD_META")
+			return
+		}
+	}
+
+	var tags []string
+	if update.Tags != nil {
+		tags, err = normalizeTags(update.Tags)
+		if err != nil {
+			h.renderError(w, http.StatusBadRequest, "BAD_TAGS")
+			return
+		}
+	}
+
+	meta, ok := h.getLiveFileMeta(w, r, hash)
+	if !ok {
+		return
+	}
+
+	if update.Filename != nil {
+		meta.Filename = sanitizeFilename(*update.Filename)
+	}
+
+	if update.ContentType != nil {
+		meta.ContentType = *update.ContentType
+	}
+
+	if update.Meta != nil {
+		meta.UserMeta = update.Meta
+	}
+
+	if update.Tags != nil {
+		meta.Tags = tags
+	}
+
+	err = h.App.Redis.UpdateFileMeta(meta)
+	if err != nil {
+		h.requestLogger(r).Error("could not update file meta", "file_id", hash, "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return
+	}
+
+	res := MetaResponse{Filename: meta.Filename, ContentType: meta.ContentType, Meta: meta.UserMeta, Tags: meta.Tags}
+	if res.Meta == nil {
+		res.Meta = map[string]string{}
+	}
+
+	if res.Tags == nil {
+		res.Tags = []string{}
+	}
+
+	h.renderJSON(w, http.StatusOK, res)
+}
+
+// getLiveFileMeta method returns metadata of stored file which is not expired, error is rendered otherwise
+func (h *Handler) getLiveFileMeta(w http.ResponseWriter, r *http.Request, hash string) (*FileMeta, bool) {
+	meta, err := h.App.Redis.GetFileMeta(hash)
+	if err != nil {
+		h.requestLogger(r).Error("could not get file meta", "file_id", hash, "error", err)
+		h.renderError(w, http.StatusInternalServerError, "INTERNAL_SERVER_ERROR")
+		return nil, false
+	}
+
+	if _, ok := h.App.Storage.FindFile(hash); !ok || meta == nil {
+		h.renderMissingFile(w, r, hash)
+		return nil, false
+	}
+
+	if meta.ExpiresAt != nil && !time.Now().Before(*meta.ExpiresAt) {
+		h.renderError(w, http.StatusGone, "FILE_EXPIRED")
+		return nil, false
+	}
+
+	return meta, true
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSanitizeFilename(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{name: "report.pdf", expected: "report.pdf"},
+		{name: "../../etc/passwd", expected: "passwd"},
+		{name: `C:\Users\me\photo.jpg`, expected: "photo.jpg"},
+		{name: "bad\"name\x00\n.txt", expected: "badname.txt"},
+		{name: " отчёт.txt ", expected: "отчёт.txt"},
+		{name: "..", expected: ""},
+		{name: "", expected: ""},
+		{name: strings.Repeat("я", 200), expected: strings.Repeat("я", 127)},
+	}
+
+	for _, tc := range cases {
+		if v := sanitizeFilename(tc.name); v != tc.expected {
+			t.Errorf("Filename for %q must be %q but got %q\n", tc.name, tc.expected, v)
+		}
+	}
+}
+
+func TestGetContentDisposition(t *testing.T) {
+	cases := []struct {
+		filename string
+		expected string
+	}{
+		{filename: "report.pdf", expected: `attachment; filename="report.pdf"`},
+		{filename: "my report;1.pdf", expected: `attachment; filename="my report;1.pdf"`},
+		{filename: "отчёт 1.txt", expected: `attachment; filename="_____ 1.txt"; filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82%201.txt`},
+	}
+
+	for _, tc := range cases {
+		if v := getContentDisposition(tc.filename); v != tc.expected {
+			t.Errorf("Header for %q must be %s but got %s\n", tc.filename, tc.expected, v)
+		}
+	}
+}
+
+func TestGetUserMeta(t *testing.T) {
+	cases := []struct {
+		headers map[string]string
+		meta    map[string]string
+		err     error
+	}{
+		{headers: map[string]string{}, meta: map[string]string{}, err: nil},
+		{headers: map[string]string{"X-Meta-Project": "t2", "X-Meta-Build-Id": "42", "X-Other": "1"}, meta: map[string]string{"project": "t2", "build-id": "42"}, err: nil},
+		{headers: map[string]string{"X-Meta-Project": strings.Repeat("a", maxUserMetaSize)}, meta: nil, err: errUserMetaTooLarge},
+		{headers: map[string]string{"X-Meta-Project.Name": "t2"}, meta: nil, err: errBadUserMeta},
+	}
+
+	for _, tc := range cases {
+		header := http.Header{}
+		for k, v := range tc.headers {
+			header.Set(k, v)
+		}
+
+		meta, err := getUserMeta(header)
+		if err != tc.err {
+			t.Errorf("Error for %v must be %v but got %v\n", tc.headers, tc.err, err)
+			continue
+		}
+
+		if err == nil && (len(meta) != len(tc.meta) || meta["project"] != tc.meta["project"] || meta["build-id"] != tc.meta["build-id"]) {
+			t.Errorf("Meta for %v must be %v but got %v\n", tc.headers, tc.meta, meta)
+		}
+	}
+}
+
+func TestHandlerFileMeta(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{MaxSize: 1024})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	h := NewHandler(app)
+
+	body := &bytes.Buffer{}
+	writer := multipart.NewWriter(body)
+
+	part, _ := writer.CreatePart(textproto.MIMEHeader{
+		"Content-Disposition": {`form-data; name="file"; filename="../отчёт.csv"`},
+		"Content-Type":        {"text/csv"},
+	})
+	part.Write([]byte("a,b\n1,2\n"))
+	writer.Close()
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("POST", "/files", body)
+	r.Header.Set("Content-Type", writer.FormDataContentType())
+	r.Header.Set("X-Meta-Project", "t2")
+	h.ServeHTTP(w, r)
+
+	res := UploadResponse{}
+	json.Unmarshal(w.Body.Bytes(), &res)
+
+	if w.Code != 200 {
+		t.Fatalf("Code must be %d but got %d\n", 200, w.Code)
+	}
+
+	app.wg.Wait()
+
+	for _, method := range []string{"GET", "HEAD"} {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(method, "/files/"+res.Hash, nil)
+		h.ServeHTTP(w, r)
+
+		if w.Code != 200 {
+			t.Errorf("Code for %s must be %d but got %d\n", method, 200, w.Code)
+		}
+
+		if v := w.Header().Get("Content-Disposition"); !strings.Contains(v, "filename*=UTF-8''%D0%BE%D1%82%D1%87%D1%91%D1%82.csv") {
+			t.Errorf("Content disposition for %s must contain original filename but got %s\n", method, v)
+		}
+
+		if v := w.Header().Get("Content-Type"); v != "text/csv" {
+			t.Errorf("Content type for %s must be %s but got %s\n", method, "text/csv", v)
+		}
+
+		if v := w.Header().Get("X-Meta-Project"); v != "t2" {
+			t.Errorf("Custom metadata for %s must be %s but got %s\n", method, "t2", v)
+		}
+	}
+
+	app.wg.Wait()
+
+	cases := []struct {
+		hash    string
+		body    string
+		code    int
+		message string
+	}{
+		{hash: res.Hash, body: `{"filename": "data.csv", "meta": {"owner": "ops"}}`, code: 200},
+		{hash: res.Hash, body: `{"content_type": "text/plain; charset=utf-8"}`, code: 200},
+		{hash: res.Hash, body: `{"content_type": "text/"}`, code: 400, message: "BAD_CONTENT_TYPE"},
+		{hash: res.Hash, body: `{"meta": {"owner": "` + strings.Repeat("a", maxUserMetaSize) + `"}}`, code: 400, message: "META_TOO_LARGE"},
+		{hash: res.Hash, body: `{"meta": {"bad key": "value"}}`, code: 400, message: "BAD_META"},
+		{hash: res.Hash, body: `{"tags": ["Release", "release", "v1.0"]}`, code: 200},
+		{hash: res.Hash, body: `{"tags": ["bad tag"]}`, code: 400, message: "BAD_TAGS"},
+		{hash: res.Hash, body: `{`, code: 400, message: "BAD_REQUEST"},
+		{hash: getTestFileID("missing", time.Now()), body: `{}`, code: 404, message: "FILE_NOT_FOUND"},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("PATCH", "/files/"+tc.hash+"/meta", strings.NewReader(tc.body))
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("Code for %s must be %d but got %d\n", tc.body, tc.code, w.Code)
+		}
+
+		errResp := ErrorResponse{}
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+
+		if tc.message != "" && errResp.Error != tc.message {
+			t.Errorf("Error message must be %v but got %v\n", tc.message, errResp.Error)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r, _ = http.NewRequest("HEAD", "/files/"+res.Hash, nil)
+	h.ServeHTTP(w, r)
+
+	if v := w.Header().Get("Content-Disposition"); v != `attachment; filename="data.csv"` {
+		t.Errorf("Content disposition must be changed but got %s\n", v)
+	}
+
+	if v := w.Header().Get("Content-Type"); v != "text/plain; charset=utf-8" {
+		t.Errorf("Content type must be changed but got %s\n", v)
+	}
+
+	if w.Header().Get("X-Meta-Project") != "" || w.Header().Get("X-Meta-Owner") != "ops" {
+		t.Errorf("Custom metadata must be replaced but got %v\n", w.Header())
+	}
+}
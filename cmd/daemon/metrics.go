@@ -0,0 +1,381 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// default latency buckets in seconds
+var defaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metric is a single family which can be rendered in prometheus text format
+type metric interface {
+	write(w io.Writer)
+}
+
+// CounterVec struct is a counter partitioned by labels
+type CounterVec struct {
+	sync.Mutex
+	name   string
+	help   string
+	labels []string
+	values map[string]float64
+}
+
+// Inc method increments counter by one
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+// Add method adds value to counter
+func (c *CounterVec) Add(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	c.Lock()
+	c.values[key] += v
+	c.Unlock()
+}
+
+// Value method returns current counter value
+func (c *CounterVec) Value(labelValues ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+
+	return c.values[strings.Join(labelValues, "\xff")]
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.Lock()
+	defer c.Unlock()
+
+	writeHeader(w, c.name, c.help, "counter")
+
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, formatLabels(c.labels, key, "", ""), formatValue(c.values[key]))
+	}
+}
+
+// NewCounterVec func returns CounterVec pointer
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		name:   name,
+		help:   help,
+		labels: labels,
+		values: map[string]float64{},
+	}
+
+	// counter without labels should be rendered even if it has not been touched
+	if len(labels) == 0 {
+		c.values[""] = 0
+	}
+
+	return c
+}
+
+// GaugeVec struct is a gauge partitioned by labels
+type GaugeVec struct {
+	CounterVec
+}
+
+// Set method sets gauge value
+func (g *GaugeVec) Set(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	g.Lock()
+	g.values[key] = v
+	g.Unlock()
+}
+
+func (g *GaugeVec) write(w io.Writer) {
+	g.Lock()
+	defer g.Unlock()
+
+	writeHeader(w, g.name, g.help, "gauge")
+
+	for _, key := range sortedKeys(g.values) {
+		fmt.Fprintf(w, "%s%s %s\n", g.name, formatLabels(g.labels, key, "", ""), formatValue(g.values[key]))
+	}
+}
+
+// NewGaugeVec func returns GaugeVec pointer
+func NewGaugeVec(name, help string, labels ...string) *GaugeVec {
+	g := &GaugeVec{
+		CounterVec: CounterVec{
+			name:   name,
+			help:   help,
+			labels: labels,
+			values: map[string]float64{},
+		},
+	}
+
+	if len(labels) == 0 {
+		g.values[""] = 0
+	}
+
+	return g
+}
+
+// GaugeFunc struct is a gauge which value is calculated on every scrape
+type GaugeFunc struct {
+	name string
+	help string
+	fn   func() float64
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	fmt.Fprintf(w, "%s %s\n", g.name, formatValue(g.fn()))
+}
+
+// NewGaugeFunc func returns GaugeFunc pointer
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	return &GaugeFunc{
+		name: name,
+		help: help,
+		fn:   fn,
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+// HistogramVec struct is a histogram partitioned by labels
+type HistogramVec struct {
+	sync.Mutex
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	values  map[string]*histogram
+}
+
+// Observe method adds observation to histogram
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	key := strings.Join(labelValues, "\xff")
+
+	h.Lock()
+	defer h.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+
+	hist.count++
+	hist.sum += v
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.Lock()
+	defer h.Unlock()
+
+	writeHeader(w, h.name, h.help, "histogram")
+
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		hist := h.values[key]
+
+		for i, upper := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", formatValue(upper)), hist.counts[i])
+		}
+
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, formatLabels(h.labels, key, "le", "+Inf"), hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, formatLabels(h.labels, key, "", ""), formatValue(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, formatLabels(h.labels, key, "", ""), hist.count)
+	}
+}
+
+// NewHistogramVec func returns HistogramVec pointer
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	return &HistogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: buckets,
+		values:  map[string]*histogram{},
+	}
+}
+
+// Metrics struct contains all application metrics
+type Metrics struct {
+	Requests            *CounterVec
+	RequestDuration     *HistogramVec
+	BytesIn             *CounterVec
+	BytesOut            *CounterVec
+	RateLimitRejections *CounterVec
+	CorruptedFiles      *CounterVec
+	RepairedFiles       *CounterVec
+	ReplicatedFiles     *CounterVec
+	RebalancedFiles     *CounterVec
+	RebuiltShards       *CounterVec
+	AutoCleanRuns       *CounterVec
+	AutoCleanFiles      *CounterVec
+	AutoCleanBytes      *CounterVec
+	AutoCleanNextRun    *GaugeVec
+	StorageUsage        *GaugeVec
+	StorageLimit        *GaugeVec
+	TrashUsage          *GaugeVec
+	TrashPurged         *CounterVec
+	ExpiredFiles        *CounterVec
+	ScrubRuns           *CounterVec
+	ScrubIssues         *CounterVec
+	ConfigReloads       *CounterVec
+
+	mu      sync.Mutex
+	metrics []metric
+}
+
+// Register method adds metric which will be rendered on scrape
+func (m *Metrics) Register(v metric) {
+	m.mu.Lock()
+	m.metrics = append(m.metrics, v)
+	m.mu.Unlock()
+}
+
+// Render method writes all metrics in prometheus text format
+func (m *Metrics) Render(w io.Writer) {
+	m.mu.Lock()
+	metrics := append([]metric{}, m.metrics...)
+	m.mu.Unlock()
+
+	for _, v := range metrics {
+		v.write(w)
+	}
+}
+
+// NewMetrics func returns Metrics pointer
+func NewMetrics() *Metrics {
+	m := &Metrics{
+		Requests:            NewCounterVec("t2_http_requests_total", "Total number of http requests.", "action", "status"),
+		RequestDuration:     NewHistogramVec("t2_http_request_duration_seconds", "Http request latency.", defaultBuckets, "action", "status"),
+		BytesIn:             NewCounterVec("t2_http_received_bytes_total", "Total number of bytes received from clients.", "action"),
+		BytesOut:            NewCounterVec("t2_http_sent_bytes_total", "Total number of bytes sent to clients.", "action"),
+		RateLimitRejections: NewCounterVec("t2_rate_limit_rejections_total", "Total number of requests rejected by rate limits.", "limit"),
+		CorruptedFiles:      NewCounterVec("t2_corrupted_files_total", "Total number of detected corrupted files."),
+		RepairedFiles:       NewCounterVec("t2_repaired_files_total", "Total number of corrupted files repaired from sources."),
+		ReplicatedFiles:     NewCounterVec("t2_replicated_files_total", "Total number of copies created by re-replication."),
+		RebalancedFiles:     NewCounterVec("t2_rebalanced_files_total", "Total number of files moved to other nodes of cluster."),
+		RebuiltShards:       NewCounterVec("t2_rebuilt_shards_total", "Total number of damaged shards rebuilt by storage checks."),
+		AutoCleanRuns:       NewCounterVec("t2_autoclean_runs_total", "Total number of autoclean runs.", "result"),
+		AutoCleanFiles:      NewCounterVec("t2_autoclean_evicted_files_total", "Total number of files evicted by autoclean."),
+		AutoCleanBytes:      NewCounterVec("t2_autoclean_freed_bytes_total", "Total number of bytes freed by autoclean."),
+		AutoCleanNextRun:    NewGaugeVec("t2_autoclean_next_run_timestamp_seconds", "Time of the next scheduled autoclean run."),
+		StorageUsage:        NewGaugeVec("t2_storage_usage_bytes", "Total size of stored files."),
+		StorageLimit:        NewGaugeVec("t2_storage_limit_bytes", "Storage limit from config."),
+		TrashUsage:          NewGaugeVec("t2_trash_usage_bytes", "Total size of files in trash."),
+		TrashPurged:         NewCounterVec("t2_trash_purged_files_total", "Total number of files purged from trash.", "reason"),
+		ExpiredFiles:        NewCounterVec("t2_expired_files_total", "Total number of removed expired files."),
+		ScrubRuns:           NewCounterVec("t2_scrub_runs_total", "Total number of storage scrubs.", "result"),
+		ScrubIssues:         NewCounterVec("t2_scrub_issues_total", "Total number of problems found by storage checks.", "problem"),
+		ConfigReloads:       NewCounterVec("t2_config_reloads_total", "Total number of config reloads.", "result"),
+	}
+
+	for _, v := range []metric{
+		m.Requests,
+		m.RequestDuration,
+		m.BytesIn,
+		m.BytesOut,
+		m.RateLimitRejections,
+		m.CorruptedFiles,
+		m.RepairedFiles,
+		m.ReplicatedFiles,
+		m.RebalancedFiles,
+		m.RebuiltShards,
+		m.AutoCleanRuns,
+		m.AutoCleanFiles,
+		m.AutoCleanBytes,
+		m.AutoCleanNextRun,
+		m.StorageUsage,
+		m.StorageLimit,
+		m.TrashUsage,
+		m.TrashPurged,
+		m.ExpiredFiles,
+		m.ScrubRuns,
+		m.ScrubIssues,
+		m.ConfigReloads,
+	} {
+		m.Register(v)
+	}
+
+	return m
+}
+
+func writeHeader(w io.Writer, name, help, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s %s\n", name, kind)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+func formatLabels(names []string, key, extraName, extraValue string) string {
+	pairs := []string{}
+
+	if len(names) > 0 {
+		values := strings.Split(key, "\xff")
+
+		for i, name := range names {
+			value := ""
+			if i < len(values) {
+				value = values[i]
+			}
+
+			pairs = append(pairs, name+"=\""+escapeLabelValue(value)+"\"")
+		}
+	}
+
+	if extraName != "" {
+		pairs = append(pairs, extraName+"=\""+escapeLabelValue(extraValue)+"\"")
+	}
+
+	if len(pairs) == 0 {
+		return ""
+	}
+
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func escapeLabelValue(v string) string {
+	v = strings.Replace(v, "\\", "\\\\", -1)
+	v = strings.Replace(v, "\n", "\\n", -1)
+
+	return strings.Replace(v, "\"", "\\\"", -1)
+}
+
+func formatValue(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	}
+
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCounterVec(t *testing.T) {
+	c := NewCounterVec("example_total", "Example counter.", "action", "status")
+
+	c.Inc("download", "200")
+	c.Inc("download", "200")
+	c.Add(3, "upload", "500")
+
+	cases := []struct {
+		labels []string
+		value  float64
+	}{
+		{
+			labels: []string{"download", "200"},
+			value:  2,
+		},
+		{
+			labels: []string{"upload", "500"},
+			value:  3,
+		},
+		{
+			labels: []string{"remove", "204"},
+			value:  0,
+		},
+	}
+
+	for _, tc := range cases {
+		v := c.Value(tc.labels...)
+		if v != tc.value {
+			t.Errorf("Value must be %v but got %v\n", tc.value, v)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	c.write(buf)
+
+	expected := "# HELP example_total Example counter.\n" +
+		"# TYPE example_total counter\n" +
+		"example_total{action=\"download\",status=\"200\"} 2\n" +
+		"example_total{action=\"upload\",status=\"500\"} 3\n"
+
+	if buf.String() != expected {
+		t.Errorf("Output must be %q but got %q\n", expected, buf.String())
+	}
+}
+
+func TestCounterVecWithoutLabels(t *testing.T) {
+	c := NewCounterVec("example_total", "Example counter.")
+
+	buf := &bytes.Buffer{}
+	c.write(buf)
+
+	if !strings.Contains(buf.String(), "\nexample_total 0\n") {
+		t.Errorf("Output must contain zero value but got %q\n", buf.String())
+	}
+}
+
+func TestGaugeVec(t *testing.T) {
+	g := NewGaugeVec("example_bytes", "Example gauge.")
+
+	g.Set(10)
+	g.Set(5)
+
+	buf := &bytes.Buffer{}
+	g.write(buf)
+
+	expected := "# HELP example_bytes Example gauge.\n" +
+		"# TYPE example_bytes gauge\n" +
+		"example_bytes 5\n"
+
+	if buf.String() != expected {
+		t.Errorf("Output must be %q but got %q\n", expected, buf.String())
+	}
+}
+
+func TestGaugeFunc(t *testing.T) {
+	g := NewGaugeFunc("example_connections", "Example gauge.", func() float64 {
+		return 7
+	})
+
+	buf := &bytes.Buffer{}
+	g.write(buf)
+
+	if !strings.Contains(buf.String(), "\nexample_connections 7\n") {
+		t.Errorf("Output must contain value but got %q\n", buf.String())
+	}
+}
+
+func TestHistogramVec(t *testing.T) {
+	h := NewHistogramVec("example_seconds", "Example histogram.", []float64{0.1, 1}, "action")
+
+	h.Observe(0.05, "download")
+	h.Observe(0.5, "download")
+	h.Observe(5, "download")
+
+	buf := &bytes.Buffer{}
+	h.write(buf)
+
+	expected := "# HELP example_seconds Example histogram.\n" +
+		"# TYPE example_seconds histogram\n" +
+		"example_seconds_bucket{action=\"download\",le=\"0.1\"} 1\n" +
+		"example_seconds_bucket{action=\"download\",le=\"1\"} 2\n" +
+		"example_seconds_bucket{action=\"download\",le=\"+Inf\"} 3\n" +
+		"example_seconds_sum{action=\"download\"} 5.55\n" +
+		"example_seconds_count{action=\"download\"} 3\n"
+
+	if buf.String() != expected {
+		t.Errorf("Output must be %q but got %q\n", expected, buf.String())
+	}
+}
+
+func TestMetricsRender(t *testing.T) {
+	m := NewMetrics()
+
+	m.Requests.Inc("download", "200")
+	m.Register(NewGaugeFunc("example_gauge", "Example gauge.", func() float64 {
+		return 1
+	}))
+
+	buf := &bytes.Buffer{}
+	m.Render(buf)
+
+	for _, name := range []string{
+		"t2_http_requests_total{action=\"download\",status=\"200\"} 1",
+		"# TYPE t2_http_request_duration_seconds histogram",
+		"t2_corrupted_files_total 0",
+		"t2_storage_usage_bytes 0",
+		"example_gauge 1",
+	} {
+		if !strings.Contains(buf.String(), name) {
+			t.Errorf("Output must contain %q\n", name)
+		}
+	}
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	cases := []struct {
+		value string
+		res   string
+	}{
+		{
+			value: "example",
+			res:   "example",
+		},
+		{
+			value: "a\"b",
+			res:   "a\\\"b",
+		},
+		{
+			value: "a\\b\nc",
+			res:   "a\\\\b\\nc",
+		},
+	}
+
+	for _, tc := range cases {
+		res := escapeLabelValue(tc.value)
+		if res != tc.res {
+			t.Errorf("Res must be %s but got %s\n", tc.res, res)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// default max age of cached response for quarantined file
+const defaultQuarantineMaxAge = 300
+
+// errChecksumMismatch is returned if copy of file from repair source is corrupted too
+var errChecksumMismatch = errors.New("Checksum mismatch")
+
+// QuarantineConfig struct contains info about
+// - sources which are used for repair of corrupted files, e.g. paths of replicas or secondary backends with the same layout
+// - max age of cached error for quarantined file in seconds, default is 300
+type QuarantineConfig struct {
+	Sources []string `json:"sources"`
+	MaxAge  int      `json:"max_age"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *QuarantineConfig) SetDefaults() {
+	if cfg.MaxAge == 0 {
+		cfg.MaxAge = defaultQuarantineMaxAge
+	}
+}
+
+// GetQuarantine method returns quarantine config, default one is returned if it's not set
+func (cfg *StorageConfig) GetQuarantine() *QuarantineConfig {
+	if cfg.Quarantine != nil {
+		return cfg.Quarantine
+	}
+
+	v := &QuarantineConfig{}
+	v.SetDefaults()
+
+	return v
+}
+
+// validateQuarantineConfig func adds problems of quarantine config to errs
+func validateQuarantineConfig(errs *ValidationErrors, cfg *QuarantineConfig, storagePath string) {
+	if cfg == nil {
+		return
+	}
+
+	for _, source := range cfg.Sources {
+		if source == "" || path.Clean(source) == path.Clean(storagePath) {
+			errs.Add("storage.quarantine.sources", "must contain paths which differ from storage path")
+			break
+		}
+	}
+
+	if cfg.MaxAge < 0 {
+		errs.Add("storage.quarantine.max_age", "must not be negative")
+	}
+}
+
+// QuarantineFile method moves corrupted file to quarantine, it's excluded from storage usage and indexes
+func (app *Application) QuarantineFile(hash, reason string, t time.Time) (bool, error) {
+	size, err := app.Storage.GetFileSize(hash)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	ok, err := app.Storage.QuarantineFile(hash)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	err = app.Redis.QuarantineFile(hash, reason, t)
+	if err != nil {
+		return true, err
+	}
+
+	app.Metrics.CorruptedFiles.Inc()
+	app.emitEvent(&Event{Type: eventFileQuarantined, FileID: hash, Reason: reason, Time: t})
+
+	return true, app.AddUsage(-size)
+}
+
+// HealFile method restores quarantined file from the first repair source which has valid copy of it
+// false is returned if there are no sources or none of them has valid copy
+func (app *Application) HealFile(hash string) (bool, error) {
+	expected := strings.Split(hash, "-")[0]
+	if !isSHA256(expected) {
+		return false, nil
+	}
+
+	logger := app.Logger.With("component", "quarantine", "file_id", hash)
+
+	for _, source := range getRepairSources(app.GetConfig().Storage) {
+		size, err := app.copyFromSource(source, hash, expected)
+		if os.IsNotExist(err) {
+			continue
+		} else if err == errFileExists {
+			// file has been repaired concurrently
+			return true, nil
+		} else if err != nil {
+			logger.Warn("could not repair file from source", "source", source, "error", err)
+			continue
+		}
+
+		_, err = app.Storage.RemoveQuarantinedFile(hash)
+		if err != nil {
+			logger.Error("could not remove quarantined file", "error", err)
+		}
+
+		// encoding depends on current compression config
+		err = app.recordEncoding(hash, nil)
+		if err != nil {
+			return true, err
+		}
+
+		now := time.Now()
+
+		err = app.Redis.UnquarantineFile(hash)
+		if err != nil {
+			return true, err
+		}
+
+		err = app.Redis.RecordAccess(hash, now, getHalfLife(app.GetConfig().Storage.GetEviction()))
+		if err != nil {
+			return true, err
+		}
+
+		app.Metrics.RepairedFiles.Inc()
+		app.emitEvent(&Event{Type: eventFileRepaired, FileID: hash, Reason: source, Time: now})
+
+		return true, app.AddUsage(size)
+	}
+
+	return false, nil
+}
+
+// copyFromSource method copies file from source to storage and verifies its checksum on the fly
+// compressed or encrypted copy in source is decoded, copy is removed if checksum does not match
+func (app *Application) copyFromSource(source, hash, expected string) (int64, error) {
+	f, err := os.Open(path.Join(source, hash[:2], hash))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	content, err := app.Storage.decodeContent(hash, f, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	h := sha256.New()
+
+	size, err := app.Storage.CreateFile(hash, io.TeeReader(content, h))
+	if err != nil {
+		if err != errFileExists && err != errQuorumNotReached {
+			app.Storage.RemoveFile(hash)
+		}
+
+		return 0, err
+	}
+
+	if hex.EncodeToString(h.Sum(nil)) != expected {
+		app.Storage.RemoveFile(hash)
+		return 0, errChecksumMismatch
+	}
+
+	return size, nil
+}
+
+// healFileAsync method repairs quarantined file in background if repair sources are configured
+func (app *Application) healFileAsync(hash string) {
+	if len(getRepairSources(app.GetConfig().Storage)) == 0 {
+		return
+	}
+
+	app.Go(func() {
+		ok, err := app.HealFile(hash)
+		if err != nil {
+			app.Logger.Error("could not repair file", "component", "quarantine", "file_id", hash, "error", err)
+		} else if !ok {
+			app.Logger.Warn("valid copy of file is not found", "component", "quarantine", "file_id", hash)
+		}
+	})
+}
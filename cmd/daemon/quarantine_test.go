@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func createSourceTestFile(dir, hash, content string) {
+	os.MkdirAll(path.Join(dir, hash[:2]), 0755)
+	ioutil.WriteFile(path.Join(dir, hash[:2], hash), []byte(content), 0644)
+}
+
+func TestApplicationHealFile(t *testing.T) {
+	source, _ := ioutil.TempDir("", "t2-source")
+	defer os.RemoveAll(source)
+
+	app := newTrashTestApplication(t, &StorageConfig{Quarantine: &QuarantineConfig{Sources: []string{source}}})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.ReconcileUsage()
+
+	now := time.Now()
+	hash := getTestFileID("valid", now)
+
+	createTrashTestFile(app, hash, 7, now)
+
+	ok, err := app.QuarantineFile(hash, "checksum", now)
+	if !ok || err != nil {
+		t.Errorf("File must be quarantined but got %v, %v\n", ok, err)
+	}
+
+	// source does not have file
+	ok, err = app.HealFile(hash)
+	if ok || err != nil {
+		t.Errorf("File must not be repaired but got %v, %v\n", ok, err)
+	}
+
+	// copy in source is corrupted too
+	createSourceTestFile(source, hash, "corrupted")
+
+	ok, err = app.HealFile(hash)
+	if ok || err != nil {
+		t.Errorf("File must not be repaired but got %v, %v\n", ok, err)
+	}
+
+	if _, exists := app.Storage.GetFile(hash); exists {
+		t.Error("Corrupted copy must be removed\n")
+	}
+
+	createSourceTestFile(source, hash, "valid")
+
+	ok, err = app.HealFile(hash)
+	if !ok || err != nil {
+		t.Errorf("File must be repaired but got %v, %v\n", ok, err)
+	}
+
+	if _, exists := app.Storage.GetFile(hash); !exists {
+		t.Error("File must be restored in storage\n")
+	}
+
+	if _, err := os.Stat(path.Join(app.Config.Storage.Path, quarantineDir, hash[:2], hash)); !os.IsNotExist(err) {
+		t.Errorf("Quarantined file must be removed but got %v\n", err)
+	}
+
+	quarantined, _ := app.Redis.IsQuarantined(hash)
+	exists, _ := app.Redis.HasFileMeta([]string{hash})
+	if quarantined || !exists[0] {
+		t.Errorf("Metadata must be restored but got %v, %v\n", quarantined, exists)
+	}
+
+	usage, _, _ := app.Redis.GetUsage()
+	if usage != 5 {
+		t.Errorf("Usage must be %d but got %d\n", 5, usage)
+	}
+}
+
+func TestHandlerDownloadCorruptedFile(t *testing.T) {
+	source, _ := ioutil.TempDir("", "t2-source")
+	defer os.RemoveAll(source)
+
+	app := newTrashTestApplication(t, &StorageConfig{Quarantine: &QuarantineConfig{MaxAge: 60}})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+	hash := getTestFileID("valid", now)
+
+	createTrashTestFile(app, hash, 7, now)
+
+	h := NewHandler(app)
+
+	cases := []struct {
+		errMessage string
+	}{
+		{errMessage: "FILE_IS_CORRUPTED"},
+		{errMessage: "FILE_IS_QUARANTINED"},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/files/"+hash, nil)
+
+		h.ServeHTTP(w, r)
+
+		if w.Code != 422 {
+			t.Errorf("Code must be %d but got %d\n", 422, w.Code)
+		}
+
+		if v := w.Header().Get("Cache-Control"); v != "public, max-age=60" {
+			t.Errorf("Cache-Control must be %s but got %s\n", "public, max-age=60", v)
+		}
+
+		errResp := ErrorResponse{}
+		json.Unmarshal(w.Body.Bytes(), &errResp)
+
+		if errResp.Error != tc.errMessage {
+			t.Errorf("Error message must be %v but got %v\n", tc.errMessage, errResp.Error)
+		}
+	}
+
+	// file is repaired in background after the next detection
+	app.Config.Storage.Quarantine.Sources = []string{source}
+	createSourceTestFile(source, hash, "valid")
+
+	app.Storage.RemoveQuarantinedFile(hash)
+	app.Redis.UnquarantineFile(hash)
+	createSourceTestFile(app.Config.Storage.Path, hash, "corrupted")
+
+	w := httptest.NewRecorder()
+	r, _ := http.NewRequest("GET", "/files/"+hash, nil)
+	h.ServeHTTP(w, r)
+
+	app.wg.Wait()
+
+	w = httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+
+	if w.Code != 200 || w.Body.String() != "valid" {
+		t.Errorf("File must be repaired but got %d, %s\n", w.Code, w.Body.String())
+	}
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"encoding/base64"
+	"encoding/json"
+	"math"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/garyburd/redigo/redis"
@@ -10,122 +14,1432 @@ import (
 const (
 	metaPrefix = "META:"
 	scoreKey   = "DOWNLOAD_SCORES"
+
+	// sorted sets of eviction policies, see EvictionConfig
+	accessKey    = "ACCESS_TIMES"
+	createdKey   = "CREATED_TIMES"
+	decayKey     = "DECAY_SCORES"
+	gdsfKey      = "GDSF_SCORES"
+	inflationKey = "GDSF_INFLATION"
+
+	// sorted set of files with expiry
+	expiresKey = "EXPIRY_TIMES"
+
+	// sorted set of corrupted files by time of detection
+	quarantineKey = "QUARANTINE"
+
+	// report of the latest storage scrub
+	scrubReportKey = "SCRUB_REPORT"
+
+	// total size of stored files, it's kept per node in cluster mode
+	usageKey = "STORAGE_USAGE"
+
+	// list of autoclean reports
+	reportsKey = "AUTOCLEAN_REPORTS"
+
+	// counter of autoclean report ids, it's shared by cluster
+	reportIDKey = "AUTOCLEAN_REPORT_ID"
+
+	// trashed files: sorted set by time of removal, hash of sizes and total size, they are kept per node in cluster mode
+	trashKey      = "TRASH"
+	trashSizesKey = "TRASH_SIZES"
+	trashUsageKey = "TRASH_USAGE"
+
+	// sorted set of encrypted files by time of encryption
+	encryptedKey = "ENCRYPTED"
+
+	// indexes of file listing: sorted set of sizes and sets of files by owner, tag and content type
+	sizeKey           = "FILE_SIZES"
+	ownerPrefix       = "OWNER:"
+	tagPrefix         = "TAG:"
+	contentTypePrefix = "CONTENT_TYPE:"
 )
 
-// RedisConfig struct
+// usageScript changes usage counter only if it has been initialized by reconciliation
+var usageScript = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return redis.call('INCRBY', KEYS[1], ARGV[1])
+end
+
+return false
+`)
+
+// accessScript updates last access time, decayed frequency and gdsf priority of file
+// decayed frequency is kept in log space: ln(sum(e^(lambda*t))) for all access times,
+// so scores of all files decay with the same speed and we never rewrite them
+// gdsf priority is inflation + frequency / size
+var accessScript = redis.NewScript(6, `
+local id = ARGV[1]
+local now = tonumber(ARGV[2])
+local x = now * tonumber(ARGV[3])
+
+redis.call('ZADD', KEYS[1], now, id)
+
+local old = redis.call('ZSCORE', KEYS[2], id)
+if old then
+	old = tonumber(old)
+	local hi, lo = math.max(old, x), math.min(old, x)
+	x = hi + math.log(1 + math.exp(lo - hi))
+end
+redis.call('ZADD', KEYS[2], x, id)
+
+local freq = tonumber(redis.call('ZSCORE', KEYS[4], id) or '0') + 1
+local size = tonumber(redis.call('HGET', KEYS[5], 'size') or '1')
+if size < 1 then
+	size = 1
+end
+local inflation = tonumber(redis.call('GET', KEYS[6]) or '0')
+redis.call('ZADD', KEYS[3], inflation + freq / size, id)
+
+return 1
+`)
+
+// inflationScript raises gdsf inflation to priority of evicted file
+var inflationScript = redis.NewScript(2, `
+local h = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if h then
+	local l = tonumber(redis.call('GET', KEYS[2]) or '0')
+	if tonumber(h) > l then
+		redis.call('SET', KEYS[2], h)
+	end
+end
+
+return 1
+`)
+
+// trashScript adds file to trash index and returns total size of trash
+// size of file which is already in trash is replaced
+var trashScript = redis.NewScript(3, `
+local old = redis.call('HGET', KEYS[2], ARGV[1])
+if old then
+	redis.call('DECRBY', KEYS[3], old)
+end
+
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('HSET', KEYS[2], ARGV[1], ARGV[3])
+
+return redis.call('INCRBY', KEYS[3], ARGV[3])
+`)
+
+// untrashScript removes file from trash index and returns its size
+var untrashScript = redis.NewScript(3, `
+local size = redis.call('HGET', KEYS[2], ARGV[1])
+if not size then
+	return false
+end
+
+redis.call('ZREM', KEYS[1], ARGV[1])
+redis.call('HDEL', KEYS[2], ARGV[1])
+redis.call('DECRBY', KEYS[3], size)
+
+return tonumber(size)
+`)
+
+// newDataKeyScript saves wrapped data key of file and adds it to index of encrypted files if it has no key yet
+var newDataKeyScript = redis.NewScript(2, `
+if redis.call('HEXISTS', KEYS[1], 'data_key') == 1 then
+	return 0
+end
+
+redis.call('HMSET', KEYS[1], 'key_id', ARGV[1], 'data_key', ARGV[2])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[4])
+
+return 1
+`)
+
+// dataKeyScript replaces wrapped data key of file only if it's not changed since it has been read
+var dataKeyScript = redis.NewScript(1, `
+if redis.call('HGET', KEYS[1], 'data_key') ~= ARGV[1] then
+	return 0
+end
+
+redis.call('HMSET', KEYS[1], 'key_id', ARGV[2], 'data_key', ARGV[3])
+
+return 1
+`)
+
+// indexScript replaces sets of file listing which contain file, new keys of sets are kept in "index_keys" field of meta
+// keys from meta are used if new ones are not passed, only live files (with creation time) are added to indexes
+var indexScript = redis.NewScript(3, `
+local old = redis.call('HGET', KEYS[1], 'index_keys')
+if old then
+	for _, key in ipairs(cjson.decode(old)) do
+		redis.call('SREM', key, ARGV[1])
+	end
+end
+
+if ARGV[2] ~= '' then
+	redis.call('HSET', KEYS[1], 'index_keys', ARGV[2])
+end
+
+if not redis.call('ZSCORE', KEYS[3], ARGV[1]) then
+	return 0
+end
+
+local keys = redis.call('HGET', KEYS[1], 'index_keys')
+if keys then
+	for _, key in ipairs(cjson.decode(keys)) do
+		redis.call('SADD', key, ARGV[1])
+	end
+end
+
+local size = redis.call('HGET', KEYS[1], 'size')
+if size then
+	redis.call('ZADD', KEYS[2], size, ARGV[1])
+end
+
+return 1
+`)
+
+// unindexScript removes file from indexes of file listing, keys of sets are kept in meta for restoring
+var unindexScript = redis.NewScript(2, `
+local keys = redis.call('HGET', KEYS[1], 'index_keys')
+if keys then
+	for _, key in ipairs(cjson.decode(keys)) do
+		redis.call('SREM', key, ARGV[1])
+	end
+end
+
+redis.call('ZREM', KEYS[2], ARGV[1])
+
+return 1
+`)
+
+// listScript returns files from sorted set KEYS[1] in order ARGV[1] (asc or desc) after cursor (ARGV[2] score, ARGV[3] file)
+// files must be in sorted sets KEYS[2..ARGV[6]+1] with scores between ARGV[7+2i] and ARGV[8+2i] (empty bound is open)
+// and in all sets of the rest KEYS, at most ARGV[4] files are returned and at most ARGV[5] files are examined
+// reply contains score and id of the last examined file (empty if the end is reached) and found files
+var listScript = redis.NewScript(-1, `
+local desc = ARGV[1] == 'desc'
+local count, maxScan, ranges = tonumber(ARGV[4]), tonumber(ARGV[5]), tonumber(ARGV[6])
+local sortMin, sortMax = '', ''
+
+for i = 1, ranges do
+	if KEYS[i + 1] == KEYS[1] then
+		sortMin, sortMax = ARGV[5 + 2 * i], ARGV[6 + 2 * i]
+	end
+end
+
+local start, skipScore = 0, nil
+
+if ARGV[2] ~= '' then
+	local rank
+	if desc then
+		rank = redis.call('ZREVRANK', KEYS[1], ARGV[3])
+	else
+		rank = redis.call('ZRANK', KEYS[1], ARGV[3])
+	end
+
+	local score = redis.call('ZSCORE', KEYS[1], ARGV[3])
+	if rank and score and tonumber(score) == tonumber(ARGV[2]) then
+		start = rank + 1
+	else
+		-- file of cursor has been removed or its score has been changed, files with the same score are skipped by id
+		skipScore = tonumber(ARGV[2])
+		if desc then
+			start = redis.call('ZCOUNT', KEYS[1], '(' .. ARGV[2], '+inf')
+		else
+			start = redis.call('ZCOUNT', KEYS[1], '-inf', '(' .. ARGV[2])
+		end
+	end
+end
+
+-- files before range of sorted set are skipped at once
+if desc and sortMax ~= '' then
+	start = math.max(start, redis.call('ZCOUNT', KEYS[1], '(' .. sortMax, '+inf'))
+elseif not desc and sortMin ~= '' then
+	start = math.max(start, redis.call('ZCOUNT', KEYS[1], '-inf', '(' .. sortMin))
+end
+
+local function matches(id, score)
+	for i = 1, ranges do
+		local v = score
+		if KEYS[i + 1] ~= KEYS[1] then
+			v = redis.call('ZSCORE', KEYS[i + 1], id)
+		end
+
+		if not v then
+			return false
+		end
+
+		v = tonumber(v)
+		local min, max = ARGV[5 + 2 * i], ARGV[6 + 2 * i]
+		if (min ~= '' and v < tonumber(min)) or (max ~= '' and v > tonumber(max)) then
+			return false
+		end
+	end
+
+	for i = ranges + 2, #KEYS do
+		if redis.call('SISMEMBER', KEYS[i], id) == 0 then
+			return false
+		end
+	end
+
+	return true
+end
+
+local found = {}
+local lastScore, lastID = '', ''
+local scanned = 0
+local batch = 100
+
+while #found < count and scanned < maxScan do
+	local items
+	if desc then
+		items = redis.call('ZREVRANGE', KEYS[1], start, start + batch - 1, 'WITHSCORES')
+	else
+		items = redis.call('ZRANGE', KEYS[1], start, start + batch - 1, 'WITHSCORES')
+	end
+
+	local finished = #items < 2 * batch
+
+	for i = 1, #items, 2 do
+		local id, score = items[i], items[i + 1]
+		local v = tonumber(score)
+
+		if (desc and sortMin ~= '' and v < tonumber(sortMin)) or (not desc and sortMax ~= '' and v > tonumber(sortMax)) then
+			finished = true
+			break
+		end
+
+		start = start + 1
+		scanned = scanned + 1
+		lastScore, lastID = score, id
+
+		local skipped = skipScore and v == skipScore and ((desc and id >= ARGV[3]) or (not desc and id <= ARGV[3]))
+		if not skipped and matches(id, score) then
+			table.insert(found, id)
+		end
+
+		if #found >= count or scanned >= maxScan then
+			finished = false
+			break
+		end
+	end
+
+	if finished then
+		lastScore, lastID = '', ''
+		break
+	end
+end
+
+local res = {lastScore, lastID}
+for _, id in ipairs(found) do
+	table.insert(res, id)
+end
+
+return res
+`)
+
+// RedisConfig struct contains info about
+// - redis address
+// - max count of active and idle connections in pool
+// - idle timeout in seconds
 type RedisConfig struct {
-	Host string
-	Port int
+	Host        string `json:"host"`
+	Port        int    `json:"port"`
+	MaxActive   int    `json:"max_active"`
+	MaxIdle     int    `json:"max_idle"`
+	IdleTimeout int    `json:"idle_timeout"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *RedisConfig) SetDefaults() {
+	if cfg.Host == "" {
+		cfg.Host = "127.0.0.1"
+	}
+
+	// default port is 6379
+	if cfg.Port == 0 {
+		cfg.Port = 6379
+	}
+
+	if cfg.MaxActive == 0 {
+		cfg.MaxActive = 10
+	}
+
+	if cfg.MaxIdle == 0 {
+		cfg.MaxIdle = 5
+	}
+
+	if cfg.IdleTimeout == 0 {
+		cfg.IdleTimeout = 10
+	}
 }
 
 // FileMeta struct
 type FileMeta struct {
-	Hash      string
-	CreatedAt *time.Time
-	DeletedAt *time.Time
-	Size      int64
-	Score     int
+	Hash           string
+	CreatedAt      *time.Time
+	DeletedAt      *time.Time
+	ExpiresAt      *time.Time
+	Size           int64
+	Score          int
+	KeyFingerprint string
+	Filename       string
+	ContentType    string
+	UserMeta       map[string]string
+	Owner          string
+	Tags           []string
 }
 
 // Redis struct
+// pool could be replaced on config reload, so it's guarded by mutex
 type Redis struct {
-	*redis.Pool
+	sync.RWMutex
 	Config *RedisConfig
+	Logger *Logger
+	pool   *redis.Pool
+
+	// id of cluster node, counters of local storage are kept per node
+	NodeID string
+}
+
+// nodeKey method returns key of value which belongs to local storage of node
+func (r *Redis) nodeKey(key string) string {
+	if r.NodeID == "" {
+		return key
+	}
+
+	return key + ":" + r.NodeID
+}
+
+// Get method returns connection from current pool
+// connection errors are logged here with address of redis, so callers don't repeat it
+func (r *Redis) Get() redis.Conn {
+	r.RLock()
+	defer r.RUnlock()
+
+	conn := r.pool.Get()
+	if err := conn.Err(); err != nil {
+		r.Logger.Error("could not get redis connection", "host", r.Config.Host, "port", r.Config.Port, "active", r.pool.ActiveCount(), "error", err)
+	}
+
+	return conn
+}
+
+// ActiveCount method returns number of connections in current pool
+func (r *Redis) ActiveCount() int {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.pool.ActiveCount()
+}
+
+// IdleCount method returns number of idle connections in current pool
+func (r *Redis) IdleCount() int {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.pool.IdleCount()
+}
+
+// Close method closes current pool
+func (r *Redis) Close() error {
+	r.RLock()
+	defer r.RUnlock()
+
+	return r.pool.Close()
+}
+
+// Reload method replaces pool if config has been changed
+// connections which are in use are closed by old pool when they are returned
+func (r *Redis) Reload(cfg *RedisConfig) {
+	cfg.SetDefaults()
+
+	r.Lock()
+	if r.Config != nil && *r.Config == *cfg {
+		r.Unlock()
+		return
+	}
+
+	old := r.pool
+	r.pool = newRedisPool(cfg)
+	r.Config = cfg
+	r.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+
+	r.Logger.Info("redis pool reloaded", "host", cfg.Host, "port", cfg.Port, "max_active", cfg.MaxActive, "max_idle", cfg.MaxIdle)
 }
 
 // SaveFileMeta method
 func (r *Redis) SaveFileMeta(file *FileMeta) error {
+	args, err := getDescriptionArgs(file)
+	if err != nil {
+		return err
+	}
+
 	conn := r.Get()
 	defer conn.Close()
 
 	conn.Send("HMSET", metaPrefix+file.Hash, "size", file.Size, "created_at", file.CreatedAt.Unix())
 	conn.Send("ZADD", scoreKey, file.Score, file.Hash)
+	conn.Send("ZADD", createdKey, file.CreatedAt.Unix(), file.Hash)
 
-	_, err := conn.Do("")
+	if file.ExpiresAt != nil {
+		conn.Send("HSET", metaPrefix+file.Hash, "expires_at", file.ExpiresAt.Unix())
+		conn.Send("ZADD", expiresKey, file.ExpiresAt.Unix(), file.Hash)
+	}
+
+	if file.KeyFingerprint != "" {
+		conn.Send("HSET", metaPrefix+file.Hash, "key_fingerprint", file.KeyFingerprint)
+	}
+
+	if file.Owner != "" {
+		conn.Send("HSET", metaPrefix+file.Hash, "owner", file.Owner)
+	}
+
+	if len(args) > 1 {
+		conn.Send("HMSET", args...)
+	}
+
+	// repaired file without description keeps its indexes
+	keys := ""
+	if v := getIndexKeys(file); len(v) > 0 {
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+
+		keys = string(data)
+	}
+
+	indexScript.Send(conn, metaPrefix+file.Hash, sizeKey, createdKey, file.Hash, keys)
+
+	_, err = conn.Do("")
 
 	return err
 }
 
-// IncScore method
-func (r *Redis) IncScore(hash string) (int, error) {
-	conn := r.Get()
-	defer conn.Close()
+// GetFileMeta method returns metadata of file, nil is returned if file has no metadata
+func (r *Redis) GetFileMeta(hash string) (*FileMeta, error) {
+	files, err := r.GetFilesMeta([]string{hash})
+	if err != nil {
+		return nil, err
+	}
 
-	return redis.Int(conn.Do("ZINCRBY", scoreKey, 1, hash))
+	return files[0], nil
 }
 
-// GetUnusedFiles method
-func (r *Redis) GetUnusedFiles(limit int) ([]string, error) {
+// GetFilesMeta method returns metadata of files, it's nil for files without metadata
+func (r *Redis) GetFilesMeta(hashes []string) ([]*FileMeta, error) {
+	if len(hashes) == 0 {
+		return []*FileMeta{}, nil
+	}
+
 	conn := r.Get()
 	defer conn.Close()
 
-	if limit < 1 {
-		limit = 0
-	} else {
-		limit--
+	for _, hash := range hashes {
+		conn.Send("HMGET", metaPrefix+hash, "size", "created_at", "expires_at",
+			"key_fingerprint", "filename", "content_type", "user_meta", "owner", "tags")
 	}
 
-	replies, err := redis.Values(conn.Do("ZRANGE", scoreKey, 0, limit))
+	replies, err := redis.Values(conn.Do(""))
 	if err != nil {
 		return nil, err
 	}
 
-	res := []string{}
-	for _, v := range replies {
-		hash, err := redis.String(v, nil)
+	res := make([]*FileMeta, len(replies))
+	for i, reply := range replies {
+		values, err := redis.Strings(reply, nil)
 		if err != nil {
 			return nil, err
 		}
 
-		res = append(res, hash)
+		res[i], err = getFileMeta(hashes[i], values)
+		if err != nil {
+			return nil, err
+		}
 	}
 
 	return res, nil
 }
 
-// MarkFileAsDeleted method
-func (r *Redis) MarkFileAsDeleted(hash string, t *time.Time) error {
-	conn := r.Get()
-	defer conn.Close()
+// getFileMeta func returns metadata of file from values of meta fields, see GetFilesMeta
+func getFileMeta(hash string, values []string) (*FileMeta, error) {
+	if values[1] == "" {
+		return nil, nil
+	}
+
+	file := &FileMeta{
+		Hash:           hash,
+		KeyFingerprint: values[3],
+		Filename:       values[4],
+		ContentType:    values[5],
+		Owner:          values[7],
+	}
+
+	file.Size, _ = strconv.ParseInt(values[0], 10, 64)
+
+	createdAt, _ := strconv.ParseInt(values[1], 10, 64)
+	file.CreatedAt = getTime(createdAt)
+
+	if values[2] != "" {
+		expiresAt, _ := strconv.ParseInt(values[2], 10, 64)
+		file.ExpiresAt = getTime(expiresAt)
+	}
+
+	if values[6] != "" {
+		err := json.Unmarshal([]byte(values[6]), &file.UserMeta)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if values[8] != "" {
+		err := json.Unmarshal([]byte(values[8]), &file.Tags)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return file, nil
+}
+
+// UpdateFileMeta method replaces original filename, content type, custom metadata and tags of file, empty fields are removed
+// indexes of file listing are updated
+func (r *Redis) UpdateFileMeta(file *FileMeta) error {
+	args, err := getDescriptionArgs(file)
+	if err != nil {
+		return err
+	}
 
-	size, err := redis.Int(conn.Do("ZSCORE", scoreKey, hash))
+	keys, err := json.Marshal(getIndexKeys(file))
 	if err != nil {
 		return err
 	}
 
-	conn.Send("HMSET", metaPrefix+hash, "deleted_at", t.Unix(), "score", size)
-	conn.Send("ZREM", scoreKey, hash)
+	conn := r.Get()
+	defer conn.Close()
+
+	removed := []interface{}{metaPrefix + file.Hash}
+	if file.Filename == "" {
+		removed = append(removed, "filename")
+	}
+
+	if file.ContentType == "" {
+		removed = append(removed, "content_type")
+	}
+
+	if len(file.UserMeta) == 0 {
+		removed = append(removed, "user_meta")
+	}
+
+	if len(file.Tags) == 0 {
+		removed = append(removed, "tags")
+	}
+
+	if len(args) > 1 {
+		conn.Send("HMSET", args...)
+	}
+
+	if len(removed) > 1 {
+		conn.Send("HDEL", removed...)
+	}
+
+	indexScript.Send(conn, metaPrefix+file.Hash, sizeKey, createdKey, file.Hash, keys)
 
 	_, err = conn.Do("")
 
 	return err
 }
 
-// NewRedis func returns Redis pointer
-func NewRedis(cfg *RedisConfig) *Redis {
-	// for simplicity we use default timeouts for connect/read/write and concrete values for idle/max clients
-	// @todo move to config
+// getDescriptionArgs func returns arguments of HMSET for original filename, content type, custom metadata and tags
+// key of hash is the first argument, empty fields are skipped
+func getDescriptionArgs(file *FileMeta) ([]interface{}, error) {
+	args := []interface{}{metaPrefix + file.Hash}
 
-	// default port is 6379
-	if cfg.Port == 0 {
-		cfg.Port = 6379
+	if file.Filename != "" {
+		args = append(args, "filename", file.Filename)
 	}
 
-	pool := &redis.Pool{
-		MaxActive:   10,
-		MaxIdle:     5,
-		IdleTimeout: 10 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			return redis.Dial("tcp", cfg.Host+":"+strconv.Itoa(cfg.Port))
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
+	if file.ContentType != "" {
+		args = append(args, "content_type", file.ContentType)
 	}
 
-	return &Redis{
-		pool,
-		cfg,
+	if len(file.UserMeta) > 0 {
+		data, err := json.Marshal(file.UserMeta)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, "user_meta", data)
+	}
+
+	if len(file.Tags) > 0 {
+		data, err := json.Marshal(file.Tags)
+		if err != nil {
+			return nil, err
+		}
+
+		args = append(args, "tags", data)
+	}
+
+	return args, nil
+}
+
+func getTime(v int64) *time.Time {
+	t := time.Unix(v, 0)
+
+	return &t
+}
+
+// GetExpiresAt method returns expiry of file, it's nil if file never expires
+func (r *Redis) GetExpiresAt(hash string) (*time.Time, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	v, err := redis.Int64(conn.Do("ZSCORE", expiresKey, hash))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	t := time.Unix(v, 0)
+
+	return &t, nil
+}
+
+// SetFileEncoding method saves encoding of stored file, it's removed for files which are not compressed
+func (r *Redis) SetFileEncoding(hash, encoding string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	var err error
+
+	if encoding == "" {
+		_, err = conn.Do("HDEL", metaPrefix+hash, "encoding")
+	} else {
+		_, err = conn.Do("HSET", metaPrefix+hash, "encoding", encoding)
+	}
+
+	return err
+}
+
+// GetFileEncoding method returns encoding of stored file, it's empty if file is not compressed
+func (r *Redis) GetFileEncoding(hash string) (string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	v, err := redis.String(conn.Do("HGET", metaPrefix+hash, "encoding"))
+	if err == redis.ErrNil {
+		return "", nil
+	}
+
+	return v, err
+}
+
+// SaveDataKey method saves data key of encrypted file wrapped by master key with given id
+// false is returned if file has data key already, it's not replaced
+func (r *Redis) SaveDataKey(hash, keyID string, wrapped []byte) (bool, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	v := base64.StdEncoding.EncodeToString(wrapped)
+
+	return redis.Bool(newDataKeyScript.Do(conn, metaPrefix+hash, encryptedKey, keyID, v, time.Now().Unix(), hash))
+}
+
+// GetDataKey method returns id of master key and wrapped data key of encrypted file
+func (r *Redis) GetDataKey(hash string) (string, []byte, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("HMGET", metaPrefix+hash, "key_id", "data_key"))
+	if err != nil {
+		return "", nil, err
+	}
+
+	if values[0] == "" || values[1] == "" {
+		return "", nil, errDataKeyNotFound
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(values[1])
+	if err != nil {
+		return "", nil, err
+	}
+
+	return values[0], wrapped, nil
+}
+
+// SaveClientKey method saves fingerprint of client key and checksum of stored content of file encrypted by it
+func (r *Redis) SaveClientKey(hash, fingerprint, storedSHA256 string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("HMSET", metaPrefix+hash, "key_fingerprint", fingerprint, "stored_sha256", storedSHA256)
+
+	return err
+}
+
+// GetClientKey method returns fingerprint of client key and checksum of stored content of file encrypted by it
+func (r *Redis) GetClientKey(hash string) (string, string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(conn.Do("HMGET", metaPrefix+hash, "key_fingerprint", "stored_sha256"))
+	if err != nil {
+		return "", "", err
+	}
+
+	if values[0] == "" {
+		return "", "", errDataKeyNotFound
+	}
+
+	return values[0], values[1], nil
+}
+
+// ReplaceDataKey method replaces wrapped data key of file, false is returned if key has been changed concurrently
+func (r *Redis) ReplaceDataKey(hash string, oldWrapped []byte, keyID string, wrapped []byte) (bool, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	old := base64.StdEncoding.EncodeToString(oldWrapped)
+	v := base64.StdEncoding.EncodeToString(wrapped)
+
+	return redis.Bool(dataKeyScript.Do(conn, metaPrefix+hash, old, keyID, v))
+}
+
+// GetEncryptedFiles method returns encrypted files in order of encryption
+func (r *Redis) GetEncryptedFiles(offset, count int) ([]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGE", encryptedKey, offset, offset+count-1))
+}
+
+// GetExpiredFiles method returns files which expire not later than t
+func (r *Redis) GetExpiredFiles(t time.Time, count int) ([]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", expiresKey, "-inf", t.Unix(), "LIMIT", 0, count))
+}
+
+// IncScore method
+func (r *Redis) IncScore(hash string) (int, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Int(conn.Do("ZINCRBY", scoreKey, 1, hash))
+}
+
+// RecordAccess method updates eviction scores of file on upload and download
+// half life is used for decay of download frequency
+func (r *Redis) RecordAccess(hash string, t time.Time, halfLife time.Duration) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	lambda := math.Ln2 / halfLife.Seconds()
+
+	_, err := accessScript.Do(conn, accessKey, decayKey, gdsfKey, scoreKey, metaPrefix+hash, inflationKey, hash, t.Unix(), lambda)
+
+	return err
+}
+
+// GetUnusedFiles method
+func (r *Redis) GetUnusedFiles(limit int) ([]string, error) {
+	if limit < 1 {
+		limit = 1
+	}
+
+	return r.GetEvictionCandidates(scoreKey, 0, limit)
+}
+
+// GetEvictionCandidates method returns files with the lowest scores in sorted set
+func (r *Redis) GetEvictionCandidates(key string, offset, count int) ([]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGE", key, offset, offset+count-1))
+}
+
+// GetFilesCreatedBefore method returns files which have been created before t
+// files without known creation time are ignored
+func (r *Redis) GetFilesCreatedBefore(t time.Time, offset, count int) ([]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", createdKey, 1, t.Unix(), "LIMIT", offset, count))
+}
+
+// GetCreatedTimes method returns creation time of files, it's 0 if time is unknown
+func (r *Redis) GetCreatedTimes(hashes []string) ([]int64, error) {
+	scores, err := r.GetScores(createdKey, hashes)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]int64, len(scores))
+	for i, v := range scores {
+		res[i] = int64(v)
+	}
+
+	return res, nil
+}
+
+// GetScores method returns scores of files in sorted set, it's 0 if file is not in set
+func (r *Redis) GetScores(key string, hashes []string) ([]float64, error) {
+	if len(hashes) == 0 {
+		return []float64{}, nil
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	for _, hash := range hashes {
+		conn.Send("ZSCORE", key, hash)
+	}
+
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]float64, len(replies))
+	for i, v := range replies {
+		res[i], err = redis.Float64(v, nil)
+		if err == redis.ErrNil {
+			err = nil
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return res, nil
+}
+
+// NextAutoCleanReportID method returns id of new autoclean report, it's unique in cluster
+func (r *Redis) NextAutoCleanReportID() (int64, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Int64(conn.Do("INCR", reportIDKey))
+}
+
+// SaveAutoCleanReport method stores report of autoclean run, only the latest reports are kept
+func (r *Redis) SaveAutoCleanReport(report *AutoCleanReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	conn.Send("LPUSH", reportsKey, data)
+	conn.Send("LTRIM", reportsKey, 0, maxAutoCleanReports-1)
+
+	_, err = conn.Do("")
+
+	return err
+}
+
+// GetAutoCleanReports method returns the latest reports of autoclean runs, newest first
+func (r *Redis) GetAutoCleanReports(count int) ([]*AutoCleanReport, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	if count < 1 || count > maxAutoCleanReports {
+		count = maxAutoCleanReports
+	}
+
+	values, err := redis.ByteSlices(conn.Do("LRANGE", reportsKey, 0, count-1))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]*AutoCleanReport, 0, len(values))
+	for _, v := range values {
+		report := &AutoCleanReport{}
+
+		err = json.Unmarshal(v, report)
+		if err != nil {
+			return nil, err
+		}
+
+		res = append(res, report)
+	}
+
+	return res, nil
+}
+
+// FillEvictionIndex method adds files which are known only by download scores to sorted set with zero score,
+// it's needed for files which have been uploaded before the index appeared
+func (r *Redis) FillEvictionIndex(key string) error {
+	if key == scoreKey {
+		return nil
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err := conn.Do("ZUNIONSTORE", key, 2, key, scoreKey, "WEIGHTS", 1, 0, "AGGREGATE", "MAX")
+
+	return err
+}
+
+// AddUsage method changes storage usage counter and returns new value
+// false is returned if counter has not been initialized yet
+func (r *Redis) AddUsage(delta int64) (int64, bool, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	usage, err := redis.Int64(usageScript.Do(conn, r.nodeKey(usageKey), delta))
+	if err == redis.ErrNil {
+		return 0, false, nil
+	}
+
+	return usage, err == nil, err
+}
+
+// CorrectUsage method changes storage usage counter, it's initialized if it doesn't exist
+func (r *Redis) CorrectUsage(delta int64) (int64, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Int64(conn.Do("INCRBY", r.nodeKey(usageKey), delta))
+}
+
+// GetUsage method returns storage usage counter
+// false is returned if counter has not been initialized yet
+func (r *Redis) GetUsage() (int64, bool, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	usage, err := redis.Int64(conn.Do("GET", r.nodeKey(usageKey)))
+	if err == redis.ErrNil {
+		return 0, false, nil
+	}
+
+	return usage, err == nil, err
+}
+
+// MarkFileAsDeleted method
+func (r *Redis) MarkFileAsDeleted(hash string, t *time.Time) error {
+	return r.markFileAsDeleted(hash, t, nil, nil)
+}
+
+// markFileAsDeleted method marks file as deleted in transaction with changes of eviction policy (nil policy is skipped),
+// it's executed only if lock is still held, errLockLost is returned otherwise (nil lock is not checked)
+func (r *Redis) markFileAsDeleted(hash string, t *time.Time, lock *RedisLock, policy EvictionPolicy) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	err := lock.watch(conn)
+	if err != nil {
+		return err
+	}
+
+	score, err := redis.Int(conn.Do("ZSCORE", scoreKey, hash))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	conn.Send("MULTI")
+
+	// policy reads scores of file before they are removed
+	if policy != nil {
+		err = policy.Evicted(conn, hash)
+		if err != nil {
+			return err
+		}
+	}
+
+	conn.Send("HMSET", metaPrefix+hash, "deleted_at", t.Unix(), "score", score)
+
+	for _, key := range []string{scoreKey, accessKey, createdKey, decayKey, gdsfKey, expiresKey} {
+		conn.Send("ZREM", key, hash)
+	}
+
+	unindexScript.Send(conn, metaPrefix+hash, sizeKey, hash)
+
+	_, err = lock.exec(conn)
+
+	return err
+}
+
+// RestoreFileMeta method returns restored file to indexes, download score and expiry are kept from the time of removal
+func (r *Redis) RestoreFileMeta(hash string) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	values, err := redis.Values(conn.Do("HMGET", metaPrefix+hash, "score", "created_at", "expires_at"))
+	if err != nil {
+		return err
+	}
+
+	res, err := getInt64Values(values)
+	if err != nil {
+		return err
+	}
+
+	score, createdAt, expiresAt := res[0], res[1], res[2]
+
+	conn.Send("HDEL", metaPrefix+hash, "deleted_at", "score")
+	conn.Send("ZADD", scoreKey, score, hash)
+	conn.Send("ZADD", createdKey, createdAt, hash)
+
+	if expiresAt > 0 {
+		conn.Send("ZADD", expiresKey, expiresAt, hash)
+	}
+
+	indexScript.Send(conn, metaPrefix+hash, sizeKey, createdKey, hash, "")
+
+	_, err = conn.Do("")
+
+	return err
+}
+
+// TrashFile method adds file to trash index and returns total size of trash
+func (r *Redis) TrashFile(hash string, size int64, t time.Time) (int64, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Int64(trashScript.Do(conn, r.nodeKey(trashKey), r.nodeKey(trashSizesKey), r.nodeKey(trashUsageKey), hash, t.Unix(), size))
+}
+
+// UntrashFile method removes file from trash index and returns its size
+// false is returned if file is not in trash
+func (r *Redis) UntrashFile(hash string) (int64, bool, error) {
+	return r.untrashFile(hash, nil)
+}
+
+// untrashFile method removes file from trash index in transaction,
+// it's executed only if lock is still held, errLockLost is returned otherwise (nil lock is not checked)
+func (r *Redis) untrashFile(hash string, lock *RedisLock) (int64, bool, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	err := lock.watch(conn)
+	if err != nil {
+		return 0, false, err
+	}
+
+	conn.Send("MULTI")
+	untrashScript.Send(conn, r.nodeKey(trashKey), r.nodeKey(trashSizesKey), r.nodeKey(trashUsageKey), hash)
+
+	values, err := lock.exec(conn)
+	if err != nil {
+		return 0, false, err
+	}
+
+	size, err := redis.Int64(values[0], nil)
+	if err == redis.ErrNil {
+		return 0, false, nil
+	}
+
+	return size, err == nil, err
+}
+
+// GetTrashedFiles method returns files from trash, the oldest first
+func (r *Redis) GetTrashedFiles(offset, count int) ([]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGE", r.nodeKey(trashKey), offset, offset+count-1))
+}
+
+// GetTrashedBefore method returns files which have been moved to trash before t
+func (r *Redis) GetTrashedBefore(t time.Time, count int) ([]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGEBYSCORE", r.nodeKey(trashKey), "-inf", "("+strconv.FormatInt(t.Unix(), 10), "LIMIT", 0, count))
+}
+
+// GetTrashSizes method returns sizes of trashed files, it's 0 for files which are not in trash
+func (r *Redis) GetTrashSizes(hashes []string) ([]int64, error) {
+	if len(hashes) == 0 {
+		return []int64{}, nil
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	args := redis.Args{}.Add(r.nodeKey(trashSizesKey)).AddFlat(hashes)
+
+	values, err := redis.Values(conn.Do("HMGET", args...))
+	if err != nil {
+		return nil, err
+	}
+
+	return getInt64Values(values)
+}
+
+// GetTrashUsage method returns total size of trash
+func (r *Redis) GetTrashUsage() (int64, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	usage, err := redis.Int64(conn.Do("GET", r.nodeKey(trashUsageKey)))
+	if err == redis.ErrNil {
+		return 0, nil
+	}
+
+	return usage, err
+}
+
+// QuarantineFile method flags file as corrupted and removes it from indexes
+// download score is kept in meta like for removed files
+func (r *Redis) QuarantineFile(hash, reason string, t time.Time) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	score, err := redis.Int(conn.Do("ZSCORE", scoreKey, hash))
+	if err != nil && err != redis.ErrNil {
+		return err
+	}
+
+	conn.Send("HMSET", metaPrefix+hash, "quarantined_at", t.Unix(), "quarantine_reason", reason, "score", score)
+	conn.Send("ZADD", quarantineKey, t.Unix(), hash)
+
+	for _, key := range []string{scoreKey, accessKey, createdKey, decayKey, gdsfKey, expiresKey} {
+		conn.Send("ZREM", key, hash)
+	}
+
+	unindexScript.Send(conn, metaPrefix+hash, sizeKey, hash)
+
+	_, err = conn.Do("")
+
+	return err
+}
+
+// UnquarantineFile method removes quarantine flag of repaired file and restores its indexes
+func (r *Redis) UnquarantineFile(hash string) error {
+	conn := r.Get()
+
+	conn.Send("HDEL", metaPrefix+hash, "quarantined_at", "quarantine_reason")
+	conn.Send("ZREM", quarantineKey, hash)
+
+	_, err := conn.Do("")
+	conn.Close()
+
+	if err != nil {
+		return err
+	}
+
+	return r.RestoreFileMeta(hash)
+}
+
+// IsQuarantined method returns true if file is in quarantine
+func (r *Redis) IsQuarantined(hash string) (bool, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err := redis.Int64(conn.Do("ZSCORE", quarantineKey, hash))
+	if err == redis.ErrNil {
+		return false, nil
+	}
+
+	return err == nil, err
+}
+
+// GetQuarantinedFiles method returns corrupted files, the oldest first
+func (r *Redis) GetQuarantinedFiles(offset, count int) ([]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGE", quarantineKey, offset, offset+count-1))
+}
+
+// GetLiveFiles method returns stored files ordered by creation time
+func (r *Redis) GetLiveFiles(offset, count int) ([]string, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	return redis.Strings(conn.Do("ZRANGE", createdKey, offset, offset+count-1))
+}
+
+// IndexFile method replaces indexes of file listing by ones of file metadata, removed files are not indexed
+func (r *Redis) IndexFile(file *FileMeta) error {
+	keys, err := json.Marshal(getIndexKeys(file))
+	if err != nil {
+		return err
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err = indexScript.Do(conn, metaPrefix+file.Hash, sizeKey, createdKey, file.Hash, keys)
+
+	return err
+}
+
+// ListFiles method returns live files which match filter in its order and cursor of the next page
+// at most maxScan files are examined, so page could contain less than count files even if there are more of them,
+// cursor is nil if there are no more files
+func (r *Redis) ListFiles(filter *FileFilter, after *FileCursor, count, maxScan int) ([]string, *FileCursor, error) {
+	ranges, sets := filter.getIndexes()
+
+	keys := []interface{}{filter.getSortKey()}
+	for _, v := range ranges {
+		keys = append(keys, v.key)
+	}
+
+	for _, v := range sets {
+		keys = append(keys, v)
+	}
+
+	order := "asc"
+	if filter.Desc {
+		order = "desc"
+	}
+
+	args := redis.Args{len(keys)}.AddFlat(keys).Add(order)
+	if after != nil {
+		args = args.Add(after.Score, after.Hash)
+	} else {
+		args = args.Add("", "")
+	}
+
+	args = args.Add(count, maxScan, len(ranges))
+	for _, v := range ranges {
+		args = args.Add(v.min, v.max)
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	values, err := redis.Strings(listScript.Do(conn, args...))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var next *FileCursor
+	if values[1] != "" {
+		next = &FileCursor{Score: values[0], Hash: values[1]}
+	}
+
+	return values[2:], next, nil
+}
+
+// HasFileMeta method returns true for files which have metadata and are not removed or quarantined
+func (r *Redis) HasFileMeta(hashes []string) ([]bool, error) {
+	if len(hashes) == 0 {
+		return []bool{}, nil
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	for _, hash := range hashes {
+		conn.Send("ZSCORE", createdKey, hash)
+	}
+
+	replies, err := redis.Values(conn.Do(""))
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]bool, len(replies))
+	for i, v := range replies {
+		res[i] = v != nil
+	}
+
+	return res, nil
+}
+
+// RepairFileMeta method recreates metadata of file which exists on disk, flags of removal are cleared
+func (r *Redis) RepairFileMeta(file *FileMeta) error {
+	conn := r.Get()
+	defer conn.Close()
+
+	conn.Send("HDEL", metaPrefix+file.Hash, "deleted_at", "quarantined_at", "quarantine_reason")
+	conn.Send("ZREM", quarantineKey, file.Hash)
+
+	_, err := conn.Do("")
+	if err != nil {
+		return err
+	}
+
+	return r.SaveFileMeta(file)
+}
+
+// SaveScrubReport method stores report of the latest scrub
+func (r *Redis) SaveScrubReport(report *FsckReport) error {
+	data, err := json.Marshal(report)
+	if err != nil {
+		return err
+	}
+
+	conn := r.Get()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", scrubReportKey, data)
+
+	return err
+}
+
+// GetScrubReport method returns report of the latest scrub, it's nil if storage has not been scrubbed yet
+func (r *Redis) GetScrubReport() (*FsckReport, error) {
+	conn := r.Get()
+	defer conn.Close()
+
+	data, err := redis.Bytes(conn.Do("GET", scrubReportKey))
+	if err == redis.ErrNil {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	report := &FsckReport{}
+
+	err = json.Unmarshal(data, report)
+	if err != nil {
+		return nil, err
+	}
+
+	return report, nil
+}
+
+// NewRedis func returns Redis pointer
+func NewRedis(cfg *RedisConfig) *Redis {
+	cfg.SetDefaults()
+
+	return &Redis{
+		Config: cfg,
+		pool:   newRedisPool(cfg),
+	}
+}
+
+// getInt64Values func converts replies to numbers, missing values are 0
+func getInt64Values(values []interface{}) ([]int64, error) {
+	res := make([]int64, len(values))
+
+	for i, v := range values {
+		if v == nil {
+			continue
+		}
+
+		n, err := redis.Int64(v, nil)
+		if err != nil {
+			return nil, err
+		}
+
+		res[i] = n
+	}
+
+	return res, nil
+}
+
+func newRedisPool(cfg *RedisConfig) *redis.Pool {
+	// for simplicity we use default timeouts for connect/read/write
+	return &redis.Pool{
+		MaxActive:   cfg.MaxActive,
+		MaxIdle:     cfg.MaxIdle,
+		IdleTimeout: time.Duration(cfg.IdleTimeout) * time.Second,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", cfg.Host+":"+strconv.Itoa(cfg.Port))
+		},
+		TestOnBorrow: func(c redis.Conn, t time.Time) error {
+			_, err := c.Do("PING")
+			return err
+		},
 	}
 }
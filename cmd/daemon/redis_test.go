@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"reflect"
+	"strings"
 	"testing"
 	"time"
 
@@ -13,7 +15,7 @@ func TestNewRedis(t *testing.T) {
 
 	r := NewRedis(&cfg)
 
-	conn, err := r.Dial()
+	conn, err := r.pool.Dial()
 
 	if err != nil {
 		t.Errorf("Could not connect to redis: %v\n", err)
@@ -27,12 +29,32 @@ func TestNewRedis(t *testing.T) {
 
 	defer conn.Close()
 
-	err = r.TestOnBorrow(conn, time.Now())
+	err = r.pool.TestOnBorrow(conn, time.Now())
 	if err != nil {
 		t.Errorf("Could not ping redis: %v\n", err)
 	}
 }
 
+func TestRedisGetLogsErrors(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	r := NewRedis(&RedisConfig{Port: 1})
+	r.Logger = NewWriterLogger(buf, LevelInfo, "logfmt")
+
+	conn := r.Get()
+	defer conn.Close()
+
+	if conn.Err() == nil {
+		t.Fatal("Connection error must not be nil")
+	}
+
+	for _, v := range []string{"msg=\"could not get redis connection\"", "host=127.0.0.1", "port=1", "error="} {
+		if !strings.Contains(buf.String(), v) {
+			t.Errorf("Log must contain %s but got %s\n", v, buf.String())
+		}
+	}
+}
+
 func TestRedisSaveMetaData(t *testing.T) {
 	r := NewRedis(&RedisConfig{})
 
@@ -320,3 +342,453 @@ func TestRedisGetUnusedFiles(t *testing.T) {
 	}
 
 }
+
+func TestRedisRecordAccess(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+	halfLife := time.Hour
+
+	files := []FileMeta{
+		FileMeta{Hash: "small", Size: 10, CreatedAt: &now},
+		FileMeta{Hash: "large", Size: 1000, CreatedAt: &now},
+		FileMeta{Hash: "old", Size: 10, CreatedAt: &now},
+	}
+
+	for _, meta := range files {
+		r.SaveFileMeta(&meta)
+	}
+
+	accesses := []struct {
+		hash string
+		t    time.Time
+	}{
+		{hash: "old", t: now.Add(-3 * time.Hour)},
+		{hash: "old", t: now.Add(-3 * time.Hour)},
+		{hash: "old", t: now.Add(-3 * time.Hour)},
+		{hash: "small", t: now},
+		{hash: "small", t: now},
+		{hash: "large", t: now},
+	}
+
+	for _, v := range accesses {
+		err := r.RecordAccess(v.hash, v.t, halfLife)
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			return
+		}
+	}
+
+	cases := []struct {
+		key      string
+		expected []string
+	}{
+		{
+			key:      accessKey,
+			expected: []string{"old", "large", "small"},
+		},
+		{
+			// 3 accesses 3 half lives ago weigh less than 1 access now
+			key:      decayKey,
+			expected: []string{"old", "large", "small"},
+		},
+		{
+			key:      gdsfKey,
+			expected: []string{"large", "old", "small"},
+		},
+	}
+
+	for _, tc := range cases {
+		keys, err := r.GetEvictionCandidates(tc.key, 0, 10)
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		if !reflect.DeepEqual(keys, tc.expected) {
+			t.Errorf("Keys of %s must be %v but got %v\n", tc.key, tc.expected, keys)
+		}
+	}
+
+	keys, _ := r.GetEvictionCandidates(accessKey, 1, 1)
+	if !reflect.DeepEqual(keys, []string{"large"}) {
+		t.Errorf("Keys must be %v but got %v\n", []string{"large"}, keys)
+	}
+}
+
+func TestRedisRaiseInflation(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+	r.SaveFileMeta(&FileMeta{Hash: "example", Size: 1, CreatedAt: &now})
+	r.RecordAccess("example", now, time.Hour)
+
+	policy, _ := NewEvictionPolicy(policyGDSF, r)
+
+	err := r.markFileAsDeleted("example", &now, nil, policy)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	inflation, _ := redis.Float64(conn.Do("GET", inflationKey))
+	if inflation != 1 {
+		t.Errorf("Inflation must be %v but got %v\n", 1, inflation)
+	}
+
+	// new files get priority over inflation
+	r.SaveFileMeta(&FileMeta{Hash: "example2", Size: 2, CreatedAt: &now})
+	r.RecordAccess("example2", now, time.Hour)
+
+	priority, _ := redis.Float64(conn.Do("ZSCORE", gdsfKey, "example2"))
+	if priority != 1.5 {
+		t.Errorf("Priority must be %v but got %v\n", 1.5, priority)
+	}
+
+	// unknown file does not change inflation
+	r.markFileAsDeleted("unknown", &now, nil, policy)
+
+	inflation, _ = redis.Float64(conn.Do("GET", inflationKey))
+	if inflation != 1 {
+		t.Errorf("Inflation must be %v but got %v\n", 1, inflation)
+	}
+}
+
+func TestRedisCreatedTimes(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+	old := now.Add(-time.Hour)
+
+	r.SaveFileMeta(&FileMeta{Hash: "new", Size: 1, CreatedAt: &now})
+	r.SaveFileMeta(&FileMeta{Hash: "old", Size: 1, CreatedAt: &old})
+
+	keys, err := r.GetFilesCreatedBefore(now.Add(-time.Minute), 0, 10)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	if !reflect.DeepEqual(keys, []string{"old"}) {
+		t.Errorf("Keys must be %v but got %v\n", []string{"old"}, keys)
+	}
+
+	times, err := r.GetCreatedTimes([]string{"new", "unknown", "old"})
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	expected := []int64{now.Unix(), 0, old.Unix()}
+	if !reflect.DeepEqual(times, expected) {
+		t.Errorf("Times must be %v but got %v\n", expected, times)
+	}
+}
+
+func TestRedisAutoCleanReports(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	for i := 1; i <= maxAutoCleanReports+5; i++ {
+		err := r.SaveAutoCleanReport(&AutoCleanReport{ID: int64(i), Result: "success"})
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+		}
+	}
+
+	cases := []struct {
+		count    int
+		expected int
+		first    int64
+	}{
+		{count: 2, expected: 2, first: maxAutoCleanReports + 5},
+		{count: 0, expected: maxAutoCleanReports, first: maxAutoCleanReports + 5},
+		{count: 1000, expected: maxAutoCleanReports, first: maxAutoCleanReports + 5},
+	}
+
+	for _, tc := range cases {
+		reports, err := r.GetAutoCleanReports(tc.count)
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+		}
+
+		if len(reports) != tc.expected {
+			t.Errorf("Reports count must be %d but got %d\n", tc.expected, len(reports))
+			continue
+		}
+
+		if reports[0].ID != tc.first {
+			t.Errorf("First report must be %d but got %d\n", tc.first, reports[0].ID)
+		}
+	}
+
+	scores, err := r.GetScores(accessKey, []string{})
+	if err != nil || len(scores) != 0 {
+		t.Errorf("Scores must be empty but got %v, %v\n", scores, err)
+	}
+}
+
+func TestRedisTrash(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+
+	usage, err := r.TrashFile("old", 10, now.Add(-time.Hour))
+	if err != nil || usage != 10 {
+		t.Errorf("Usage must be %d but got %d, %v\n", 10, usage, err)
+	}
+
+	r.TrashFile("new", 5, now)
+
+	// size of trashed file is replaced
+	usage, _ = r.TrashFile("new", 7, now)
+	if usage != 17 {
+		t.Errorf("Usage must be %d but got %d\n", 17, usage)
+	}
+
+	keys, _ := r.GetTrashedFiles(0, 10)
+	if !reflect.DeepEqual(keys, []string{"old", "new"}) {
+		t.Errorf("Keys must be %v but got %v\n", []string{"old", "new"}, keys)
+	}
+
+	keys, _ = r.GetTrashedBefore(now.Add(-time.Minute), 10)
+	if !reflect.DeepEqual(keys, []string{"old"}) {
+		t.Errorf("Keys must be %v but got %v\n", []string{"old"}, keys)
+	}
+
+	sizes, _ := r.GetTrashSizes([]string{"new", "unknown", "old"})
+	if !reflect.DeepEqual(sizes, []int64{7, 0, 10}) {
+		t.Errorf("Sizes must be %v but got %v\n", []int64{7, 0, 10}, sizes)
+	}
+
+	size, ok, err := r.UntrashFile("old")
+	if size != 10 || !ok || err != nil {
+		t.Errorf("Size must be %d but got %d, %v, %v\n", 10, size, ok, err)
+	}
+
+	_, ok, _ = r.UntrashFile("old")
+	if ok {
+		t.Error("File must not be in trash\n")
+	}
+
+	usage, _ = r.GetTrashUsage()
+	if usage != 7 {
+		t.Errorf("Usage must be %d but got %d\n", 7, usage)
+	}
+
+	// trash of another node is kept apart
+	other := NewRedis(&RedisConfig{})
+	other.NodeID = "node1"
+
+	other.TrashFile("other", 3, now)
+
+	keys, _ = r.GetTrashedFiles(0, 10)
+	if !reflect.DeepEqual(keys, []string{"new"}) {
+		t.Errorf("Keys must be %v but got %v\n", []string{"new"}, keys)
+	}
+
+	usage, _ = other.GetTrashUsage()
+	if usage != 3 {
+		t.Errorf("Usage must be %d but got %d\n", 3, usage)
+	}
+}
+
+func TestRedisRestoreFileMeta(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+	r.SaveFileMeta(&FileMeta{Hash: "example", Size: 1, CreatedAt: &now, Score: 3})
+	r.MarkFileAsDeleted("example", &now)
+
+	err := r.RestoreFileMeta("example")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	score, _ := redis.Int(conn.Do("ZSCORE", scoreKey, "example"))
+	if score != 3 {
+		t.Errorf("Score must be %d but got %d\n", 3, score)
+	}
+
+	times, _ := r.GetCreatedTimes([]string{"example"})
+	if times[0] != now.Unix() {
+		t.Errorf("Created time must be %d but got %d\n", now.Unix(), times[0])
+	}
+
+	deleted, _ := conn.Do("HGET", metaPrefix+"example", "deleted_at")
+	if deleted != nil {
+		t.Errorf("Deleted time must be removed but got %v\n", deleted)
+	}
+}
+
+func TestRedisQuarantineFile(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	now := time.Now()
+	r.SaveFileMeta(&FileMeta{Hash: "example", Size: 1, CreatedAt: &now, ExpiresAt: &now, Score: 3})
+	r.SaveFileMeta(&FileMeta{Hash: "valid", Size: 1, CreatedAt: &now})
+
+	err := r.QuarantineFile("example", "checksum", now)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	exists, _ := r.HasFileMeta([]string{"example", "valid", "unknown"})
+	if !reflect.DeepEqual(exists, []bool{false, true, false}) {
+		t.Errorf("Result must be %v but got %v\n", []bool{false, true, false}, exists)
+	}
+
+	keys, _ := r.GetQuarantinedFiles(0, 10)
+	if !reflect.DeepEqual(keys, []string{"example"}) {
+		t.Errorf("Keys must be %v but got %v\n", []string{"example"}, keys)
+	}
+
+	keys, _ = r.GetExpiredFiles(now.Add(time.Minute), 10)
+	if len(keys) != 0 {
+		t.Errorf("Quarantined file must not expire but got %v\n", keys)
+	}
+
+	reason, _ := redis.String(conn.Do("HGET", metaPrefix+"example", "quarantine_reason"))
+	if reason != "checksum" {
+		t.Errorf("Reason must be %s but got %s\n", "checksum", reason)
+	}
+
+	err = r.RepairFileMeta(&FileMeta{Hash: "example", Size: 1, CreatedAt: &now})
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	exists, _ = r.HasFileMeta([]string{"example"})
+	keys, _ = r.GetQuarantinedFiles(0, 10)
+	if !exists[0] || len(keys) != 0 {
+		t.Errorf("File must be repaired but got %v, %v\n", exists, keys)
+	}
+
+	reason, _ = redis.String(conn.Do("HGET", metaPrefix+"example", "quarantine_reason"))
+	if reason != "" {
+		t.Errorf("Reason must be removed but got %s\n", reason)
+	}
+}
+
+func TestRedisScrubReport(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	report, err := r.GetScrubReport()
+	if report != nil || err != nil {
+		t.Errorf("Report must be nil but got %v, %v\n", report, err)
+	}
+
+	r.SaveScrubReport(&FsckReport{Result: "success", CheckedFiles: 3, Corrupted: 1})
+
+	report, err = r.GetScrubReport()
+	if err != nil || report == nil || report.CheckedFiles != 3 || report.Corrupted != 1 {
+		t.Errorf("Unexpected report %#v, %v\n", report, err)
+	}
+}
+
+func TestRedisFillEvictionIndex(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	// file uploaded before access index
+	conn.Do("ZADD", scoreKey, 10, "legacy")
+
+	now := time.Now()
+	r.SaveFileMeta(&FileMeta{Hash: "example", Size: 1, CreatedAt: &now})
+	r.RecordAccess("example", now, time.Hour)
+
+	err := r.FillEvictionIndex(accessKey)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	keys, _ := r.GetEvictionCandidates(accessKey, 0, 10)
+	if !reflect.DeepEqual(keys, []string{"legacy", "example"}) {
+		t.Errorf("Keys must be %v but got %v\n", []string{"legacy", "example"}, keys)
+	}
+
+	accessedAt, _ := redis.Int64(conn.Do("ZSCORE", accessKey, "example"))
+	if accessedAt != now.Unix() {
+		t.Errorf("Score must be kept %d but got %d\n", now.Unix(), accessedAt)
+	}
+
+	// marked as deleted file is removed from all indexes
+	r.MarkFileAsDeleted("example", &now)
+
+	for _, key := range []string{scoreKey, accessKey, createdKey, decayKey, gdsfKey} {
+		_, err := redis.Float64(conn.Do("ZSCORE", key, "example"))
+		if err != redis.ErrNil {
+			t.Errorf("File must be removed from %s\n", key)
+		}
+	}
+}
+
+func TestRedisUsage(t *testing.T) {
+	r := NewRedis(&RedisConfig{})
+
+	// flush db before test (we can do it on test environment)
+	conn := r.Get()
+	defer conn.Close()
+	conn.Do("FLUSHDB")
+
+	_, ok, err := r.AddUsage(10)
+	if err != nil || ok {
+		t.Errorf("Counter must not be changed before initialization (%v)\n", err)
+	}
+
+	usage, err := r.CorrectUsage(100)
+	if err != nil || usage != 100 {
+		t.Errorf("Usage must be %d but got %d (%v)\n", 100, usage, err)
+	}
+
+	usage, ok, err = r.AddUsage(-30)
+	if err != nil || !ok || usage != 70 {
+		t.Errorf("Usage must be %d but got %d (%v)\n", 70, usage, err)
+	}
+
+	usage, ok, err = r.GetUsage()
+	if err != nil || !ok || usage != 70 {
+		t.Errorf("Usage must be %d but got %d (%v)\n", 70, usage, err)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import "errors"
+
+var (
+	// errTooFewShards is returned if there are less valid shards than data shards
+	errTooFewShards = errors.New("Too few shards to reconstruct data")
+	// errSingularMatrix is returned if matrix could not be inverted
+	errSingularMatrix = errors.New("Matrix is singular")
+)
+
+// tables of GF(2^8) arithmetic with polynomial x^8 + x^4 + x^3 + x^2 + 1
+var (
+	gfExp [510]byte
+	gfLog [256]int
+	gfMul [256][256]byte
+)
+
+func init() {
+	x := 1
+	for i := 0; i < 255; i++ {
+		gfExp[i] = byte(x)
+		gfExp[i+255] = byte(x)
+		gfLog[x] = i
+
+		x <<= 1
+		if x&0x100 != 0 {
+			x ^= 0x11d
+		}
+	}
+
+	for a := 1; a < 256; a++ {
+		for b := 1; b < 256; b++ {
+			gfMul[a][b] = gfExp[gfLog[a]+gfLog[b]]
+		}
+	}
+}
+
+func gfInv(a byte) byte {
+	return gfExp[255-gfLog[a]]
+}
+
+// ReedSolomon struct is systematic Reed-Solomon code with k data and m parity shards
+// parity rows of encoding matrix form Cauchy matrix, so any k rows of it could be inverted
+type ReedSolomon struct {
+	DataShards   int
+	ParityShards int
+
+	matrix [][]byte
+}
+
+// NewReedSolomon func returns ReedSolomon pointer, count of shards must not exceed 256
+func NewReedSolomon(dataShards, parityShards int) (*ReedSolomon, error) {
+	if dataShards < 1 || parityShards < 0 || dataShards+parityShards > 256 {
+		return nil, errors.New("Invalid count of shards")
+	}
+
+	rs := &ReedSolomon{
+		DataShards:   dataShards,
+		ParityShards: parityShards,
+		matrix:       make([][]byte, dataShards+parityShards),
+	}
+
+	for i := range rs.matrix {
+		rs.matrix[i] = make([]byte, dataShards)
+
+		if i < dataShards {
+			rs.matrix[i][i] = 1
+			continue
+		}
+
+		for j := 0; j < dataShards; j++ {
+			rs.matrix[i][j] = gfInv(byte(i) ^ byte(j))
+		}
+	}
+
+	return rs, nil
+}
+
+// Encode method fills parity shards by data shards, all shards must have the same size
+func (rs *ReedSolomon) Encode(shards [][]byte) {
+	for i := rs.DataShards; i < len(shards); i++ {
+		rs.encodeRow(shards[:rs.DataShards], shards[i], rs.matrix[i])
+	}
+}
+
+// Reconstruct method restores shards which are not valid in place, all shards must have the same size
+// errTooFewShards is returned if there are less valid shards than data shards
+func (rs *ReedSolomon) Reconstruct(shards [][]byte, valid []bool) error {
+	k := rs.DataShards
+
+	rows := []int{}
+	dataValid := true
+
+	for i := range shards {
+		if valid[i] && len(rows) < k {
+			rows = append(rows, i)
+		}
+
+		if i < k && !valid[i] {
+			dataValid = false
+		}
+	}
+
+	if len(rows) < k {
+		return errTooFewShards
+	}
+
+	if !dataValid {
+		// data = inverse(rows of matrix) * valid shards
+		sub := make([][]byte, k)
+		input := make([][]byte, k)
+
+		for i, row := range rows {
+			sub[i] = append([]byte{}, rs.matrix[row]...)
+			input[i] = shards[row]
+		}
+
+		inv, err := invertMatrix(sub)
+		if err != nil {
+			return err
+		}
+
+		for i := 0; i < k; i++ {
+			if !valid[i] {
+				rs.encodeRow(input, shards[i], inv[i])
+			}
+		}
+	}
+
+	// parity is recomputed from restored data
+	for i := k; i < len(shards); i++ {
+		if !valid[i] {
+			rs.encodeRow(shards[:k], shards[i], rs.matrix[i])
+		}
+	}
+
+	return nil
+}
+
+// encodeRow method writes linear combination of input shards with coefficients of row to out
+func (rs *ReedSolomon) encodeRow(input [][]byte, out []byte, row []byte) {
+	for x := range out {
+		out[x] = 0
+	}
+
+	for j, c := range row {
+		if c == 0 {
+			continue
+		}
+
+		table := &gfMul[c]
+		for x, v := range input[j] {
+			out[x] ^= table[v]
+		}
+	}
+}
+
+// invertMatrix func inverts square matrix by Gauss-Jordan elimination, matrix is changed
+func invertMatrix(m [][]byte) ([][]byte, error) {
+	n := len(m)
+
+	inv := make([][]byte, n)
+	for i := range inv {
+		inv[i] = make([]byte, n)
+		inv[i][i] = 1
+	}
+
+	for col := 0; col < n; col++ {
+		pivot := -1
+		for row := col; row < n; row++ {
+			if m[row][col] != 0 {
+				pivot = row
+				break
+			}
+		}
+
+		if pivot < 0 {
+			return nil, errSingularMatrix
+		}
+
+		m[col], m[pivot] = m[pivot], m[col]
+		inv[col], inv[pivot] = inv[pivot], inv[col]
+
+		if c := m[col][col]; c != 1 {
+			scale := gfInv(c)
+			for j := 0; j < n; j++ {
+				m[col][j] = gfMul[scale][m[col][j]]
+				inv[col][j] = gfMul[scale][inv[col][j]]
+			}
+		}
+
+		for row := 0; row < n; row++ {
+			c := m[row][col]
+			if row == col || c == 0 {
+				continue
+			}
+
+			for j := 0; j < n; j++ {
+				m[row][j] ^= gfMul[c][m[col][j]]
+				inv[row][j] ^= gfMul[c][inv[col][j]]
+			}
+		}
+	}
+
+	return inv, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func TestNewReedSolomon(t *testing.T) {
+	cases := []struct {
+		data   int
+		parity int
+		valid  bool
+	}{
+		{data: 1, parity: 0, valid: true},
+		{data: 4, parity: 2, valid: true},
+		{data: 200, parity: 56, valid: true},
+		{data: 0, parity: 2, valid: false},
+		{data: 2, parity: -1, valid: false},
+		{data: 200, parity: 57, valid: false},
+	}
+
+	for _, tc := range cases {
+		_, err := NewReedSolomon(tc.data, tc.parity)
+		if (err == nil) != tc.valid {
+			t.Errorf("Valid flag for %d+%d must be %v but got %v\n", tc.data, tc.parity, tc.valid, err)
+		}
+	}
+}
+
+func TestReedSolomonReconstruct(t *testing.T) {
+	cases := []struct {
+		data   int
+		parity int
+		lost   []int
+		err    error
+	}{
+		{data: 3, parity: 2, lost: []int{}, err: nil},
+		{data: 3, parity: 2, lost: []int{0}, err: nil},
+		{data: 3, parity: 2, lost: []int{1, 4}, err: nil},
+		{data: 3, parity: 2, lost: []int{0, 2}, err: nil},
+		{data: 3, parity: 2, lost: []int{3, 4}, err: nil},
+		{data: 3, parity: 2, lost: []int{0, 1, 2}, err: errTooFewShards},
+		{data: 10, parity: 4, lost: []int{0, 5, 9, 12}, err: nil},
+		{data: 1, parity: 1, lost: []int{0}, err: nil},
+	}
+
+	for _, tc := range cases {
+		rs, _ := NewReedSolomon(tc.data, tc.parity)
+
+		shards := make([][]byte, tc.data+tc.parity)
+		for i := range shards {
+			shards[i] = make([]byte, 64)
+
+			if i < tc.data {
+				rand.Read(shards[i])
+			}
+		}
+
+		rs.Encode(shards)
+
+		expected := make([][]byte, len(shards))
+		for i := range shards {
+			expected[i] = append([]byte{}, shards[i]...)
+		}
+
+		valid := make([]bool, len(shards))
+		for i := range valid {
+			valid[i] = true
+		}
+
+		for _, i := range tc.lost {
+			valid[i] = false
+			shards[i] = make([]byte, 64)
+		}
+
+		err := rs.Reconstruct(shards, valid)
+		if err != tc.err {
+			t.Errorf("Error for lost %v must be %v but got %v\n", tc.lost, tc.err, err)
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		for i := range shards {
+			if !bytes.Equal(shards[i], expected[i]) {
+				t.Errorf("Shard %d for lost %v must be restored\n", i, tc.lost)
+			}
+		}
+	}
+}
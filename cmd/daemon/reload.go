@@ -0,0 +1,138 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+)
+
+// ReloadConfig method reads config from ConfigPath and applies it
+// invalid config is rejected and current one is kept
+func (app *Application) ReloadConfig() error {
+	if app.ConfigPath == "" {
+		return errors.New("Config path is not set")
+	}
+
+	cfg, err := LoadConfig(app.ConfigPath)
+	if err != nil {
+		app.Metrics.ConfigReloads.Inc("error")
+		app.Logger.Error("could not reload config", "error", err)
+		return err
+	}
+
+	return app.ApplyConfig(cfg)
+}
+
+// ApplyConfig method validates config and replaces current one atomically
+// - rate limit is rebuilt, counters of limits which are enabled in both configs are kept
+// - storage max size and limit are applied to new requests and next autoclean run
+// - redis pool is recreated if redis config has been changed
+// fields which could not be changed without restart keep current values, warning is logged for them
+func (app *Application) ApplyConfig(cfg *Config) error {
+	err := cfg.Validate()
+	if err != nil {
+		app.Metrics.ConfigReloads.Inc("error")
+		app.Logger.Error("new config is invalid, current one is kept", "error", err)
+		return err
+	}
+
+	app.mu.Lock()
+	defer app.mu.Unlock()
+
+	if fields := keepRestartFields(app.Config, cfg); len(fields) > 0 {
+		app.Logger.Warn("config fields require restart, current values are kept", "fields", fields)
+	}
+
+	rateLimit := NewRateLimit(cfg.RateLimit)
+	if app.RateLimit != nil {
+		rateLimit.Logger = app.RateLimit.Logger
+		rateLimit.Inherit(app.RateLimit)
+	}
+
+	if app.Storage != nil {
+		app.Storage.SetConfig(cfg.Storage)
+	}
+
+	if app.Redis != nil {
+		app.Redis.Reload(cfg.Redis)
+	}
+
+	app.Config = cfg
+	app.RateLimit = rateLimit
+
+	// schedule could be changed
+	app.RescheduleAutoClean()
+
+	app.Metrics.StorageLimit.Set(float64(cfg.Storage.Limit))
+	app.Metrics.ConfigReloads.Inc("success")
+	app.Logger.Info("config reloaded")
+
+	return nil
+}
+
+// keepRestartFields func copies fields which are used only on start from old config to new one
+// and returns names of fields which have been changed
+func keepRestartFields(old, cfg *Config) []string {
+	changed := []string{}
+
+	if old == nil {
+		return changed
+	}
+
+	if old.Host != cfg.Host || old.Port != cfg.Port {
+		changed = append(changed, "host/port")
+		cfg.Host = old.Host
+		cfg.Port = old.Port
+	}
+
+	if old.ShutdownTimeout != cfg.ShutdownTimeout {
+		changed = append(changed, "shutdown_timeout")
+		cfg.ShutdownTimeout = old.ShutdownTimeout
+	}
+
+	if old.Storage != nil && old.Storage.Path != cfg.Storage.Path {
+		changed = append(changed, "storage.path")
+		cfg.Storage.Path = old.Storage.Path
+	}
+
+	// layout of shards could not be changed for stored files
+	if old.Storage != nil && !reflect.DeepEqual(old.Storage.Erasure, cfg.Storage.Erasure) {
+		changed = append(changed, "storage.erasure")
+		cfg.Storage.Erasure = old.Storage.Erasure
+	}
+
+	if !reflect.DeepEqual(old.Log, cfg.Log) {
+		changed = append(changed, "log")
+		cfg.Log = old.Log
+	}
+
+	if !reflect.DeepEqual(old.AccessLog, cfg.AccessLog) {
+		changed = append(changed, "access_log")
+		cfg.AccessLog = old.AccessLog
+	}
+
+	// certificates are reloaded from the same files
+	if !reflect.DeepEqual(old.TLS, cfg.TLS) {
+		changed = append(changed, "tls")
+		cfg.TLS = old.TLS
+	}
+
+	if getDrainDelay(old) != getDrainDelay(cfg) {
+		changed = append(changed, "health.drain_delay")
+
+		if cfg.Health == nil {
+			cfg.Health = &HealthConfig{}
+		}
+
+		cfg.Health.DrainDelay = getDrainDelay(old)
+	}
+
+	return changed
+}
+
+func getDrainDelay(cfg *Config) int {
+	if cfg.Health == nil {
+		return 0
+	}
+
+	return cfg.Health.DrainDelay
+}
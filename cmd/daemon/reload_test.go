@@ -0,0 +1,185 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newReloadTestApplication() *Application {
+	cfg, _ := NewConfig("mocks/config/full.json")
+
+	return NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(cfg.RateLimit), NewRedis(cfg.Redis))
+}
+
+func TestApplicationApplyConfig(t *testing.T) {
+	app := newReloadTestApplication()
+
+	oldLimit := app.GetRateLimit()
+	oldLimit.AddConnection("127.0.0.1")
+
+	cfg, _ := NewConfig("mocks/config/full.json")
+	cfg.Port = 9090
+	cfg.Storage.Path = "example"
+	cfg.Storage.MaxSize = 1024
+	cfg.Storage.Limit = 4096
+	cfg.RateLimit.MaxConnectionsFromIP = 2
+	cfg.RateLimit.RPS.Upload = 0
+	cfg.Redis.MaxActive = 20
+
+	err := app.ApplyConfig(cfg)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	if app.GetConfig() != cfg {
+		t.Error("Config must be replaced")
+	}
+
+	// restart is required for these fields
+	if cfg.Port != 8080 || cfg.Storage.Path != "mocks/storage/" {
+		t.Errorf("Port and storage path must be kept but got %d and %s\n", cfg.Port, cfg.Storage.Path)
+	}
+
+	if size := app.Storage.GetMaxSizeOfFile(); size != 1024 {
+		t.Errorf("Max size must be %d but got %d\n", 1024, size)
+	}
+
+	if v := app.Metrics.StorageLimit.Value(); v != 4096 {
+		t.Errorf("Storage limit metric must be %v but got %v\n", 4096, v)
+	}
+
+	if v := app.Metrics.ConfigReloads.Value("success"); v != 1 {
+		t.Errorf("Reloads count must be %v but got %v\n", 1, v)
+	}
+
+	if app.Redis.Config.MaxActive != 20 {
+		t.Errorf("Redis max active must be %d but got %d\n", 20, app.Redis.Config.MaxActive)
+	}
+
+	rateLimit := app.GetRateLimit()
+	if rateLimit == oldLimit {
+		t.Error("Rate limit must be replaced")
+	}
+
+	// connection which has been opened before reload is counted
+	if !rateLimit.AddConnection("127.0.0.1") {
+		t.Error("Second connection must be allowed")
+	}
+
+	if rateLimit.AddConnection("127.0.0.1") {
+		t.Error("Third connection must not be allowed")
+	}
+	rateLimit.RemoveConnection("127.0.0.1")
+
+	// and released by old rate limit
+	oldLimit.RemoveConnection("127.0.0.1")
+
+	if !rateLimit.AddConnection("127.0.0.1") {
+		t.Error("Connection must be allowed after release")
+	}
+
+	if rateLimit.rpsUpload != nil {
+		t.Error("Upload rps limit must be disabled")
+	}
+}
+
+func TestApplicationApplyInvalidConfig(t *testing.T) {
+	app := newReloadTestApplication()
+
+	old := app.GetConfig()
+	oldLimit := app.GetRateLimit()
+
+	cfg, _ := NewConfig("mocks/config/full.json")
+	cfg.Storage.MaxSize = -1
+
+	err := app.ApplyConfig(cfg)
+	if _, ok := err.(ValidationErrors); !ok {
+		t.Errorf("Error must be ValidationErrors but got %v\n", err)
+	}
+
+	if app.GetConfig() != old || app.GetRateLimit() != oldLimit {
+		t.Error("Current config must be kept")
+	}
+
+	if v := app.Metrics.ConfigReloads.Value("error"); v != 1 {
+		t.Errorf("Errors count must be %v but got %v\n", 1, v)
+	}
+}
+
+func TestApplicationReloadConfig(t *testing.T) {
+	app := newReloadTestApplication()
+
+	err := app.ReloadConfig()
+	if err == nil {
+		t.Error("Error must not be nil without config path")
+	}
+
+	f, err := ioutil.TempFile("", "t2-config")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"storage": {"path": "mocks/storage/", "max_size": 100, "limit": 200}}`)
+	f.Close()
+
+	app.ConfigPath = f.Name()
+
+	err = app.ReloadConfig()
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	if cfg := app.GetConfig(); cfg.Storage.MaxSize != 100 || cfg.Storage.Limit != 200 {
+		t.Errorf("Unexpected storage config %#v\n", cfg.Storage)
+	}
+
+	ioutil.WriteFile(f.Name(), []byte("{"), 0644)
+
+	err = app.ReloadConfig()
+	if err == nil {
+		t.Error("Error must not be nil for broken config")
+	}
+
+	if cfg := app.GetConfig(); cfg.Storage.MaxSize != 100 {
+		t.Errorf("Current config must be kept but got %#v\n", cfg.Storage)
+	}
+}
+
+func TestKeepRestartFields(t *testing.T) {
+	old := &Config{
+		Host:    "127.0.0.1",
+		Port:    8080,
+		Storage: &StorageConfig{Path: "storage"},
+		Log:     &LogConfig{Level: "info"},
+		Health:  &HealthConfig{DrainDelay: 5},
+	}
+
+	cfg := &Config{
+		Host:    "127.0.0.1",
+		Port:    8080,
+		Storage: &StorageConfig{Path: "storage", Limit: 100},
+		Log:     &LogConfig{Level: "debug"},
+		TLS:     &TLSConfig{CertFile: "example"},
+		Health:  &HealthConfig{MinFreeSpace: 10},
+	}
+
+	fields := keepRestartFields(old, cfg)
+
+	expected := []string{"log", "tls", "health.drain_delay"}
+	if !reflect.DeepEqual(fields, expected) {
+		t.Errorf("Fields must be %v but got %v\n", expected, fields)
+	}
+
+	if cfg.Log.Level != "info" || cfg.TLS != nil || cfg.Health.DrainDelay != 5 || cfg.Health.MinFreeSpace != 10 {
+		t.Error("Restart fields must be copied from old config")
+	}
+
+	if cfg.Storage.Limit != 100 {
+		t.Error("Other fields must not be changed")
+	}
+}
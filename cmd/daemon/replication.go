@@ -0,0 +1,425 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// default interval of re-replication of under-replicated files
+const defaultReplicationInterval = 3600
+
+// key of re-replication lock, only one node re-replicates files at the same time
+const replicationLockKey = "REPLICATION_LOCK"
+
+// errQuorumNotReached is returned if uploaded file is not saved to write quorum of locations
+var errQuorumNotReached = errors.New("Write quorum is not reached")
+
+// ReplicationConfig struct contains info about
+// - replicas, paths of directories or mounted backends where files are copied synchronously on upload
+// - write quorum, count of locations including storage path which must save file before reply, default is majority
+// - interval of re-replication of under-replicated files in seconds, default is 3600
+type ReplicationConfig struct {
+	Replicas    []string `json:"replicas"`
+	WriteQuorum int      `json:"write_quorum"`
+	Interval    int      `json:"interval"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *ReplicationConfig) SetDefaults() {
+	if cfg.WriteQuorum == 0 {
+		cfg.WriteQuorum = (len(cfg.Replicas)+1)/2 + 1
+	}
+
+	if cfg.Interval == 0 {
+		cfg.Interval = defaultReplicationInterval
+	}
+}
+
+// GetReplication method returns replication config, config without replicas is returned if it's not set
+func (cfg *StorageConfig) GetReplication() *ReplicationConfig {
+	if cfg.Replication != nil {
+		return cfg.Replication
+	}
+
+	v := &ReplicationConfig{}
+	v.SetDefaults()
+
+	return v
+}
+
+// validateReplicationConfig func adds problems of replication config to errs
+func validateReplicationConfig(errs *ValidationErrors, cfg *ReplicationConfig, storagePath string) {
+	if cfg == nil {
+		return
+	}
+
+	seen := map[string]bool{path.Clean(storagePath): true}
+
+	for _, replica := range cfg.Replicas {
+		if replica == "" || seen[path.Clean(replica)] {
+			errs.Add("storage.replication.replicas", "must contain unique paths which differ from storage path")
+			break
+		}
+
+		seen[path.Clean(replica)] = true
+	}
+
+	if cfg.WriteQuorum < 0 || cfg.WriteQuorum > len(cfg.Replicas)+1 {
+		errs.Add("storage.replication.write_quorum", "must be between 1 and count of replicas plus one")
+	}
+
+	if cfg.Interval < 0 {
+		errs.Add("storage.replication.interval", "must not be negative")
+	}
+}
+
+// getRepairSources func returns locations which could have valid copy of corrupted file
+func getRepairSources(cfg *StorageConfig) []string {
+	return append(append([]string{}, cfg.GetQuarantine().Sources...), cfg.GetReplication().Replicas...)
+}
+
+// replicate method copies stored file to replicas in parallel and returns count of replicas which have it
+func (s *Storage) replicate(root string, replicas []string, hash string) int {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+
+	count := 0
+
+	for _, replica := range replicas {
+		wg.Add(1)
+
+		go func(replica string) {
+			defer wg.Done()
+
+			err := s.copyFile(root, replica, hash)
+			if err != nil {
+				s.Logger.Warn("could not copy file to replica", "file_id", hash, "replica", replica, "error", err)
+				return
+			}
+
+			mu.Lock()
+			count++
+			mu.Unlock()
+		}(replica)
+	}
+
+	wg.Wait()
+
+	return count
+}
+
+// removeReplicas method removes copies of file from replicas
+func (s *Storage) removeReplicas(hash string) {
+	for _, replica := range s.GetConfig().GetReplication().Replicas {
+		err := os.Remove(path.Join(replica, hash[:2], hash))
+		if err != nil && !os.IsNotExist(err) {
+			s.Logger.Warn("could not remove file from replica", "file_id", hash, "replica", replica, "error", err)
+		}
+	}
+}
+
+// FindFile method returns path of file in storage or in the first replica which has it
+func (s *Storage) FindFile(hash string) (string, bool) {
+	if fileName, ok := s.GetFile(hash); ok {
+		return fileName, true
+	}
+
+	for _, replica := range s.GetConfig().GetReplication().Replicas {
+		fileName := path.Join(replica, hash[:2], hash)
+
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName, true
+		}
+	}
+
+	return "", false
+}
+
+// OpenReplica method returns reader of original content of the first valid copy of file in replicas and size of content
+// copy is verified before it's returned, so it's read twice, corrupted copies are removed, they are restored by re-replication
+// client key is required for file which is encrypted by it, copies are not verified without it
+func (s *Storage) OpenReplica(hash string, clientKey []byte) (io.ReadCloser, int64, bool) {
+	expected := strings.Split(hash, "-")[0]
+
+	for _, replica := range s.GetConfig().GetReplication().Replicas {
+		fileName := path.Join(replica, hash[:2], hash)
+
+		f, err := os.Open(fileName)
+		if err != nil {
+			continue
+		}
+
+		// copy could be compressed and encrypted
+		content, err := s.decodeContent(hash, f, clientKey)
+		if isKeyError(err) {
+			f.Close()
+			continue
+		}
+
+		size := &countingWriter{}
+
+		if err == nil {
+			var sum string
+
+			if sum, err = getSHA256Sum(io.TeeReader(content, size)); err == nil && sum != expected {
+				err = errChecksumMismatch
+			}
+		}
+
+		f.Close()
+
+		if err == nil {
+			if r, err := s.openReplicaContent(fileName, hash, clientKey); err == nil {
+				return r, size.count, true
+			}
+
+			continue
+		}
+
+		s.Logger.Warn("copy of file in replica is corrupted", "file_id", hash, "replica", replica)
+		os.Remove(fileName)
+	}
+
+	return nil, 0, false
+}
+
+// openReplicaContent method returns reader of original content of copy of file
+func (s *Storage) openReplicaContent(fileName, hash string, clientKey []byte) (io.ReadCloser, error) {
+	f, err := os.Open(fileName)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := s.decodeContent(hash, f, clientKey)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return readCloser{content, f}, nil
+}
+
+// ReplicateFile method copies file from any location which has it to locations which don't have it
+// it returns count of created copies, os.ErrNotExist is returned if there are no copies at all
+func (s *Storage) ReplicateFile(hash string) (int, error) {
+	cfg := s.GetConfig()
+	locations := append([]string{cfg.Path}, cfg.GetReplication().Replicas...)
+
+	var missing []string
+	source := ""
+
+	for _, location := range locations {
+		if _, err := os.Stat(path.Join(location, hash[:2], hash)); err == nil {
+			if source == "" {
+				source = location
+			}
+		} else if os.IsNotExist(err) {
+			missing = append(missing, location)
+		} else {
+			return 0, err
+		}
+	}
+
+	if source == "" {
+		return 0, os.ErrNotExist
+	}
+
+	count := 0
+
+	for _, location := range missing {
+		err := s.copyFile(source, location, hash)
+		if err != nil {
+			return count, err
+		}
+
+		s.Logger.Debug("file replicated", "file_id", hash, "source", source, "location", location)
+		count++
+	}
+
+	return count, nil
+}
+
+// copyFile method copies file from one location to another through temporary file
+// checksum of copy is verified for files with sha256 in id, existing copy is not replaced
+func (s *Storage) copyFile(fromRoot, toRoot, hash string) error {
+	fileName := path.Join(toRoot, hash[:2], hash)
+
+	if _, err := os.Stat(fileName); err == nil {
+		return nil
+	}
+
+	src, err := os.Open(path.Join(fromRoot, hash[:2], hash))
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	err = os.MkdirAll(path.Dir(fileName), 0755)
+	if err != nil {
+		return err
+	}
+
+	dst, err := ioutil.TempFile(path.Dir(fileName), "."+hash+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dst.Name())
+
+	_, err = io.Copy(dst, src)
+	if err == nil {
+		err = dst.Sync()
+	}
+
+	if err == nil {
+		err = s.verifyCopy(dst, hash)
+	}
+
+	if e := dst.Close(); err == nil {
+		err = e
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(dst.Name(), fileName)
+}
+
+// verifyCopy method checks sha256 of original content of copy for files with sha256 in id
+func (s *Storage) verifyCopy(f *os.File, hash string) error {
+	expected := strings.Split(hash, "-")[0]
+	if !isSHA256(expected) {
+		return nil
+	}
+
+	_, err := f.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	sum, err := s.getContentSHA256(hash, f)
+	if err != nil {
+		return err
+	}
+
+	if sum != expected {
+		return errChecksumMismatch
+	}
+
+	return nil
+}
+
+// Rereplicate method restores missing copies of stored files and returns count of created copies
+func (app *Application) Rereplicate(ctx context.Context) (int, error) {
+	count := 0
+	offset := 0
+
+	for {
+		hashes, err := app.Redis.GetLiveFiles(offset, 100)
+		if err != nil {
+			return count, err
+		} else if len(hashes) == 0 {
+			return count, nil
+		}
+
+		for _, hash := range hashes {
+			if err := ctx.Err(); err != nil {
+				return count, err
+			}
+
+			_, err := app.Storage.GetFileSize(hash)
+			missing := os.IsNotExist(err)
+
+			n, err := app.Storage.ReplicateFile(hash)
+			if os.IsNotExist(err) {
+				// file without copies is reported by fsck
+				continue
+			} else if err != nil {
+				app.Logger.Warn("could not replicate file", "component", "replication", "file_id", hash, "error", err)
+				continue
+			}
+
+			// restored file in storage path is counted in usage
+			if size, err := app.Storage.GetFileSize(hash); missing && err == nil {
+				err = app.AddUsage(size)
+				if err != nil {
+					return count, err
+				}
+			}
+
+			count += n
+			app.Metrics.ReplicatedFiles.Add(float64(n))
+		}
+
+		offset += len(hashes)
+	}
+}
+
+// RunRereplicate method re-replicates files periodically under replication lock until application is shut down
+func (app *Application) RunRereplicate() {
+	app.Go(func() {
+		for {
+			cfg := app.GetConfig()
+
+			interval := time.Duration(cfg.Storage.GetReplication().Interval) * time.Second
+			if interval <= 0 {
+				interval = defaultReplicationInterval * time.Second
+			}
+
+			timer := time.NewTimer(interval)
+
+			select {
+			case <-app.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			if len(cfg.Storage.GetReplication().Replicas) == 0 {
+				continue
+			}
+
+			app.rereplicate(cfg)
+		}
+	})
+}
+
+func (app *Application) rereplicate(cfg *Config) {
+	logger := app.Logger.With("component", "replication")
+
+	lock, err := app.Redis.AcquireLock(replicationLockKey, getLockTTL(cfg.AutoClean))
+	if err != nil {
+		logger.Error("could not acquire replication lock", "error", err)
+		return
+	} else if lock == nil {
+		logger.Debug("re-replication is in progress on another node")
+		return
+	}
+	defer lock.Release()
+
+	ctx, cancel := context.WithCancel(app.ctx)
+
+	renewed := make(chan struct{})
+	go func() {
+		lock.KeepAlive(ctx, cancel)
+		close(renewed)
+	}()
+
+	count, err := app.Rereplicate(ctx)
+
+	cancel()
+	<-renewed
+
+	if err != nil {
+		logger.Error("re-replication failed", "error", err)
+	} else if count > 0 {
+		logger.Info("files re-replicated", "copies", count)
+	}
+}
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+func newReplicationTestApplication(t *testing.T, quorum int) (*Application, []string) {
+	replicas := make([]string, 2)
+	for i := range replicas {
+		replicas[i], _ = ioutil.TempDir("", "t2-replica")
+	}
+
+	replication := &ReplicationConfig{Replicas: replicas, WriteQuorum: quorum}
+	replication.SetDefaults()
+
+	app := newTrashTestApplication(t, &StorageConfig{Replication: replication})
+	app.Storage.Logger = app.Logger
+
+	return app, replicas
+}
+
+func removeReplicationTestApplication(app *Application, replicas []string) {
+	os.RemoveAll(app.Config.Storage.Path)
+
+	for _, replica := range replicas {
+		os.RemoveAll(replica)
+	}
+}
+
+func hasReplicaFile(replica, hash string) bool {
+	_, err := os.Stat(path.Join(replica, hash[:2], hash))
+
+	return err == nil
+}
+
+func TestReplicationConfigSetDefaults(t *testing.T) {
+	cases := []struct {
+		replicas []string
+		quorum   int
+	}{
+		{replicas: nil, quorum: 1},
+		{replicas: []string{"a"}, quorum: 2},
+		{replicas: []string{"a", "b"}, quorum: 2},
+		{replicas: []string{"a", "b", "c", "d"}, quorum: 3},
+	}
+
+	for _, tc := range cases {
+		cfg := &ReplicationConfig{Replicas: tc.replicas}
+		cfg.SetDefaults()
+
+		if cfg.WriteQuorum != tc.quorum {
+			t.Errorf("Write quorum for %v must be %d but got %d\n", tc.replicas, tc.quorum, cfg.WriteQuorum)
+		}
+	}
+}
+
+func TestValidateReplicationConfig(t *testing.T) {
+	cases := []struct {
+		cfg    *ReplicationConfig
+		fields []string
+	}{
+		{cfg: &ReplicationConfig{Replicas: []string{"a", "b"}, WriteQuorum: 3}, fields: []string{}},
+		{cfg: &ReplicationConfig{Replicas: []string{"storage/"}, WriteQuorum: 1}, fields: []string{"storage.replication.replicas"}},
+		{cfg: &ReplicationConfig{Replicas: []string{"a", "a"}, WriteQuorum: 1}, fields: []string{"storage.replication.replicas"}},
+		{cfg: &ReplicationConfig{Replicas: []string{"a"}, WriteQuorum: 3}, fields: []string{"storage.replication.write_quorum"}},
+		{cfg: &ReplicationConfig{WriteQuorum: 1, Interval: -1}, fields: []string{"storage.replication.interval"}},
+	}
+
+	for _, tc := range cases {
+		errs := ValidationErrors{}
+		validateReplicationConfig(&errs, tc.cfg, "storage")
+
+		fields := []string{}
+		for _, e := range errs {
+			fields = append(fields, e.Field)
+		}
+
+		if len(fields) != len(tc.fields) || (len(fields) > 0 && fields[0] != tc.fields[0]) {
+			t.Errorf("Errors for %v must be %v but got %v\n", tc.cfg, tc.fields, fields)
+		}
+	}
+}
+
+func TestStorageCreateFileReplication(t *testing.T) {
+	app, replicas := newReplicationTestApplication(t, 3)
+	defer removeReplicationTestApplication(app, replicas)
+
+	hash := getTestFileID("valid", time.Now())
+
+	size, err := app.Storage.CreateFile(hash, bytes.NewBufferString("valid"))
+	if size != 5 || err != nil {
+		t.Errorf("Size must be %d but got %d, %v\n", 5, size, err)
+	}
+
+	for _, replica := range replicas {
+		if !hasReplicaFile(replica, hash) {
+			t.Errorf("File must be copied to %s\n", replica)
+		}
+	}
+
+	ok, _ := app.Storage.RemoveFile(hash)
+	if !ok || hasReplicaFile(replicas[0], hash) || hasReplicaFile(replicas[1], hash) {
+		t.Error("File must be removed from storage and replicas\n")
+	}
+
+	// the second replica is not writable
+	os.RemoveAll(replicas[1])
+	ioutil.WriteFile(replicas[1], []byte{}, 0644)
+
+	_, err = app.Storage.CreateFile(hash, bytes.NewBufferString("valid"))
+	if err != errQuorumNotReached {
+		t.Errorf("Error must be %v but got %v\n", errQuorumNotReached, err)
+	}
+
+	if _, ok := app.Storage.FindFile(hash); ok {
+		t.Error("All copies must be removed if quorum is not reached\n")
+	}
+
+	app.Config.Storage.Replication.WriteQuorum = 2
+
+	_, err = app.Storage.CreateFile(hash, bytes.NewBufferString("valid"))
+	if err != nil || !hasReplicaFile(replicas[0], hash) {
+		t.Errorf("File must be saved to quorum but got %v\n", err)
+	}
+}
+
+// readTestReplica func returns content of the first valid copy of file in replicas
+func readTestReplica(app *Application, hash string, clientKey []byte) ([]byte, bool) {
+	r, _, ok := app.Storage.OpenReplica(hash, clientKey)
+	if !ok {
+		return nil, false
+	}
+	defer r.Close()
+
+	data, err := ioutil.ReadAll(r)
+
+	return data, err == nil
+}
+
+func TestStorageOpenReplica(t *testing.T) {
+	app, replicas := newReplicationTestApplication(t, 0)
+	defer removeReplicationTestApplication(app, replicas)
+
+	hash := getTestFileID("valid", time.Now())
+	app.Storage.CreateFile(hash, bytes.NewBufferString("valid"))
+
+	// storage lost file, the first replica has corrupted copy
+	app.Storage.QuarantineFile(hash)
+	ioutil.WriteFile(path.Join(replicas[0], hash[:2], hash), []byte("corrupted"), 0644)
+
+	fileName, ok := app.Storage.FindFile(hash)
+	if !ok || fileName != path.Join(replicas[0], hash[:2], hash) {
+		t.Errorf("File must be found in replica but got %s\n", fileName)
+	}
+
+	data, ok := readTestReplica(app, hash, nil)
+	if !ok || string(data) != "valid" {
+		t.Errorf("Content must be %s but got %s\n", "valid", data)
+	}
+
+	if hasReplicaFile(replicas[0], hash) {
+		t.Error("Corrupted copy must be removed\n")
+	}
+}
+
+func TestApplicationRereplicate(t *testing.T) {
+	app, replicas := newReplicationTestApplication(t, 0)
+	defer removeReplicationTestApplication(app, replicas)
+
+	app.ReconcileUsage()
+
+	now := time.Now()
+	hash := getTestFileID("valid", now)
+
+	app.Storage.CreateFile(hash, bytes.NewBufferString("valid"))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: 5, CreatedAt: &now})
+
+	createTrashTestFile(app, "example", 0, now)
+
+	// copies in storage and the first replica are lost
+	os.Remove(path.Join(app.Config.Storage.Path, hash[:2], hash))
+	os.Remove(path.Join(replicas[0], hash[:2], hash))
+
+	count, err := app.Rereplicate(context.Background())
+	if count != 2 || err != nil {
+		t.Errorf("Count must be %d but got %d, %v\n", 2, count, err)
+	}
+
+	if _, ok := app.Storage.GetFile(hash); !ok || !hasReplicaFile(replicas[0], hash) {
+		t.Error("File must be restored in all locations\n")
+	}
+
+	usage, _, _ := app.Redis.GetUsage()
+	if usage != 5 {
+		t.Errorf("Usage must be %d but got %d\n", 5, usage)
+	}
+
+	count, _ = app.Rereplicate(context.Background())
+	if count != 0 {
+		t.Errorf("Count must be %d but got %d\n", 0, count)
+	}
+}
+
+func TestHandlerDownloadFromReplica(t *testing.T) {
+	app, replicas := newReplicationTestApplication(t, 0)
+	defer removeReplicationTestApplication(app, replicas)
+
+	now := time.Now()
+	hash := getTestFileID("valid", now)
+
+	app.Storage.CreateFile(hash, bytes.NewBufferString("valid"))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: 5, CreatedAt: &now})
+
+	h := NewHandler(app)
+
+	cases := []struct {
+		rng  string
+		code int
+		body string
+	}{
+		{rng: "bytes=1-3", code: 206, body: "ali"},
+		{code: 200, body: "valid"},
+	}
+
+	for _, tc := range cases {
+		// file in storage is corrupted
+		ioutil.WriteFile(path.Join(app.Config.Storage.Path, hash[:2], hash), []byte("wrong"), 0644)
+
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest("GET", "/files/"+hash, nil)
+		r.Header.Set("Range", tc.rng)
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code || w.Body.String() != tc.body {
+			t.Errorf("File must be read from replica but got %d, %s\n", w.Code, w.Body.String())
+		}
+
+		app.wg.Wait()
+	}
+
+	// file in storage is repaired from replica
+	data, _ := ioutil.ReadFile(path.Join(app.Config.Storage.Path, hash[:2], hash))
+	if string(data) != "valid" {
+		t.Errorf("Content must be %s but got %s\n", "valid", data)
+	}
+}
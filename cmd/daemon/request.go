@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+type contextKey string
+
+const requestInfoKey contextKey = "request_info"
+
+// requestInfo struct contains request data which is filled by router and handlers
+// and used for access log
+type requestInfo struct {
+	ID        string
+	FileID    string
+	Limit     string
+	Principal string
+	Aborted   bool
+}
+
+// getRequestInfo func returns request info from context
+// it never returns nil, so handlers could be called without ServeHTTP (in tests)
+func getRequestInfo(r *http.Request) *requestInfo {
+	if info, ok := r.Context().Value(requestInfoKey).(*requestInfo); ok {
+		return info
+	}
+
+	return &requestInfo{}
+}
+
+// getRequestID func returns request id from header or generates new one
+func getRequestID(r *http.Request) string {
+	id := r.Header.Get(requestIDHeader)
+
+	if id != "" && len(id) <= 128 && isPrintable(id) {
+		return id
+	}
+
+	return newRequestID()
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+
+	if _, err := rand.Read(b); err != nil {
+		return ""
+	}
+
+	return hex.EncodeToString(b)
+}
+
+func isPrintable(v string) bool {
+	for _, c := range v {
+		if c < 0x21 || c > 0x7e {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getIP func returns client ip
+// for simplicity we don't check ip from headers (X-FORWARDED-FOR, X-REAL-IP)
+func getIP(r *http.Request) string {
+	return strings.Split(r.RemoteAddr, ":")[0]
+}
+
+// withRequestInfo func returns request with new request info in context
+func withRequestInfo(r *http.Request, info *requestInfo) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestInfoKey, info))
+}
+
+// statusWriter struct remembers response status and counts written bytes
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	count  int64
+}
+
+// WriteHeader method
+func (w *statusWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Write method
+func (w *statusWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.count += int64(n)
+
+	return n, err
+}
+
+// Status method returns response status
+func (w *statusWriter) Status() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+
+	return w.status
+}
+
+// countingReader struct counts bytes read from request body
+type countingReader struct {
+	io.ReadCloser
+	count int64
+}
+
+// Read method
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	r.count += int64(n)
+
+	return n, err
+}
+
+// chargedReader struct counts bytes read from body and passes their count to charge on close
+type chargedReader struct {
+	countingReader
+	charge func(int64)
+}
+
+// Close method
+func (r *chargedReader) Close() error {
+	r.charge(r.count)
+
+	return r.countingReader.Close()
+}
+
+// countingWriter struct counts written bytes and discards them
+type countingWriter struct {
+	count int64
+}
+
+// Write method
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.count += int64(len(b))
+
+	return len(b), nil
+}
+
+// bufferedResponse struct keeps the beginning of response body until limit is reached
+// start func sets headers before body is sent, write error is remembered
+type bufferedResponse struct {
+	http.ResponseWriter
+	buf     bytes.Buffer
+	limit   int
+	start   func()
+	started bool
+	err     error
+}
+
+// Write method
+func (w *bufferedResponse) Write(b []byte) (int, error) {
+	if !w.started && w.buf.Len()+len(b) <= w.limit {
+		return w.buf.Write(b)
+	}
+
+	if !w.started {
+		w.started = true
+		w.start()
+		w.ResponseWriter.WriteHeader(http.StatusOK)
+
+		if _, w.err = w.ResponseWriter.Write(w.buf.Bytes()); w.err != nil {
+			return 0, w.err
+		}
+
+		w.buf.Reset()
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	if err != nil {
+		w.err = err
+	}
+
+	return n, err
+}
+
+// flush method sends buffered body with its length if it has not been sent yet
+func (w *bufferedResponse) flush() error {
+	if w.started {
+		return nil
+	}
+
+	w.started = true
+	w.start()
+
+	w.Header().Set("Content-Length", strconv.Itoa(w.buf.Len()))
+	w.ResponseWriter.WriteHeader(http.StatusOK)
+
+	_, w.err = w.ResponseWriter.Write(w.buf.Bytes())
+
+	return w.err
+}
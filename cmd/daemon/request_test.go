@@ -0,0 +1,95 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGetRequestID(t *testing.T) {
+	cases := []struct {
+		header   string
+		expected string
+	}{
+		{
+			header:   "example-id",
+			expected: "example-id",
+		},
+		{
+			header: "",
+		},
+		{
+			header: "bad id",
+		},
+		{
+			header: strings.Repeat("a", 129),
+		},
+	}
+
+	for _, tc := range cases {
+		r, _ := http.NewRequest("GET", "/", nil)
+		if tc.header != "" {
+			r.Header.Set(requestIDHeader, tc.header)
+		}
+
+		id := getRequestID(r)
+
+		if tc.expected != "" {
+			if id != tc.expected {
+				t.Errorf("Id must be %s but got %s\n", tc.expected, id)
+			}
+
+			continue
+		}
+
+		// new id must be generated
+		if len(id) != 32 || id == tc.header {
+			t.Errorf("Id must be generated but got %s\n", id)
+		}
+	}
+}
+
+func TestGetRequestInfo(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+
+	if getRequestInfo(r) == nil {
+		t.Error("Request info must not be nil")
+	}
+
+	info := &requestInfo{ID: "example"}
+	r = withRequestInfo(r, info)
+
+	if getRequestInfo(r) != info {
+		t.Errorf("Request info must be %v but got %v\n", info, getRequestInfo(r))
+	}
+}
+
+func TestGetIP(t *testing.T) {
+	r, _ := http.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:12345"
+
+	if ip := getIP(r); ip != "127.0.0.1" {
+		t.Errorf("Ip must be %s but got %s\n", "127.0.0.1", ip)
+	}
+}
+
+func TestStatusWriter(t *testing.T) {
+	rec := httptest.NewRecorder()
+	w := &statusWriter{ResponseWriter: rec}
+
+	if w.Status() != 200 {
+		t.Errorf("Status must be %d but got %d\n", 200, w.Status())
+	}
+
+	w.WriteHeader(404)
+	w.Write([]byte("example"))
+
+	if w.Status() != 404 {
+		t.Errorf("Status must be %d but got %d\n", 404, w.Status())
+	}
+
+	if w.count != 7 {
+		t.Errorf("Count must be %d but got %d\n", 7, w.count)
+	}
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// default count of virtual nodes of cluster node on hash ring
+const defaultVirtualNodes = 128
+
+// Ring struct is consistent hash ring, each node has several virtual nodes on it
+type Ring struct {
+	points []uint64
+	nodes  map[uint64]ClusterNode
+}
+
+// NewRing func returns Ring pointer with virtual nodes of given nodes
+func NewRing(nodes []ClusterNode, virtualNodes int) *Ring {
+	if virtualNodes <= 0 {
+		virtualNodes = defaultVirtualNodes
+	}
+
+	r := &Ring{nodes: map[uint64]ClusterNode{}}
+
+	for _, node := range nodes {
+		for i := 0; i < virtualNodes; i++ {
+			sum := sha256.Sum256([]byte(node.ID + "#" + strconv.Itoa(i)))
+			point := binary.BigEndian.Uint64(sum[:8])
+
+			// collision is resolved in favour of node with the smallest id, so all nodes build the same ring
+			if v, ok := r.nodes[point]; ok && v.ID < node.ID {
+				continue
+			}
+
+			if _, ok := r.nodes[point]; !ok {
+				r.points = append(r.points, point)
+			}
+
+			r.nodes[point] = node
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+
+	return r
+}
+
+// Get method returns owner of file, false is returned if ring is empty
+func (r *Ring) Get(fileID string) (ClusterNode, bool) {
+	if r == nil || len(r.points) == 0 {
+		return ClusterNode{}, false
+	}
+
+	point := getRingPoint(fileID)
+
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= point })
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.nodes[r.points[i]], true
+}
+
+// getRingPoint func returns position of file on ring
+// sha256 prefix of file id is used as is, other ids are hashed
+func getRingPoint(fileID string) uint64 {
+	if prefix := strings.Split(fileID, "-")[0]; isSHA256(prefix) {
+		b, _ := hex.DecodeString(prefix[:16])
+		return binary.BigEndian.Uint64(b)
+	}
+
+	sum := sha256.Sum256([]byte(fileID))
+
+	return binary.BigEndian.Uint64(sum[:8])
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func getTestNodes(count int) []ClusterNode {
+	nodes := make([]ClusterNode, count)
+	for i := range nodes {
+		nodes[i] = ClusterNode{ID: "node" + strconv.Itoa(i), Address: "http://node" + strconv.Itoa(i)}
+	}
+
+	return nodes
+}
+
+func TestRingGet(t *testing.T) {
+	var r *Ring
+
+	if _, ok := r.Get("example"); ok {
+		t.Error("Empty ring must not have owners\n")
+	}
+
+	r = NewRing(getTestNodes(3), 0)
+
+	counts := map[string]int{}
+	owners := map[string]string{}
+
+	for i := 0; i < 3000; i++ {
+		id := getTestFileID(strconv.Itoa(i), time.Unix(1515151515, 0))
+
+		node, ok := r.Get(id)
+		if !ok {
+			t.Errorf("Owner of %s must be found\n", id)
+			return
+		}
+
+		counts[node.ID]++
+		owners[id] = node.ID
+	}
+
+	for id, count := range counts {
+		if count < 600 || count > 1400 {
+			t.Errorf("Count of files of %s must be about %d but got %d\n", id, 1000, count)
+		}
+	}
+
+	// ring doesn't depend on order of nodes
+	nodes := getTestNodes(3)
+	reversed := NewRing([]ClusterNode{nodes[2], nodes[1], nodes[0]}, 0)
+
+	// only files of new node change their owner
+	extended := NewRing(getTestNodes(4), 0)
+
+	moved := 0
+
+	for id, owner := range owners {
+		if node, _ := reversed.Get(id); node.ID != owner {
+			t.Errorf("Owner of %s must be %s but got %s\n", id, owner, node.ID)
+		}
+
+		if node, _ := extended.Get(id); node.ID != owner {
+			moved++
+
+			if node.ID != "node3" {
+				t.Errorf("File %s must be moved to %s but got %s\n", id, "node3", node.ID)
+			}
+		}
+	}
+
+	if moved < 450 || moved > 1050 {
+		t.Errorf("Count of moved files must be about %d but got %d\n", 750, moved)
+	}
+}
+
+func TestGetRingPoint(t *testing.T) {
+	cases := []struct {
+		id       string
+		expected uint64
+	}{
+		{id: "b4373779db9de9f4782f1d878c5468b24c2d8110d3b322602c0322f486223f0c-1515151515-1", expected: 0xb4373779db9de9f4},
+		{id: "0000000000000001782f1d878c5468b24c2d8110d3b322602c0322f486223f0c", expected: 1},
+	}
+
+	for _, tc := range cases {
+		if v := getRingPoint(tc.id); v != tc.expected {
+			t.Errorf("Point of %s must be %x but got %x\n", tc.id, tc.expected, v)
+		}
+	}
+
+	// ids without hash are hashed
+	if getRingPoint("example1") == getRingPoint("example2") {
+		t.Error("Points of different ids must differ\n")
+	}
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"errors"
+	"math/rand"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule interface returns time of the next run after t, zero time means there are no more runs
+type Schedule interface {
+	Next(t time.Time) time.Time
+}
+
+// IntervalSchedule type runs job every interval
+type IntervalSchedule time.Duration
+
+// Next method
+func (s IntervalSchedule) Next(t time.Time) time.Time {
+	return t.Add(time.Duration(s))
+}
+
+// CronSchedule struct runs job at minutes matched by cron expression, each field is a bit set of allowed values
+type CronSchedule struct {
+	minutes  uint64
+	hours    uint64
+	days     uint64
+	months   uint64
+	weekdays uint64
+
+	// day matches if day of month or day of week matches when both of them are restricted
+	anyDay     bool
+	anyWeekday bool
+}
+
+// cron expressions with names
+var cronMacros = map[string]string{
+	"@yearly":   "0 0 1 1 *",
+	"@annually": "0 0 1 1 *",
+	"@monthly":  "0 0 1 * *",
+	"@weekly":   "0 0 * * 0",
+	"@daily":    "0 0 * * *",
+	"@midnight": "0 0 * * *",
+	"@hourly":   "0 * * * *",
+}
+
+// ParseCronSchedule func parses cron expression with 5 fields: minute, hour, day of month, month and day of week
+// fields support *, lists, ranges and steps, e.g. "*/15 1-5 * * 1,3", sunday is 0 or 7
+func ParseCronSchedule(spec string) (*CronSchedule, error) {
+	spec = strings.TrimSpace(spec)
+	if macro, ok := cronMacros[spec]; ok {
+		spec = macro
+	}
+
+	fields := strings.Fields(spec)
+	if len(fields) != 5 {
+		return nil, errors.New("Cron expression must contain 5 fields")
+	}
+
+	s := &CronSchedule{
+		anyDay:     fields[2] == "*" || fields[2] == "?",
+		anyWeekday: fields[4] == "*" || fields[4] == "?",
+	}
+
+	bounds := []struct {
+		name     string
+		min, max int
+		bits     *uint64
+	}{
+		{"minute", 0, 59, &s.minutes},
+		{"hour", 0, 23, &s.hours},
+		{"day of month", 1, 31, &s.days},
+		{"month", 1, 12, &s.months},
+		{"day of week", 0, 7, &s.weekdays},
+	}
+
+	for i, b := range bounds {
+		bits, err := parseCronField(fields[i], b.min, b.max)
+		if err != nil {
+			return nil, errors.New("Invalid " + b.name + ": " + err.Error())
+		}
+
+		*b.bits = bits
+	}
+
+	// 7 is sunday too
+	if s.weekdays&(1<<7) != 0 {
+		s.weekdays |= 1
+	}
+
+	return s, nil
+}
+
+func parseCronField(field string, min, max int) (uint64, error) {
+	var bits uint64
+
+	for _, part := range strings.Split(field, ",") {
+		step := 1
+
+		if i := strings.Index(part, "/"); i >= 0 {
+			n, err := strconv.Atoi(part[i+1:])
+			if err != nil || n < 1 {
+				return 0, errors.New("step must be positive number in " + part)
+			}
+
+			step = n
+			part = part[:i]
+		}
+
+		from, to := min, max
+
+		if part != "*" && part != "?" {
+			bounds := strings.SplitN(part, "-", 2)
+
+			n, err := strconv.Atoi(bounds[0])
+			if err != nil {
+				return 0, errors.New("unexpected value " + part)
+			}
+
+			from, to = n, n
+
+			if len(bounds) == 2 {
+				to, err = strconv.Atoi(bounds[1])
+				if err != nil {
+					return 0, errors.New("unexpected value " + part)
+				}
+			} else if step > 1 {
+				// "5/10" means from 5 to max with step 10
+				to = max
+			}
+		}
+
+		if from < min || to > max || from > to {
+			return 0, errors.New("value is out of range " + strconv.Itoa(min) + "-" + strconv.Itoa(max) + " in " + part)
+		}
+
+		for v := from; v <= to; v += step {
+			bits |= 1 << uint(v)
+		}
+	}
+
+	return bits, nil
+}
+
+// Next method
+func (s *CronSchedule) Next(t time.Time) time.Time {
+	loc := t.Location()
+
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	// expressions like "0 0 30 2 *" never match
+	limit := t.AddDate(5, 0, 0)
+
+	for t.Before(limit) {
+		if s.months&(1<<uint(t.Month())) == 0 {
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if !s.matchDay(t) {
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, loc)
+			continue
+		}
+
+		if s.hours&(1<<uint(t.Hour())) == 0 {
+			t = time.Date(t.Year(), t.Month(), t.Day(), t.Hour()+1, 0, 0, 0, loc)
+			continue
+		}
+
+		if s.minutes&(1<<uint(t.Minute())) == 0 {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		return t
+	}
+
+	return time.Time{}
+}
+
+func (s *CronSchedule) matchDay(t time.Time) bool {
+	day := s.days&(1<<uint(t.Day())) != 0
+	weekday := s.weekdays&(1<<uint(t.Weekday())) != 0
+
+	if s.anyDay || s.anyWeekday {
+		return day && weekday
+	}
+
+	return day || weekday
+}
+
+// getNextRun func returns time of the next run with random delay up to jitter
+// jitter spreads runs of several nodes which have the same schedule
+func getNextRun(s Schedule, t time.Time, jitter time.Duration) time.Time {
+	next := s.Next(t)
+	if next.IsZero() || jitter <= 0 {
+		return next
+	}
+
+	return next.Add(time.Duration(rand.Int63n(int64(jitter))))
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCronSchedule(t *testing.T) {
+	cases := []struct {
+		spec string
+		err  bool
+	}{
+		{spec: "* * * * *"},
+		{spec: "*/15 1-5 * * 1,3"},
+		{spec: "0 0 1 1 7"},
+		{spec: "5/10 * * * *"},
+		{spec: "@daily"},
+		{spec: "* * * *", err: true},
+		{spec: "60 * * * *", err: true},
+		{spec: "* 5-1 * * *", err: true},
+		{spec: "*/0 * * * *", err: true},
+		{spec: "a * * * *", err: true},
+		{spec: "* * 0 * *", err: true},
+		{spec: "@sometimes", err: true},
+	}
+
+	for _, tc := range cases {
+		_, err := ParseCronSchedule(tc.spec)
+		if (err != nil) != tc.err {
+			t.Errorf("Error for %s must be %v but got %v\n", tc.spec, tc.err, err)
+		}
+	}
+}
+
+func TestCronScheduleNext(t *testing.T) {
+	// it's wednesday
+	now := time.Date(2018, time.March, 14, 10, 7, 30, 0, time.UTC)
+
+	cases := []struct {
+		spec     string
+		expected time.Time
+	}{
+		{spec: "* * * * *", expected: time.Date(2018, time.March, 14, 10, 8, 0, 0, time.UTC)},
+		{spec: "*/15 * * * *", expected: time.Date(2018, time.March, 14, 10, 15, 0, 0, time.UTC)},
+		{spec: "5/10 * * * *", expected: time.Date(2018, time.March, 14, 10, 15, 0, 0, time.UTC)},
+		{spec: "30 3 * * *", expected: time.Date(2018, time.March, 15, 3, 30, 0, 0, time.UTC)},
+		{spec: "@hourly", expected: time.Date(2018, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{spec: "0 0 * * 0", expected: time.Date(2018, time.March, 18, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 * * 7", expected: time.Date(2018, time.March, 18, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 12 1 * *", expected: time.Date(2018, time.April, 1, 12, 0, 0, 0, time.UTC)},
+		{spec: "0 0 29 2 *", expected: time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		// day of month or day of week
+		{spec: "0 0 20 * 5", expected: time.Date(2018, time.March, 16, 0, 0, 0, 0, time.UTC)},
+		{spec: "0 0 30 2 *", expected: time.Time{}},
+	}
+
+	for _, tc := range cases {
+		s, err := ParseCronSchedule(tc.spec)
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		next := s.Next(now)
+		if !next.Equal(tc.expected) {
+			t.Errorf("Next run for %s must be %v but got %v\n", tc.spec, tc.expected, next)
+		}
+	}
+}
+
+func TestGetNextRun(t *testing.T) {
+	now := time.Now()
+	s := IntervalSchedule(time.Minute)
+
+	if next := getNextRun(s, now, 0); !next.Equal(now.Add(time.Minute)) {
+		t.Errorf("Next run must be %v but got %v\n", now.Add(time.Minute), next)
+	}
+
+	for i := 0; i < 100; i++ {
+		next := getNextRun(s, now, 10*time.Second)
+		if next.Before(now.Add(time.Minute)) || !next.Before(now.Add(time.Minute+10*time.Second)) {
+			t.Errorf("Next run must be in jitter range but got %v\n", next.Sub(now))
+		}
+	}
+}
+
+func TestAutoCleanConfigGetSchedule(t *testing.T) {
+	now := time.Date(2018, time.March, 14, 10, 7, 30, 0, time.UTC)
+
+	cases := []struct {
+		cfg      *AutoCleanConfig
+		expected time.Time
+		err      bool
+	}{
+		{cfg: nil, expected: now.Add(10 * time.Minute)},
+		{cfg: &AutoCleanConfig{Interval: 60}, expected: now.Add(time.Minute)},
+		{cfg: &AutoCleanConfig{Interval: 60, Schedule: "0 * * * *"}, expected: time.Date(2018, time.March, 14, 11, 0, 0, 0, time.UTC)},
+		{cfg: &AutoCleanConfig{Schedule: "0 *"}, err: true},
+	}
+
+	for _, tc := range cases {
+		s, err := tc.cfg.GetSchedule()
+		if (err != nil) != tc.err {
+			t.Errorf("Error must be %v but got %v\n", tc.err, err)
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if next := s.Next(now); !next.Equal(tc.expected) {
+			t.Errorf("Next run must be %v but got %v\n", tc.expected, next)
+		}
+	}
+}
+
+func TestApplicationNextAutoCleanDelay(t *testing.T) {
+	cfg := &Config{Storage: &StorageConfig{}, AutoClean: &AutoCleanConfig{Interval: 60, Jitter: 10}}
+	app := NewApplication(cfg, NewStorage(cfg.Storage), NewRateLimit(&RateLimitConfig{}), nil)
+
+	delay := app.nextAutoCleanDelay(time.Now())
+	if delay < time.Minute || delay >= time.Minute+10*time.Second {
+		t.Errorf("Delay must be in jitter range but got %v\n", delay)
+	}
+}
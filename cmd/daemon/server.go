@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// default time for finishing in-flight requests on shutdown
+const defaultShutdownTimeout = 30 * time.Second
+
+// Server struct runs http server and handles signals
+type Server struct {
+	App             *Application
+	HTTP            *http.Server
+	TLS             *TLSReloader
+	ShutdownTimeout time.Duration
+	DrainDelay      time.Duration
+
+	signals chan os.Signal
+}
+
+// Run method serves requests until SIGINT/SIGTERM is received or listener fails
+// after that it stops accepting connections, waits for in-flight requests and shuts down application
+// SIGHUP reloads config and tls certificates
+func (s *Server) Run(l net.Listener) error {
+	signal.Notify(s.signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(s.signals)
+
+	errCh := make(chan error, 1)
+	go func() {
+		if s.TLS != nil {
+			s.HTTP.TLSConfig = s.TLS.TLSConfig()
+			errCh <- s.HTTP.ServeTLS(l, "", "")
+			return
+		}
+
+		errCh <- s.HTTP.Serve(l)
+	}()
+
+	for {
+		select {
+		case err := <-errCh:
+			if err != http.ErrServerClosed {
+				s.App.Shutdown(context.Background())
+				return err
+			}
+
+			return s.Shutdown()
+		case sig := <-s.signals:
+			if sig == syscall.SIGHUP {
+				s.Reload()
+				continue
+			}
+
+			s.App.Logger.Info("shutting down", "signal", sig)
+
+			return s.Shutdown()
+		}
+	}
+}
+
+// Reload method reloads config and tls certificates, established connections are not affected
+// errors are logged and current values are kept
+func (s *Server) Reload() {
+	if s.App.ConfigPath != "" {
+		s.App.ReloadConfig()
+	}
+
+	if s.TLS == nil {
+		return
+	}
+
+	err := s.TLS.Reload()
+	if err != nil {
+		s.App.Logger.Error("could not reload tls certificates", "error", err)
+		return
+	}
+
+	s.App.Logger.Info("tls certificates reloaded")
+}
+
+// Shutdown method stops http server and application with deadline
+func (s *Server) Shutdown() error {
+	// readiness probe fails from this moment, give load balancer time to notice it
+	s.App.SetDraining()
+
+	if s.DrainDelay > 0 {
+		time.Sleep(s.DrainDelay)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer cancel()
+
+	err := s.HTTP.Shutdown(ctx)
+	if err != nil {
+		// deadline exceeded, drop connections which are still active
+		s.App.Logger.Warn("in-flight requests have not been finished before deadline", "error", err)
+		s.HTTP.Close()
+	}
+
+	// background jobs have their own deadline, requests could use up the deadline of http server
+	appCtx, appCancel := context.WithTimeout(context.Background(), s.ShutdownTimeout)
+	defer appCancel()
+
+	if e := s.App.Shutdown(appCtx); e != nil && err == nil {
+		err = e
+	}
+
+	s.App.Logger.Info("shutdown finished")
+
+	return err
+}
+
+// NewServer func returns Server pointer
+// tls is enabled if certificate is set in config
+func NewServer(app *Application, h http.Handler) (*Server, error) {
+	cfg := app.GetConfig()
+
+	timeout := defaultShutdownTimeout
+	if cfg.ShutdownTimeout > 0 {
+		timeout = time.Duration(cfg.ShutdownTimeout) * time.Second
+	}
+
+	var drainDelay time.Duration
+	if cfg.Health != nil {
+		drainDelay = time.Duration(cfg.Health.DrainDelay) * time.Second
+	}
+
+	s := &Server{
+		App: app,
+		HTTP: &http.Server{
+			Handler: h,
+		},
+		ShutdownTimeout: timeout,
+		DrainDelay:      drainDelay,
+		signals:         make(chan os.Signal, 1),
+	}
+
+	if cfg.TLS != nil && cfg.TLS.CertFile != "" {
+		t, err := NewTLSReloader(cfg.TLS)
+		if err != nil {
+			return nil, err
+		}
+
+		s.TLS = t
+	}
+
+	return s, nil
+}
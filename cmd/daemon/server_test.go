@@ -0,0 +1,178 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestNewServer(t *testing.T) {
+	cases := []struct {
+		timeout  int
+		expected time.Duration
+	}{
+		{
+			timeout:  0,
+			expected: defaultShutdownTimeout,
+		},
+		{
+			timeout:  5,
+			expected: 5 * time.Second,
+		},
+	}
+
+	for _, tc := range cases {
+		app := NewApplication(&Config{ShutdownTimeout: tc.timeout}, &Storage{}, &RateLimit{}, &Redis{})
+
+		s, err := NewServer(app, http.NotFoundHandler())
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		if s.ShutdownTimeout != tc.expected {
+			t.Errorf("Timeout must be %v but got %v\n", tc.expected, s.ShutdownTimeout)
+		}
+	}
+}
+
+func TestServerGracefulShutdown(t *testing.T) {
+	app := NewApplication(&Config{ShutdownTimeout: 5}, &Storage{}, &RateLimit{}, NewRedis(&RedisConfig{}))
+
+	started := make(chan struct{})
+	flushed := false
+
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+
+		// emulate slow upload and metadata write after response
+		time.Sleep(200 * time.Millisecond)
+
+		app.Go(func() {
+			time.Sleep(100 * time.Millisecond)
+			flushed = true
+		})
+
+		w.Write([]byte("ok"))
+	})
+
+	s, err := NewServer(app, h)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	runErr := make(chan error, 1)
+	go func() {
+		runErr <- s.Run(l)
+	}()
+
+	respCh := make(chan *http.Response, 1)
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+		}
+
+		respCh <- resp
+	}()
+
+	<-started
+	s.signals <- syscall.SIGTERM
+
+	resp := <-respCh
+	if resp != nil {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		if resp.StatusCode != 200 || string(body) != "ok" {
+			t.Errorf("In-flight request must be finished but got %d %s\n", resp.StatusCode, body)
+		}
+	}
+
+	err = <-runErr
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	if !flushed {
+		t.Error("Background writes must be finished before shutdown")
+	}
+
+	if app.ctx.Err() == nil {
+		t.Error("Application context must be canceled")
+	}
+
+	// redis pool must be closed
+	conn := app.Redis.Get()
+	defer conn.Close()
+
+	if conn.Err() == nil {
+		t.Error("Redis pool must be closed")
+	}
+
+	// server doesn't accept new connections
+	if _, err := net.Dial("tcp", l.Addr().String()); err == nil {
+		t.Error("Listener must be closed")
+	}
+}
+
+func TestServerShutdownDrainTimeout(t *testing.T) {
+	app := NewApplication(&Config{}, &Storage{}, &RateLimit{}, NewRedis(&RedisConfig{}))
+
+	started := make(chan struct{})
+	flushed := false
+
+	// background write outlives the slow request, but it's finished before its own deadline
+	app.Go(func() {
+		time.Sleep(400 * time.Millisecond)
+		flushed = true
+	})
+
+	s, err := NewServer(app, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(250 * time.Millisecond)
+		w.Write([]byte("ok"))
+	}))
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	s.ShutdownTimeout = 300 * time.Millisecond
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	go s.HTTP.Serve(l)
+
+	go func() {
+		resp, err := http.Get("http://" + l.Addr().String() + "/")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+
+	err = s.Shutdown()
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+	}
+
+	if !flushed {
+		t.Error("Background writes must be finished before shutdown")
+	}
+}
@@ -1,35 +1,174 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"io"
+	"io/ioutil"
 	"os"
 	"path"
+	"sort"
+	"strings"
+	"sync"
 )
 
 // StorageConfig struct contains info about
 // - path which used for file saving
 // - max size of file which can be uploaded on server
 // - limit
+// - high watermark in percents of limit, autoclean is started immediately when usage exceeds it
+// - low watermark in percents of limit, autoclean evicts files until usage is below it
+// - interval of usage reconciliation with disk in seconds
+// - eviction policy which is used by autoclean
+// - trash for removed files
+// - expiry of files
+// - quarantine of corrupted files
+// - synchronous replication of files
+// - erasure coding of files, shards are stored in its directories instead of path
+// - compression of files at rest
+// - encryption of files at rest
 type StorageConfig struct {
-	Path    string `json:"path"`
-	MaxSize int64  `json:"max_size"`
-	Limit   int64  `json:"limit"`
+	Path              string              `json:"path"`
+	MaxSize           int64               `json:"max_size"`
+	Limit             int64               `json:"limit"`
+	HighWatermark     int                 `json:"high_watermark"`
+	LowWatermark      int                 `json:"low_watermark"`
+	ReconcileInterval int                 `json:"reconcile_interval"`
+	Eviction          *EvictionConfig     `json:"eviction"`
+	Trash             *TrashConfig        `json:"trash"`
+	Expiry            *ExpiryConfig       `json:"expiry"`
+	Quarantine        *QuarantineConfig   `json:"quarantine"`
+	Replication       *ReplicationConfig  `json:"replication"`
+	Erasure           *ErasureConfig      `json:"erasure"`
+	Compression       *CompressionConfig  `json:"compression"`
+	Encryption        *EncryptionConfig   `json:"encryption"`
+	ContentTypes      *ContentTypesConfig `json:"content_types"`
 }
 
+// directory of trash in storage path, it's skipped by usage scan of files
+const trashDir = ".trash"
+
+// directory of corrupted files in storage path, it's skipped by usage scan of files
+const quarantineDir = ".quarantine"
+
+// errFileExists is returned if file with the same hash is stored
+var errFileExists = errors.New("File already exists")
+
 // Storage struct
+// config could be replaced on reload, so it's guarded by mutex
+// master keys are loaded on demand and dropped on reload
 type Storage struct {
-	Config *StorageConfig
+	sync.RWMutex
+	Config   *StorageConfig
+	Logger   *Logger
+	DataKeys DataKeys
+	keyRing  *KeyRing
+}
+
+// GetConfig method returns current config
+func (s *Storage) GetConfig() *StorageConfig {
+	s.RLock()
+	defer s.RUnlock()
+
+	return s.Config
+}
+
+// SetConfig method replaces config, it's applied to new requests
+func (s *Storage) SetConfig(cfg *StorageConfig) {
+	s.Lock()
+	s.Config = cfg
+	s.keyRing = nil
+	s.Unlock()
 }
 
 // GetMaxSizeOfFile method return max file size in bytes
 func (s *Storage) GetMaxSizeOfFile() int64 {
-	return s.Config.MaxSize
+	return s.GetConfig().MaxSize
+}
+
+// CreateFile method creates new file, it's compressed, encrypted and copied to replicas or split into shards before return
+// errQuorumNotReached is returned and all copies are removed if file is not saved to write quorum of locations
+// count of bytes written to disk is returned, it's total size of shards in erasure mode
+func (s *Storage) CreateFile(hash string, r io.Reader) (int64, error) {
+	return s.CreateFileWithKey(hash, r, nil)
+}
+
+// CreateFileWithKey method creates new file like CreateFile, file is encrypted by client key if it's set
+// fingerprint of client key and checksum of stored content are saved before file is copied to replicas
+func (s *Storage) CreateFileWithKey(hash string, r io.Reader, clientKey []byte) (int64, error) {
+	// content is compressed and encrypted on the fly if it's enabled
+	encoded, _ := s.encodeFile(r)
+	defer encoded.Close()
+
+	b, err := s.encryptFile(hash, encoded, clientKey)
+	if err != nil {
+		return 0, err
+	}
+
+	sum := sha256.New()
+
+	bytesCount, err := s.writeStored(hash, io.TeeReader(b, sum))
+	if err != nil {
+		return 0, err
+	}
+
+	if clientKey != nil {
+		err = s.saveClientKey(hash, clientKey, hex.EncodeToString(sum.Sum(nil)))
+		if err != nil {
+			s.RemoveFile(hash)
+			return 0, err
+		}
+	}
+
+	return bytesCount, s.copyToReplicas(hash)
+}
+
+// CreateStoredFile method creates file from stored content of another node, content is saved as is
+// it's copied to replicas or split into shards like uploaded file
+func (s *Storage) CreateStoredFile(hash string, r io.Reader) (int64, error) {
+	bytesCount, err := s.writeStored(hash, r)
+	if err != nil {
+		return 0, err
+	}
+
+	return bytesCount, s.copyToReplicas(hash)
 }
 
-// CreateFile method creates new file
-func (s *Storage) CreateFile(hash string, b io.Reader) (int64, error) {
-	folder := path.Join(s.Config.Path, hash[:2])
+// writeStored method writes stored content to storage path or splits it into shards in erasure mode
+func (s *Storage) writeStored(hash string, b io.Reader) (int64, error) {
+	cfg := s.GetConfig()
+
+	if cfg.Erasure != nil {
+		return s.createShards(hash, b)
+	}
+
+	return s.createFile(cfg.Path, hash, b)
+}
+
+// copyToReplicas method copies created file to replicas, all copies are removed if write quorum is not reached
+func (s *Storage) copyToReplicas(hash string) error {
+	cfg := s.GetConfig()
+
+	replication := cfg.GetReplication()
+	if cfg.Erasure != nil || len(replication.Replicas) == 0 {
+		return nil
+	}
+
+	if copies := 1 + s.replicate(cfg.Path, replication.Replicas, hash); copies < replication.WriteQuorum {
+		s.Logger.Error("write quorum is not reached", "file_id", hash, "copies", copies, "quorum", replication.WriteQuorum)
+
+		s.removeReplicas(hash)
+		os.Remove(path.Join(cfg.Path, hash[:2], hash))
+
+		return errQuorumNotReached
+	}
+
+	return nil
+}
+
+func (s *Storage) createFile(root, hash string, b io.Reader) (int64, error) {
+	folder := path.Join(root, hash[:2])
 
 	if _, err := os.Stat(folder); os.IsNotExist(err) {
 		err = os.MkdirAll(folder, 0755)
@@ -41,7 +180,7 @@ func (s *Storage) CreateFile(hash string, b io.Reader) (int64, error) {
 	fileName := path.Join(folder, hash)
 
 	if _, err := os.Stat(fileName); err == nil {
-		return 0, errors.New("File already exists")
+		return 0, errFileExists
 	}
 
 	file, err := os.Create(fileName)
@@ -61,25 +200,132 @@ func (s *Storage) CreateFile(hash string, b io.Reader) (int64, error) {
 		return 0, err
 	}
 
+	s.Logger.Debug("file created", "file_id", hash, "size", bytesCount)
+
 	return bytesCount, nil
 }
 
-// GetFile method returns content of file by hash
+// GetFile method returns content of file by hash, it's path of the first shard in erasure mode
 func (s *Storage) GetFile(hash string) (string, bool) {
-	fileName := path.Join(s.Config.Path, hash[:2], hash)
+	for _, root := range s.GetConfig().GetRoots() {
+		fileName := path.Join(root, hash[:2], hash)
+
+		if _, err := os.Stat(fileName); err == nil {
+			return fileName, true
+		}
+	}
 
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
-		return "", false
+	return "", false
+}
+
+// Open method returns reader of original content of file
+// file is read from replica if it's missing in storage, it's decoded from shards in erasure mode and decompressed
+func (s *Storage) Open(hash string) (io.ReadCloser, error) {
+	f, encoding, err := s.OpenStored(hash, nil)
+	if err != nil {
+		return nil, err
 	}
 
-	return fileName, true
+	content, err := newDecoder(f, encoding)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	return readCloser{content, f}, nil
+}
+
+// OpenStored method returns reader of stored content of file without header and its encoding
+// content is decrypted on the fly by client key if it's set, it's compressed if encoding is not empty
+func (s *Storage) OpenStored(hash string, clientKey []byte) (io.ReadCloser, string, error) {
+	f, err := s.OpenRaw(hash)
+	if err != nil {
+		return nil, "", err
+	}
+
+	plain, err := s.decryptFile(hash, f, clientKey)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	payload, encoding, err := decodeHeader(plain)
+	if err != nil {
+		f.Close()
+		return nil, "", err
+	}
+
+	return readCloser{payload, f}, encoding, nil
+}
+
+// OpenRaw method returns reader of stored content of file as is, it's encrypted and contains header
+// file is read from replica if it's missing in storage, it's decoded from shards in erasure mode
+func (s *Storage) OpenRaw(hash string) (io.ReadCloser, error) {
+	if s.GetConfig().Erasure != nil {
+		sr, err := s.openShards(hash)
+		if err != nil {
+			return nil, err
+		}
+
+		return sr, nil
+	}
+
+	fileName, ok := s.FindFile(hash)
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+
+	return os.Open(fileName)
+}
+
+// ReadHead method returns up to n bytes of the beginning of original content of file
+func (s *Storage) ReadHead(hash string, clientKey []byte, n int) ([]byte, error) {
+	f, encoding, err := s.OpenStored(hash, clientKey)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	content, err := newDecoder(f, encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	head := make([]byte, n)
+
+	n, err = io.ReadFull(content, head)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+
+	return head[:n], err
+}
+
+// GetEncoding method returns encoding of stored file, it's empty if file is not compressed
+func (s *Storage) GetEncoding(hash string) (string, error) {
+	f, encoding, err := s.OpenStored(hash, nil)
+	if err != nil {
+		return "", err
+	}
+
+	f.Close()
+
+	return encoding, nil
+}
+
+// StatFile method returns stat info of stored file
+// size is total size of shards and modification time is the latest one in erasure mode
+func (s *Storage) StatFile(hash string) (os.FileInfo, error) {
+	if s.GetConfig().Erasure != nil {
+		return s.getShardsInfo(hash)
+	}
+
+	return os.Stat(path.Join(s.GetConfig().Path, hash[:2], hash))
 }
 
 // GetFileSize method returns size of the file by hash
 func (s *Storage) GetFileSize(hash string) (int64, error) {
-	fileName := path.Join(s.Config.Path, hash[:2], hash)
-
-	v, err := os.Stat(fileName)
+	v, err := s.StatFile(hash)
 
 	if err != nil {
 		return 0, err
@@ -92,25 +338,305 @@ func (s *Storage) GetFileSize(hash string) (int64, error) {
 	return v.Size(), nil
 }
 
-// RemoveFile method removes file from storage
+// VerifyFile method returns sha256 of original file content and count of read bytes
+// indexes of missing and corrupted shards are returned in erasure mode, they could be rebuilt by RebuildFile
+func (s *Storage) VerifyFile(hash string, t *throttle) (string, int64, []int, error) {
+	var f io.ReadCloser
+	var sr *shardReader
+	var err error
+
+	if s.GetConfig().Erasure != nil {
+		sr, err = s.openShards(hash)
+		f = sr
+	} else {
+		f, err = os.Open(path.Join(s.GetConfig().Path, hash[:2], hash))
+	}
+
+	if err != nil {
+		return "", 0, nil, err
+	}
+	defer f.Close()
+
+	r := &throttledReader{r: f, t: t}
+
+	sum, err := s.getContentSHA256(hash, r)
+	if err != nil || sr == nil {
+		return sum, r.n, nil, err
+	}
+
+	// the rest of shards is read to find all damaged blocks
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return sum, r.n, nil, err
+	}
+
+	return sum, r.n, sr.Damaged(), nil
+}
+
+// RebuildFile method restores damaged shards of file from valid ones
+func (s *Storage) RebuildFile(hash string, damaged []int) error {
+	if s.GetConfig().Erasure == nil {
+		return nil
+	}
+
+	return s.rebuildShards(hash, damaged)
+}
+
+// WalkFiles method calls fn with names of stored files from each directory of storage
+// trash and quarantine are skipped, names are merged from all shards in erasure mode
+func (s *Storage) WalkFiles(fn func(names []string) error) error {
+	roots := s.GetConfig().GetRoots()
+	seen := map[string]bool{}
+	dirs := []string{}
+
+	for _, root := range roots {
+		items, err := getDirectories(root)
+		if os.IsNotExist(err) && len(roots) > 1 {
+			continue
+		} else if err != nil {
+			return err
+		}
+
+		for _, dir := range items {
+			// trash and quarantine
+			if strings.HasPrefix(dir, ".") || seen[dir] {
+				continue
+			}
+
+			seen[dir] = true
+			dirs = append(dirs, dir)
+		}
+	}
+
+	sort.Strings(dirs)
+
+	for _, dir := range dirs {
+		names, err := getShardNames(roots, dir)
+		if err != nil {
+			return err
+		}
+
+		err = fn(names)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// RemoveFile method removes file from storage and replicas
 func (s *Storage) RemoveFile(hash string) (bool, error) {
-	fileName := path.Join(s.Config.Path, hash[:2], hash)
+	s.removeReplicas(hash)
+
+	ok, err := s.removeFromRoots("", hash)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	s.Logger.Debug("file removed", "file_id", hash)
 
-	if _, err := os.Stat(fileName); os.IsNotExist(err) {
+	return true, nil
+}
+
+// TrashFile method moves file to trash, file in trash with the same hash is replaced
+// copies in replicas are removed, they are restored by re-replication after restore of file
+func (s *Storage) TrashFile(hash string) (bool, error) {
+	if _, ok := s.GetFile(hash); !ok {
 		return false, nil
 	}
 
-	err := os.Remove(fileName)
-	if err != nil {
+	s.removeReplicas(hash)
+
+	ok, err := s.moveInRoots("", trashDir, hash)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	s.Logger.Debug("file moved to trash", "file_id", hash)
+
+	return true, nil
+}
+
+// RestoreFile method moves file from trash back to storage
+// errFileExists is returned if the same file has been uploaded again
+func (s *Storage) RestoreFile(hash string) (bool, error) {
+	if _, ok := s.GetFile(hash); ok {
+		for _, root := range s.GetConfig().GetRoots() {
+			if _, err := os.Stat(path.Join(root, trashDir, hash[:2], hash)); err == nil {
+				return false, errFileExists
+			}
+		}
+
+		return false, nil
+	}
+
+	ok, err := s.moveInRoots(trashDir, "", hash)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	s.Logger.Debug("file restored from trash", "file_id", hash)
+
+	return true, nil
+}
+
+// PurgeFile method removes file from trash
+func (s *Storage) PurgeFile(hash string) (bool, error) {
+	ok, err := s.removeFromRoots(trashDir, hash)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	s.Logger.Debug("file purged from trash", "file_id", hash)
+
+	return true, nil
+}
+
+// QuarantineFile method moves corrupted file to quarantine, file in quarantine with the same hash is replaced
+func (s *Storage) QuarantineFile(hash string) (bool, error) {
+	ok, err := s.moveInRoots("", quarantineDir, hash)
+	if err != nil || !ok {
+		return false, err
+	}
+
+	s.Logger.Warn("file moved to quarantine", "file_id", hash)
+
+	return true, nil
+}
+
+// RemoveQuarantinedFile method removes file from quarantine
+func (s *Storage) RemoveQuarantinedFile(hash string) (bool, error) {
+	ok, err := s.removeFromRoots(quarantineDir, hash)
+	if err != nil || !ok {
 		return false, err
 	}
 
+	s.Logger.Debug("file removed from quarantine", "file_id", hash)
+
 	return true, nil
 }
 
+// moveInRoots method moves file or its shards between directories of storage, true is returned if anything has been moved
+func (s *Storage) moveInRoots(from, to, hash string) (bool, error) {
+	moved := false
+
+	for _, root := range s.GetConfig().GetRoots() {
+		fileName := path.Join(root, from, hash[:2], hash)
+
+		if _, err := os.Stat(fileName); os.IsNotExist(err) {
+			continue
+		}
+
+		folder := path.Join(root, to, hash[:2])
+
+		err := os.MkdirAll(folder, 0755)
+		if err != nil {
+			return moved, err
+		}
+
+		err = os.Rename(fileName, path.Join(folder, hash))
+		if err != nil {
+			return moved, err
+		}
+
+		moved = true
+	}
+
+	return moved, nil
+}
+
+// removeFromRoots method removes file or its shards from directory of storage, true is returned if anything has been removed
+func (s *Storage) removeFromRoots(dir, hash string) (bool, error) {
+	removed := false
+
+	for _, root := range s.GetConfig().GetRoots() {
+		err := os.Remove(path.Join(root, dir, hash[:2], hash))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return removed, err
+		}
+
+		removed = true
+	}
+
+	return removed, nil
+}
+
 // NewStorage func returns Storage pointer
 func NewStorage(cfg *StorageConfig) *Storage {
 	return &Storage{
 		Config: cfg,
 	}
 }
+
+// contentSeeker struct reads content of known size from current offset
+// content is opened on the first read and reopened if offset is moved back
+type contentSeeker struct {
+	open   func() (io.ReadCloser, error)
+	size   int64
+	offset int64
+	pos    int64
+	r      io.ReadCloser
+}
+
+// Read method
+func (c *contentSeeker) Read(p []byte) (int, error) {
+	if c.r != nil && c.pos > c.offset {
+		c.Close()
+	}
+
+	if c.r == nil {
+		r, err := c.open()
+		if err != nil {
+			return 0, err
+		}
+
+		c.r, c.pos = r, 0
+	}
+
+	if c.pos < c.offset {
+		n, err := io.CopyN(ioutil.Discard, c.r, c.offset-c.pos)
+		c.pos += n
+
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	n, err := c.r.Read(p)
+	c.pos += int64(n)
+	c.offset = c.pos
+
+	return n, err
+}
+
+// Seek method
+func (c *contentSeeker) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekCurrent:
+		offset += c.offset
+	case io.SeekEnd:
+		offset += c.size
+	}
+
+	if offset < 0 {
+		return 0, errors.New("Negative position")
+	}
+
+	c.offset = offset
+
+	return offset, nil
+}
+
+// Close method
+func (c *contentSeeker) Close() error {
+	if c.r == nil {
+		return nil
+	}
+
+	err := c.r.Close()
+	c.r = nil
+
+	return err
+}
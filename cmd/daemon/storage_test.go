@@ -2,6 +2,7 @@ package main
 
 import (
 	"bytes"
+	"io/ioutil"
 	"os"
 	"path"
 	"testing"
@@ -274,3 +275,66 @@ func TestStorageRemoveFile(t *testing.T) {
 		}
 	}
 }
+
+func TestStorageTrash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	v := NewStorage(&StorageConfig{Path: dir})
+
+	ok, err := v.TrashFile("example")
+	if ok || err != nil {
+		t.Errorf("Missing file must not be trashed but got %v, %v\n", ok, err)
+	}
+
+	v.CreateFile("example", bytes.NewBuffer([]byte("example")))
+
+	ok, err = v.TrashFile("example")
+	if !ok || err != nil {
+		t.Errorf("File must be trashed but got %v, %v\n", ok, err)
+	}
+
+	if _, ok := v.GetFile("example"); ok {
+		t.Error("Trashed file must not be available\n")
+	}
+
+	// the same file is uploaded again
+	v.CreateFile("example", bytes.NewBuffer([]byte("example")))
+
+	_, err = v.RestoreFile("example")
+	if err != errFileExists {
+		t.Errorf("Error must be %v but got %v\n", errFileExists, err)
+	}
+
+	v.RemoveFile("example")
+
+	ok, err = v.RestoreFile("example")
+	if !ok || err != nil {
+		t.Errorf("File must be restored but got %v, %v\n", ok, err)
+	}
+
+	if _, ok := v.GetFile("example"); !ok {
+		t.Error("Restored file must be available\n")
+	}
+
+	ok, _ = v.RestoreFile("example")
+	if ok {
+		t.Error("File must not be restored twice\n")
+	}
+
+	v.TrashFile("example")
+
+	ok, err = v.PurgeFile("example")
+	if !ok || err != nil {
+		t.Errorf("File must be purged but got %v, %v\n", ok, err)
+	}
+
+	ok, _ = v.PurgeFile("example")
+	if ok {
+		t.Error("File must not be purged twice\n")
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"strings"
+	"sync"
+)
+
+// TLSConfig struct contains info about
+// - certificate and private key files
+// - min tls version (1.0, 1.1, 1.2, 1.3), default is 1.2
+// - cipher policy: "default" (go defaults) or "modern" (only ECDHE with AEAD), ignored for tls 1.3
+// - explicit list of cipher suites names, it overrides policy
+// - CA bundle for client certificates verification
+// - client auth mode: none, request, verify_if_given, require
+// - mapping of client certificate subject (or common name) to principal name
+type TLSConfig struct {
+	CertFile     string            `json:"cert_file"`
+	KeyFile      string            `json:"key_file"`
+	MinVersion   string            `json:"min_version"`
+	CipherPolicy string            `json:"cipher_policy"`
+	Ciphers      []string          `json:"ciphers"`
+	ClientCAFile string            `json:"client_ca_file"`
+	ClientAuth   string            `json:"client_auth"`
+	Principals   map[string]string `json:"principals"`
+}
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+var clientAuthTypes = map[string]tls.ClientAuthType{
+	"":                tls.NoClientCert,
+	"none":            tls.NoClientCert,
+	"request":         tls.RequestClientCert,
+	"verify_if_given": tls.VerifyClientCertIfGiven,
+	"require":         tls.RequireAndVerifyClientCert,
+}
+
+var modernCiphers = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+}
+
+// TLSReloader struct keeps current certificate and client CA pool
+// they could be reloaded without dropping established connections
+type TLSReloader struct {
+	sync.RWMutex
+	Config    *TLSConfig
+	base      *tls.Config
+	cert      *tls.Certificate
+	clientCAs *x509.CertPool
+}
+
+// Reload method reads certificate and CA bundle from disk
+// old values are kept if files are invalid
+func (t *TLSReloader) Reload() error {
+	cert, err := tls.LoadX509KeyPair(t.Config.CertFile, t.Config.KeyFile)
+	if err != nil {
+		return err
+	}
+
+	var pool *x509.CertPool
+
+	if t.Config.ClientCAFile != "" {
+		data, err := ioutil.ReadFile(t.Config.ClientCAFile)
+		if err != nil {
+			return err
+		}
+
+		pool = x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(data) {
+			return errors.New("Could not parse client CA bundle")
+		}
+	}
+
+	t.Lock()
+	t.cert = &cert
+	t.clientCAs = pool
+	t.Unlock()
+
+	return nil
+}
+
+// TLSConfig method returns tls config which always uses current certificate
+func (t *TLSReloader) TLSConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			t.RLock()
+			defer t.RUnlock()
+
+			cfg := t.base.Clone()
+			cfg.Certificates = []tls.Certificate{*t.cert}
+			cfg.ClientCAs = t.clientCAs
+
+			return cfg, nil
+		},
+	}
+}
+
+// NewTLSReloader func returns TLSReloader pointer with loaded certificates
+func NewTLSReloader(cfg *TLSConfig) (*TLSReloader, error) {
+	base, err := newBaseTLSConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	t := &TLSReloader{
+		Config: cfg,
+		base:   base,
+	}
+
+	err = t.Reload()
+	if err != nil {
+		return nil, err
+	}
+
+	return t, nil
+}
+
+func newBaseTLSConfig(cfg *TLSConfig) (*tls.Config, error) {
+	minVersion := uint16(tls.VersionTLS12)
+	if cfg.MinVersion != "" {
+		v, ok := tlsVersions[cfg.MinVersion]
+		if !ok {
+			return nil, errors.New("Unknown tls version " + cfg.MinVersion)
+		}
+
+		minVersion = v
+	}
+
+	clientAuth, ok := clientAuthTypes[cfg.ClientAuth]
+	if !ok {
+		return nil, errors.New("Unknown client auth mode " + cfg.ClientAuth)
+	}
+
+	if clientAuth >= tls.VerifyClientCertIfGiven && cfg.ClientCAFile == "" {
+		return nil, errors.New("Client CA file is required for client certificates verification")
+	}
+
+	var ciphers []uint16
+
+	switch {
+	case len(cfg.Ciphers) > 0:
+		ciphers, ok = getCipherSuites(cfg.Ciphers)
+		if !ok {
+			return nil, errors.New("Unknown cipher suite in " + strings.Join(cfg.Ciphers, ","))
+		}
+	case cfg.CipherPolicy == "modern":
+		ciphers = modernCiphers
+	case cfg.CipherPolicy == "" || cfg.CipherPolicy == "default":
+		// go defaults are used
+	default:
+		return nil, errors.New("Unknown cipher policy " + cfg.CipherPolicy)
+	}
+
+	return &tls.Config{
+		MinVersion:   minVersion,
+		CipherSuites: ciphers,
+		ClientAuth:   clientAuth,
+	}, nil
+}
+
+func getCipherSuites(names []string) ([]uint16, bool) {
+	known := map[string]uint16{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite.ID
+	}
+
+	res := make([]uint16, 0, len(names))
+
+	for _, name := range names {
+		id, ok := known[name]
+		if !ok {
+			return nil, false
+		}
+
+		res = append(res, id)
+	}
+
+	return res, true
+}
+
+// getCertificatePrincipal func returns principal for client certificate
+// subject is looked up in mapping by full DN first and by common name after that,
+// common name is used as principal if there is no mapping
+func getCertificatePrincipal(cert *x509.Certificate, principals map[string]string) string {
+	if p, ok := principals[cert.Subject.String()]; ok {
+		return p
+	}
+
+	if p, ok := principals[cert.Subject.CommonName]; ok {
+		return p
+	}
+
+	return cert.Subject.CommonName
+}
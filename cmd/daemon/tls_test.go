@@ -0,0 +1,292 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"testing"
+	"time"
+)
+
+// writeTestCertificate func generates certificate signed by parent (self-signed if parent is nil)
+// and writes it with key to dir
+func writeTestCertificate(dir, name string, serial int64, isCA bool, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(serial),
+		Subject:               pkix.Name{CommonName: name, Organization: []string{"t2"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  isCA,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	if parent == nil {
+		parent = tpl
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tpl, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	err = ioutil.WriteFile(path.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	cert, err := x509.ParseCertificate(der)
+
+	return cert, key, err
+}
+
+func TestNewBaseTLSConfig(t *testing.T) {
+	cases := []struct {
+		cfg        TLSConfig
+		hasError   bool
+		minVersion uint16
+		ciphers    int
+	}{
+		{
+			cfg:        TLSConfig{},
+			minVersion: tls.VersionTLS12,
+		},
+		{
+			cfg:        TLSConfig{MinVersion: "1.3", CipherPolicy: "modern"},
+			minVersion: tls.VersionTLS13,
+			ciphers:    len(modernCiphers),
+		},
+		{
+			cfg:        TLSConfig{Ciphers: []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}},
+			minVersion: tls.VersionTLS12,
+			ciphers:    1,
+		},
+		{
+			cfg:      TLSConfig{MinVersion: "2.0"},
+			hasError: true,
+		},
+		{
+			cfg:      TLSConfig{CipherPolicy: "example"},
+			hasError: true,
+		},
+		{
+			cfg:      TLSConfig{Ciphers: []string{"example"}},
+			hasError: true,
+		},
+		{
+			cfg:      TLSConfig{ClientAuth: "example"},
+			hasError: true,
+		},
+		{
+			cfg:      TLSConfig{ClientAuth: "require"},
+			hasError: true,
+		},
+	}
+
+	for _, tc := range cases {
+		cfg, err := newBaseTLSConfig(&tc.cfg)
+
+		if tc.hasError {
+			if err == nil {
+				t.Errorf("Error must not be nil for %#v\n", tc.cfg)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+
+		if cfg.MinVersion != tc.minVersion {
+			t.Errorf("Min version must be %d but got %d\n", tc.minVersion, cfg.MinVersion)
+		}
+
+		if len(cfg.CipherSuites) != tc.ciphers {
+			t.Errorf("Ciphers count must be %d but got %d\n", tc.ciphers, len(cfg.CipherSuites))
+		}
+	}
+}
+
+func TestTLSServerWithClientCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-tls")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	ca, caKey, err := writeTestCertificate(dir, "ca", 1, true, nil, nil)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	if _, _, err := writeTestCertificate(dir, "server", 2, false, ca, caKey); err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	if _, _, err := writeTestCertificate(dir, "client", 3, false, ca, caKey); err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	cfg := &Config{
+		TLS: &TLSConfig{
+			CertFile:     path.Join(dir, "server.crt"),
+			KeyFile:      path.Join(dir, "server.key"),
+			ClientCAFile: path.Join(dir, "ca.crt"),
+			ClientAuth:   "verify_if_given",
+			Principals: map[string]string{
+				"client": "team-a",
+			},
+		},
+	}
+
+	app := NewApplication(cfg, &Storage{}, &RateLimit{}, &Redis{})
+
+	principals := make(chan string, 2)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		principals <- getPrincipal(r, cfg.TLS)
+	})
+
+	s, err := NewServer(app, h)
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	go s.Run(l)
+	defer s.HTTP.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	clientCert, err := tls.LoadX509KeyPair(path.Join(dir, "client.crt"), path.Join(dir, "client.key"))
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	cases := []struct {
+		cert      bool
+		principal string
+		serial    int64
+	}{
+		{
+			cert:      true,
+			principal: "team-a",
+			serial:    2,
+		},
+		{
+			cert:      false,
+			principal: anonymousPrincipal,
+			serial:    4,
+		},
+	}
+
+	for index, tc := range cases {
+		if index == 1 {
+			// replace server certificate and reload it
+			if _, _, err := writeTestCertificate(dir, "server", 4, false, ca, caKey); err != nil {
+				t.Errorf("Error must be nil but got %v\n", err)
+				return
+			}
+
+			s.Reload()
+		}
+
+		tlsCfg := &tls.Config{RootCAs: roots}
+		if tc.cert {
+			tlsCfg.Certificates = []tls.Certificate{clientCert}
+		}
+
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsCfg}}
+
+		resp, err := client.Get("https://" + l.Addr().String() + "/")
+		if err != nil {
+			t.Errorf("Error must be nil but got %v\n", err)
+			continue
+		}
+		resp.Body.Close()
+
+		if serial := resp.TLS.PeerCertificates[0].SerialNumber.Int64(); serial != tc.serial {
+			t.Errorf("Serial must be %d but got %d\n", tc.serial, serial)
+		}
+
+		if p := <-principals; p != tc.principal {
+			t.Errorf("Principal must be %s but got %s\n", tc.principal, p)
+		}
+	}
+}
+
+func TestTLSReloaderKeepsOldCertificate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "t2-tls")
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	if _, _, err := writeTestCertificate(dir, "server", 1, false, nil, nil); err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	r, err := NewTLSReloader(&TLSConfig{
+		CertFile: path.Join(dir, "server.crt"),
+		KeyFile:  path.Join(dir, "server.key"),
+	})
+	if err != nil {
+		t.Errorf("Error must be nil but got %v\n", err)
+		return
+	}
+
+	old := r.cert
+
+	ioutil.WriteFile(path.Join(dir, "server.crt"), []byte("broken"), 0600)
+
+	if err := r.Reload(); err == nil {
+		t.Error("Error must not be nil")
+	}
+
+	if r.cert != old {
+		t.Error("Old certificate must be kept")
+	}
+}
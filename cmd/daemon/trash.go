@@ -0,0 +1,262 @@
+package main
+
+import (
+	"os"
+	"time"
+)
+
+// default retention of trashed files is 7 days
+const defaultTrashRetention = 604800
+
+// default interval of trash purge
+const defaultPurgeInterval = 3600
+
+// TrashConfig struct contains info about
+// - enabled flag, removed files are moved to trash and could be restored until they are purged
+// - retention of files in trash in seconds, default is 604800
+// - quota of trash in bytes, the oldest files are purged when it's exceeded (0 - no quota)
+// - evictions flag, files evicted by max age are moved to trash too
+// - interval of purge job in seconds, default is 3600
+// trashed files are counted in storage usage because they occupy disk,
+// so autoclean purges trash before eviction of stored files
+type TrashConfig struct {
+	Enabled       bool  `json:"enabled"`
+	Retention     int   `json:"retention"`
+	Quota         int64 `json:"quota"`
+	Evictions     bool  `json:"evictions"`
+	PurgeInterval int   `json:"purge_interval"`
+}
+
+// SetDefaults method fills missing values with defaults
+func (cfg *TrashConfig) SetDefaults() {
+	if cfg.Retention == 0 {
+		cfg.Retention = defaultTrashRetention
+	}
+
+	if cfg.PurgeInterval == 0 {
+		cfg.PurgeInterval = defaultPurgeInterval
+	}
+}
+
+// GetTrash method returns trash config, disabled trash is returned if it's not set
+func (cfg *StorageConfig) GetTrash() *TrashConfig {
+	if cfg.Trash != nil {
+		return cfg.Trash
+	}
+
+	return &TrashConfig{}
+}
+
+// validateTrashConfig func adds problems of trash config to errs
+func validateTrashConfig(errs *ValidationErrors, cfg *TrashConfig) {
+	if cfg == nil {
+		return
+	}
+
+	if cfg.Retention < 0 {
+		errs.Add("storage.trash.retention", "must not be negative")
+	}
+
+	if cfg.Quota < 0 {
+		errs.Add("storage.trash.quota", "must not be negative")
+	}
+
+	if cfg.PurgeInterval < 0 {
+		errs.Add("storage.trash.purge_interval", "must not be negative")
+	}
+}
+
+// MoveToTrash method moves file to trash and enforces trash quota
+// storage usage is not changed, file is still on disk
+func (app *Application) MoveToTrash(hash string, t time.Time) (bool, error) {
+	size, err := app.Storage.GetFileSize(hash)
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+
+	ok, err := app.Storage.TrashFile(hash)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	usage, err := app.Redis.TrashFile(hash, size, t)
+	if err != nil {
+		return true, err
+	}
+
+	app.Metrics.TrashUsage.Set(float64(usage))
+
+	err = app.Redis.MarkFileAsDeleted(hash, &t)
+	if err != nil {
+		return true, err
+	}
+
+	quota := app.GetConfig().Storage.GetTrash().Quota
+	if quota > 0 && usage > quota {
+		_, _, err = app.purgeTrashQuota(quota, "quota")
+	}
+
+	return true, err
+}
+
+// RestoreFile method moves file from trash back to storage
+// errFileExists is returned if the same file has been uploaded after removal
+func (app *Application) RestoreFile(hash string, t time.Time) (bool, error) {
+	ok, err := app.Storage.RestoreFile(hash)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	_, _, err = app.Redis.UntrashFile(hash)
+	if err != nil {
+		return true, err
+	}
+
+	err = app.Redis.RestoreFileMeta(hash)
+	if err != nil {
+		return true, err
+	}
+
+	err = app.Redis.RecordAccess(hash, t, getHalfLife(app.GetConfig().Storage.GetEviction()))
+	if err != nil {
+		return true, err
+	}
+
+	app.updateTrashUsage()
+
+	return true, nil
+}
+
+// PurgeTrash method removes files which have been trashed before t and returns count of files and bytes
+func (app *Application) PurgeTrash(t time.Time, reason string) (int, int64, error) {
+	var count int
+	var total int64
+
+	for {
+		hashes, err := app.Redis.GetTrashedBefore(t, 20)
+		if err != nil {
+			return count, total, err
+		} else if len(hashes) == 0 {
+			break
+		}
+
+		for _, hash := range hashes {
+			size, ok, err := app.purgeTrashFile(hash, reason, nil)
+			if err != nil {
+				return count, total, err
+			}
+
+			if ok {
+				count++
+				total += size
+			}
+		}
+	}
+
+	app.updateTrashUsage()
+
+	return count, total, nil
+}
+
+// purgeTrashQuota method removes the oldest files from trash until its size is below quota
+func (app *Application) purgeTrashQuota(quota int64, reason string) (int, int64, error) {
+	var count int
+	var total int64
+
+	for {
+		usage, err := app.Redis.GetTrashUsage()
+		if err != nil || usage <= quota {
+			app.Metrics.TrashUsage.Set(float64(usage))
+			return count, total, err
+		}
+
+		hashes, err := app.Redis.GetTrashedFiles(0, 1)
+		if err != nil || len(hashes) == 0 {
+			return count, total, err
+		}
+
+		size, ok, err := app.purgeTrashFile(hashes[0], reason, nil)
+		if err != nil {
+			return count, total, err
+		}
+
+		if ok {
+			count++
+			total += size
+		}
+	}
+}
+
+// purgeTrashFile method removes file from trash and its index, it returns size of removed file
+// index is cleaned even if file does not exist, it's cleaned before file,
+// so autoclean which has lost its lock stops before purge (nil lock is not checked)
+func (app *Application) purgeTrashFile(hash, reason string, lock *RedisLock) (int64, bool, error) {
+	size, _, err := app.Redis.untrashFile(hash, lock)
+	if err != nil {
+		return 0, false, err
+	}
+
+	deleted, err := app.Storage.PurgeFile(hash)
+	if err != nil || !deleted {
+		return 0, false, err
+	}
+
+	err = app.AddUsage(-size)
+	if err != nil {
+		return size, true, err
+	}
+
+	app.Metrics.TrashPurged.Inc(reason)
+
+	return size, true, nil
+}
+
+// updateTrashUsage method updates trash usage metric
+func (app *Application) updateTrashUsage() {
+	usage, err := app.Redis.GetTrashUsage()
+	if err != nil {
+		app.Logger.Error("could not get trash usage", "component", "trash", "error", err)
+		return
+	}
+
+	app.Metrics.TrashUsage.Set(float64(usage))
+}
+
+// RunPurgeTrash method purges expired files from trash periodically until application is shut down
+// interval and retention are read from current config, so they could be changed by reload
+func (app *Application) RunPurgeTrash() {
+	app.Go(func() {
+		for {
+			cfg := app.GetConfig().Storage.GetTrash()
+
+			interval := time.Duration(cfg.PurgeInterval) * time.Second
+			if interval <= 0 {
+				interval = defaultPurgeInterval * time.Second
+			}
+
+			timer := time.NewTimer(interval)
+
+			select {
+			case <-app.ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+
+			// files trashed before trash was disabled are purged too
+			retention := cfg.Retention
+			if retention <= 0 {
+				retention = defaultTrashRetention
+			}
+
+			count, size, err := app.PurgeTrash(time.Now().Add(-time.Duration(retention)*time.Second), "retention")
+			if err != nil {
+				app.Logger.Error("could not purge trash", "component", "trash", "error", err)
+			} else if count > 0 {
+				app.Logger.Info("trash purged", "component", "trash", "files", count, "bytes", size)
+			}
+		}
+	})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTrashTestApplication(t *testing.T, storage *StorageConfig) *Application {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	storage.Path = dir
+
+	app := NewApplication(&Config{Storage: storage}, NewStorage(storage), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+	app.SetLogger(NewWriterLogger(ioutil.Discard, LevelError, ""))
+
+	conn := app.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	return app
+}
+
+func createTrashTestFile(app *Application, hash string, size int, createdAt time.Time) {
+	app.Storage.CreateFile(hash, bytes.NewBuffer([]byte(strings.Repeat("a", size))))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: int64(size), CreatedAt: &createdAt, Score: 1})
+	app.Redis.RecordAccess(hash, createdAt, time.Hour)
+	app.Redis.AddUsage(int64(size))
+}
+
+func TestApplicationMoveToTrash(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{Trash: &TrashConfig{Enabled: true, Quota: 15}})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.ReconcileUsage()
+
+	now := time.Now()
+	for _, hash := range []string{"example1", "example2", "example3"} {
+		createTrashTestFile(app, hash, 10, now)
+	}
+
+	ok, err := app.MoveToTrash("unknown", now)
+	if ok || err != nil {
+		t.Errorf("Missing file must not be trashed but got %v, %v\n", ok, err)
+	}
+
+	app.MoveToTrash("example1", now.Add(-time.Minute))
+
+	// trash is counted in usage
+	usage, _, _ := app.Redis.GetUsage()
+	if usage != 30 {
+		t.Errorf("Usage must be %d but got %d\n", 30, usage)
+	}
+
+	candidates, _ := app.Redis.GetEvictionCandidates(scoreKey, 0, 10)
+	if !reflect.DeepEqual(candidates, []string{"example2", "example3"}) {
+		t.Errorf("Trashed file must be removed from indexes but got %v\n", candidates)
+	}
+
+	// the oldest file is purged by quota
+	ok, err = app.MoveToTrash("example2", now)
+	if !ok || err != nil {
+		t.Errorf("File must be trashed but got %v, %v\n", ok, err)
+	}
+
+	trashed, _ := app.Redis.GetTrashedFiles(0, 10)
+	if !reflect.DeepEqual(trashed, []string{"example2"}) {
+		t.Errorf("Trash must be %v but got %v\n", []string{"example2"}, trashed)
+	}
+
+	usage, _, _ = app.Redis.GetUsage()
+	if usage != 20 {
+		t.Errorf("Usage must be %d but got %d\n", 20, usage)
+	}
+}
+
+func TestApplicationRestoreFile(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{Trash: &TrashConfig{Enabled: true}})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+	createTrashTestFile(app, "example1", 10, now)
+	app.MoveToTrash("example1", now)
+
+	ok, err := app.RestoreFile("example1", now)
+	if !ok || err != nil {
+		t.Errorf("File must be restored but got %v, %v\n", ok, err)
+	}
+
+	candidates, _ := app.Redis.GetEvictionCandidates(accessKey, 0, 10)
+	if !reflect.DeepEqual(candidates, []string{"example1"}) {
+		t.Errorf("Restored file must be added to indexes but got %v\n", candidates)
+	}
+
+	usage, _ := app.Redis.GetTrashUsage()
+	if usage != 0 {
+		t.Errorf("Trash usage must be %d but got %d\n", 0, usage)
+	}
+
+	ok, _ = app.RestoreFile("example1", now)
+	if ok {
+		t.Error("File must not be restored twice\n")
+	}
+
+	// file has been uploaded again
+	app.MoveToTrash("example1", now)
+	app.Storage.CreateFile("example1", bytes.NewBuffer([]byte("a")))
+
+	_, err = app.RestoreFile("example1", now)
+	if err != errFileExists {
+		t.Errorf("Error must be %v but got %v\n", errFileExists, err)
+	}
+}
+
+func TestApplicationPurgeTrash(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{Trash: &TrashConfig{Enabled: true}})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.ReconcileUsage()
+
+	now := time.Now()
+	for _, hash := range []string{"example1", "example2"} {
+		createTrashTestFile(app, hash, 10, now)
+	}
+
+	app.MoveToTrash("example1", now.Add(-2*time.Hour))
+	app.MoveToTrash("example2", now)
+
+	count, size, err := app.PurgeTrash(now.Add(-time.Hour), "retention")
+	if count != 1 || size != 10 || err != nil {
+		t.Errorf("One file must be purged but got %d, %d, %v\n", count, size, err)
+	}
+
+	trashed, _ := app.Redis.GetTrashedFiles(0, 10)
+	if !reflect.DeepEqual(trashed, []string{"example2"}) {
+		t.Errorf("Trash must be %v but got %v\n", []string{"example2"}, trashed)
+	}
+
+	usage, _, _ := app.Redis.GetUsage()
+	if usage != 10 {
+		t.Errorf("Usage must be %d but got %d\n", 10, usage)
+	}
+
+	// reconciliation counts trash
+	usage, _ = app.ReconcileUsage()
+	if usage != 10 {
+		t.Errorf("Usage must be %d but got %d\n", 10, usage)
+	}
+}
+
+func TestApplicationAutoCleanTrash(t *testing.T) {
+	now := time.Now()
+
+	cases := []struct {
+		trash   *TrashConfig
+		maxAge  int
+		limit   int64
+		files   []string
+		trashed []string
+		freed   int64
+	}{
+		{
+			// trashed file is purged before stored ones
+			trash:   &TrashConfig{Enabled: true},
+			limit:   25,
+			files:   []string{"example1:trash"},
+			trashed: []string{},
+			freed:   10,
+		},
+		{
+			trash:   &TrashConfig{Enabled: true},
+			limit:   15,
+			files:   []string{"example1:trash", "example2:limit"},
+			trashed: []string{},
+			freed:   20,
+		},
+		{
+			// expired file is moved to trash and it's purged, because limit is exceeded
+			trash:   &TrashConfig{Enabled: true, Evictions: true},
+			maxAge:  5000,
+			limit:   25,
+			files:   []string{"example2:max_age", "example1:trash"},
+			trashed: []string{"example2"},
+			freed:   10,
+		},
+		{
+			trash:   &TrashConfig{Enabled: true, Evictions: true},
+			maxAge:  5000,
+			limit:   100,
+			files:   []string{"example2:max_age"},
+			trashed: []string{"example1", "example2"},
+			freed:   0,
+		},
+	}
+
+	for _, tc := range cases {
+		app := newTrashTestApplication(t, &StorageConfig{
+			Limit:    tc.limit,
+			Trash:    tc.trash,
+			Eviction: &EvictionConfig{Policy: "ttl", MaxAge: tc.maxAge},
+		})
+		defer os.RemoveAll(app.Config.Storage.Path)
+
+		app.ReconcileUsage()
+
+		createTrashTestFile(app, "example1", 10, now)
+		createTrashTestFile(app, "example2", 10, now.Add(-2*time.Hour))
+		createTrashTestFile(app, "example3", 10, now.Add(-time.Hour))
+
+		app.MoveToTrash("example1", now)
+
+		report, err := app.RunAutoCleanNow()
+		if err != nil {
+			t.Errorf("Err must be nil but got %v\n", err)
+			continue
+		}
+
+		if files := getReportFiles(report); !reflect.DeepEqual(files, tc.files) {
+			t.Errorf("Files must be %v but got %v\n", tc.files, files)
+		}
+
+		if report.FreedBytes != tc.freed {
+			t.Errorf("Freed bytes must be %d but got %d\n", tc.freed, report.FreedBytes)
+		}
+
+		trashed, _ := app.Redis.GetTrashedFiles(0, 10)
+		if !reflect.DeepEqual(trashed, tc.trashed) {
+			t.Errorf("Trash must be %v but got %v\n", tc.trashed, trashed)
+		}
+	}
+}
+
+func TestHandlerRestoreFile(t *testing.T) {
+	app := newTrashTestApplication(t, &StorageConfig{Trash: &TrashConfig{Enabled: true}})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.Config.RateLimit = &RateLimitConfig{}
+
+	createTrashTestFile(app, "example1", 10, time.Now())
+
+	h := NewHandler(app)
+
+	cases := []struct {
+		method  string
+		path    string
+		code    int
+		message string
+	}{
+		{method: "POST", path: "/files/example1/restore", code: 404, message: "FILE_NOT_FOUND"},
+		{method: "DELETE", path: "/files/example1", code: 204},
+		{method: "GET", path: "/files/example1", code: 404, message: "FILE_NOT_FOUND"},
+		{method: "DELETE", path: "/files/example1", code: 404, message: "FILE_NOT_FOUND"},
+		{method: "GET", path: "/files/example1/restore", code: 404, message: "NOT_FOUND"},
+		{method: "POST", path: "/files/example1/restore", code: 200},
+		{method: "POST", path: "/files/example1/restore", code: 404, message: "FILE_NOT_FOUND"},
+	}
+
+	for _, tc := range cases {
+		w := httptest.NewRecorder()
+		r, _ := http.NewRequest(tc.method, tc.path, nil)
+
+		h.ServeHTTP(w, r)
+
+		if w.Code != tc.code {
+			t.Errorf("Code must be %d but got %d for %s %s\n", tc.code, w.Code, tc.method, tc.path)
+		}
+
+		if tc.message != "" && !strings.Contains(w.Body.String(), tc.message) {
+			t.Errorf("Error message must be %v but got %v\n", tc.message, w.Body.String())
+		}
+	}
+
+	if _, ok := app.Storage.GetFile("example1"); !ok {
+		t.Error("File must be restored\n")
+	}
+}
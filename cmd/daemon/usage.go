@@ -0,0 +1,165 @@
+package main
+
+import (
+	"os"
+	"path"
+	"time"
+)
+
+// GetWatermarks method returns high and low watermarks in bytes
+// missing watermarks are equal to limit
+func (cfg *StorageConfig) GetWatermarks() (int64, int64) {
+	high, low := cfg.HighWatermark, cfg.LowWatermark
+
+	if high <= 0 {
+		high = 100
+	}
+
+	if low <= 0 || low > high {
+		low = high
+	}
+
+	return cfg.Limit * int64(high) / 100, cfg.Limit * int64(low) / 100
+}
+
+// AddUsage method updates storage usage counter after file creation or removal
+// autoclean is triggered if usage exceeds high watermark
+func (app *Application) AddUsage(delta int64) error {
+	usage, ok, err := app.Redis.AddUsage(delta)
+	if err != nil || !ok {
+		// counter is initialized by reconciliation
+		return err
+	}
+
+	app.Metrics.StorageUsage.Set(float64(usage))
+
+	cfg := app.GetConfig().Storage
+	if high, _ := cfg.GetWatermarks(); cfg.Limit > 0 && usage > high {
+		app.TriggerAutoClean()
+	}
+
+	return nil
+}
+
+// GetUsage method returns storage usage, storage is scanned if counter has not been initialized
+func (app *Application) GetUsage() (int64, error) {
+	usage, ok, err := app.Redis.GetUsage()
+	if err != nil {
+		return 0, err
+	}
+
+	if !ok {
+		return app.ReconcileUsage()
+	}
+
+	return usage, nil
+}
+
+// ReconcileUsage method scans storage and corrects usage counter, trashed files are counted too
+// counter changes made during scan are kept, so usage could be overestimated until the next reconciliation
+func (app *Application) ReconcileUsage() (int64, error) {
+	start := time.Now()
+
+	before, _, err := app.Redis.GetUsage()
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+
+	// each directory of shards is counted in erasure mode
+	roots := app.GetConfig().Storage.GetRoots()
+
+	for _, root := range roots {
+		rootSize, err := getStorageSize(root)
+		if os.IsNotExist(err) && len(roots) > 1 {
+			continue
+		} else if err != nil {
+			return 0, err
+		}
+
+		trashSize, err := getStorageSize(path.Join(root, trashDir))
+		if err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+
+		size += rootSize + trashSize
+	}
+
+	usage, err := app.Redis.CorrectUsage(size - before)
+	if err != nil {
+		return 0, err
+	}
+
+	app.Metrics.StorageUsage.Set(float64(usage))
+	app.Logger.Info("storage usage reconciled", "component", "usage", "usage", usage, "drift", size-before, "duration", time.Since(start))
+
+	return usage, nil
+}
+
+// RunReconcileUsage method reconciles usage on start and periodically until application is shut down
+func (app *Application) RunReconcileUsage(interval time.Duration) {
+	app.Go(func() {
+		if _, err := app.ReconcileUsage(); err != nil {
+			app.Logger.Error("could not reconcile storage usage", "component", "usage", "error", err)
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-app.ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := app.ReconcileUsage(); err != nil {
+					app.Logger.Error("could not reconcile storage usage", "component", "usage", "error", err)
+				}
+			}
+		}
+	})
+}
+
+// updateStorageUsage method updates storage usage metric from counter
+// it's called on every scrape, so metric is actual even if autoclean is disabled
+func (app *Application) updateStorageUsage() {
+	usage, ok, err := app.Redis.GetUsage()
+	if err != nil {
+		app.Logger.Error("could not get storage usage", "component", "usage", "error", err)
+		return
+	}
+
+	// counter is initialized by reconciliation
+	if ok {
+		app.Metrics.StorageUsage.Set(float64(usage))
+	}
+}
+
+// TriggerAutoClean method asks autoclean loop to start as soon as possible
+// triggers are merged if autoclean is already requested
+func (app *Application) TriggerAutoClean() {
+	select {
+	case app.cleanTrigger <- struct{}{}:
+	default:
+	}
+}
+
+func getStorageSize(storagePath string) (int64, error) {
+	dirs, err := getDirectories(storagePath)
+	if err != nil {
+		return 0, err
+	}
+
+	var size int64
+
+	for _, dir := range dirs {
+		s, err := getDirectorySize(path.Join(storagePath, dir))
+		if err != nil {
+			return 0, err
+		}
+
+		size += s
+	}
+
+	return size, nil
+}
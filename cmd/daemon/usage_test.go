@@ -0,0 +1,185 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStorageConfigGetWatermarks(t *testing.T) {
+	cases := []struct {
+		cfg  *StorageConfig
+		high int64
+		low  int64
+	}{
+		{
+			cfg:  &StorageConfig{Limit: 1000},
+			high: 1000,
+			low:  1000,
+		},
+		{
+			cfg:  &StorageConfig{Limit: 1000, HighWatermark: 90, LowWatermark: 70},
+			high: 900,
+			low:  700,
+		},
+		{
+			cfg:  &StorageConfig{Limit: 1000, HighWatermark: 90},
+			high: 900,
+			low:  900,
+		},
+		{
+			cfg:  &StorageConfig{Limit: 1000, HighWatermark: 50, LowWatermark: 70},
+			high: 500,
+			low:  500,
+		},
+	}
+
+	for _, tc := range cases {
+		high, low := tc.cfg.GetWatermarks()
+
+		if high != tc.high || low != tc.low {
+			t.Errorf("Watermarks must be %d/%d but got %d/%d\n", tc.high, tc.low, high, low)
+		}
+	}
+}
+
+func newUsageTestApplication(t *testing.T, cfg *StorageConfig) *Application {
+	dir, err := ioutil.TempDir("", "t2-storage")
+	if err != nil {
+		t.Fatalf("Err must be nil but got %v\n", err)
+	}
+
+	cfg.Path = dir
+
+	app := NewApplication(&Config{Storage: cfg}, NewStorage(cfg), NewRateLimit(&RateLimitConfig{}), NewRedis(&RedisConfig{}))
+
+	conn := app.Redis.Get()
+	conn.Do("FLUSHDB")
+	conn.Close()
+
+	return app
+}
+
+func TestApplicationReconcileUsage(t *testing.T) {
+	app := newUsageTestApplication(t, &StorageConfig{})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.Storage.CreateFile("example1", bytes.NewBuffer([]byte(strings.Repeat("a", 10))))
+	app.Storage.CreateFile("example2", bytes.NewBuffer([]byte(strings.Repeat("a", 20))))
+
+	// counter is not changed before initialization
+	err := app.AddUsage(10)
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	}
+
+	if _, ok, _ := app.Redis.GetUsage(); ok {
+		t.Error("Usage must not be initialized")
+	}
+
+	usage, err := app.GetUsage()
+	if err != nil || usage != 30 {
+		t.Errorf("Usage must be %d but got %d (%v)\n", 30, usage, err)
+	}
+
+	err = app.AddUsage(-10)
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	}
+
+	usage, _ = app.GetUsage()
+	if usage != 20 {
+		t.Errorf("Usage must be %d but got %d\n", 20, usage)
+	}
+
+	// drift is fixed by reconciliation
+	usage, err = app.ReconcileUsage()
+	if err != nil || usage != 30 {
+		t.Errorf("Usage must be %d but got %d (%v)\n", 30, usage, err)
+	}
+
+	if v := app.Metrics.StorageUsage.Value(); v != 30 {
+		t.Errorf("Usage metric must be %v but got %v\n", 30, v)
+	}
+}
+
+func TestApplicationAddUsageTrigger(t *testing.T) {
+	app := newUsageTestApplication(t, &StorageConfig{Limit: 100, HighWatermark: 80})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	app.ReconcileUsage()
+
+	app.AddUsage(80)
+	if len(app.cleanTrigger) != 0 {
+		t.Error("Autoclean must not be triggered below high watermark")
+	}
+
+	app.AddUsage(1)
+	app.AddUsage(1)
+	if len(app.cleanTrigger) != 1 {
+		t.Error("Autoclean must be triggered above high watermark")
+	}
+}
+
+func TestApplicationAutoCleanWatermarks(t *testing.T) {
+	app := newUsageTestApplication(t, &StorageConfig{Limit: 30, HighWatermark: 90, LowWatermark: 50})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+
+	for i := 1; i <= 3; i++ {
+		hash := "example" + strconv.Itoa(i)
+
+		app.Storage.CreateFile(hash, bytes.NewBuffer([]byte(strings.Repeat("a", 10))))
+		app.Redis.SaveFileMeta(&FileMeta{Hash: hash, Size: 10, CreatedAt: &now, Score: i})
+	}
+
+	err := app.AutoClean()
+	if err != nil {
+		t.Errorf("Err must be nil but got %v\n", err)
+	}
+
+	for i, removed := range []bool{true, true, false} {
+		hash := "example" + strconv.Itoa(i+1)
+
+		if _, ok := app.Storage.GetFile(hash); ok == removed {
+			t.Errorf("File %s must be removed: %t\n", hash, removed)
+		}
+	}
+
+	usage, _, _ := app.Redis.GetUsage()
+	if usage != 10 {
+		t.Errorf("Usage must be %d but got %d\n", 10, usage)
+	}
+}
+
+func TestApplicationRunAutoCleanTrigger(t *testing.T) {
+	app := newUsageTestApplication(t, &StorageConfig{Limit: 5})
+	defer os.RemoveAll(app.Config.Storage.Path)
+
+	now := time.Now()
+	app.Storage.CreateFile("example1", bytes.NewBuffer([]byte(strings.Repeat("a", 10))))
+	app.Redis.SaveFileMeta(&FileMeta{Hash: "example1", Size: 10, CreatedAt: &now})
+
+	app.RunAutoClean()
+	app.TriggerAutoClean()
+
+	for i := 0; i < 100; i++ {
+		if _, ok := app.Storage.GetFile("example1"); !ok {
+			break
+		}
+
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	if _, ok := app.Storage.GetFile("example1"); ok {
+		t.Error("File must be removed by triggered autoclean")
+	}
+
+	app.cancel()
+	app.wg.Wait()
+}